@@ -1,11 +1,152 @@
 package main
 
 import (
-	_ "github.com/srun-soft/dpi-analysis-toolkit/configs"
-	_ "github.com/srun-soft/dpi-analysis-toolkit/internal/feature"
-	_ "github.com/srun-soft/dpi-analysis-toolkit/internal/packet_capture"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/analyzer"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/ethernet"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/feature"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/metrics"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/packet_capture"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/sink"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
+	if err := run(os.Args[1:]); err != nil {
+		configs.Log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// run 在返回前关闭 Sink, 出错时由 main 以非零状态退出
+func run(args []string) (err error) {
+	cfg, err := configs.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = configs.SetLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+
+	switch cfg.Devices {
+	case "":
+	case "all":
+		ethernet.All()
+		return nil
+	}
+
+	if cfg.FeatureFile != "" {
+		if err = feature.Load(cfg.FeatureFile); err != nil {
+			return fmt.Errorf("load feature file: %w", err)
+		}
+	} else {
+		configs.Log.Warn("No feature file, application matching disabled")
+	}
+
+	analyzers, err := analyzer.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	out, err := sink.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close sink: %w", cerr)
+		}
+	}()
+
+	engine, err := packet_capture.New(packet_capture.Config{
+		Source:       cfg.Capture.Source,
+		Device:       cfg.Capture.Device,
+		OfflineFiles: cfg.Capture.OfflineFile,
+		BPF:          cfg.Capture.BPF,
+		SnapLen:      cfg.Capture.SnapLen,
+		Promisc:      cfg.Capture.Promisc,
+		Workers:      cfg.Capture.Workers,
+		AFPacket: packet_capture.AFPacketConfig{
+			BlockSize:   cfg.Capture.AFPacket.BlockSize,
+			NumBlocks:   cfg.Capture.AFPacket.NumBlocks,
+			FanoutGroup: cfg.Capture.AFPacket.FanoutGroup,
+			FanoutType:  cfg.Capture.AFPacket.FanoutType,
+		},
+		Dissectors:              cfg.Dissectors,
+		HTTP:                    cfg.HTTP,
+		FlushTimeout:            cfg.Timeouts.StreamFlush,
+		CloseTimeout:            cfg.Timeouts.StreamClose,
+		FlowIdleTimeout:         cfg.Timeouts.FlowIdle,
+		FlowActiveTimeout:       cfg.Timeouts.FlowActive,
+		MaxBufferedPages:        cfg.Reassembly.MaxBufferedPages,
+		MaxBufferedPagesPerConn: cfg.Reassembly.MaxBufferedPagesPerConn,
+		MaxConnections:          cfg.Reassembly.MaxConnections,
+		Checksum:                cfg.Reassembly.Checksum,
+		DNSCacheSize:            cfg.DNSCache.Size,
+		DNSCacheMinTTL:          cfg.DNSCache.MinTTL,
+		DNSResolvers:            cfg.EncryptedDNS.Resolvers,
+		LocalResolvers:          cfg.EncryptedDNS.Local,
+		DoHShape:                cfg.EncryptedDNS.Shape,
+		RadiusSessionTimeout:    cfg.Radius.SessionTimeout,
+		Sink:                    out,
+		Analyzer:                analyzers,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if cfg.Metrics.Listen != "" {
+		metrics.Registry.MustRegister(engine, sink.Collector())
+		if err = metrics.Serve(ctx, cfg.Metrics.Listen); err != nil {
+			configs.Log.Error("Metrics server err:", err)
+		}
+	}
+	go reloadOnHangup(ctx, engine, cfg)
+	return engine.Run(ctx)
+}
 
+// reloadOnHangup 收到 SIGHUP 时重新加载配置
+// 仅日志级别、特征库和 BPF 支持热加载, 其余配置需重启生效
+func reloadOnHangup(ctx context.Context, engine *packet_capture.Engine, current *configs.Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		configs.Log.Info("Caught SIGHUP: reloading config")
+		cfg, err := configs.Reload()
+		if err != nil {
+			configs.Log.Error("Reload config err:", err)
+			continue
+		}
+		if err = configs.SetLogLevel(cfg.LogLevel); err != nil {
+			configs.Log.Error("Reload log level err:", err)
+		}
+		if cfg.FeatureFile != "" {
+			if err = feature.Load(cfg.FeatureFile); err != nil {
+				configs.Log.Error("Reload feature file err:", err)
+			}
+		}
+		if cfg.Capture.BPF != current.Capture.BPF {
+			if err = engine.SetBPFFilter(cfg.Capture.BPF); err != nil {
+				configs.Log.Error("Reload BPF err:", err)
+				cfg.Capture.BPF = current.Capture.BPF
+			}
+		}
+		current = cfg
+	}
 }
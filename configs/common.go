@@ -1,45 +1,474 @@
 package configs
 
 import (
-	"flag"
+	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
-	"github.com/srun-soft/dpi-analysis-toolkit/internal/ethernet"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
 )
 
 var (
-	Log         *logrus.Logger
-	Devices     = flag.String("devices", "", "获取设备列表")
-	NIC         = flag.String("n", "en0", "Network interface controller")
-	OfflineFile = flag.String("of", "", "offline filepath")
-	BPF         = flag.String("bpf", "", "Berkeley Packet Filter")
-	FeatureFile = flag.String("ff", "", "Feature filepath")
-
-	Debug  bool
-	OutPut bool
-	Radius bool
-	Defrag bool
-	HTTP   bool
-	TCP    bool
-	DNS    bool
-	ICMP   bool
+	Log *logrus.Logger
 )
 
-func init() {
-	flag.BoolVar(&Debug, "d", false, "开启调试模式 true or false")
-	flag.BoolVar(&OutPut, "o", false, "OutPut2Console")
-	flag.BoolVar(&Radius, "r", false, "Radius Protocol")
-	flag.BoolVar(&Defrag, "defrag", false, "Defrag IPv4 Protocol")
-	flag.BoolVar(&HTTP, "http", false, "HTTP Protocol")
-	flag.BoolVar(&TCP, "tcp", false, "TCP Protocol")
-	flag.BoolVar(&DNS, "dns", false, "DNS Protocol")
-	flag.BoolVar(&ICMP, "icmp", false, "ICMP Protocol")
-	flag.Parse()
-	initLog()
-
-	if *Devices != "" {
-		switch *Devices {
-		case "all":
-			ethernet.All()
+// ClickHouseIdentifier 无需引号的 ClickHouse 标识符, 库名会直接拼入建表语句
+var ClickHouseIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Config 运行配置
+// 优先级: 命令行参数 > 环境变量 > 配置文件 > 默认值
+type Config struct {
+	LogLevel     string       `yaml:"log_level"`
+	FeatureFile  string       `yaml:"feature_file"`
+	Capture      Capture      `yaml:"capture"`
+	Dissectors   []string     `yaml:"dissectors"`
+	HTTP         bool         `yaml:"http"`
+	Timeouts     Timeouts     `yaml:"timeouts"`
+	Reassembly   Reassembly   `yaml:"reassembly"`
+	DNSCache     DNSCache     `yaml:"dns_cache"`
+	Analyzers    Analyzers    `yaml:"analyzers"`
+	EncryptedDNS EncryptedDNS `yaml:"encrypted_dns"`
+	Radius       Radius       `yaml:"radius"`
+	Metrics      Metrics      `yaml:"metrics"`
+	Sinks        Sinks        `yaml:"sinks"`
+
+	// Devices 列出网卡后退出, 仅命令行
+	Devices string `yaml:"-"`
+	// File 配置文件路径, 仅命令行
+	File string `yaml:"-"`
+}
+
+// Capture 数据源配置
+type Capture struct {
+	Source      string   `yaml:"source"` // 抓包后端: pcap 或 afpacket (仅 Linux)
+	Device      string   `yaml:"device"`
+	OfflineFile Paths    `yaml:"offline_file"` // 离线 pcap/pcapng 文件或目录, 可为 gzip/zstd 压缩
+	BPF         string   `yaml:"bpf"`
+	SnapLen     int      `yaml:"snap_len"`
+	Promisc     bool     `yaml:"promisc"`
+	Workers     int      `yaml:"workers"` // 并行处理的 Worker 数量, 0 为 CPU 核数
+	AFPacket    AFPacket `yaml:"afpacket"`
+}
+
+// Paths 单个路径或路径列表
+type Paths []string
+
+func (p *Paths) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*p = Paths{node.Value}
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*p = list
+	return nil
+}
+
+// AFPacket AF_PACKET TPACKET_V3 后端配置
+type AFPacket struct {
+	BlockSize   int    `yaml:"block_size"`   // 环形缓冲区块大小, 页大小的整数倍
+	NumBlocks   int    `yaml:"num_blocks"`   // 环形缓冲区块数量
+	FanoutGroup uint16 `yaml:"fanout_group"` // fanout 组 ID, 0 表示不加入
+	FanoutType  string `yaml:"fanout_type"`  // hash, lb, cpu, rollover, random, qm
+}
+
+// Timeouts TCP 流重组与流统计超时
+type Timeouts struct {
+	StreamFlush time.Duration `yaml:"stream_flush"` // 超过该时间未收到数据的连接刷新缓冲
+	StreamClose time.Duration `yaml:"stream_close"` // 超过该时间未收到数据的连接关闭
+	FlowIdle    time.Duration `yaml:"flow_idle"`    // 超过该时间未收到数据包的流结束并输出
+	FlowActive  time.Duration `yaml:"flow_active"`  // 持续时间超过该值的流周期性输出
+}
+
+// Reassembly TCP 流重组内存上限, 0 为不限制
+type Reassembly struct {
+	MaxBufferedPages        int    `yaml:"max_buffered_pages"`          // 乱序缓冲总页数, 每页约 1.9KB
+	MaxBufferedPagesPerConn int    `yaml:"max_buffered_pages_per_conn"` // 单个连接乱序缓冲页数
+	MaxConnections          int    `yaml:"max_connections"`             // 跟踪的连接数, 超过时关闭最久未活动的连接
+	Checksum                string `yaml:"checksum"`                    // TCP 校验和: auto, verify, count, skip
+}
+
+// DNSCache 客户端 DNS 应答的地址-域名缓存, 为没有 SNI 与 HTTP Host 的记录补充域名, 需启用 dns 解析器
+type DNSCache struct {
+	Size   int           `yaml:"size"`    // 缓存的客户端-地址数量, 0 为不启用
+	MinTTL time.Duration `yaml:"min_ttl"` // 最短保留时间, 小于该值的 TTL 按该值计算
+}
+
+// EncryptedDNS DoH/DoT 识别, 列表项为域名 (同时匹配子域名)、IP 地址或网段
+// 服务端端口 853 与 ALPN 为 dot 的连接无需配置即标记为 DoT
+type EncryptedDNS struct {
+	Resolvers []string `yaml:"resolvers"` // 公共解析器, SNI 或服务端地址匹配时标记为 DoH
+	Local     []string `yaml:"local"`     // 本单位的解析器, 不标记
+	Shape     bool     `yaml:"shape"`     // 按 h2 连接的记录形态识别 DoH, 容易把 API 与 gRPC 连接误判为 DoH
+}
+
+// Radius RADIUS 计费会话, 按 Framed-IP-Address 为其他记录填写用户名, 需启用 radius 解析器
+type Radius struct {
+	SessionTimeout time.Duration `yaml:"session_timeout"` // 超过该时间没有计费报文的会话删除, 应大于 NAS 的 Interim 间隔
+}
+
+// Analyzers 记录分析, 发现异常时输出告警记录
+type Analyzers struct {
+	Enabled []string    `yaml:"enabled"`
+	DNS     DNSAnalyzer `yaml:"dns"`
+}
+
+// DNSAnalyzer DNS 隧道与 DGA 检测, 按客户端在统计窗口内累计, 需启用 dns 解析器
+type DNSAnalyzer struct {
+	Window time.Duration `yaml:"window"`
+	Tunnel DNSTunnel     `yaml:"tunnel"`
+	DGA    DGA           `yaml:"dga"`
+}
+
+// DNSTunnel 隧道检测阈值, 以下指标按区域统计, 命中的数量达到 Score 时告警
+type DNSTunnel struct {
+	Queries      int     `yaml:"queries"`       // 查询数
+	NameLength   int     `yaml:"name_length"`   // 区域之下的名称长度, 不含点
+	Entropy      float64 `yaml:"entropy"`       // 区域之下的名称字符熵, 单位 bit
+	ResponseSize int     `yaml:"response_size"` // 大应答的字节数
+	Ratio        float64 `yaml:"ratio"`         // 长或高熵名称、TXT/NULL 查询、大应答的占比
+	Score        int     `yaml:"score"`         // 触发告警的指标数, 共 4 项
+}
+
+// DGA NXDOMAIN 应答数与涉及的区域数都达到阈值时告警
+type DGA struct {
+	NXDomains int `yaml:"nxdomains"`
+	Zones     int `yaml:"zones"`
+}
+
+// Metrics Prometheus 指标
+type Metrics struct {
+	Listen string `yaml:"listen"` // /metrics 监听地址, 为空时不启用
+}
+
+// Sinks 记录输出配置
+type Sinks struct {
+	Enabled    []string   `yaml:"enabled"`
+	Mongo      Mongo      `yaml:"mongo"`
+	ClickHouse ClickHouse `yaml:"clickhouse"`
+	Redis      Redis      `yaml:"redis"`
+	NetFlow    NetFlow    `yaml:"netflow"`
+}
+
+// Mongo MongoDB 连接与写入配置
+type Mongo struct {
+	URI           string        `yaml:"uri"`
+	User          string        `yaml:"user"`
+	Password      string        `yaml:"password"`
+	AuthSource    string        `yaml:"auth_source"`
+	TLS           bool          `yaml:"tls"`
+	CAFile        string        `yaml:"ca_file"`
+	Database      string        `yaml:"database"`
+	Timeout       time.Duration `yaml:"timeout"`
+	PoolSize      uint64        `yaml:"pool_size"`
+	QueueSize     int           `yaml:"queue_size"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	Retries       int           `yaml:"retries"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff"` // 首次重试等待时间, 之后每次翻倍
+	Block         bool          `yaml:"block"`
+}
+
+// ClickHouse ClickHouse 连接与写入配置
+type ClickHouse struct {
+	URL           string        `yaml:"url"`
+	Database      string        `yaml:"database"`
+	User          string        `yaml:"user"`
+	Password      string        `yaml:"password"`
+	Timeout       time.Duration `yaml:"timeout"`
+	QueueSize     int           `yaml:"queue_size"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	Retries       int           `yaml:"retries"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff"` // 首次重试等待时间, 之后每次翻倍
+	Block         bool          `yaml:"block"`
+}
+
+// Redis Redis 连接与写入配置, 记录按协议写入 Stream
+type Redis struct {
+	Addr          string        `yaml:"addr"`
+	User          string        `yaml:"user"`
+	Password      string        `yaml:"password"`
+	DB            int           `yaml:"db"`
+	TLS           bool          `yaml:"tls"`
+	CAFile        string        `yaml:"ca_file"`
+	Timeout       time.Duration `yaml:"timeout"`
+	PoolSize      int           `yaml:"pool_size"`
+	Prefix        string        `yaml:"prefix"`  // Stream 名称为前缀加协议名, 如 dpi:protocol_http
+	MaxLen        int64         `yaml:"max_len"` // 每个 Stream 保留的大致条数, 0 为不限制
+	QueueSize     int           `yaml:"queue_size"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	Retries       int           `yaml:"retries"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff"` // 首次重试等待时间, 之后每次翻倍
+	Block         bool          `yaml:"block"`
+}
+
+// NetFlow NetFlow v9 / IPFIX 导出配置
+// 流的活动/空闲超时由 timeouts.flow_active 与 timeouts.flow_idle 决定
+type NetFlow struct {
+	Collector       string        `yaml:"collector"`        // 采集器地址 host:port
+	Version         string        `yaml:"version"`          // ipfix 或 v9
+	DomainID        uint32        `yaml:"domain_id"`        // IPFIX Observation Domain ID / v9 Source ID
+	EnterpriseID    uint32        `yaml:"enterprise_id"`    // 私有字段使用的 Private Enterprise Number
+	TemplateRefresh time.Duration `yaml:"template_refresh"` // 模板重发间隔
+	TemplatePackets int           `yaml:"template_packets"` // 每发送多少个报文重发模板
+	MTU             int           `yaml:"mtu"`
+	StringLength    int           `yaml:"string_length"` // v9 字符串字段的固定长度
+	QueueSize       int           `yaml:"queue_size"`
+	FlushInterval   time.Duration `yaml:"flush_interval"`
+}
+
+// Default 默认配置
+func Default() *Config {
+	return &Config{
+		LogLevel: "info",
+		Capture: Capture{
+			Source:  "pcap",
+			Device:  "en0",
+			SnapLen: 65536,
+			Promisc: true,
+			AFPacket: AFPacket{
+				BlockSize:  1 << 20,
+				NumBlocks:  64,
+				FanoutType: "hash",
+			},
+		},
+		Timeouts: Timeouts{
+			StreamFlush: time.Minute * 5,
+			StreamClose: time.Hour * 24,
+			FlowIdle:    time.Minute * 2,
+			FlowActive:  time.Minute * 30,
+		},
+		Reassembly: Reassembly{
+			MaxBufferedPages:        100000,
+			MaxBufferedPagesPerConn: 4000,
+			MaxConnections:          262144,
+			Checksum:                "auto",
+		},
+		DNSCache: DNSCache{
+			Size:   262144,
+			MinTTL: time.Minute * 5,
+		},
+		EncryptedDNS: EncryptedDNS{
+			Resolvers: []string{
+				"dns.google", "cloudflare-dns.com", "one.one.one.one", "dns.quad9.net",
+				"doh.opendns.com", "dns.adguard-dns.com", "dns.adguard.com", "dns.nextdns.io",
+				"doh.cleanbrowsing.org", "doh.mullvad.net", "dns.alidns.com", "doh.pub", "doh.360.cn",
+				"8.8.8.8", "8.8.4.4", "1.1.1.1", "1.0.0.1", "9.9.9.9", "149.112.112.112",
+				"223.5.5.5", "223.6.6.6", "2001:4860:4860::8888", "2001:4860:4860::8844",
+				"2606:4700:4700::1111", "2606:4700:4700::1001",
+			},
+		},
+		Radius: Radius{
+			SessionTimeout: time.Hour * 2,
+		},
+		Analyzers: Analyzers{
+			DNS: DNSAnalyzer{
+				Window: time.Minute,
+				Tunnel: DNSTunnel{
+					Queries:      100,
+					NameLength:   52,
+					Entropy:      3.5,
+					ResponseSize: 512,
+					Ratio:        0.5,
+					Score:        3,
+				},
+				DGA: DGA{
+					NXDomains: 30,
+					Zones:     10,
+				},
+			},
+		},
+		Sinks: Sinks{
+			// 默认只输出到标准输出, 数据库需显式启用
+			Enabled: []string{"console"},
+			Mongo: Mongo{
+				URI:           "mongodb://localhost:27017/dpi",
+				Timeout:       time.Second * 10,
+				QueueSize:     10000,
+				BatchSize:     500,
+				FlushInterval: time.Second,
+				Retries:       3,
+				RetryBackoff:  time.Millisecond * 200,
+			},
+			ClickHouse: ClickHouse{
+				URL:           "http://localhost:8123",
+				Database:      "dpi",
+				Timeout:       time.Second * 30,
+				QueueSize:     100000,
+				BatchSize:     10000,
+				FlushInterval: time.Second * 5,
+				Retries:       3,
+				RetryBackoff:  time.Millisecond * 200,
+			},
+			Redis: Redis{
+				Addr:          "localhost:6379",
+				Timeout:       time.Second * 10,
+				Prefix:        "dpi:",
+				MaxLen:        1000000,
+				QueueSize:     10000,
+				BatchSize:     500,
+				FlushInterval: time.Second,
+				Retries:       3,
+				RetryBackoff:  time.Millisecond * 200,
+			},
+			NetFlow: NetFlow{
+				Collector: "127.0.0.1:4739",
+				Version:   "ipfix",
+				// RFC 5612 文档用 PEN, 部署时应替换为本单位的编号
+				EnterpriseID:    32473,
+				TemplateRefresh: time.Minute,
+				TemplatePackets: 20,
+				MTU:             1400,
+				StringLength:    64,
+				QueueSize:       10000,
+				FlushInterval:   time.Second,
+			},
+		},
+	}
+}
+
+// Validate 检查配置, 返回所有错误
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	_, err := logrus.ParseLevel(c.LogLevel)
+	check(err == nil, "log_level: unknown level %q", c.LogLevel)
+	if c.FeatureFile != "" {
+		_, err = os.Stat(c.FeatureFile)
+		check(err == nil, "feature_file: %v", err)
+	}
+	check(c.Capture.Device != "" || len(c.Capture.OfflineFile) > 0, "capture: device or offline_file is required")
+	check(c.Capture.SnapLen > 0, "capture.snap_len: must be positive, got %d", c.Capture.SnapLen)
+	switch c.Capture.Source {
+	case "pcap":
+	case "afpacket":
+		a := c.Capture.AFPacket
+		check(len(c.Capture.OfflineFile) == 0, "capture.source: afpacket cannot read offline_file")
+		check(a.BlockSize > 0 && a.BlockSize%4096 == 0, "capture.afpacket.block_size: must be a positive multiple of 4096, got %d", a.BlockSize)
+		check(a.NumBlocks > 0, "capture.afpacket.num_blocks: must be positive")
+		switch a.FanoutType {
+		case "hash", "lb", "cpu", "rollover", "random", "qm":
+		default:
+			check(false, "capture.afpacket.fanout_type: unknown type %q", a.FanoutType)
+		}
+	default:
+		check(false, "capture.source: must be pcap or afpacket, got %q", c.Capture.Source)
+	}
+	check(c.Capture.Workers >= 0, "capture.workers: must not be negative, got %d", c.Capture.Workers)
+	check(c.Timeouts.StreamFlush > 0, "timeouts.stream_flush: must be positive")
+	check(c.Timeouts.StreamClose > 0, "timeouts.stream_close: must be positive")
+	check(c.Timeouts.FlowIdle > 0, "timeouts.flow_idle: must be positive")
+	check(c.Timeouts.FlowActive > 0, "timeouts.flow_active: must be positive")
+	r := c.Reassembly
+	check(r.MaxBufferedPages >= 0, "reassembly.max_buffered_pages: must not be negative")
+	check(r.MaxBufferedPagesPerConn >= 0, "reassembly.max_buffered_pages_per_conn: must not be negative")
+	check(r.MaxConnections >= 0, "reassembly.max_connections: must not be negative")
+	check(contains([]string{"auto", "verify", "count", "skip"}, r.Checksum), "reassembly.checksum: must be auto, verify, count or skip, got %q", r.Checksum)
+	check(c.DNSCache.Size >= 0, "dns_cache.size: must not be negative")
+	check(c.DNSCache.MinTTL > 0, "dns_cache.min_ttl: must be positive")
+	check(c.Radius.SessionTimeout > 0, "radius.session_timeout: must be positive")
+	if c.Metrics.Listen != "" {
+		_, _, err = net.SplitHostPort(c.Metrics.Listen)
+		check(err == nil, "metrics.listen: %v", err)
+	}
+
+	for _, name := range c.Sinks.Enabled {
+		switch name {
+		case "mongo":
+			m := c.Sinks.Mongo
+			check(strings.HasPrefix(m.URI, "mongodb://") || strings.HasPrefix(m.URI, "mongodb+srv://"),
+				"sinks.mongo.uri: must start with mongodb:// or mongodb+srv://, got %q", m.URI)
+			check(m.QueueSize > 0, "sinks.mongo.queue_size: must be positive")
+			check(m.BatchSize > 0, "sinks.mongo.batch_size: must be positive")
+			check(m.FlushInterval > 0, "sinks.mongo.flush_interval: must be positive")
+			check(m.Retries >= 0, "sinks.mongo.retries: must not be negative")
+			check(m.RetryBackoff > 0, "sinks.mongo.retry_backoff: must be positive")
+		case "clickhouse":
+			ch := c.Sinks.ClickHouse
+			u, err := url.Parse(ch.URL)
+			check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+				"sinks.clickhouse.url: must be an http(s) URL, got %q", ch.URL)
+			check(ch.QueueSize > 0, "sinks.clickhouse.queue_size: must be positive")
+			check(ch.BatchSize > 0, "sinks.clickhouse.batch_size: must be positive")
+			check(ch.FlushInterval > 0, "sinks.clickhouse.flush_interval: must be positive")
+			check(ch.Retries >= 0, "sinks.clickhouse.retries: must not be negative")
+			check(ch.RetryBackoff > 0, "sinks.clickhouse.retry_backoff: must be positive")
+			check(ch.Database == "" || ClickHouseIdentifier.MatchString(ch.Database),
+				"sinks.clickhouse.database: must contain only letters, digits and underscores, got %q", ch.Database)
+		case "redis":
+			r := c.Sinks.Redis
+			_, _, err := net.SplitHostPort(r.Addr)
+			check(err == nil, "sinks.redis.addr: must be host:port, got %q", r.Addr)
+			check(r.MaxLen >= 0, "sinks.redis.max_len: must not be negative")
+			check(r.QueueSize > 0, "sinks.redis.queue_size: must be positive")
+			check(r.BatchSize > 0, "sinks.redis.batch_size: must be positive")
+			check(r.FlushInterval > 0, "sinks.redis.flush_interval: must be positive")
+			check(r.Retries >= 0, "sinks.redis.retries: must not be negative")
+			check(r.RetryBackoff > 0, "sinks.redis.retry_backoff: must be positive")
+		case "netflow":
+			nf := c.Sinks.NetFlow
+			_, _, err := net.SplitHostPort(nf.Collector)
+			check(err == nil, "sinks.netflow.collector: must be host:port, got %q", nf.Collector)
+			check(nf.Version == "ipfix" || nf.Version == "v9", "sinks.netflow.version: must be ipfix or v9, got %q", nf.Version)
+			check(nf.TemplateRefresh > 0, "sinks.netflow.template_refresh: must be positive")
+			check(nf.TemplatePackets > 0, "sinks.netflow.template_packets: must be positive")
+			check(nf.MTU >= 512 && nf.MTU <= 65507, "sinks.netflow.mtu: must be between 512 and 65507, got %d", nf.MTU)
+			check(nf.StringLength > 0 && nf.StringLength <= 255, "sinks.netflow.string_length: must be between 1 and 255, got %d", nf.StringLength)
+			check(nf.QueueSize > 0, "sinks.netflow.queue_size: must be positive")
+			check(nf.FlushInterval > 0, "sinks.netflow.flush_interval: must be positive")
+			check(contains(c.Dissectors, "flow"), "sinks.netflow: requires the flow dissector")
+		}
+	}
+
+	for _, entry := range append(append([]string(nil), c.EncryptedDNS.Resolvers...), c.EncryptedDNS.Local...) {
+		if strings.Contains(entry, "/") {
+			_, _, err = net.ParseCIDR(entry)
+			check(err == nil, "encrypted_dns: invalid network %q", entry)
+		}
+	}
+
+	for _, name := range c.Analyzers.Enabled {
+		switch name {
+		case "dns":
+			d := c.Analyzers.DNS
+			check(d.Window > 0, "analyzers.dns.window: must be positive")
+			check(d.Tunnel.Queries > 0, "analyzers.dns.tunnel.queries: must be positive")
+			check(d.Tunnel.NameLength > 0, "analyzers.dns.tunnel.name_length: must be positive")
+			check(d.Tunnel.Entropy > 0, "analyzers.dns.tunnel.entropy: must be positive")
+			check(d.Tunnel.ResponseSize > 0, "analyzers.dns.tunnel.response_size: must be positive")
+			check(d.Tunnel.Ratio > 0 && d.Tunnel.Ratio <= 1, "analyzers.dns.tunnel.ratio: must be in (0, 1], got %v", d.Tunnel.Ratio)
+			check(d.Tunnel.Score >= 1 && d.Tunnel.Score <= 4, "analyzers.dns.tunnel.score: must be between 1 and 4, got %d", d.Tunnel.Score)
+			check(d.DGA.NXDomains > 0, "analyzers.dns.dga.nxdomains: must be positive")
+			check(d.DGA.Zones > 0, "analyzers.dns.dga.zones: must be positive")
+			check(contains(c.Dissectors, "dns"), "analyzers.dns: requires the dns dissector")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+func contains(list []string, name string) bool {
+	for _, item := range list {
+		if item == name {
+			return true
 		}
 	}
+	return false
 }
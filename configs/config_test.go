@@ -0,0 +1,225 @@
+package configs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile 在临时目录写入配置文件并返回路径
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "dpi.yaml", `
+log_level: warn
+capture:
+  device: eth1
+  bpf: tcp
+dissectors: [tcp]
+sinks:
+  mongo:
+    retries: 5
+  redis:
+    retries: 5
+`)
+	t.Setenv("DPI_LOG_LEVEL", "error")
+	t.Setenv("DPI_BPF", "udp")
+	t.Setenv("DPI_DNS", "true")
+	t.Setenv("DPI_REDIS_BLOCK", "true")
+	t.Setenv("DPI_MONGO_RETRY_BACKOFF", "1s")
+	t.Setenv("DPI_CLICKHOUSE_BLOCK", "true")
+	cfg, err := Load([]string{"-c", path, "-bpf", "icmp", "-redis-retries", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"flag over env and file", cfg.Capture.BPF, "icmp"},
+		{"env over file", cfg.LogLevel, "error"},
+		{"file over default", cfg.Capture.Device, "eth1"},
+		{"nested file value", cfg.Sinks.Mongo.Retries, 5},
+		{"nested flag over file", cfg.Sinks.Redis.Retries, 1},
+		{"nested env", cfg.Sinks.Redis.Block, true},
+		{"nested duration env", cfg.Sinks.Mongo.RetryBackoff, time.Second},
+		{"clickhouse block env", cfg.Sinks.ClickHouse.Block, true},
+		{"switch env appends to file list", cfg.Dissectors, []string{"tcp", "dns"}},
+		{"default", cfg.Timeouts.FlowIdle, time.Minute * 2},
+		{"file path", cfg.File, path},
+	} {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// 没有 -c 时使用 DPI_CONFIG
+	t.Setenv("DPI_CONFIG", path)
+	if cfg, err = Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.File != path || cfg.Capture.Device != "eth1" || cfg.Capture.BPF != "udp" {
+		t.Errorf("DPI_CONFIG: file %q device %q bpf %q", cfg.File, cfg.Capture.Device, cfg.Capture.BPF)
+	}
+
+	t.Setenv("DPI_WORKERS", "many")
+	if _, err = Load(nil); err == nil || !strings.Contains(err.Error(), "DPI_WORKERS") {
+		t.Errorf("invalid env value: %v", err)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	yamlPath := writeFile(t, "dpi.yaml", `
+log_level: debug
+capture:
+  device: eth1
+  offline_file: /data/a.pcap
+dissectors: [tcp, dns]
+timeouts:
+  flow_idle: 30s
+sinks:
+  enabled: [console]
+  redis:
+    retries: 0
+    block: true
+`)
+	tomlPath := writeFile(t, "dpi.toml", `
+log_level = "debug"
+dissectors = ["tcp", "dns"]
+
+[capture]
+device = "eth1"
+offline_file = "/data/a.pcap"
+
+[timeouts]
+flow_idle = "30s"
+
+[sinks]
+enabled = ["console"]
+
+[sinks.redis]
+retries = 0
+block = true
+`)
+	fromYAML, err := Load([]string{"-c", yamlPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromTOML, err := Load([]string{"-c", tomlPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromYAML.File, fromTOML.File = "", ""
+	if !reflect.DeepEqual(fromYAML, fromTOML) {
+		t.Errorf("toml config differs from yaml:\n%+v\n%+v", fromTOML, fromYAML)
+	}
+	if fromTOML.Timeouts.FlowIdle != time.Second*30 || len(fromTOML.Capture.OfflineFile) != 1 {
+		t.Errorf("toml values: flow_idle %s offline_file %v", fromTOML.Timeouts.FlowIdle, fromTOML.Capture.OfflineFile)
+	}
+	if r := fromTOML.Sinks.Redis; r.Retries != 0 || !r.Block {
+		t.Errorf("toml values: redis retries %d block %v", r.Retries, r.Block)
+	}
+}
+
+func TestLoadUnknownFields(t *testing.T) {
+	for name, content := range map[string]string{
+		"dpi.yaml":  "capture:\n  devcie: eth0\n",
+		"dpi.toml":  "[capture]\ndevcie = \"eth0\"\n",
+		"top.yaml":  "log_levle: info\n",
+		"type.yaml": "capture:\n  workers: many\n",
+		"bad.toml":  "[capture\n",
+	} {
+		path := writeFile(t, name, content)
+		_, err := Load([]string{"-c", path})
+		if err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("%s: error %v", name, err)
+			continue
+		}
+		if strings.Contains(content, "devcie") && !strings.Contains(err.Error(), "devcie") {
+			t.Errorf("%s: error does not name the unknown field: %v", name, err)
+		}
+	}
+	if _, err := Load([]string{"-c", filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Error("missing config file: no error")
+	}
+}
+
+func TestLoadExample(t *testing.T) {
+	// 示例中的特征库路径在测试环境不存在
+	if _, err := Load([]string{"-c", "config.example.yaml", "-ff="}); err != nil {
+		t.Errorf("config.example.yaml: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	c := Default()
+	c.LogLevel = "loud"
+	c.Capture.SnapLen = 0
+	c.Capture.Source = "netmap"
+	c.Reassembly.Checksum = "maybe"
+	c.Sinks.Enabled = []string{"mongo", "clickhouse", "redis"}
+	c.Sinks.Mongo.URI = "localhost:27017"
+	c.Sinks.ClickHouse.Database = "dpi;"
+	c.Sinks.Redis.Retries = -1
+	c.Sinks.Mongo.RetryBackoff = 0
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("no error")
+	}
+	// 一次返回全部错误
+	for _, field := range []string{"log_level:", "capture.snap_len:", "capture.source:", "reassembly.checksum:", "sinks.mongo.uri:", "sinks.clickhouse.database:", "sinks.redis.retries:", "sinks.mongo.retry_backoff:"} {
+		if !strings.Contains(err.Error(), "\n  "+field) {
+			t.Errorf("missing %s in:\n%v", field, err)
+		}
+	}
+	if n := strings.Count(err.Error(), "\n  "); n != 8 {
+		t.Errorf("got %d errors, want 8:\n%v", n, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := writeFile(t, "dpi.yaml", "log_level: info\ncapture:\n  bpf: tcp\n")
+	cfg, err := Load([]string{"-c", path, "-log-level", "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != "debug" || cfg.Capture.BPF != "tcp" {
+		t.Fatalf("load: log_level %q bpf %q", cfg.LogLevel, cfg.Capture.BPF)
+	}
+	if err = os.WriteFile(path, []byte("log_level: warn\ncapture:\n  bpf: udp\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = Reload(); err != nil {
+		t.Fatal(err)
+	}
+	// 配置文件的修改生效, 命令行参数仍然覆盖配置文件
+	if cfg.LogLevel != "debug" || cfg.Capture.BPF != "udp" || cfg.File != path {
+		t.Errorf("reload: log_level %q bpf %q file %q", cfg.LogLevel, cfg.Capture.BPF, cfg.File)
+	}
+	// 命令行参数覆盖配置文件中的无效值
+	if err = os.WriteFile(path, []byte("log_level: loud\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Reload(); err != nil {
+		t.Errorf("invalid log_level overridden by flag: %v", err)
+	}
+	if err = os.WriteFile(path, []byte("capture:\n  snap_len: 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Reload(); err == nil {
+		t.Error("invalid reload: no error")
+	}
+}
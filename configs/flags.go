@@ -0,0 +1,402 @@
+package configs
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 命令行参数与配置文件加载
+// 命令行参数在首次 Load 时记录下来, Reload 重新读取配置文件后按原顺序再次应用
+
+// setting 一次命令行参数赋值
+type setting struct {
+	name  string
+	value string
+}
+
+var (
+	loadMu  sync.Mutex
+	cmdline []setting
+	cfgFile string
+)
+
+// Load 解析命令行参数并加载配置
+func Load(args []string) (*Config, error) {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+
+	cfg := Default()
+	fs := newFlagSet(cfg)
+	var recorded []setting
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Value = &recordedValue{Value: f.Value, name: f.Name, log: &recorded}
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	cmdline, cfgFile = recorded, cfg.File
+	if cfgFile == "" {
+		cfgFile = os.Getenv("DPI_CONFIG")
+	}
+	return build()
+}
+
+// Reload 重新读取配置文件, 命令行参数仍然生效
+func Reload() (*Config, error) {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	return build()
+}
+
+func build() (*Config, error) {
+	cfg := Default()
+	fs := newFlagSet(cfg)
+	if cfgFile != "" {
+		if err := loadFile(cfgFile, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfgFile, err)
+		}
+	}
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+	for _, s := range cmdline {
+		if err := fs.Set(s.name, s.value); err != nil {
+			return nil, err
+		}
+	}
+	cfg.File = cfgFile
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile 读取配置文件, .toml 文件按 TOML 解析, 其他按 YAML
+// TOML 先解析为 map 再转为 YAML 解码, 两种格式共用字段名与未知字段检查
+func loadFile(name string, cfg *Config) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(name), ".toml") {
+		var m map[string]interface{}
+		if _, err = toml.Decode(string(data), &m); err != nil {
+			return err
+		}
+		if data, err = yaml.Marshal(m); err != nil {
+			return err
+		}
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// newFlagSet 定义命令行参数, 参数直接写入 cfg
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&cfg.File, "c", "", "Config file (YAML, or TOML with a .toml extension), or DPI_CONFIG")
+	fs.StringVar(&cfg.Devices, "devices", "", "获取设备列表")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level (debug, info, warn, error)")
+	fs.Var(&debugFlag{cfg}, "d", "开启调试模式 true or false")
+	fs.StringVar(&cfg.FeatureFile, "ff", cfg.FeatureFile, "Feature filepath")
+
+	fs.StringVar(&cfg.Capture.Source, "source", cfg.Capture.Source, "Capture backend (pcap, afpacket)")
+	fs.StringVar(&cfg.Capture.Device, "n", cfg.Capture.Device, "Network interface controller")
+	fs.Var((*listFlag)(&cfg.Capture.OfflineFile), "of", "Offline pcap/pcapng files or directories, comma separated")
+	fs.StringVar(&cfg.Capture.BPF, "bpf", cfg.Capture.BPF, "Berkeley Packet Filter")
+	fs.IntVar(&cfg.Capture.SnapLen, "snaplen", cfg.Capture.SnapLen, "Capture snap length")
+	fs.BoolVar(&cfg.Capture.Promisc, "promisc", cfg.Capture.Promisc, "Promiscuous mode")
+	fs.IntVar(&cfg.Capture.Workers, "workers", cfg.Capture.Workers, "Worker goroutines, 0 for one per CPU")
+	fs.IntVar(&cfg.Capture.AFPacket.BlockSize, "afpacket-block-size", cfg.Capture.AFPacket.BlockSize, "AF_PACKET ring block size in bytes")
+	fs.IntVar(&cfg.Capture.AFPacket.NumBlocks, "afpacket-blocks", cfg.Capture.AFPacket.NumBlocks, "AF_PACKET ring block count")
+	fs.Var((*uint16Flag)(&cfg.Capture.AFPacket.FanoutGroup), "fanout-group", "AF_PACKET fanout group ID, 0 to disable")
+	fs.StringVar(&cfg.Capture.AFPacket.FanoutType, "fanout-type", cfg.Capture.AFPacket.FanoutType, "AF_PACKET fanout type (hash, lb, cpu, rollover, random, qm)")
+
+	fs.Var((*listFlag)(&cfg.Dissectors), "dissectors", "Enabled dissectors, comma separated (e.g. tcp,dns)")
+	fs.Var(&switchFlag{list: &cfg.Dissectors, name: "radius"}, "r", "Radius Protocol")
+	fs.Var(&switchFlag{list: &cfg.Dissectors, name: "defrag"}, "defrag", "Defrag IPv4 Protocol")
+	fs.Var(&switchFlag{list: &cfg.Dissectors, name: "flow"}, "flow", "Flow statistics")
+	fs.Var(&switchFlag{list: &cfg.Dissectors, name: "tcp"}, "tcp", "TCP Protocol")
+	fs.Var(&switchFlag{list: &cfg.Dissectors, name: "dns"}, "dns", "DNS Protocol")
+	fs.Var(&switchFlag{list: &cfg.Dissectors, name: "icmp"}, "icmp", "ICMP Protocol")
+	fs.Var(&switchFlag{list: &cfg.Dissectors, name: "quic"}, "quic", "QUIC Initial (SNI, ALPN, JA4)")
+	fs.BoolVar(&cfg.HTTP, "http", cfg.HTTP, "HTTP Protocol")
+	fs.DurationVar(&cfg.Timeouts.StreamFlush, "stream-flush", cfg.Timeouts.StreamFlush, "Flush TCP streams idle for this long")
+	fs.DurationVar(&cfg.Timeouts.StreamClose, "stream-close", cfg.Timeouts.StreamClose, "Close TCP streams idle for this long")
+	fs.DurationVar(&cfg.Timeouts.FlowIdle, "flow-idle", cfg.Timeouts.FlowIdle, "Export flows idle for this long")
+	fs.DurationVar(&cfg.Timeouts.FlowActive, "flow-active", cfg.Timeouts.FlowActive, "Export long-lived flows at this interval")
+	fs.IntVar(&cfg.Reassembly.MaxBufferedPages, "max-pages", cfg.Reassembly.MaxBufferedPages, "Max out-of-order pages buffered for TCP reassembly, 0 for unlimited")
+	fs.IntVar(&cfg.Reassembly.MaxBufferedPagesPerConn, "max-pages-per-conn", cfg.Reassembly.MaxBufferedPagesPerConn, "Max out-of-order pages buffered per TCP connection, 0 for unlimited")
+	fs.IntVar(&cfg.Reassembly.MaxConnections, "max-connections", cfg.Reassembly.MaxConnections, "Max tracked TCP connections, 0 for unlimited")
+	fs.StringVar(&cfg.Reassembly.Checksum, "checksum", cfg.Reassembly.Checksum, "TCP checksum handling (auto, verify, count, skip)")
+	fs.IntVar(&cfg.DNSCache.Size, "dns-cache-size", cfg.DNSCache.Size, "Max client/address pairs cached from DNS answers, 0 to disable")
+	fs.DurationVar(&cfg.DNSCache.MinTTL, "dns-cache-min-ttl", cfg.DNSCache.MinTTL, "Keep DNS cache entries at least this long regardless of TTL")
+
+	fs.Var((*listFlag)(&cfg.EncryptedDNS.Resolvers), "dns-resolvers", "Public DoH/DoT resolvers (names, addresses or networks), comma separated")
+	fs.Var((*listFlag)(&cfg.EncryptedDNS.Local), "local-resolvers", "Local resolvers not tagged as encrypted DNS, comma separated")
+	fs.BoolVar(&cfg.EncryptedDNS.Shape, "doh-shape", cfg.EncryptedDNS.Shape, "Tag h2 connections carrying only small records as DoH (may mislabel API and gRPC traffic)")
+	fs.DurationVar(&cfg.Radius.SessionTimeout, "radius-session-timeout", cfg.Radius.SessionTimeout, "Drop RADIUS sessions without accounting packets for this long")
+	fs.Var((*listFlag)(&cfg.Analyzers.Enabled), "analyzers", "Enabled analyzers, comma separated (e.g. dns)")
+	d := &cfg.Analyzers.DNS
+	fs.DurationVar(&d.Window, "dns-window", d.Window, "DNS analyzer counting window per client")
+	fs.IntVar(&d.Tunnel.Queries, "dns-tunnel-queries", d.Tunnel.Queries, "DNS tunnel: queries to one zone per window")
+	fs.IntVar(&d.Tunnel.NameLength, "dns-tunnel-name-length", d.Tunnel.NameLength, "DNS tunnel: length of the name below the zone")
+	fs.Float64Var(&d.Tunnel.Entropy, "dns-tunnel-entropy", d.Tunnel.Entropy, "DNS tunnel: entropy in bits of the name below the zone")
+	fs.IntVar(&d.Tunnel.ResponseSize, "dns-tunnel-response-size", d.Tunnel.ResponseSize, "DNS tunnel: size in bytes of a large response")
+	fs.Float64Var(&d.Tunnel.Ratio, "dns-tunnel-ratio", d.Tunnel.Ratio, "DNS tunnel: share of suspicious names, TXT/NULL queries and large responses")
+	fs.IntVar(&d.Tunnel.Score, "dns-tunnel-score", d.Tunnel.Score, "DNS tunnel: indicators (of 4) required to alert")
+	fs.IntVar(&d.DGA.NXDomains, "dns-dga-nxdomains", d.DGA.NXDomains, "DGA: NXDOMAIN responses per window")
+	fs.IntVar(&d.DGA.Zones, "dns-dga-zones", d.DGA.Zones, "DGA: distinct zones among NXDOMAIN responses per window")
+
+	fs.StringVar(&cfg.Metrics.Listen, "metrics", cfg.Metrics.Listen, "Serve Prometheus /metrics on this address (e.g. :9464)")
+
+	fs.Var((*listFlag)(&cfg.Sinks.Enabled), "sinks", "Record sinks, comma separated (console, mongo, clickhouse, redis, netflow)")
+	fs.Var(&switchFlag{list: &cfg.Sinks.Enabled, name: "console"}, "o", "OutPut2Console")
+
+	m := &cfg.Sinks.Mongo
+	fs.StringVar(&m.URI, "mongo-uri", m.URI, "MongoDB connection URI")
+	fs.StringVar(&m.User, "mongo-user", m.User, "MongoDB user")
+	fs.StringVar(&m.Password, "mongo-password", m.Password, "MongoDB password")
+	fs.StringVar(&m.AuthSource, "mongo-auth-source", m.AuthSource, "MongoDB authentication database")
+	fs.BoolVar(&m.TLS, "mongo-tls", m.TLS, "Connect to MongoDB over TLS")
+	fs.StringVar(&m.CAFile, "mongo-ca-file", m.CAFile, "MongoDB TLS CA certificate file")
+	fs.StringVar(&m.Database, "mongo-db", m.Database, "MongoDB database, empty for one database per protocol")
+	fs.DurationVar(&m.Timeout, "mongo-timeout", m.Timeout, "MongoDB connect timeout")
+	fs.Uint64Var(&m.PoolSize, "mongo-pool", m.PoolSize, "MongoDB max connection pool size, 0 for driver default")
+	fs.IntVar(&m.QueueSize, "mongo-queue", m.QueueSize, "MongoDB writer queue size")
+	fs.IntVar(&m.BatchSize, "mongo-batch", m.BatchSize, "MongoDB InsertMany batch size")
+	fs.DurationVar(&m.FlushInterval, "mongo-flush", m.FlushInterval, "MongoDB writer flush interval")
+	fs.IntVar(&m.Retries, "mongo-retries", m.Retries, "MongoDB write retries before dropping a batch")
+	fs.DurationVar(&m.RetryBackoff, "mongo-retry-backoff", m.RetryBackoff, "MongoDB write retry backoff, doubled on each retry")
+	fs.BoolVar(&m.Block, "mongo-block", m.Block, "Block capture when the MongoDB queue is full instead of dropping records")
+
+	ch := &cfg.Sinks.ClickHouse
+	fs.StringVar(&ch.URL, "clickhouse-url", ch.URL, "ClickHouse HTTP interface address")
+	fs.StringVar(&ch.Database, "clickhouse-db", ch.Database, "ClickHouse database")
+	fs.StringVar(&ch.User, "clickhouse-user", ch.User, "ClickHouse user")
+	fs.StringVar(&ch.Password, "clickhouse-password", ch.Password, "ClickHouse password")
+	fs.DurationVar(&ch.Timeout, "clickhouse-timeout", ch.Timeout, "ClickHouse request timeout")
+	fs.IntVar(&ch.QueueSize, "clickhouse-queue", ch.QueueSize, "ClickHouse writer queue size")
+	fs.IntVar(&ch.BatchSize, "clickhouse-batch", ch.BatchSize, "ClickHouse insert batch size")
+	fs.DurationVar(&ch.FlushInterval, "clickhouse-flush", ch.FlushInterval, "ClickHouse writer flush interval")
+	fs.IntVar(&ch.Retries, "clickhouse-retries", ch.Retries, "ClickHouse insert retries before dropping a batch")
+	fs.DurationVar(&ch.RetryBackoff, "clickhouse-retry-backoff", ch.RetryBackoff, "ClickHouse insert retry backoff, doubled on each retry")
+	fs.BoolVar(&ch.Block, "clickhouse-block", ch.Block, "Block capture when the ClickHouse queue is full instead of dropping records")
+
+	nf := &cfg.Sinks.NetFlow
+	fs.StringVar(&nf.Collector, "netflow-collector", nf.Collector, "NetFlow/IPFIX collector address")
+	fs.StringVar(&nf.Version, "netflow-version", nf.Version, "Export protocol (ipfix, v9)")
+	fs.Var((*uint32Flag)(&nf.DomainID), "netflow-domain", "IPFIX observation domain / NetFlow v9 source ID")
+	fs.Var((*uint32Flag)(&nf.EnterpriseID), "netflow-pen", "Private enterprise number for application, SNI and HTTP host fields")
+	fs.DurationVar(&nf.TemplateRefresh, "netflow-template-refresh", nf.TemplateRefresh, "Resend templates at this interval")
+	fs.IntVar(&nf.TemplatePackets, "netflow-template-packets", nf.TemplatePackets, "Resend templates every N packets")
+	fs.IntVar(&nf.MTU, "netflow-mtu", nf.MTU, "Maximum export packet size")
+
+	r := &cfg.Sinks.Redis
+	fs.StringVar(&r.Addr, "redis-addr", r.Addr, "Redis address")
+	fs.StringVar(&r.User, "redis-user", r.User, "Redis user")
+	fs.StringVar(&r.Password, "redis-password", r.Password, "Redis password")
+	fs.IntVar(&r.DB, "redis-db", r.DB, "Redis database")
+	fs.BoolVar(&r.TLS, "redis-tls", r.TLS, "Connect to Redis over TLS")
+	fs.DurationVar(&r.Timeout, "redis-timeout", r.Timeout, "Redis dial timeout")
+	fs.StringVar(&r.CAFile, "redis-ca-file", r.CAFile, "Redis TLS CA certificate file")
+	fs.IntVar(&r.PoolSize, "redis-pool", r.PoolSize, "Redis connection pool size, 0 for driver default")
+	fs.StringVar(&r.Prefix, "redis-prefix", r.Prefix, "Redis stream name prefix, followed by the record kind")
+	fs.Int64Var(&r.MaxLen, "redis-max-len", r.MaxLen, "Approximate entries kept per Redis stream, 0 for unlimited")
+	fs.IntVar(&r.QueueSize, "redis-queue", r.QueueSize, "Redis writer queue size")
+	fs.IntVar(&r.BatchSize, "redis-batch", r.BatchSize, "Redis XADD pipeline size")
+	fs.DurationVar(&r.FlushInterval, "redis-flush", r.FlushInterval, "Redis writer flush interval")
+	fs.IntVar(&r.Retries, "redis-retries", r.Retries, "Redis XADD pipeline retries before dropping a batch")
+	fs.DurationVar(&r.RetryBackoff, "redis-retry-backoff", r.RetryBackoff, "Redis XADD pipeline retry backoff, doubled on each retry")
+	fs.BoolVar(&r.Block, "redis-block", r.Block, "Block capture when the Redis queue is full instead of dropping records")
+	return fs
+}
+
+// applyEnv 从环境变量读取参数
+// 变量名为 DPI_ 加大写参数名, "-" 替换为 "_", 如 -mongo-uri 对应 DPI_MONGO_URI
+// 列表参数先于开关参数应用, 保证 DPI_DNS=true 追加到 DPI_DISSECTORS 之后
+func applyEnv(fs *flag.FlagSet) error {
+	var env []setting
+	fs.VisitAll(func(f *flag.Flag) {
+		name := "DPI_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, setting{name: f.Name, value: v})
+		}
+	})
+	sort.SliceStable(env, func(i, j int) bool {
+		_, si := fs.Lookup(env[i].name).Value.(*switchFlag)
+		_, sj := fs.Lookup(env[j].name).Value.(*switchFlag)
+		return !si && sj
+	})
+	for _, s := range env {
+		if err := fs.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("invalid value %q for DPI_%s: %w", s.value, strings.ToUpper(strings.ReplaceAll(s.name, "-", "_")), err)
+		}
+	}
+	return nil
+}
+
+// recordedValue 记录命令行参数的赋值顺序
+type recordedValue struct {
+	flag.Value
+	name string
+	log  *[]setting
+}
+
+// String flag.PrintDefaults 会对零值调用 String 判断默认值
+func (r *recordedValue) String() string {
+	if r.Value == nil {
+		return ""
+	}
+	return r.Value.String()
+}
+
+func (r *recordedValue) Set(s string) error {
+	*r.log = append(*r.log, setting{name: r.name, value: s})
+	return r.Value.Set(s)
+}
+
+func (r *recordedValue) IsBoolFlag() bool {
+	b, ok := r.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// listFlag 逗号分隔的列表, 赋值时替换整个列表
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// switchFlag 布尔开关, 为 true 时将 name 加入列表, 为 false 时移除
+type switchFlag struct {
+	list *[]string
+	name string
+}
+
+func (s *switchFlag) String() string {
+	if s.list == nil {
+		return "false"
+	}
+	for _, item := range *s.list {
+		if item == s.name {
+			return "true"
+		}
+	}
+	return "false"
+}
+
+func (s *switchFlag) Set(v string) error {
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	items := (*s.list)[:0:0]
+	for _, item := range *s.list {
+		if item != s.name {
+			items = append(items, item)
+		}
+	}
+	if on {
+		items = append(items, s.name)
+	}
+	*s.list = items
+	return nil
+}
+
+func (s *switchFlag) IsBoolFlag() bool {
+	return true
+}
+
+// uint32Flag 32 位无符号整数参数
+type uint32Flag uint32
+
+func (u *uint32Flag) String() string {
+	if u == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*u), 10)
+}
+
+func (u *uint32Flag) Set(s string) error {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return err
+	}
+	*u = uint32Flag(v)
+	return nil
+}
+
+// uint16Flag 16 位无符号整数参数
+type uint16Flag uint16
+
+func (u *uint16Flag) String() string {
+	if u == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*u), 10)
+}
+
+func (u *uint16Flag) Set(s string) error {
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return err
+	}
+	*u = uint16Flag(v)
+	return nil
+}
+
+// debugFlag -d 开启调试模式, 等同于 -log-level debug
+type debugFlag struct {
+	cfg *Config
+}
+
+func (d *debugFlag) String() string {
+	if d.cfg == nil {
+		return "false"
+	}
+	return fmt.Sprint(d.cfg.LogLevel == "debug")
+}
+
+func (d *debugFlag) Set(v string) error {
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	if on {
+		d.cfg.LogLevel = "debug"
+	}
+	return nil
+}
+
+func (d *debugFlag) IsBoolFlag() bool {
+	return true
+}
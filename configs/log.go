@@ -1,26 +1,28 @@
 package configs
 
 import (
-	"fmt"
 	format "github.com/antonfisher/nested-logrus-formatter"
 	"github.com/sirupsen/logrus"
 	"time"
 )
 
-func initLog() {
+func init() {
 	Log = logrus.New()
-
-	if Debug {
-		Log.SetLevel(logrus.DebugLevel)
-	} else {
-		Log.SetLevel(logrus.InfoLevel)
-	}
-
+	Log.SetLevel(logrus.InfoLevel)
 	Log.SetFormatter(&format.Formatter{
 		HideKeys:        false,
 		TimestampFormat: time.RFC3339,
 		FieldsOrder:     []string{"component", "category"},
 	})
+}
 
-	Log.WithField("Log组件加载成功", fmt.Sprintf("DEBUG模式:%t", Debug)).Info()
+// SetLogLevel 设置日志级别, 可在运行中调用
+func SetLogLevel(level string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Log.SetLevel(l)
+	Log.WithField("Log组件加载成功", "level:"+l.String()).Info()
+	return nil
 }
@@ -1 +1,83 @@
 package analyzer
+
+import (
+	"fmt"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"sort"
+	"sync"
+)
+
+// Analyzer 分析解析器输出的记录
+// Analyze 在记录补全字段后调用, 可能在多个 goroutine 中同时调用, 返回需要输出的告警
+type Analyzer interface {
+	Analyze(r record.Protocol) []*record.Alert
+}
+
+// Factory 根据配置创建分析器
+type Factory func(c *configs.Config) (Analyzer, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register 注册分析器, 重复注册同名分析器会 panic
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("analyzer: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("analyzer: Register called twice for analyzer " + name)
+	}
+	registry[name] = factory
+}
+
+// Analyzers 返回已注册的分析器名称
+func Analyzers() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New 按配置中启用的名称创建分析器, 多个分析器组合为 Multi
+func New(c *configs.Config) (Multi, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	var multi Multi
+	seen := make(map[string]bool, len(c.Analyzers.Enabled))
+	for _, name := range c.Analyzers.Enabled {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		factory, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown analyzer %q", name)
+		}
+		a, err := factory(c)
+		if err != nil {
+			return nil, fmt.Errorf("analyzer %s: %w", name, err)
+		}
+		multi = append(multi, a)
+	}
+	return multi, nil
+}
+
+// Multi 依次调用所有分析器, 合并告警
+type Multi []Analyzer
+
+func (m Multi) Analyze(r record.Protocol) []*record.Alert {
+	var alerts []*record.Alert
+	for _, a := range m {
+		alerts = append(alerts, a.Analyze(r)...)
+	}
+	return alerts
+}
@@ -0,0 +1,292 @@
+package analyzer
+
+import (
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS 隧道与 DGA 检测
+// 按客户端在统计窗口内累计 DNS 记录, 时间取记录的抓包时间:
+// 隧道按区域统计查询数、长或高熵的子域名、TXT/NULL 查询与大应答, 命中的指标数达到 score 时告警;
+// DGA 统计 NXDOMAIN 应答数与涉及的不同区域数, 都达到阈值时告警.
+// 同一客户端的同一类告警在一个窗口内只输出一次
+
+// 告警类型
+const (
+	AlertDNSTunnel = "dns_tunnel"
+	AlertDGA       = "dga"
+)
+
+const (
+	dnsMinSamples       = 10    // 查询或应答数达到该值后才计算占比
+	dnsEntropyMinLength = 16    // 短于该长度的子域名不计算熵
+	dnsMaxClients       = 65536 // 跟踪的客户端数量上限
+	dnsMaxZones         = 256   // 每个客户端跟踪的区域数量上限
+	dnsMaxSamples       = 5     // 告警附带的查询名称数量
+)
+
+func init() {
+	Register("dns", func(c *configs.Config) (Analyzer, error) {
+		return &dnsAnalyzer{cfg: c.Analyzers.DNS, clients: make(map[string]*dnsClient)}, nil
+	})
+}
+
+type dnsAnalyzer struct {
+	cfg     configs.DNSAnalyzer
+	mu      sync.Mutex
+	clients map[string]*dnsClient
+	swept   time.Time // 上次清理不活动客户端的时间
+}
+
+// dnsClient 一个客户端在当前窗口内的统计
+type dnsClient struct {
+	ip    net.IP
+	start time.Time
+	last  time.Time
+	zones map[string]*dnsZone
+	// NXDOMAIN 应答
+	nxdomains  int
+	nxZones    map[string]bool
+	nxSamples  []string
+	dgaAlerted bool
+}
+
+// dnsZone 客户端对一个区域的查询统计
+type dnsZone struct {
+	queries     int
+	suspicious  int // 长或高熵的子域名
+	txt         int // TXT 与 NULL 查询
+	responses   int
+	large       int // 不小于 response_size 的应答
+	maxResponse int
+	samples     []string
+	alerted     bool
+}
+
+func (a *dnsAnalyzer) Analyze(r record.Protocol) []*record.Alert {
+	d, ok := r.(*record.Dns)
+	if !ok || len(d.Questions) == 0 {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(d.Questions[0].Name, "."))
+	zone := dnsZoneOf(name)
+	if zone == "" {
+		return nil
+	}
+	ip := d.SrcIP
+	if d.Response {
+		ip = d.DstIP
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sweep(d.Timestamp)
+	c := a.client(ip, d.Timestamp)
+	if c == nil {
+		return nil
+	}
+	var alerts []*record.Alert
+	if d.Response && d.RCode == "NXDOMAIN" {
+		c.nxdomains++
+		if len(c.nxZones) < dnsMaxZones {
+			c.nxZones[zone] = true
+		}
+		c.nxSamples = appendSample(c.nxSamples, name)
+		if alert := a.dga(c, d.Timestamp); alert != nil {
+			alerts = append(alerts, alert)
+		}
+	}
+
+	z, ok := c.zones[zone]
+	if !ok {
+		if len(c.zones) >= dnsMaxZones {
+			return alerts
+		}
+		z = &dnsZone{}
+		c.zones[zone] = z
+	}
+	if !d.Response {
+		z.queries++
+		if a.suspicious(name, zone) {
+			z.suspicious++
+			z.samples = appendSample(z.samples, name)
+		}
+		if t := d.Questions[0].Type; t == "TXT" || t == "NULL" {
+			z.txt++
+		}
+	} else {
+		z.responses++
+		if d.Size >= a.cfg.Tunnel.ResponseSize {
+			z.large++
+		}
+		if d.Size > z.maxResponse {
+			z.maxResponse = d.Size
+		}
+	}
+	if alert := a.tunnel(c, zone, z, d.Timestamp); alert != nil {
+		alerts = append(alerts, alert)
+	}
+	return alerts
+}
+
+// client 返回客户端的统计, 窗口结束时重新开始; 达到数量上限时返回 nil
+func (a *dnsAnalyzer) client(ip net.IP, ts time.Time) *dnsClient {
+	key := string(ip.To16())
+	c, ok := a.clients[key]
+	if !ok {
+		if len(a.clients) >= dnsMaxClients {
+			return nil
+		}
+		c = &dnsClient{ip: ip}
+		a.clients[key] = c
+	}
+	if !ok || ts.Sub(c.start) >= a.cfg.Window {
+		c.start = ts
+		c.zones = make(map[string]*dnsZone)
+		c.nxdomains, c.nxZones, c.nxSamples, c.dgaAlerted = 0, make(map[string]bool), nil, false
+	}
+	c.last = ts
+	return c
+}
+
+// sweep 每个窗口删除一次超过一个窗口没有记录的客户端
+func (a *dnsAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.swept) < a.cfg.Window {
+		return
+	}
+	a.swept = now
+	for key, c := range a.clients {
+		if now.Sub(c.last) >= a.cfg.Window {
+			delete(a.clients, key)
+		}
+	}
+}
+
+// suspicious 判断区域之下的部分是否过长或字符熵过高
+func (a *dnsAnalyzer) suspicious(name, zone string) bool {
+	sub := strings.ReplaceAll(strings.TrimSuffix(strings.TrimSuffix(name, zone), "."), ".", "")
+	if len(sub) >= a.cfg.Tunnel.NameLength {
+		return true
+	}
+	return len(sub) >= dnsEntropyMinLength && entropy(sub) >= a.cfg.Tunnel.Entropy
+}
+
+func (a *dnsAnalyzer) tunnel(c *dnsClient, zone string, z *dnsZone, ts time.Time) *record.Alert {
+	if z.alerted {
+		return nil
+	}
+	t := a.cfg.Tunnel
+	var reasons []string
+	if z.queries >= t.Queries {
+		reasons = append(reasons, "rate")
+	}
+	if z.queries >= dnsMinSamples {
+		if ratio(z.suspicious, z.queries) >= t.Ratio {
+			reasons = append(reasons, "names")
+		}
+		if ratio(z.txt, z.queries) >= t.Ratio {
+			reasons = append(reasons, "txt")
+		}
+	}
+	if z.responses >= dnsMinSamples && ratio(z.large, z.responses) >= t.Ratio {
+		reasons = append(reasons, "response_size")
+	}
+	if len(reasons) < t.Score {
+		return nil
+	}
+	z.alerted = true
+	return &record.Alert{
+		Analyzer: "dns",
+		Type:     AlertDNSTunnel,
+		SrcIP:    c.ip,
+		Zone:     zone,
+		Score:    len(reasons),
+		Reasons:  reasons,
+		Evidence: map[string]int{
+			"queries":          z.queries,
+			"suspicious_names": z.suspicious,
+			"txt_queries":      z.txt,
+			"responses":        z.responses,
+			"large_responses":  z.large,
+			"max_response":     z.maxResponse,
+		},
+		Samples:   append([]string(nil), z.samples...),
+		StartTime: c.start,
+		Timestamp: ts,
+	}
+}
+
+func (a *dnsAnalyzer) dga(c *dnsClient, ts time.Time) *record.Alert {
+	g := a.cfg.DGA
+	if c.dgaAlerted || c.nxdomains < g.NXDomains || len(c.nxZones) < g.Zones {
+		return nil
+	}
+	c.dgaAlerted = true
+	return &record.Alert{
+		Analyzer: "dns",
+		Type:     AlertDGA,
+		SrcIP:    c.ip,
+		Score:    2,
+		Reasons:  []string{"nxdomain", "zones"},
+		Evidence: map[string]int{
+			"nxdomains": c.nxdomains,
+			"zones":     len(c.nxZones),
+		},
+		Samples:   append([]string(nil), c.nxSamples...),
+		StartTime: c.start,
+		Timestamp: ts,
+	}
+}
+
+// secondLevels 国家顶级域名下常见的二级域名, 其下一级才是注册的区域
+var secondLevels = map[string]bool{"com": true, "net": true, "org": true, "gov": true, "edu": true, "co": true, "ac": true}
+
+// dnsZoneOf 返回名称所属的注册区域, 如 a.b.example.com 为 example.com, a.example.com.cn 为 example.com.cn
+func dnsZoneOf(name string) string {
+	labels := strings.Split(name, ".")
+	n := len(labels)
+	if n < 2 {
+		return name
+	}
+	if n >= 3 && len(labels[n-1]) == 2 && secondLevels[labels[n-2]] {
+		return strings.Join(labels[n-3:], ".")
+	}
+	return strings.Join(labels[n-2:], ".")
+}
+
+// entropy 按字节计算的香农熵, 单位 bit
+func entropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var h float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(s))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+func ratio(n, total int) float64 {
+	return float64(n) / float64(total)
+}
+
+func appendSample(samples []string, name string) []string {
+	if len(samples) >= dnsMaxSamples {
+		return samples
+	}
+	for _, s := range samples {
+		if s == name {
+			return samples
+		}
+	}
+	return append(samples, name)
+}
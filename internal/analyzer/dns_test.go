@@ -0,0 +1,386 @@
+package analyzer
+
+import (
+	"fmt"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testStart  = time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	testClient = net.ParseIP("10.0.0.2")
+	testServer = net.ParseIP("10.0.0.53")
+)
+
+// testConfig 阈值较小的配置, 隧道的每个指标单独即可告警
+func testConfig() configs.DNSAnalyzer {
+	return configs.DNSAnalyzer{
+		Window: time.Minute,
+		Tunnel: configs.DNSTunnel{Queries: 1000, NameLength: 30, Entropy: 3.5, ResponseSize: 200, Ratio: 0.5, Score: 1},
+		DGA:    configs.DGA{NXDomains: 5, Zones: 3},
+	}
+}
+
+func newTestAnalyzer(cfg configs.DNSAnalyzer) *dnsAnalyzer {
+	return &dnsAnalyzer{cfg: cfg, clients: make(map[string]*dnsClient)}
+}
+
+func dnsQuery(client net.IP, name, typ string, ts time.Time) *record.Dns {
+	return &record.Dns{SrcIP: client, DstIP: testServer, Timestamp: ts, Size: 40,
+		Questions: []record.DnsQuestion{{Name: name, Type: typ, Class: "IN"}}}
+}
+
+func dnsResponse(client net.IP, name, rcode string, size int, ts time.Time) *record.Dns {
+	return &record.Dns{SrcIP: testServer, DstIP: client, Response: true, RCode: rcode, Size: size, Timestamp: ts,
+		Questions: []record.DnsQuestion{{Name: name, Type: "A", Class: "IN"}}}
+}
+
+// analyze 依次分析记录, 返回每条记录产生的告警
+func analyze(a *dnsAnalyzer, records []*record.Dns) [][]*record.Alert {
+	out := make([][]*record.Alert, len(records))
+	for i, r := range records {
+		out[i] = a.Analyze(r)
+	}
+	return out
+}
+
+// alertIndexes 返回产生告警的记录序号
+func alertIndexes(alerts [][]*record.Alert) []int {
+	var idx []int
+	for i, as := range alerts {
+		for range as {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// queries 返回 n 个查询, 前 special 个使用 specialName 与 specialType
+func queries(n, special int, specialName, specialType string) []*record.Dns {
+	var out []*record.Dns
+	for i := 0; i < n; i++ {
+		name, typ := fmt.Sprintf("www%d.example.com", i), "A"
+		if i < special {
+			name, typ = fmt.Sprintf(specialName, i), specialType
+		}
+		out = append(out, dnsQuery(testClient, name, typ, testStart.Add(time.Duration(i)*time.Millisecond)))
+	}
+	return out
+}
+
+func responses(n, large int) []*record.Dns {
+	var out []*record.Dns
+	for i := 0; i < n; i++ {
+		size := 100
+		if i < large {
+			size = 200
+		}
+		out = append(out, dnsResponse(testClient, "www.example.com", "NOERROR", size, testStart.Add(time.Duration(i)*time.Millisecond)))
+	}
+	return out
+}
+
+func TestDNSTunnelIndicators(t *testing.T) {
+	// 区域之下 32 个字符
+	const long = "%02dabcdefghijklmnopqrstuvwxyz1234.example.com"
+	rate := testConfig()
+	rate.Tunnel.Queries = 20
+	both := testConfig()
+	both.Tunnel.Score = 2
+	for _, tt := range []struct {
+		name    string
+		cfg     configs.DNSAnalyzer
+		records []*record.Dns
+		alerts  []int
+		reasons []string
+	}{
+		{"rate below", rate, queries(19, 0, "", ""), nil, nil},
+		{"rate", rate, queries(20, 0, "", ""), []int{19}, []string{"rate"}},
+		// 比例在查询数达到 dnsMinSamples 后才计算
+		{"names below", testConfig(), queries(10, 4, long, "A"), nil, nil},
+		{"names", testConfig(), queries(10, 5, long, "A"), []int{9}, []string{"names"}},
+		{"names few samples", testConfig(), queries(9, 9, long, "A"), nil, nil},
+		{"txt below", testConfig(), queries(10, 4, "t%d.example.com", "TXT"), nil, nil},
+		{"txt", testConfig(), queries(10, 5, "t%d.example.com", "TXT"), []int{9}, []string{"txt"}},
+		{"null", testConfig(), queries(10, 5, "t%d.example.com", "NULL"), []int{9}, []string{"txt"}},
+		{"response size below", testConfig(), responses(10, 4), nil, nil},
+		{"response size", testConfig(), responses(10, 5), []int{9}, []string{"response_size"}},
+		// score 2 时一个指标不够
+		{"score below", both, queries(10, 10, long, "A"), nil, nil},
+		{"score", both, queries(10, 10, long, "TXT"), []int{9}, []string{"names", "txt"}},
+	} {
+		alerts := analyze(newTestAnalyzer(tt.cfg), tt.records)
+		idx := alertIndexes(alerts)
+		if !reflect.DeepEqual(idx, tt.alerts) {
+			t.Errorf("%s: alerts at %v, want %v", tt.name, idx, tt.alerts)
+			continue
+		}
+		if len(idx) == 0 {
+			continue
+		}
+		alert := alerts[idx[0]][0]
+		if alert.Type != AlertDNSTunnel || alert.Zone != "example.com" || !alert.SrcIP.Equal(testClient) ||
+			alert.Score != len(tt.reasons) || !reflect.DeepEqual(alert.Reasons, tt.reasons) {
+			t.Errorf("%s: alert %+v, want reasons %v", tt.name, alert, tt.reasons)
+		}
+	}
+}
+
+func TestDNSTunnelEvidence(t *testing.T) {
+	records := queries(10, 5, "%02dabcdefghijklmnopqrstuvwxyz1234.example.com", "A")
+	alerts := analyze(newTestAnalyzer(testConfig()), records)
+	alert := alerts[9][0]
+	if alert.Evidence["queries"] != 10 || alert.Evidence["suspicious_names"] != 5 || alert.Evidence["txt_queries"] != 0 {
+		t.Errorf("evidence %v", alert.Evidence)
+	}
+	// 最多附带 dnsMaxSamples 个名称
+	if len(alert.Samples) != dnsMaxSamples || alert.Samples[0] != "00abcdefghijklmnopqrstuvwxyz1234.example.com" {
+		t.Errorf("samples %v", alert.Samples)
+	}
+	if !alert.StartTime.Equal(testStart) || !alert.Timestamp.Equal(records[9].Timestamp) {
+		t.Errorf("alert window %v - %v", alert.StartTime, alert.Timestamp)
+	}
+}
+
+func TestDNSSuspicious(t *testing.T) {
+	a := newTestAnalyzer(testConfig())
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"www.example.com", false},
+		{"example.com", false},
+		// 长度不含点, 30 个字符达到 name_length
+		{"aaaaaaaaaa.aaaaaaaaaa.aaaaaaaaaa.example.com", true},
+		{"aaaaaaaaaa.aaaaaaaaaa.aaaaaaaaa.example.com", false},
+		// 熵 4 bit, 短于 dnsEntropyMinLength 时不计算
+		{"abcdefghijklmnop.example.com", true},
+		{"abcdefghijklmno.example.com", false},
+		{"abcdefgh.ijklmnop.example.com", true},
+		{"aaaaaaaaaaaaaaaaaaaa.example.com", false},
+		{"abcdefghijklmnop.example.com.cn", true},
+	} {
+		if got := a.suspicious(tt.name, dnsZoneOf(tt.name)); got != tt.want {
+			t.Errorf("suspicious(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for s, want := range map[string]float64{"": 0, "aaaa": 0, "ab": 1, "abcd": 2, "abcdefghijklmnop": 4} {
+		if got := entropy(s); math.Abs(got-want) > 1e-9 {
+			t.Errorf("entropy(%q) = %v, want %v", s, got, want)
+		}
+	}
+	for name, want := range map[string]string{
+		"a.b.example.com": "example.com", "example.com": "example.com", "localhost": "localhost",
+		"a.example.com.cn": "example.com.cn", "a.example.cn": "example.cn", "a.b.example.co.uk": "example.co.uk",
+	} {
+		if got := dnsZoneOf(name); got != want {
+			t.Errorf("dnsZoneOf(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func nxdomains(zones []string, from time.Time) []*record.Dns {
+	var out []*record.Dns
+	for i, zone := range zones {
+		out = append(out, dnsResponse(testClient, fmt.Sprintf("x%d.%s", i, zone), "NXDOMAIN", 100, from.Add(time.Duration(i)*time.Second)))
+	}
+	return out
+}
+
+func TestDNSDGA(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		zones  []string
+		alerts []int
+	}{
+		{"too few nxdomains", []string{"a.com", "b.com", "c.com", "a.com"}, nil},
+		{"too few zones", []string{"a.com", "b.com", "a.com", "b.com", "a.com", "b.com"}, nil},
+		{"both", []string{"a.com", "b.com", "a.com", "b.com", "c.com"}, []int{4}},
+		{"zones last", []string{"a.com", "a.com", "a.com", "b.com", "b.com", "c.com"}, []int{5}},
+		// 一个窗口内只告警一次
+		{"once", []string{"a.com", "b.com", "c.com", "d.com", "e.com", "f.com", "g.com"}, []int{4}},
+	} {
+		alerts := analyze(newTestAnalyzer(testConfig()), nxdomains(tt.zones, testStart))
+		if idx := alertIndexes(alerts); !reflect.DeepEqual(idx, tt.alerts) {
+			t.Errorf("%s: alerts at %v, want %v", tt.name, idx, tt.alerts)
+			continue
+		}
+		if len(tt.alerts) > 0 {
+			alert := alerts[tt.alerts[0]][0]
+			zones := make(map[string]bool)
+			for _, zone := range tt.zones[:tt.alerts[0]+1] {
+				zones[zone] = true
+			}
+			if alert.Type != AlertDGA || !alert.SrcIP.Equal(testClient) || alert.Evidence["nxdomains"] != tt.alerts[0]+1 || alert.Evidence["zones"] != len(zones) {
+				t.Errorf("%s: alert %+v", tt.name, alert)
+			}
+		}
+	}
+
+	// NOERROR 应答与查询不计入
+	a := newTestAnalyzer(testConfig())
+	for i, zone := range []string{"a.com", "b.com", "c.com", "d.com", "e.com"} {
+		ts := testStart.Add(time.Duration(i) * time.Second)
+		a.Analyze(dnsQuery(testClient, "x."+zone, "A", ts))
+		if alerts := a.Analyze(dnsResponse(testClient, "x."+zone, "NOERROR", 100, ts)); len(alerts) != 0 {
+			t.Fatalf("NOERROR response alerted: %+v", alerts[0])
+		}
+	}
+}
+
+func TestDNSWindow(t *testing.T) {
+	a := newTestAnalyzer(testConfig())
+	zones := []string{"a.com", "b.com", "c.com", "d.com", "e.com", "f.com"}
+	if idx := alertIndexes(analyze(a, nxdomains(zones, testStart))); !reflect.DeepEqual(idx, []int{4}) {
+		t.Fatalf("first window: alerts at %v", idx)
+	}
+	// 新窗口重新计数, 之前的应答不计入
+	next := testStart.Add(time.Minute)
+	if idx := alertIndexes(analyze(a, nxdomains(zones[:4], next))); idx != nil {
+		t.Fatalf("second window: alerts at %v before the threshold", idx)
+	}
+	if c := a.clients[string(testClient.To16())]; c.nxdomains != 4 || len(c.nxZones) != 4 || !c.start.Equal(next) {
+		t.Errorf("second window: %d nxdomains in %d zones from %v", c.nxdomains, len(c.nxZones), c.start)
+	}
+	if alerts := a.Analyze(nxdomains(zones[4:5], next.Add(time.Second*10))[0]); len(alerts) != 1 {
+		t.Errorf("second window: %d alerts, want 1", len(alerts))
+	}
+
+	// 隧道告警同样按区域每个窗口一次
+	cfg := testConfig()
+	cfg.Tunnel.Queries = 3
+	a = newTestAnalyzer(cfg)
+	var records []*record.Dns
+	for i := 0; i < 5; i++ {
+		records = append(records, dnsQuery(testClient, "www.example.com", "A", testStart.Add(time.Duration(i)*time.Second)))
+	}
+	for i := 0; i < 3; i++ {
+		records = append(records, dnsQuery(testClient, "www.example.net", "A", testStart.Add(time.Duration(5+i)*time.Second)))
+	}
+	for i := 0; i < 3; i++ {
+		records = append(records, dnsQuery(testClient, "www.example.com", "A", testStart.Add(time.Minute+time.Duration(i)*time.Second)))
+	}
+	if idx := alertIndexes(analyze(a, records)); !reflect.DeepEqual(idx, []int{2, 7, 10}) {
+		t.Errorf("tunnel alerts at %v, want [2 7 10]", idx)
+	}
+}
+
+func TestDNSSweep(t *testing.T) {
+	a := newTestAnalyzer(testConfig())
+	idle, active, late := net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.4"), net.ParseIP("10.0.0.5")
+	a.Analyze(dnsQuery(idle, "www.example.com", "A", testStart))
+	a.Analyze(dnsQuery(active, "www.example.com", "A", testStart.Add(time.Second*30)))
+	// 距上次清理不足一个窗口, 不清理
+	a.Analyze(dnsQuery(late, "www.example.com", "A", testStart.Add(time.Second*59)))
+	if len(a.clients) != 3 {
+		t.Fatalf("%d clients before the sweep, want 3", len(a.clients))
+	}
+	a.Analyze(dnsQuery(late, "www.example.com", "A", testStart.Add(time.Minute)))
+	if _, ok := a.clients[string(idle.To16())]; ok {
+		t.Error("idle client not removed")
+	}
+	for _, ip := range []net.IP{active, late} {
+		if _, ok := a.clients[string(ip.To16())]; !ok {
+			t.Errorf("client %s removed", ip)
+		}
+	}
+}
+
+func TestDNSLimits(t *testing.T) {
+	a := newTestAnalyzer(testConfig())
+	// 已跟踪 dnsMaxClients 个客户端时不再跟踪新客户端
+	for i := 0; i < dnsMaxClients; i++ {
+		ip := net.IPv4(10, 1, byte(i>>8), byte(i)).To16()
+		a.clients[string(ip)] = &dnsClient{ip: ip, start: testStart, last: testStart}
+	}
+	a.swept = testStart
+	a.Analyze(dnsQuery(testClient, "www.example.com", "A", testStart))
+	if _, ok := a.clients[string(testClient.To16())]; ok || len(a.clients) != dnsMaxClients {
+		t.Errorf("%d clients, new client tracked %v", len(a.clients), ok)
+	}
+
+	// 每个客户端最多跟踪 dnsMaxZones 个区域, 之后的区域不计数
+	cfg := testConfig()
+	cfg.Tunnel.Queries = 2
+	a = newTestAnalyzer(cfg)
+	for i := 0; i < dnsMaxZones; i++ {
+		if alerts := a.Analyze(dnsQuery(testClient, fmt.Sprintf("www.zone%d.com", i), "A", testStart)); len(alerts) != 0 {
+			t.Fatalf("zone %d alerted", i)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if alerts := a.Analyze(dnsQuery(testClient, "www.extra.com", "A", testStart)); len(alerts) != 0 {
+			t.Errorf("untracked zone alerted: %+v", alerts[0])
+		}
+	}
+	if alerts := a.Analyze(dnsQuery(testClient, "www.zone0.com", "A", testStart)); len(alerts) != 1 {
+		t.Errorf("tracked zone: %d alerts, want 1", len(alerts))
+	}
+	c := a.clients[string(testClient.To16())]
+	if len(c.zones) != dnsMaxZones {
+		t.Errorf("%d zones tracked, want %d", len(c.zones), dnsMaxZones)
+	}
+
+	// NXDOMAIN 的区域同样有上限, 计数不受影响
+	for i := 0; i <= dnsMaxZones; i++ {
+		a.Analyze(dnsResponse(testClient, fmt.Sprintf("x.nx%d.com", i), "NXDOMAIN", 100, testStart))
+	}
+	if c.nxdomains != dnsMaxZones+1 || len(c.nxZones) != dnsMaxZones {
+		t.Errorf("%d nxdomains in %d zones", c.nxdomains, len(c.nxZones))
+	}
+}
+
+func TestDNSIgnored(t *testing.T) {
+	cfg := testConfig()
+	cfg.Tunnel.Queries = 1
+	a := newTestAnalyzer(cfg)
+	for _, r := range []record.Protocol{
+		&record.Http{Host: "www.example.com"},
+		&record.Dns{SrcIP: testClient, Timestamp: testStart},
+		dnsQuery(testClient, "", "A", testStart),
+	} {
+		if alerts := a.Analyze(r); len(alerts) != 0 {
+			t.Errorf("%T %+v alerted", r, r)
+		}
+	}
+	if len(a.clients) != 0 {
+		t.Errorf("%d clients tracked", len(a.clients))
+	}
+}
+
+func TestNew(t *testing.T) {
+	cfg := configs.Default()
+	cfg.Analyzers.Enabled = []string{"dns", "dns"}
+	multi, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(multi) != 1 {
+		t.Fatalf("%d analyzers, want 1", len(multi))
+	}
+	if _, ok := multi[0].(*dnsAnalyzer); !ok {
+		t.Fatalf("analyzer %T", multi[0])
+	}
+	// Multi 合并各分析器的告警
+	rate := testConfig()
+	rate.Tunnel.Queries = 1
+	combined := Multi{multi[0], newTestAnalyzer(rate), newTestAnalyzer(rate)}
+	if alerts := combined.Analyze(dnsQuery(testClient, "www.example.com", "A", testStart)); len(alerts) != 2 {
+		t.Errorf("%d alerts from the combined analyzers, want 2", len(alerts))
+	}
+
+	cfg.Analyzers.Enabled = []string{"dns", "missing"}
+	if _, err = New(cfg); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("unknown analyzer: %v", err)
+	}
+	if names := Analyzers(); !reflect.DeepEqual(names, []string{"dns"}) {
+		t.Errorf("registered %v", names)
+	}
+}
@@ -1,5 +0,0 @@
-package analyzer
-
-func run() {
-
-}
@@ -1,10 +1,77 @@
 package database
 
-type User struct {
-	Name string
-	Age  int
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ClickHouse HTTP 接口客户端
+// 通过 8123 端口的 HTTP 接口执行语句, 便于使用兼容实现或 httptest 进行测试
+
+type ClickHouse struct {
+	addr     string
+	database string
+	username string
+	password string
+	client   *http.Client
 }
 
-func init() {
+// NewClickHouse 创建客户端, addr 形如 http://localhost:8123
+func NewClickHouse(addr, database, username, password string, timeout time.Duration) *ClickHouse {
+	return &ClickHouse{
+		addr:     strings.TrimRight(addr, "/"),
+		database: database,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Database 返回库名, 语句中的表名需由调用方加上库名前缀
+func (c *ClickHouse) Database() string {
+	return c.database
+}
+
+// Ping 检查服务是否可用
+func (c *ClickHouse) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.addr+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req)
+}
+
+// Exec 执行语句, body 不为空时作为语句的数据部分 (如 INSERT ... FORMAT JSONEachRow)
+func (c *ClickHouse) Exec(ctx context.Context, query string, body []byte) error {
+	params := url.Values{}
+	params.Set("query", query)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.addr+"/?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return c.do(req)
+}
 
+func (c *ClickHouse) do(req *http.Request) error {
+	if c.username != "" {
+		req.Header.Set("X-ClickHouse-User", c.username)
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("clickhouse: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
 }
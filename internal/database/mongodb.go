@@ -2,30 +2,82 @@ package database
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"github.com/srun-soft/dpi-analysis-toolkit/configs"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
 	"time"
 )
 
-var (
-	MongoDB *mongo.Client
-)
+// MongoConfig MongoDB 连接配置
+type MongoConfig struct {
+	URI            string
+	Username       string
+	Password       string
+	AuthSource     string
+	TLS            bool
+	CAFile         string // TLS 根证书, 为空时使用系统证书
+	ConnectTimeout time.Duration
+	MaxPoolSize    uint64
+}
 
-func init() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// ConnectMongo 连接 MongoDB 并检查连接
+func ConnectMongo(c MongoConfig) (*mongo.Client, error) {
+	if c.ConnectTimeout <= 0 {
+		c.ConnectTimeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.ConnectTimeout)
 	defer cancel()
-	// 设置客户端连接配置 TODO 更换配置地址与端口
-	opts := options.Client().ApplyURI("mongodb://localhost:27017/dpi")
+
+	opts := options.Client().ApplyURI(c.URI).SetConnectTimeout(c.ConnectTimeout)
+	if c.Username != "" {
+		opts.SetAuth(options.Credential{
+			Username:   c.Username,
+			Password:   c.Password,
+			AuthSource: c.AuthSource,
+		})
+	}
+	if c.TLS {
+		tlsConfig, err := newTLSConfig(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if c.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(c.MaxPoolSize)
+	}
 	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
-		configs.Log.Fatal("Failed to Connect MongoDB!", err)
+		return nil, fmt.Errorf("connect MongoDB: %w", err)
 	}
 
 	// check connect
 	if err = client.Ping(ctx, nil); err != nil {
-		configs.Log.Fatal("Failed to check connect MongoDB!", err)
+		_ = client.Disconnect(context.Background())
+		return nil, fmt.Errorf("check connect MongoDB: %w", err)
 	}
 	configs.Log.Info("Connected to MongoDB!")
-	MongoDB = client
+	return client, nil
+}
+
+// newTLSConfig 根据根证书文件创建 TLS 配置
+func newTLSConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	config.RootCAs = pool
+	return config, nil
 }
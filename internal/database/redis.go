@@ -2,27 +2,57 @@ package database
 
 import (
 	"context"
+	"fmt"
 	"github.com/redis/go-redis/v9"
 	"github.com/srun-soft/dpi-analysis-toolkit/configs"
 	"time"
 )
 
-var (
-	Rdb *redis.Client
-)
+// RedisConfig Redis 连接配置
+type RedisConfig struct {
+	Addr        string
+	Username    string
+	Password    string
+	DB          int
+	TLS         bool
+	CAFile      string
+	DialTimeout time.Duration
+	PoolSize    int
+	MaxRetries  int // 命令失败后的重试次数, 0 时不重试
+}
 
-func init() {
-	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+// ConnectRedis 连接 Redis 并检查连接
+func ConnectRedis(c RedisConfig) (*redis.Client, error) {
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = 10 * time.Second
+	}
+	opts := &redis.Options{
+		Addr:        c.Addr,
+		Username:    c.Username,
+		Password:    c.Password,
+		DB:          c.DB,
+		DialTimeout: c.DialTimeout,
+		PoolSize:    c.PoolSize,
+		MaxRetries:  c.MaxRetries,
+	}
+	// go-redis 中 0 表示默认的 3 次, -1 表示不重试
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = -1
+	}
+	if c.TLS {
+		tlsConfig, err := newTLSConfig(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.DialTimeout)
 	defer cancel()
-	rdb := redis.NewClient(&redis.Options{
-		// TODO 具体的redis连接配置
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
+	rdb := redis.NewClient(opts)
 	if err := rdb.Ping(ctx).Err(); err != nil {
-		configs.Log.Fatalln("Failed to connection Redis", err)
+		_ = rdb.Close()
+		return nil, fmt.Errorf("connect Redis: %w", err)
 	}
 	configs.Log.Info("Connected to Redis!")
-	Rdb = rdb
+	return rdb, nil
 }
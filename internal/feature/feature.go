@@ -7,15 +7,19 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 var (
+	mu          sync.RWMutex
 	AppFeatures []App
 	Ac          *ahocorasick.Matcher
 	HostFeature []string
 	HostMap     = make(map[int]string)
 )
 
+var featureRe = regexp.MustCompile(`(\d+) (.+):\[(.+)]`)
+
 type App struct {
 	Id       string
 	Name     string
@@ -31,29 +35,59 @@ type Feature struct {
 	Dict    string `json:"dict" comment:"负载特征"`
 }
 
-// load feature. 加载特征库
-func init() {
-	file, err := os.Open(*configs.FeatureFile)
+// library 一次加载的特征库
+type library struct {
+	apps        []App
+	hostFeature []string
+	hostMap     map[int]string
+}
+
+// Load 加载特征库, 成功后替换当前特征库, 可在运行中调用
+func Load(path string) error {
+	file, err := os.Open(path)
 	if err != nil {
-		configs.Log.Fatal("os open err:", err)
+		return err
 	}
 
 	defer file.Close()
 
+	l := &library{hostMap: make(map[int]string)}
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
 			continue
 		}
-		parseFeature(line)
+		l.parseFeature(line)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	ac := ahocorasick.NewStringMatcher(l.hostFeature)
+
+	mu.Lock()
+	AppFeatures, HostFeature, HostMap, Ac = l.apps, l.hostFeature, l.hostMap, ac
+	mu.Unlock()
+	configs.Log.Infof("Feature library loaded: %d apps, %d host features", len(l.apps), len(l.hostFeature))
+	return nil
+}
+
+// Match 返回域名命中的应用名称, 未加载特征库或未命中时返回空
+func Match(host string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if Ac == nil {
+		return ""
+	}
+	hits := Ac.MatchThreadSafe([]byte(host))
+	if hits == nil {
+		return ""
 	}
-	Ac = ahocorasick.NewStringMatcher(HostFeature)
+	return HostMap[hits[0]]
 }
 
-func parseFeature(line string) {
-	re := regexp.MustCompile(`(\d+) (.+):\[(.+)]`)
-	match := re.FindStringSubmatch(line)
+func (l *library) parseFeature(line string) {
+	match := featureRe.FindStringSubmatch(line)
 	if len(match) == 0 {
 		return
 	}
@@ -78,8 +112,8 @@ func parseFeature(line string) {
 			str[5],
 		}
 		if len(f.Host) > 0 {
-			HostFeature = append(HostFeature, f.Host)
-			HostMap[len(HostFeature)-1] = app.Name
+			l.hostFeature = append(l.hostFeature, f.Host)
+			l.hostMap[len(l.hostFeature)-1] = app.Name
 			// .替换为空再插入
 
 			dot := strings.Count(f.Host, ".")
@@ -89,16 +123,16 @@ func parseFeature(line string) {
 				// 去掉前缀,并且忽略大量相同的二级域名
 				if parts[len(parts)-1] != "qq" && parts[len(parts)-1] != "com" {
 					host = strings.TrimPrefix(f.Host, parts[0]+".")
-					HostFeature = append(HostFeature, host)
-					HostMap[len(HostFeature)-1] = app.Name
+					l.hostFeature = append(l.hostFeature, host)
+					l.hostMap[len(l.hostFeature)-1] = app.Name
 				}
 				// 去掉后缀
 				host = strings.TrimSuffix(f.Host, "."+parts[len(parts)-1])
-				HostFeature = append(HostFeature, host)
-				HostMap[len(HostFeature)-1] = app.Name
+				l.hostFeature = append(l.hostFeature, host)
+				l.hostMap[len(l.hostFeature)-1] = app.Name
 			}
 		}
 		app.Features = append(app.Features, f)
 	}
-	AppFeatures = append(AppFeatures, app)
+	l.apps = append(l.apps, app)
 }
@@ -0,0 +1,53 @@
+package fingerprint
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// JA3
+// 版本,加密套件,扩展,支持的椭圆曲线,点格式 五个字段以逗号分隔, 字段内以 - 分隔的十进制值,
+// 过滤 GREASE; 指纹为该字符串的 MD5
+
+// JA3 返回 JA3 字符串与其 MD5
+func (h *ClientHello) JA3() (string, string) {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(h.Version)))
+	b.WriteByte(',')
+	writeDecimals(&b, h.CipherSuites)
+	b.WriteByte(',')
+	writeDecimals(&b, h.Extensions)
+	b.WriteByte(',')
+	writeDecimals(&b, h.SupportedGroups)
+	b.WriteByte(',')
+	for i, f := range h.ECPointFormats {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(f)))
+	}
+	s := b.String()
+	return s, md5Hex(s)
+}
+
+// writeDecimals 写入以 - 分隔的十进制值, 跳过 GREASE
+func writeDecimals(b *strings.Builder, values []uint16) {
+	first := true
+	for _, v := range values {
+		if IsGREASE(v) {
+			continue
+		}
+		if !first {
+			b.WriteByte('-')
+		}
+		first = false
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
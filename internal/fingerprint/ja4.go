@@ -0,0 +1,129 @@
+package fingerprint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// JA4
+// a_b_c 三段: a 为传输协议、版本、是否有 SNI、加密套件数、扩展数与 ALPN 首尾字符;
+// b 为排序后加密套件的 SHA-256 前 12 位; c 为排序后扩展 (不含 SNI 与 ALPN) 加签名算法的 SHA-256 前 12 位
+
+// JA4 传输协议
+const (
+	TransportTCP  = 't'
+	TransportQUIC = 'q'
+	TransportDTLS = 'd'
+)
+
+// JA4 返回 JA4 指纹, transport 为 TransportTCP 或 TransportQUIC
+func (h *ClientHello) JA4(transport byte) string {
+	ciphers := withoutGREASE(h.CipherSuites)
+	exts := withoutGREASE(h.Extensions)
+
+	sni := 'i'
+	if h.ServerName != "" {
+		sni = 'd'
+	}
+	a := fmt.Sprintf("%c%s%c%02d%02d%s", transport, ja4Version(h.MaxVersion()), sni,
+		min(len(ciphers), 99), min(len(exts), 99), ja4ALPN(h.ALPN))
+
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	b := ja4Hash(hexList(ciphers))
+
+	var c string
+	sorted := make([]uint16, 0, len(exts))
+	for _, e := range exts {
+		if e != extServerName && e != extALPN {
+			sorted = append(sorted, e)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if len(sorted) > 0 {
+		c = hexList(sorted)
+		if sigs := withoutGREASE(h.SignatureAlgorithms); len(sigs) > 0 {
+			c += "_" + hexList(sigs)
+		}
+	}
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	case 0xfeff:
+		return "d1"
+	case 0xfefd:
+		return "d2"
+	case 0xfefc:
+		return "d3"
+	}
+	return "00"
+}
+
+// ja4ALPN 第一个 ALPN 的首尾字符, 不是字母数字时使用其十六进制表示的首尾字符
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	p := alpn[0]
+	first, last := p[0], p[len(p)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte(p))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// ja4Hash SHA-256 前 12 位, 空字符串为 12 个 0
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// hexList 以逗号分隔的 4 位十六进制值
+func hexList(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !IsGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,150 @@
+package fingerprint
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/cryptobyte"
+	"strconv"
+	"strings"
+)
+
+// ServerHello 与证书
+// JA3S 为 版本,加密套件,扩展 的 MD5; JA4S 为 协议版本扩展数ALPN_加密套件_扩展 (按出现顺序) 的 SHA-256 前 12 位.
+// TLS 1.3 的证书在加密后发送, 只有 TLS 1.2 及以下可以取得证书链
+
+// 握手消息类型
+const (
+	HandshakeServerHello = 0x02
+	HandshakeCertificate = 0x0b
+)
+
+// ServerHello 服务端选择的参数
+type ServerHello struct {
+	Version           uint16 // legacy_version
+	SupportedVersion  uint16 // supported_versions 扩展, TLS 1.3 时为 0x0304
+	CipherSuite       uint16
+	Extensions        []uint16
+	ALPN              string
+	HelloRetryRequest bool
+}
+
+// helloRetryRequestRandom RFC 8446 4.1.3 中 HelloRetryRequest 使用的固定 random
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// ParseServerHello 解析完整的 ServerHello 握手消息, data 从握手类型开始
+func ParseServerHello(data []byte) (*ServerHello, error) {
+	s := cryptobyte.String(data)
+	var typ uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&typ) || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, errMalformed
+	}
+	if typ != HandshakeServerHello {
+		return nil, errors.New("not a ServerHello")
+	}
+
+	h := &ServerHello{}
+	var random []byte
+	var sessionID cryptobyte.String
+	var compression uint8
+	if !body.ReadUint16(&h.Version) || !body.ReadBytes(&random, 32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16(&h.CipherSuite) || !body.ReadUint8(&compression) {
+		return nil, errMalformed
+	}
+	h.HelloRetryRequest = string(random) == string(helloRetryRequestRandom)
+	if body.Empty() {
+		return h, nil
+	}
+	var exts cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&exts) {
+		return nil, errMalformed
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var ext cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&ext) {
+			return nil, errMalformed
+		}
+		h.Extensions = append(h.Extensions, typ)
+		switch typ {
+		case extSupportedVersions:
+			if !ext.ReadUint16(&h.SupportedVersion) {
+				return nil, errMalformed
+			}
+		case extALPN:
+			var protos, proto cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&protos) || !protos.ReadUint8LengthPrefixed(&proto) {
+				return nil, errMalformed
+			}
+			h.ALPN = string(proto)
+		}
+	}
+	return h, nil
+}
+
+// NegotiatedVersion 协商的版本
+func (h *ServerHello) NegotiatedVersion() uint16 {
+	if h.SupportedVersion != 0 {
+		return h.SupportedVersion
+	}
+	return h.Version
+}
+
+// JA3S 返回 JA3S 字符串与其 MD5
+func (h *ServerHello) JA3S() (string, string) {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(h.Version)))
+	b.WriteByte(',')
+	b.WriteString(strconv.Itoa(int(h.CipherSuite)))
+	b.WriteByte(',')
+	writeDecimals(&b, h.Extensions)
+	s := b.String()
+	return s, md5Hex(s)
+}
+
+// JA4S 返回 JA4S 指纹, transport 为 TransportTCP 或 TransportQUIC
+func (h *ServerHello) JA4S(transport byte) string {
+	var alpn []string
+	if h.ALPN != "" {
+		alpn = []string{h.ALPN}
+	}
+	a := fmt.Sprintf("%c%s%02d%s", transport, ja4Version(h.NegotiatedVersion()), min(len(h.Extensions), 99), ja4ALPN(alpn))
+	return fmt.Sprintf("%s_%04x_%s", a, h.CipherSuite, ja4Hash(hexList(h.Extensions)))
+}
+
+// CipherSuiteName 加密套件的 IANA 名称, 未知时为十六进制值
+func CipherSuiteName(id uint16) string {
+	return tls.CipherSuiteName(id)
+}
+
+// ParseCertificates 解析 TLS 1.2 及以下的 Certificate 握手消息, 第一个为服务端证书
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	s := cryptobyte.String(data)
+	var typ uint8
+	var body, list cryptobyte.String
+	if !s.ReadUint8(&typ) || !s.ReadUint24LengthPrefixed(&body) || !body.ReadUint24LengthPrefixed(&list) {
+		return nil, errMalformed
+	}
+	if typ != HandshakeCertificate {
+		return nil, errors.New("not a Certificate")
+	}
+	var certs []*x509.Certificate
+	for !list.Empty() {
+		var der cryptobyte.String
+		if !list.ReadUint24LengthPrefixed(&der) {
+			return nil, errMalformed
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return certs, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
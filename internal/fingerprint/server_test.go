@@ -0,0 +1,223 @@
+package fingerprint
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"golang.org/x/crypto/cryptobyte"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testServerHelloMsg 从握手类型开始的 ServerHello 消息, exts 为 nil 时不写扩展
+func testServerHelloMsg(version, cipher uint16, random []byte, exts []testExt) []byte {
+	if random == nil {
+		random = make([]byte, 32)
+	}
+	var b cryptobyte.Builder
+	b.AddUint8(HandshakeServerHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(version)
+		b.AddBytes(random)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(make([]byte, 32)) })
+		b.AddUint16(cipher)
+		b.AddUint8(0)
+		if exts == nil {
+			return
+		}
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, e := range exts {
+				b.AddUint16(e.typ)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(e.data) })
+			}
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func TestServerHelloFingerprints(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		msg     []byte
+		ja3s    string
+		ja3Hash string
+		ja4s    string
+		version uint16
+		alpn    string
+		hrr     bool
+	}{
+		{
+			// JA4 技术文档中的 JA4S 示例
+			name:    "tls 1.3",
+			msg:     testServerHelloMsg(0x0303, 0x1301, nil, []testExt{{extSupportedVersions, []byte{3, 4}}, {0x0033, make([]byte, 36)}}),
+			ja3s:    "771,4865,43-51",
+			ja4s:    "t130200_1301_a56c5b993250",
+			version: 0x0304,
+		},
+		{
+			name: "tls 1.2 alpn",
+			msg: testServerHelloMsg(0x0301, 0x002f, nil, []testExt{{0xff01, []byte{0}}, {extServerName, nil},
+				{extECPointFormats, []byte{1, 0}}, {0x0023, nil}, {0x0005, nil}, alpnExt("h2")}),
+			ja3s:    "769,47,65281-0-11-35-5-16",
+			ja3Hash: "836ce314215654b5b1f85f97c73e506f",
+			ja4s:    "t1006h2_002f_9bd66850b8f2",
+			version: 0x0301,
+			alpn:    "h2",
+		},
+		{
+			name:    "no extensions",
+			msg:     testServerHelloMsg(0x0303, 0xc02f, nil, nil),
+			ja3s:    "771,49199,",
+			ja4s:    "t120000_c02f_000000000000",
+			version: 0x0303,
+		},
+		{
+			name:    "hello retry request",
+			msg:     testServerHelloMsg(0x0303, 0x1302, helloRetryRequestRandom, []testExt{{extSupportedVersions, []byte{3, 4}}, {0x0033, []byte{0, 0x1d}}}),
+			ja3s:    "771,4866,43-51",
+			ja4s:    "t130200_1302_a56c5b993250",
+			version: 0x0304,
+			hrr:     true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseServerHello(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ja3s, hash := h.JA3S()
+			if ja3s != tt.ja3s || hash != md5Hex(ja3s) || tt.ja3Hash != "" && hash != tt.ja3Hash {
+				t.Errorf("JA3S %s %s, want %s %s", ja3s, hash, tt.ja3s, tt.ja3Hash)
+			}
+			if ja4s := h.JA4S(TransportTCP); ja4s != tt.ja4s {
+				t.Errorf("JA4S %s, want %s", ja4s, tt.ja4s)
+			}
+			if q := h.JA4S(TransportQUIC); q[0] != 'q' || q[1:] != tt.ja4s[1:] {
+				t.Errorf("QUIC JA4S %s", q)
+			}
+			if h.NegotiatedVersion() != tt.version || h.ALPN != tt.alpn || h.HelloRetryRequest != tt.hrr {
+				t.Errorf("version %#x alpn %q hrr %v", h.NegotiatedVersion(), h.ALPN, h.HelloRetryRequest)
+			}
+		})
+	}
+}
+
+func TestParseServerHelloMalformed(t *testing.T) {
+	full := testServerHelloMsg(0x0303, 0x1301, nil, []testExt{{extSupportedVersions, []byte{3, 4}}, alpnExt("h2")})
+	// 握手消息的长度前缀使任何截断都不完整
+	for i := 0; i < len(full); i++ {
+		if _, err := ParseServerHello(full[:i]); err == nil {
+			t.Fatalf("truncated to %d of %d bytes: no error", i, len(full))
+		}
+	}
+	for i := range full {
+		data := append([]byte(nil), full...)
+		data[i] ^= 0xff
+		_, _ = ParseServerHello(data)
+	}
+	clientHello := append([]byte(nil), full...)
+	clientHello[0] = HandshakeClientHello
+	for name, data := range map[string][]byte{
+		"not a server hello": clientHello,
+		"short version":      testServerHelloMsg(0x0303, 0x1301, nil, []testExt{{extSupportedVersions, []byte{3}}}),
+		"empty alpn":         testServerHelloMsg(0x0303, 0x1301, nil, []testExt{{extALPN, []byte{0, 0}}}),
+	} {
+		if h, err := ParseServerHello(data); err == nil {
+			t.Errorf("%s: parsed %+v", name, h)
+		}
+	}
+}
+
+// testCert 生成证书, parent 为 nil 时自签名
+func testCert(t *testing.T, name string, notBefore, notAfter time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(notBefore.Unix()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// testCertificateMsg 从握手类型开始的 Certificate 消息
+func testCertificateMsg(ders ...[]byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(HandshakeCertificate)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, der := range ders {
+				b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(der) })
+			}
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func TestParseCertificates(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ca, caKey := testCert(t, "Test CA", now.AddDate(-1, 0, 0), now.AddDate(5, 0, 0), nil, nil)
+	leaf, _ := testCert(t, "example.com", now.AddDate(0, -1, 0), now.AddDate(0, 2, 0), ca, caKey)
+	expired, _ := testCert(t, "expired.example.com", now.AddDate(-2, 0, 0), now.AddDate(-1, 0, 0), ca, caKey)
+	self, _ := testCert(t, "self.example.com", now.AddDate(0, -1, 0), now.AddDate(1, 0, 0), nil, nil)
+
+	for _, chain := range [][]*x509.Certificate{{leaf, ca}, {expired, ca}, {self}} {
+		var ders [][]byte
+		for _, c := range chain {
+			ders = append(ders, c.Raw)
+		}
+		certs, err := ParseCertificates(testCertificateMsg(ders...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != len(chain) {
+			t.Fatalf("got %d certificates, want %d", len(certs), len(chain))
+		}
+		for i, c := range certs {
+			if !c.Equal(chain[i]) {
+				t.Errorf("certificate %d is %s, want %s", i, c.Subject, chain[i].Subject)
+			}
+		}
+	}
+
+	if certs, err := ParseCertificates(testCertificateMsg()); err != nil || len(certs) != 0 {
+		t.Errorf("empty chain: %d certificates, %v", len(certs), err)
+	}
+	// 证书无法解析时返回之前已解析的证书
+	certs, err := ParseCertificates(testCertificateMsg(leaf.Raw, []byte{0x30, 0x03, 0x02, 0x01, 0x01}))
+	if err == nil || len(certs) != 1 || !certs[0].Equal(leaf) {
+		t.Errorf("bad second certificate: %d certificates, %v", len(certs), err)
+	}
+	full := testCertificateMsg(leaf.Raw, ca.Raw)
+	for _, n := range []int{0, 3, 7, 10, len(full) - 1} {
+		if _, err := ParseCertificates(full[:n]); err == nil {
+			t.Errorf("truncated to %d of %d bytes: no error", n, len(full))
+		}
+	}
+	serverHello := append([]byte(nil), full...)
+	serverHello[0] = HandshakeServerHello
+	if _, err := ParseCertificates(serverHello); err == nil {
+		t.Error("not a Certificate: no error")
+	}
+}
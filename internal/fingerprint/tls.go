@@ -0,0 +1,201 @@
+package fingerprint
+
+import (
+	"errors"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// TLS 握手指纹
+// 解析 ClientHello 中与指纹相关的字段, 计算 JA3 与 JA4; TCP 上的 TLS 与 QUIC 共用
+
+// 握手消息类型
+const (
+	HandshakeClientHello = 0x01
+)
+
+// 扩展类型
+const (
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+var errMalformed = errors.New("malformed handshake message")
+
+// ClientHello 按出现顺序保留各列表, GREASE 值在计算指纹时过滤
+type ClientHello struct {
+	Version             uint16   // legacy_version
+	SupportedVersions   []uint16 // supported_versions 扩展
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	ECPointFormats      []uint8
+	SignatureAlgorithms []uint16
+	ALPN                []string
+	ServerName          string
+}
+
+// ParseClientHello 解析完整的 ClientHello 握手消息, data 从握手类型开始
+func ParseClientHello(data []byte) (*ClientHello, error) {
+	s := cryptobyte.String(data)
+	var typ uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&typ) || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, errMalformed
+	}
+	if typ != HandshakeClientHello {
+		return nil, errors.New("not a ClientHello")
+	}
+
+	h := &ClientHello{}
+	var sessionID, ciphers, compression cryptobyte.String
+	if !body.ReadUint16(&h.Version) || !body.Skip(32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return nil, errMalformed
+	}
+	for !ciphers.Empty() {
+		var c uint16
+		if !ciphers.ReadUint16(&c) {
+			return nil, errMalformed
+		}
+		h.CipherSuites = append(h.CipherSuites, c)
+	}
+	if body.Empty() {
+		// 没有扩展的旧版本客户端
+		return h, nil
+	}
+	var exts cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&exts) {
+		return nil, errMalformed
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var ext cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&ext) {
+			return nil, errMalformed
+		}
+		h.Extensions = append(h.Extensions, typ)
+		if !h.parseExtension(typ, ext) {
+			return nil, errMalformed
+		}
+	}
+	return h, nil
+}
+
+func (h *ClientHello) parseExtension(typ uint16, ext cryptobyte.String) bool {
+	switch typ {
+	case extServerName:
+		var names cryptobyte.String
+		if !ext.ReadUint16LengthPrefixed(&names) {
+			return false
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return false
+			}
+			if nameType == 0 && h.ServerName == "" {
+				h.ServerName = string(name)
+			}
+		}
+	case extSupportedGroups:
+		return readUint16List(&ext, &h.SupportedGroups)
+	case extSignatureAlgorithms:
+		return readUint16List(&ext, &h.SignatureAlgorithms)
+	case extECPointFormats:
+		var formats cryptobyte.String
+		if !ext.ReadUint8LengthPrefixed(&formats) {
+			return false
+		}
+		h.ECPointFormats = append(h.ECPointFormats, formats...)
+	case extALPN:
+		var protos cryptobyte.String
+		if !ext.ReadUint16LengthPrefixed(&protos) {
+			return false
+		}
+		for !protos.Empty() {
+			var proto cryptobyte.String
+			if !protos.ReadUint8LengthPrefixed(&proto) {
+				return false
+			}
+			h.ALPN = append(h.ALPN, string(proto))
+		}
+	case extSupportedVersions:
+		var versions cryptobyte.String
+		if !ext.ReadUint8LengthPrefixed(&versions) {
+			return false
+		}
+		for !versions.Empty() {
+			var v uint16
+			if !versions.ReadUint16(&v) {
+				return false
+			}
+			h.SupportedVersions = append(h.SupportedVersions, v)
+		}
+	}
+	return true
+}
+
+// readUint16List 读取 2 字节长度前缀的 uint16 列表
+func readUint16List(s *cryptobyte.String, list *[]uint16) bool {
+	var l cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&l) {
+		return false
+	}
+	for !l.Empty() {
+		var v uint16
+		if !l.ReadUint16(&v) {
+			return false
+		}
+		*list = append(*list, v)
+	}
+	return true
+}
+
+// MaxVersion 协商时可用的最高版本, 优先使用 supported_versions
+func (h *ClientHello) MaxVersion() uint16 {
+	max := uint16(0)
+	for _, v := range h.SupportedVersions {
+		if !IsGREASE(v) && v > max {
+			max = v
+		}
+	}
+	if max == 0 {
+		max = h.Version
+	}
+	return max
+}
+
+// IsGREASE 判断是否为 RFC 8701 保留的 GREASE 值
+func IsGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// VersionName 返回版本名称, 如 TLS 1.3
+func VersionName(v uint16) string {
+	switch v {
+	case 0x0300:
+		return "SSL 3.0"
+	case 0x0301:
+		return "TLS 1.0"
+	case 0x0302:
+		return "TLS 1.1"
+	case 0x0303:
+		return "TLS 1.2"
+	case 0x0304:
+		return "TLS 1.3"
+	case 0xfeff:
+		return "DTLS 1.0"
+	case 0xfefd:
+		return "DTLS 1.2"
+	case 0xfefc:
+		return "DTLS 1.3"
+	}
+	return ""
+}
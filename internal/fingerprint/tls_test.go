@@ -0,0 +1,250 @@
+package fingerprint
+
+import (
+	"golang.org/x/crypto/cryptobyte"
+	"reflect"
+	"testing"
+)
+
+// ClientHello 字节构造
+
+type testExt struct {
+	typ  uint16
+	data []byte
+}
+
+type testHello struct {
+	version uint16
+	ciphers []uint16
+	exts    []testExt // 为 nil 时不写扩展
+}
+
+// bytes 返回从握手类型开始的 ClientHello 消息
+func (h testHello) bytes() []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(HandshakeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(h.version)
+		b.AddBytes(make([]byte, 32)) // random
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(make([]byte, 32)) })
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, c := range h.ciphers {
+				b.AddUint16(c)
+			}
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+		if h.exts == nil {
+			return
+		}
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, e := range h.exts {
+				b.AddUint16(e.typ)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(e.data) })
+			}
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func sniExt(name string) testExt {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(name)) })
+	})
+	return testExt{extServerName, b.BytesOrPanic()}
+}
+
+func alpnExt(protos ...string) testExt {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, p := range protos {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(p)) })
+		}
+	})
+	return testExt{extALPN, b.BytesOrPanic()}
+}
+
+// listExt 2 字节长度前缀的 uint16 列表, 如 supported_groups
+func listExt(typ uint16, values ...uint16) testExt {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, v := range values {
+			b.AddUint16(v)
+		}
+	})
+	return testExt{typ, b.BytesOrPanic()}
+}
+
+func versionsExt(versions ...uint16) testExt {
+	var b cryptobyte.Builder
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, v := range versions {
+			b.AddUint16(v)
+		}
+	})
+	return testExt{extSupportedVersions, b.BytesOrPanic()}
+}
+
+// chromeHello 与 JA4 技术文档示例相同的加密套件、扩展与签名算法, 加入 GREASE 值
+func chromeHello(sni bool) testHello {
+	exts := []testExt{{typ: 0x0a0a}}
+	if sni {
+		exts = append(exts, sniExt("example.com"))
+	}
+	exts = append(exts,
+		testExt{typ: 0x0017},
+		testExt{0xff01, []byte{0}},
+		listExt(extSupportedGroups, 0x1a1a, 0x001d, 0x0017, 0x0018),
+		testExt{extECPointFormats, []byte{1, 0}},
+		testExt{typ: 0x0023},
+	)
+	if sni {
+		exts = append(exts, alpnExt("h2", "http/1.1"))
+	}
+	exts = append(exts,
+		testExt{0x0005, []byte{1, 0, 0, 0, 0}},
+		listExt(extSignatureAlgorithms, 0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601),
+		testExt{typ: 0x0012},
+		testExt{0x0033, []byte{0, 5, 0x1a, 0x1a, 0, 1, 0}},
+		testExt{0x002d, []byte{1, 1}},
+		versionsExt(0x2a2a, 0x0304, 0x0303),
+		testExt{0x001b, []byte{2, 0, 2}},
+		testExt{0x4469, []byte{0, 3, 2, 'h', '2'}},
+		testExt{0x0015, make([]byte, 16)},
+		testExt{0x4a4a, []byte{0}},
+	)
+	return testHello{
+		version: 0x0303,
+		ciphers: []uint16{0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8,
+			0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		exts: exts,
+	}
+}
+
+func TestClientHelloFingerprints(t *testing.T) {
+	chromeJA3 := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	for _, tt := range []struct {
+		name    string
+		hello   testHello
+		ja3     string
+		ja3Hash string
+		ja4     string
+		sni     string
+		alpn    []string
+		version uint16
+	}{
+		{
+			// JA3 README 中的示例
+			name: "ja3 reference",
+			hello: testHello{
+				version: 0x0301,
+				ciphers: []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+				exts: []testExt{sniExt("example.com"), listExt(extSupportedGroups, 23, 24, 25),
+					{extECPointFormats, []byte{1, 0}}},
+			},
+			ja3:     "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0",
+			ja3Hash: "ada70206e40642a3e4461f35503241d5",
+			ja4:     "t10d120300_",
+			sni:     "example.com",
+			version: 0x0301,
+		},
+		{
+			// JA4 技术文档中的示例, GREASE 不计入
+			name:    "grease",
+			hello:   chromeHello(true),
+			ja3:     chromeJA3,
+			ja3Hash: "cd08e31494f9531f560d64c695473da9", // 常见的 Chrome JA3
+			ja4:     "t13d1516h2_8daaf6152771_e5627efa2ab1",
+			sni:     "example.com",
+			alpn:    []string{"h2", "http/1.1"},
+			version: 0x0304,
+		},
+		{
+			// SNI 与 ALPN 本来就不参与 c 段, 只有 a 段变化
+			name:    "no sni or alpn",
+			hello:   chromeHello(false),
+			ja3:     "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,23-65281-10-11-35-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			ja4:     "t13i151400_8daaf6152771_e5627efa2ab1",
+			version: 0x0304,
+		},
+		{
+			name:    "no extensions",
+			hello:   testHello{version: 0x0300, ciphers: []uint16{0x000a, 0x002f}},
+			ja3:     "768,10-47,,,",
+			ja4:     "ts3i020000_",
+			version: 0x0300,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseClientHello(tt.hello.bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ja3, hash := h.JA3()
+			if ja3 != tt.ja3 {
+				t.Errorf("JA3 %s\nwant %s", ja3, tt.ja3)
+			}
+			if hash != md5Hex(ja3) || tt.ja3Hash != "" && hash != tt.ja3Hash {
+				t.Errorf("JA3 hash %s, want %s", hash, tt.ja3Hash)
+			}
+			ja4 := h.JA4(TransportTCP)
+			if len(tt.ja4) == 11 {
+				// 只比较 a 段
+				ja4 = ja4[:11]
+			}
+			if ja4 != tt.ja4 {
+				t.Errorf("JA4 %s, want %s", ja4, tt.ja4)
+			}
+			if q := h.JA4(TransportQUIC); q[0] != 'q' || q[1:] != h.JA4(TransportTCP)[1:] {
+				t.Errorf("QUIC JA4 %s", q)
+			}
+			if h.ServerName != tt.sni || !reflect.DeepEqual(h.ALPN, tt.alpn) || h.MaxVersion() != tt.version {
+				t.Errorf("sni %q alpn %q version %#x", h.ServerName, h.ALPN, h.MaxVersion())
+			}
+		})
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	for alpn, want := range map[string]string{"": "00", "h2": "h2", "http/1.1": "h1", "h3-29": "h9", "\xab": "ab", "\x00x": "08"} {
+		if got := ja4ALPN([]string{alpn}); got != want {
+			t.Errorf("ja4ALPN(%q) = %s, want %s", alpn, got, want)
+		}
+	}
+}
+
+func TestParseClientHelloMalformed(t *testing.T) {
+	full := chromeHello(true).bytes()
+	// 任何截断都返回错误
+	for i := 0; i < len(full); i++ {
+		if _, err := ParseClientHello(full[:i]); err == nil {
+			t.Fatalf("truncated to %d of %d bytes: no error", i, len(full))
+		}
+	}
+	// 改写任意字节不能 panic
+	for i := range full {
+		data := append([]byte(nil), full...)
+		data[i] ^= 0xff
+		_, _ = ParseClientHello(data)
+	}
+
+	serverHello := append([]byte(nil), full...)
+	serverHello[0] = 0x02
+	// 加密套件列表长度在类型、长度、版本、random 与 32 字节 session id 之后
+	oddCiphers := testHello{version: 0x0303, ciphers: []uint16{0x1301}}.bytes()
+	oddCiphers[72] = 3
+	for name, data := range map[string][]byte{
+		"not a client hello": serverHello,
+		"sni overrun":        testHello{version: 0x0303, ciphers: []uint16{0x1301}, exts: []testExt{{extServerName, []byte{0, 9, 0, 0, 5, 'a'}}}}.bytes(),
+		"alpn overrun":       testHello{version: 0x0303, ciphers: []uint16{0x1301}, exts: []testExt{{extALPN, []byte{0, 3, 5, 'h', '2'}}}}.bytes(),
+		"odd groups":         testHello{version: 0x0303, ciphers: []uint16{0x1301}, exts: []testExt{{extSupportedGroups, []byte{0, 3, 0, 0x1d, 0}}}}.bytes(),
+		"odd versions":       testHello{version: 0x0303, ciphers: []uint16{0x1301}, exts: []testExt{{extSupportedVersions, []byte{3, 3, 4, 3}}}}.bytes(),
+		"odd cipher suites":  oddCiphers,
+	} {
+		if h, err := ParseClientHello(data); err == nil {
+			t.Errorf("%s: parsed %+v", name, h)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Prometheus 指标
+// 各模块实现 prometheus.Collector, 在 main 中注册到 Registry, 由 Serve 通过 HTTP /metrics 提供
+
+// Namespace 指标名称前缀
+const Namespace = "dpi"
+
+// Registry 进程内的指标注册表, 默认包含 Go 运行时与进程指标
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Serve 在 addr 上提供 /metrics, ctx 取消时关闭服务
+// 监听失败时立即返回错误, 之后的错误只记录日志
+func Serve(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{
+		ErrorLog: configs.Log,
+	}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: time.Second * 10}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		_ = srv.Shutdown(shutdown)
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			configs.Log.Errorf("Metrics server err:%s", err)
+		}
+	}()
+	configs.Log.Infof("Serving metrics on http://%s/metrics", ln.Addr())
+	return nil
+}
+
+// Desc 创建带前缀的指标描述
+func Desc(subsystem, name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(Namespace, subsystem, name), help, labels, nil)
+}
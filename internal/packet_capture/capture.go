@@ -1,28 +1,27 @@
 package packet_capture
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/examples/util"
-	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/reassembly"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/analyzer"
 	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
-	"log"
-	"net"
-	"os"
-	"os/signal"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/sink"
+	"io"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const closeTimeout = time.Hour * 24 // Closing inactive: TODO: from CLI
+const closeTimeout = time.Hour * 24 // Closing inactive
 const timeout = time.Minute * 5
 
-var COUNT int
-var stats struct {
+type stats struct {
 	ipdefrag            int
 	missedBytes         int
 	pkt                 int
@@ -30,6 +29,8 @@ var stats struct {
 	totalsz             int
 	rejectFsm           int
 	rejectOpt           int
+	rejectChecksum      int // 校验和错误被拒绝的报文
+	badChecksum         int // 校验和错误的报文, 包括未被拒绝的
 	rejectConnFsm       int
 	reassembled         int
 	outOfOrderBytes     int
@@ -38,281 +39,427 @@ var stats struct {
 	biggestChunkPackets int
 	overlapBytes        int
 	overlapPackets      int
+	bufferLimitHits     int // 缓冲页达到上限, 跳过缺失数据的次数
+	evictedConns        int // 连接数达到上限被关闭的连接
+	openConns           int // 当前未完成重组的连接
 }
 
-type Packet interface {
-	run(wg *sync.WaitGroup)
+// merge 累加其他 Worker 的统计
+func (s *stats) merge(o *stats) {
+	s.ipdefrag += o.ipdefrag
+	s.missedBytes += o.missedBytes
+	s.pkt += o.pkt
+	s.sz += o.sz
+	s.totalsz += o.totalsz
+	s.rejectFsm += o.rejectFsm
+	s.rejectOpt += o.rejectOpt
+	s.rejectChecksum += o.rejectChecksum
+	s.badChecksum += o.badChecksum
+	s.rejectConnFsm += o.rejectConnFsm
+	s.reassembled += o.reassembled
+	s.outOfOrderBytes += o.outOfOrderBytes
+	s.outOfOrderPackets += o.outOfOrderPackets
+	if o.biggestChunkBytes > s.biggestChunkBytes {
+		s.biggestChunkBytes = o.biggestChunkBytes
+	}
+	if o.biggestChunkPackets > s.biggestChunkPackets {
+		s.biggestChunkPackets = o.biggestChunkPackets
+	}
+	s.overlapBytes += o.overlapBytes
+	s.overlapPackets += o.overlapPackets
+	s.bufferLimitHits += o.bufferLimitHits
+	s.evictedConns += o.evictedConns
+	s.openConns += o.openConns
 }
 
-func init() {
-	defer util.Run()
-	var handle *pcap.Handle
-	var err error
-	offline := false
+// Config 抓包引擎配置
+type Config struct {
+	Source string // 抓包后端, 默认为 pcap, 见 Sources
+	Device string // 网卡名称
+	// OfflineFiles 离线 pcap/pcapng 文件或目录, 可为 gzip/zstd 压缩; 不为空时忽略 Device 与 Source
+	OfflineFiles []string
+	BPF          string // Berkeley Packet Filter
+	SnapLen      int
+	Promisc      bool
+	AFPacket     AFPacketConfig
 
-	// 根据 OfflineFile 决定读取离线包还是网卡流量
-	if *configs.OfflineFile != "" {
-		if handle, err = pcap.OpenOffline(*configs.OfflineFile); err != nil {
-			configs.Log.Fatal("PCAP OpenOffline error:", err)
-		}
-		offline = true
-	} else {
-		inactive, err := pcap.NewInactiveHandle(*configs.NIC)
-		if err != nil {
-			configs.Log.Fatalf("could not create: %v", err)
-		}
-		defer inactive.CleanUp()
-		if err = inactive.SetSnapLen(65536); err != nil {
-			configs.Log.Fatalf("could not set snap length: %v", err)
-		} else if err = inactive.SetPromisc(true); err != nil {
-			configs.Log.Fatalf("could not set promisc mode: %v", err)
-		} else if err = inactive.SetTimeout(time.Second); err != nil {
-			configs.Log.Fatalf("could not set timeout: %v", err)
-		}
-		if handle, err = inactive.Activate(); err != nil {
-			configs.Log.Fatal("PCAP Activate error:", err)
-		}
-	}
-	defer handle.Close()
-	// Berkeley Packet Filter 流量条件过滤
-	if *configs.BPF != "" {
-		configs.Log.Infof("Berkeley Packet Filter:%s", *configs.BPF)
-		if err = handle.SetBPFFilter(*configs.BPF); err != nil {
-			log.Fatal("BPF filter error:", err)
-		}
-	}
+	// Dissectors 启用的协议解析器名称, 执行顺序由注册时的 order 决定
+	Dissectors []string
+	// HTTP 是否在 TCP 流重组后解析 HTTP
+	HTTP bool
+	// FlushTimeout 超过该时间未收到数据的 TCP 连接刷新缓冲, 默认 5 分钟
+	FlushTimeout time.Duration
+	// CloseTimeout 超过该时间未收到数据的 TCP 连接关闭, 默认 24 小时
+	CloseTimeout time.Duration
+	// FlowIdleTimeout 超过该时间未收到数据包的流结束并输出, 默认 2 分钟
+	FlowIdleTimeout time.Duration
+	// FlowActiveTimeout 持续时间超过该值的流周期性输出, 默认 30 分钟
+	FlowActiveTimeout time.Duration
+	// MaxBufferedPages 所有 Worker 乱序缓冲的总页数上限 (每页约 1.9KB), 0 为不限制
+	MaxBufferedPages int
+	// MaxBufferedPagesPerConn 单个连接乱序缓冲的页数上限, 0 为不限制
+	MaxBufferedPagesPerConn int
+	// MaxConnections 所有 Worker 跟踪的 TCP 连接数上限, 超过时关闭最久未活动的连接, 0 为不限制
+	MaxConnections int
+	// Checksum TCP 校验和处理模式: auto (默认), verify, count, skip
+	Checksum string
+	// Workers 并行处理的 Worker 数量, 默认为 CPU 核数
+	Workers int
+	// DNSCacheSize 启用 dns 解析器时缓存的客户端地址-域名数量, 用于补充没有 SNI 的记录, 0 为不缓存
+	DNSCacheSize int
+	// DNSCacheMinTTL 缓存记录的最短保留时间, 小于该值的 TTL 按该值计算, 默认 5 分钟
+	DNSCacheMinTTL time.Duration
+	// DNSResolvers 公共 DoH/DoT 解析器的域名、地址或网段, TLS 连接的 SNI 或服务端地址匹配时标记为加密 DNS
+	DNSResolvers []string
+	// LocalResolvers 本单位的解析器, 不标记为加密 DNS
+	LocalResolvers []string
+	// DoHShape 按 h2 连接的应用数据记录形态识别 DoH, 默认关闭; API 与 gRPC 连接的记录形态相近, 容易误判
+	DoHShape bool
+	// RadiusSessionTimeout 启用 radius 解析器时, 超过该时间没有计费报文的会话删除, 默认 2 小时
+	RadiusSessionTimeout time.Duration
+	// Sink 记录输出, 为空时丢弃记录; 由调用方负责关闭
+	Sink sink.Sink
+	// Analyzer 分析输出的记录, 产生的告警同样写入 Sink; 为空时不分析
+	Analyzer analyzer.Analyzer
+}
 
-	var dec gopacket.Decoder
-	var ok bool
-	decoderName := fmt.Sprintf("%s", handle.LinkType())
-	if dec, ok = gopacket.DecodersByLayerName[decoderName]; !ok {
-		configs.Log.Fatalln("No decoder named", decoderName)
-	}
-	source := gopacket.NewPacketSource(handle, dec)
-	source.NoCopy = true
-	configs.Log.Info("Starting to read packets\n")
-	COUNT = 0
-	defragger := ip4defrag.NewIPv4Defragmenter()
+// AFPacketConfig AF_PACKET 后端配置
+type AFPacketConfig struct {
+	BlockSize   int    // 环形缓冲区块大小, 需为页大小的整数倍
+	NumBlocks   int    // 环形缓冲区块数量
+	FanoutGroup uint16 // fanout 组 ID, 0 表示不加入
+	FanoutType  string // hash (默认), lb, cpu, rollover, random, qm
+}
 
-	// 创建流重组连接池
-	streamFactory := &tcpStreamFactory{doHTTP: configs.HTTP}
-	streamPool := reassembly.NewStreamPool(streamFactory)
-	assembler := reassembly.NewAssembler(streamPool)
+// Engine 抓包分析引擎
+// 负责打开数据源、将数据包分发到 Worker 并在结束时刷新各 Worker 的解析器
+type Engine struct {
+	config  Config
+	source  Source
+	offline bool
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+	sourceMu     sync.Mutex // 保护关闭数据源与读取数据源计数
+	sourceClosed bool
 
-	for packet := range source.Packets() {
-		COUNT++
-		if COUNT == 300 {
-			configs.Log.Info(COUNT)
-		}
-		configs.Log.Infof("Packet Count:%d", COUNT)
-		// network layer
-		var srcIP, dstIP net.IP
-		var ttl uint8
-		if packet.NetworkLayer() == nil {
-			continue
-		}
-		if packet.NetworkLayer().LayerType() == layers.LayerTypeIPv4 {
-			networkLayer := packet.NetworkLayer().(*layers.IPv4)
-			srcIP, dstIP, ttl = networkLayer.SrcIP, networkLayer.DstIP, networkLayer.TTL
-			ttl = networkLayer.TTL
-		} else if packet.NetworkLayer().LayerType() == layers.LayerTypeIPv6 {
-			networkLayer := packet.NetworkLayer().(*layers.IPv6)
-			srcIP, dstIP, ttl = networkLayer.SrcIP, networkLayer.DstIP, networkLayer.HopLimit
+	// 按链路层类型缓存, 只在抓包 goroutine 中访问
+	decoders map[layers.LinkType]gopacket.Decoder // 不支持的链路层类型为 nil
+	shards   map[layers.LinkType]*shardParser
+
+	capture *Worker      // 分片前解析器, 在抓包 goroutine 中执行
+	workers []*Worker    // 按流哈希分发
+	domains *domainCache // DNS 地址-域名缓存, 未启用时为 nil
+
+	resolvers      *resolverList // 公共 DoH/DoT 解析器
+	localResolvers *resolverList // 本单位的解析器
+
+	sessions *radiusSessions // RADIUS 会话表, 未启用时为 nil
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	packets uint64 // 读取的数据包数量, 原子访问
+	records *prometheus.CounterVec
+	errors  *prometheus.CounterVec
+}
+
+// New 根据配置打开网卡或离线文件, 创建引擎
+func New(config Config) (*Engine, error) {
+	if config.SnapLen <= 0 {
+		config.SnapLen = 65536
+	}
+	if config.FlushTimeout <= 0 {
+		config.FlushTimeout = timeout
+	}
+	if config.CloseTimeout <= 0 {
+		config.CloseTimeout = closeTimeout
+	}
+	if config.FlowIdleTimeout <= 0 {
+		config.FlowIdleTimeout = flowIdleTimeout
+	}
+	if config.FlowActiveTimeout <= 0 {
+		config.FlowActiveTimeout = flowActiveTimeout
+	}
+	if config.Workers <= 0 {
+		config.Workers = runtime.NumCPU()
+	}
+	if config.DNSCacheMinTTL <= 0 {
+		config.DNSCacheMinTTL = dnsCacheMinTTL
+	}
+	if config.RadiusSessionTimeout <= 0 {
+		config.RadiusSessionTimeout = radiusSessionTimeout
+	}
+	e := &Engine{
+		config:   config,
+		stop:     make(chan struct{}),
+		decoders: make(map[layers.LinkType]gopacket.Decoder),
+		shards:   make(map[layers.LinkType]*shardParser),
+		records:  newRecordCounter("records_total", "Records emitted by dissectors."),
+		errors:   newRecordCounter("record_errors_total", "Records the sink failed to accept."),
+	}
+	regs, err := lookupDissectors(config.Dissectors)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkChecksumMode(config.Checksum); err != nil {
+		return nil, err
+	}
+	if e.resolvers, err = newResolverList(config.DNSResolvers); err != nil {
+		return nil, err
+	}
+	if e.localResolvers, err = newResolverList(config.LocalResolvers); err != nil {
+		return nil, err
+	}
+	if e.source, err = openSource(config); err != nil {
+		return nil, err
+	}
+	e.offline = len(config.OfflineFiles) > 0
+	if hasDissector(config.Dissectors, "dns") {
+		e.domains = newDomainCache(config.DNSCacheSize, config.DNSCacheMinTTL)
+	}
+	if hasDissector(config.Dissectors, "radius") {
+		e.sessions = newRadiusSessions(config.RadiusSessionTimeout)
+	}
+	var pre, sharded []registration
+	for _, r := range regs {
+		if r.preShard {
+			pre = append(pre, r)
 		} else {
-			continue
+			sharded = append(sharded, r)
 		}
-		// defrag IPv4 packet IP碎片整理
-		// ----------------------------
-		if configs.Defrag {
-			ipv4Layer := packet.Layer(layers.LayerTypeIPv4)
-			if ipv4Layer == nil {
-				continue
-			}
-			ip4 := ipv4Layer.(*layers.IPv4)
-			l := ip4.Length
-			var newip4 *layers.IPv4
-			if offline {
-				// 离线包使用数据包中的时间戳
-				newip4, err = defragger.DefragIPv4WithTimestamp(ip4, packet.Metadata().CaptureInfo.Timestamp)
-			} else {
-				// 在线分析使用当前时间
-				newip4, err = defragger.DefragIPv4(ip4)
-			}
+	}
+	e.capture = newWorker(e, -1, pre)
+	for i := 0; i < config.Workers; i++ {
+		e.workers = append(e.workers, newWorker(e, i, sharded))
+	}
+	return e, nil
+}
 
-			if err != nil {
-				configs.Log.Fatalln("Error while de-fragmenting", err)
-			} else if newip4 == nil {
-				configs.Log.Debug("Fragment...\n")
-				continue // packet fragment, we don't have whole packet yet.
-			}
-			if newip4.Length != l {
-				stats.ipdefrag++
-				configs.Log.Debugf("Decoding re-assembled packet: %s\n", newip4.NextLayerType())
-				pb, ok := packet.(gopacket.PacketBuilder)
-				if !ok {
-					panic("Not a PacketBuilder")
-				}
-				nextDecoder := newip4.NextLayerType()
-				_ = nextDecoder.Decode(newip4.Payload, pb)
-			}
-		}
-		// ----------------------------
-		// TCP 流重组
-		// ----------------------------
-		if configs.TCP {
-			tcpLayer := packet.Layer(layers.LayerTypeTCP)
-			if tcpLayer == nil {
-				continue
-			}
-			tcp := tcpLayer.(*layers.TCP)
-			err = tcp.SetNetworkLayerForChecksum(packet.NetworkLayer())
-			if err != nil {
-				configs.Log.Fatalf("Failed to set network layer for checksum: %s\n", err)
-			}
-			c := Context{
-				CaptureInfo: packet.Metadata().CaptureInfo,
+// SetBPFFilter 替换数据源的 Berkeley Packet Filter, 可在运行中调用
+func (e *Engine) SetBPFFilter(expr string) error {
+	if err := e.source.SetBPFFilter(expr); err != nil {
+		return err
+	}
+	configs.Log.Infof("Berkeley Packet Filter:%s", expr)
+	return nil
+}
+
+// Emit 补全记录字段与用户名并写入输出, 再交给分析器; 供解析器在任意 goroutine 中调用
+func (e *Engine) Emit(r record.Protocol) {
+	e.attribute(r)
+	r.Parse()
+	e.records.WithLabelValues(r.Kind()).Inc()
+	if e.config.Sink != nil {
+		if err := e.config.Sink.Write(r); err != nil {
+			e.errors.WithLabelValues(r.Kind()).Inc()
+			// 丢弃由写入队列限频打印
+			if !errors.Is(err, sink.ErrDropped) {
+				configs.Log.Errorf("Emit %s record err:%s", r.Kind(), err)
 			}
-			stats.totalsz += len(tcp.Payload)
-			assembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, &c)
 		}
-		// ----------------------------
-		// DNS 分析
-		// ----------------------------
-		if configs.DNS {
-			ipv4Layer := packet.Layer(layers.LayerTypeIPv4)
-			if ipv4Layer == nil {
-				continue
-			}
-			ip4 := ipv4Layer.(*layers.IPv4)
-			dnsLayer := packet.Layer(layers.LayerTypeDNS)
-			if dnsLayer != nil {
-				dns := dnsLayer.(*layers.DNS)
-				dnsBson := &record.Dns{
-					SrcIP:    ip4.SrcIP,
-					DstIP:    ip4.DstIP,
-					SrcIPStr: ip4.SrcIP.String(),
-					DstIPStr: ip4.DstIP.String(),
-					Host:     string(dns.Questions[0].Name),
-					Type:     dns.Questions[0].Type.String(),
-					Class:    dns.Questions[0].Class.String(),
-				}
-				dnsBson.Save2Mongo()
-			}
+	}
+	if e.config.Analyzer != nil {
+		for _, alert := range e.config.Analyzer.Analyze(r) {
+			e.Emit(alert)
 		}
-		// ----------------------------
-		// Radius 协议
-		// ----------------------------
-		if configs.Radius {
-			r := &layers.RADIUS{}
-			radiusLayer := packet.Layer(layers.LayerTypeRADIUS)
-			if radiusLayer != nil {
-				r = radiusLayer.(*layers.RADIUS)
-				radiusPacket := &radiusReader{
-					r,
-				}
-				radiusPacket.run()
-				continue
-			}
-			transport := packet.TransportLayer()
-			if transport == nil {
-				continue
-			}
-			if transport != nil && transport.TransportFlow().Dst().String() == "1813" && transport.TransportFlow().Src().String() == "1813" {
-				configs.Log.Info(packet.ApplicationLayer())
-				err = r.DecodeFromBytes(packet.ApplicationLayer().Payload(), gopacket.NilDecodeFeedback)
-				if err != nil {
-					configs.Log.Error("Error decoding Radius packet:", err)
+	}
+}
+
+// readPackets 在独立 goroutine 中读取数据源, done 关闭或数据源结束时退出
+// 退出时向返回的 channel 发送读取错误, 正常结束时为 nil
+func (e *Engine) readPackets(done <-chan struct{}) (<-chan workItem, <-chan error) {
+	out := make(chan workItem, workerQueueSize)
+	exited := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { exited <- err }()
+		defer close(out)
+		for {
+			var data []byte
+			var ci gopacket.CaptureInfo
+			data, ci, err = e.source.ReadPacketData()
+			if err == ErrTimeout {
+				err = nil
+				select {
+				case <-done:
+					return
+				default:
 					continue
 				}
-				radiusPacket := &radiusReader{
-					r,
-				}
-				radiusPacket.run()
-				continue
-			}
-		}
-		// ----------------------------
-		// ICMP 协议
-		if configs.ICMP {
-			icmpLayer := packet.Layer(layers.LayerTypeICMPv4)
-			if icmpLayer == nil {
-				continue
+			} else if err == io.EOF {
+				err = nil
+				return
+			} else if err != nil {
+				err = fmt.Errorf("read packet: %w", err)
+				return
 			}
-			icmp := &IcmpReader{
-				srcIP:  srcIP,
-				dstIP:  dstIP,
-				ttl:    ttl,
-				time:   packet.Metadata().Timestamp,
-				layers: icmpLayer.(*layers.ICMPv4),
+			select {
+			case out <- workItem{data: data, ci: ci}:
+			case <-done:
+				return
 			}
-			configs.Log.Debugf(icmp.description)
-			//icmp.run()
 		}
-		// ----------------------------
+	}()
+	return out, exited
+}
 
-		if COUNT%1000 == 0 {
-			ref := packet.Metadata().CaptureInfo.Timestamp
-			flushed, closed := assembler.FlushWithOptions(reassembly.FlushOptions{
-				T:  ref.Add(-timeout),
-				TC: ref.Add(-closeTimeout),
-			})
-			configs.Log.Debugf("Forced flush: %d flushed, %d closed (%s)", flushed, closed, ref)
+// decoder 返回链路层类型对应的解码器, 不支持时返回 nil
+func (e *Engine) decoder(linkType layers.LinkType) gopacket.Decoder {
+	d, ok := e.decoders[linkType]
+	if !ok {
+		name := fmt.Sprintf("%s", linkType)
+		d, ok = gopacket.DecodersByLayerName[name]
+		if !ok && layers.LinkTypeMetadata[linkType].Name != "UnknownLinkType" {
+			// 链路层名称与层名称不一致 (如 Raw) 时按链路层类型解码
+			d, ok = linkType, true
 		}
-		done := false
-		select {
-		case <-signalChan:
-			configs.Log.Println(os.Stderr, "\nCaught SIGINT: aborting\n")
-			done = true
-		default:
-			// NOP: continue
+		if !ok {
+			configs.Log.Warnf("No decoder named %s, dropping its packets", name)
 		}
-		if done {
-			break
+		e.decoders[linkType] = d
+		e.shards[linkType] = newShardParser(linkType)
+	}
+	return d
+}
+
+// dispatch 计算流哈希并交给对应的 Worker
+// IPv4 分片先交给分片前解析器, 重组完成后按完整数据包分发; 无法快速解析的数据包在此完整解码
+func (e *Engine) dispatch(item workItem) {
+	linkType, ok := packetLinkType(item.ci)
+	if !ok {
+		linkType = e.source.LinkType()
+	}
+	if item.decoder = e.decoder(linkType); item.decoder == nil {
+		return
+	}
+	hash, fragment, ok := e.shards[linkType].hash(item.data)
+	if !ok || (fragment && len(e.capture.dissectors) > 0) {
+		p := e.capture.decode(item)
+		if p == nil {
+			return
+		}
+		if fragment && !e.capture.dissect(p) {
+			return
 		}
+		hash, item.packet = packetHash(p), p
+	}
+	w := e.workers[hash%uint32(len(e.workers))]
+	w.queue <- item
+}
+
+// stats 汇总所有 Worker 最近发布的统计
+func (e *Engine) stats() stats {
+	s := e.capture.snapshot()
+	for _, w := range e.workers {
+		ws := w.snapshot()
+		s.merge(&ws)
 	}
+	return s
+}
 
-	closed := assembler.FlushAll()
-	configs.Log.Debugf("Final flush: %d closed", closed)
-	if configs.Debug {
-		streamPool.Dump()
+// closeSource 关闭数据源, 之后不再读取数据源计数
+func (e *Engine) closeSource() {
+	e.sourceMu.Lock()
+	defer e.sourceMu.Unlock()
+	if !e.sourceClosed {
+		e.sourceClosed = true
+		e.source.Close()
+	}
+}
+
+// sourceStats 返回数据源计数, 数据源不支持或已关闭时 ok 为 false
+func (e *Engine) sourceStats() (s SourceStats, ok bool) {
+	e.sourceMu.Lock()
+	defer e.sourceMu.Unlock()
+	ss, supported := e.source.(StatsSource)
+	if !supported || e.sourceClosed {
+		return s, false
+	}
+	s, err := ss.Stats()
+	if err != nil {
+		configs.Log.Debugf("Source stats err:%s", err)
+		return s, false
 	}
+	return s, true
+}
 
-	streamFactory.WaitGoRoutines()
-	configs.Log.Debugf("%s\n", assembler.Dump())
-	configs.Log.Printf("IPdefrag:\t\t%d\n", stats.ipdefrag)
+// Stop 停止正在运行的引擎, 可重复调用
+func (e *Engine) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stop)
+	})
+}
 
-	//table := tablewriter.NewWriter(os.Stdout)
-	//table.SetHeader([]string{
-	//	"field",
-	//	"remark",
-	//	"value",
-	//})
-	//data := [][]string{
-	//	{"missed bytes", "丢失字节", strconv.Itoa(stats.missedBytes)},
-	//	{"total packets", "总包数", strconv.Itoa(stats.pkt)},
-	//	{"rejected FSM", "无法重组", strconv.Itoa(stats.rejectFsm)},
-	//	{"rejected Options", "不支持的选项", strconv.Itoa(stats.rejectOpt)},
-	//	{"reassembled bytes", "重组字节数", strconv.Itoa(stats.sz)},
-	//	{"total TCP bytes", "tcp连接字节数", strconv.Itoa(stats.totalsz)},
-	//	{"conn rejected FSM", "连接被拒", strconv.Itoa(stats.rejectConnFsm)},
-	//	{"reassembled chunks", "重组块大小", strconv.Itoa(stats.reassembled)},
-	//	{"out-of-order packets", "乱序数据包", strconv.Itoa(stats.outOfOrderPackets)},
-	//	{"out-of-order bytes", "乱序字节", strconv.Itoa(stats.outOfOrderBytes)},
-	//	{"biggest-chunk packets", "最大块数据包", strconv.Itoa(stats.biggestChunkPackets)},
-	//	{"biggest-chunk bytes", "最大字节数", strconv.Itoa(stats.biggestChunkBytes)},
-	//	{"overlap packets", "重叠数据包", strconv.Itoa(stats.overlapPackets)},
-	//	{"overlap bytes", "重叠字节", strconv.Itoa(stats.overlapBytes)},
-	//}
-	//table.AppendBulk(data)
-	//table.Render()
+// Run 读取数据包直到数据源结束、ctx 取消或调用 Stop
+// 返回前会刷新所有 Worker 的 TCP 流并关闭数据源; 读取数据源或刷新输出失败时返回错误
+func (e *Engine) Run(ctx context.Context) error {
+	defer e.closeSource()
 
-	//tlsTable := tablewriter.NewWriter(os.Stdout)
-	//tlsTable.SetHeader([]string{"ident", "host", "up(bytes)", "down(bytes)", "startTime", "endTime", "startPID", "endPID", "totalPacket"})
-	//for _, v := range tls {
-	//	tlsTable.Append(v)
-	//}
-	//tlsTable.Render()
+	if e.decoder(e.source.LinkType()) == nil {
+		return fmt.Errorf("no decoder named %s", e.source.LinkType())
+	}
+	var wg sync.WaitGroup
+	for _, w := range e.workers {
+		wg.Add(1)
+		go w.run(&wg)
+	}
+	configs.Log.Infof("Starting to read packets with %d workers", len(e.workers))
+
+	done := make(chan struct{})
+	packets, readerDone := e.readPackets(done)
+	var count int
+	var lastFlush time.Time
+	for finished := false; !finished; {
+		var item workItem
+		var ok bool
+		select {
+		case <-ctx.Done():
+			configs.Log.Info("Context canceled: aborting")
+			finished = true
+			continue
+		case <-e.stop:
+			configs.Log.Info("Engine stopped: aborting")
+			finished = true
+			continue
+		case item, ok = <-packets:
+			if !ok {
+				finished = true
+				continue
+			}
+		}
+		count++
+		atomic.AddUint64(&e.packets, 1)
+		item.index = count
+		configs.Log.Debugf("Packet Count:%d", count)
+		e.dispatch(item)
+
+		if ts := item.ci.Timestamp; ts.Sub(lastFlush) >= workerFlushInterval {
+			if !lastFlush.IsZero() {
+				for _, w := range e.workers {
+					w.queue <- workItem{flush: ts}
+				}
+				e.capture.publish()
+			}
+			lastFlush = ts
+		}
+	}
+	close(done)
+	err := <-readerDone
+	e.capture.publish()
+
+	for _, w := range e.workers {
+		close(w.queue)
+	}
+	wg.Wait()
+	if e.config.Sink != nil {
+		if ferr := e.config.Sink.Flush(); ferr != nil && err == nil {
+			err = fmt.Errorf("flush sink: %w", ferr)
+		} else if ferr != nil {
+			// 保留读取错误, 刷新错误附加在消息中
+			err = fmt.Errorf("%w; flush sink: %v", err, ferr)
+		}
+	}
+	s := e.stats()
+	configs.Log.Printf("Packets:%d IPdefrag:%d Reassembled:%d MissedBytes:%d BufferLimitHits:%d EvictedConns:%d BadChecksum:%d RejectedChecksum:%d",
+		count, s.ipdefrag, s.reassembled, s.missedBytes, s.bufferLimitHits, s.evictedConns, s.badChecksum, s.rejectChecksum)
+	return err
 }
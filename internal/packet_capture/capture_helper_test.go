@@ -0,0 +1,221 @@
+package packet_capture
+
+import (
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的抓包构造与记录收集
+
+var testStart = time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+type testPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// testCapture 按顺序构造以太网数据包, 每个数据包的时间递增 10ms
+type testCapture struct {
+	t       *testing.T
+	ts      time.Time
+	packets []testPacket
+}
+
+func newTestCapture(t *testing.T) *testCapture {
+	return &testCapture{t: t, ts: testStart}
+}
+
+// ip 按地址族返回网络层, 传输层校验和据此计算
+func (c *testCapture) ip(src, dst string, proto layers.IPProtocol) (gopacket.SerializableLayer, gopacket.NetworkLayer, layers.EthernetType) {
+	s, d := net.ParseIP(src), net.ParseIP(dst)
+	if s.To4() != nil {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: s.To4(), DstIP: d.To4()}
+		return ip, ip, layers.EthernetTypeIPv4
+	}
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: s, DstIP: d}
+	return ip, ip, layers.EthernetTypeIPv6
+}
+
+func (c *testCapture) add(ethType layers.EthernetType, ls ...gopacket.SerializableLayer) {
+	c.t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: ethType,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{eth}, ls...)...); err != nil {
+		c.t.Fatalf("serialize packet: %v", err)
+	}
+	c.ts = c.ts.Add(time.Millisecond * 10)
+	data := append([]byte(nil), buf.Bytes()...)
+	c.packets = append(c.packets, testPacket{
+		ci:   gopacket.CaptureInfo{Timestamp: c.ts, CaptureLength: len(data), Length: len(data)},
+		data: data,
+	})
+}
+
+func (c *testCapture) udp(src, dst string, sport, dport uint16, payload []byte) {
+	ip, nl, ethType := c.ip(src, dst, layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+	_ = udp.SetNetworkLayerForChecksum(nl)
+	c.add(ethType, ip, udp, gopacket.Payload(payload))
+}
+
+// testConn 一个 TCP 连接, 自动维护两个方向的序号
+type testConn struct {
+	c                 *testCapture
+	client, server    string
+	cport, sport      uint16
+	clientSeq, srvSeq uint32
+}
+
+func (c *testCapture) tcp(client, server string, cport, sport uint16) *testConn {
+	return &testConn{c: c, client: client, server: server, cport: cport, sport: sport, clientSeq: 1000, srvSeq: 5000}
+}
+
+func (tc *testConn) segment(fromClient bool, tcp *layers.TCP, payload []byte) {
+	src, dst := tc.client, tc.server
+	tcp.SrcPort, tcp.DstPort = layers.TCPPort(tc.cport), layers.TCPPort(tc.sport)
+	tcp.Seq, tcp.Ack = tc.clientSeq, tc.srvSeq
+	if !fromClient {
+		src, dst = dst, src
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+		tcp.Seq, tcp.Ack = tc.srvSeq, tc.clientSeq
+	}
+	tcp.Window = 65535
+	ip, nl, ethType := tc.c.ip(src, dst, layers.IPProtocolTCP)
+	_ = tcp.SetNetworkLayerForChecksum(nl)
+	tc.c.add(ethType, ip, tcp, gopacket.Payload(payload))
+	n := uint32(len(payload))
+	if tcp.SYN || tcp.FIN {
+		n++
+	}
+	if fromClient {
+		tc.clientSeq += n
+	} else {
+		tc.srvSeq += n
+	}
+}
+
+func (tc *testConn) handshake() *testConn {
+	tc.segment(true, &layers.TCP{SYN: true}, nil)
+	tc.segment(false, &layers.TCP{SYN: true, ACK: true}, nil)
+	tc.segment(true, &layers.TCP{ACK: true}, nil)
+	return tc
+}
+
+// send 发送一个数据段
+func (tc *testConn) send(fromClient bool, payload []byte) *testConn {
+	tc.segment(fromClient, &layers.TCP{ACK: true, PSH: true}, payload)
+	return tc
+}
+
+func (tc *testConn) close() {
+	tc.segment(true, &layers.TCP{FIN: true, ACK: true}, nil)
+	tc.segment(false, &layers.TCP{FIN: true, ACK: true}, nil)
+	tc.segment(true, &layers.TCP{ACK: true}, nil)
+}
+
+// write 写入 pcap 文件
+func (c *testCapture) write(path string) string {
+	c.t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err = w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		c.t.Fatal(err)
+	}
+	for _, p := range c.packets {
+		if err = w.WritePacket(p.ci, p.data); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// file 写入临时目录中的 pcap 文件
+func (c *testCapture) file() string {
+	return c.write(filepath.Join(c.t.TempDir(), "capture.pcap"))
+}
+
+// testSink 收集引擎输出的记录
+type testSink struct {
+	mu      sync.Mutex
+	records []record.Protocol
+	flushes int
+	closes  int
+}
+
+func (s *testSink) Write(r record.Protocol) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *testSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushes++
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closes++
+	return nil
+}
+
+// kind 返回指定类型的记录
+func (s *testSink) kind(kind string) []record.Protocol {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []record.Protocol
+	for _, r := range s.records {
+		if r.Kind() == kind {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// runCapture 以离线文件运行引擎直到文件结束, 返回收集到的记录
+func runCapture(t *testing.T, config Config, files ...string) *testSink {
+	t.Helper()
+	s := &testSink{}
+	config.OfflineFiles, config.Sink = files, s
+	e, err := New(config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err = e.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return s
+}
+
+func serializeDNS(t *testing.T, d *layers.DNS) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := d.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatalf("serialize dns: %v", err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
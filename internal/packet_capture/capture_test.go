@@ -0,0 +1,167 @@
+package packet_capture
+
+import (
+	"context"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/sink"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDNSMessage(t *testing.T, name string, response bool) []byte {
+	t.Helper()
+	d := &layers.DNS{ID: 0x1234, QR: response, RD: true,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+	if response {
+		d.RA = true
+		d.Answers = []layers.DNSResourceRecord{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN,
+			TTL: 300, IP: []byte{93, 184, 216, 34}}}
+	}
+	return serializeDNS(t, d)
+}
+
+// engineCapture DNS 查询应答与一个 HTTP 请求
+func engineCapture(t *testing.T) *testCapture {
+	c := newTestCapture(t)
+	c.udp("10.0.0.2", "10.0.0.53", 40000, 53, testDNSMessage(t, "example.com", false))
+	c.udp("10.0.0.53", "10.0.0.2", 53, 40000, testDNSMessage(t, "example.com", true))
+	conn := c.tcp("10.0.0.2", "93.184.216.34", 40001, 80).handshake()
+	conn.send(true, []byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\nUser-Agent: test\r\n\r\n"))
+	conn.send(false, []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	conn.close()
+	return c
+}
+
+func TestEngineRunOffline(t *testing.T) {
+	path := engineCapture(t).file()
+	for _, workers := range []int{1, 4} {
+		s := runCapture(t, Config{Dissectors: []string{"flow", "tcp", "dns"}, HTTP: true, Workers: workers}, path)
+
+		if n := len(s.kind(record.ProtocolDNS)); n != 2 {
+			t.Errorf("workers %d: got %d dns records, want 2", workers, n)
+		}
+		https := s.kind(record.ProtocolHTTP)
+		if len(https) != 1 {
+			t.Fatalf("workers %d: got %d http records, want 1", workers, len(https))
+		}
+		h := https[0].(*record.Http)
+		if h.Host != "example.com" || h.Method != "GET" || h.URL != "/index.html" || h.SrcIPStr != "10.0.0.2" {
+			t.Errorf("workers %d: http record %+v", workers, h)
+		}
+
+		flows := s.kind(record.ProtocolFlow)
+		if len(flows) != 2 {
+			t.Fatalf("workers %d: got %d flow records, want 2", workers, len(flows))
+		}
+		for _, r := range flows {
+			f := r.(*record.Flow)
+			if f.Proto == "tcp" {
+				if f.UpPackets != 5 || f.DownPackets != 3 || f.HTTPHost != "example.com" || f.AppProto != protoHTTP {
+					t.Errorf("workers %d: tcp flow %+v", workers, f)
+				}
+			} else if f.UpPackets != 1 || f.DownPackets != 1 {
+				t.Errorf("workers %d: udp flow %+v", workers, f)
+			}
+		}
+		if s.flushes != 1 || s.closes != 0 {
+			t.Errorf("workers %d: sink flushed %d closed %d times, want 1 and 0", workers, s.flushes, s.closes)
+		}
+	}
+}
+
+func TestEngineStop(t *testing.T) {
+	path := engineCapture(t).file()
+	e, err := New(Config{OfflineFiles: []string{path}, Dissectors: []string{"flow", "tcp", "dns"}, Sink: &testSink{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Stop()
+	e.Stop()
+	done := make(chan error)
+	go func() { done <- e.Run(context.Background()) }()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("Run did not return after Stop")
+	}
+	if !e.sourceClosed {
+		t.Error("source not closed after Run")
+	}
+}
+
+func TestEngineContextCanceled(t *testing.T) {
+	path := engineCapture(t).file()
+	e, err := New(Config{OfflineFiles: []string{path}, Dissectors: []string{"tcp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = e.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+// flushFailingSink 刷新时返回错误
+type flushFailingSink struct {
+	testSink
+}
+
+func (s *flushFailingSink) Flush() error {
+	_ = s.testSink.Flush()
+	return errors.New("flush failed")
+}
+
+func TestEngineRunErrors(t *testing.T) {
+	// 截断最后一个数据包, 之前的数据包照常处理
+	c := engineCapture(t)
+	path := c.file()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, data[:len(data)-10], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name      string
+		path      string
+		sink      sink.Sink
+		readErr   bool
+		flushFail bool
+	}{
+		{"truncated", path, &testSink{}, true, false},
+		{"flush", engineCapture(t).file(), &flushFailingSink{}, false, true},
+		{"both", path, &flushFailingSink{}, true, true},
+	} {
+		e, err := New(Config{OfflineFiles: []string{tt.path}, Dissectors: []string{"dns"}, Sink: tt.sink})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.Run(context.Background())
+		if err == nil {
+			t.Errorf("%s: Run returned nil", tt.name)
+			continue
+		}
+		if got := errors.Is(err, io.ErrUnexpectedEOF); got != tt.readErr {
+			t.Errorf("%s: read error reported %v, want %v: %v", tt.name, got, tt.readErr, err)
+		}
+		if got := strings.Contains(err.Error(), "flush failed"); got != tt.flushFail {
+			t.Errorf("%s: flush error reported %v, want %v: %v", tt.name, got, tt.flushFail, err)
+		}
+	}
+}
+
+func TestEngineUnknownDissector(t *testing.T) {
+	if _, err := New(Config{OfflineFiles: []string{"missing.pcap"}, Dissectors: []string{"nope"}}); err == nil {
+		t.Fatal("New accepted an unknown dissector")
+	}
+}
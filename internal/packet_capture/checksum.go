@@ -0,0 +1,112 @@
+package packet_capture
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+)
+
+// TCP 校验和
+// 网卡开启 TX checksum offload 时, 本机发出的数据包在抓包时还没有计算校验和.
+// auto 模式统计每个接口前 checksumSamples 个 TCP 报文, 错误比例超过 checksumOffloadRatio
+// 时认为开启了 offload 并停止校验, 否则按 verify 处理; 统计期间只计数不拒绝.
+
+// 校验和模式
+const (
+	ChecksumAuto   = "auto"   // 按接口自动检测
+	ChecksumVerify = "verify" // 拒绝校验和错误的报文
+	ChecksumCount  = "count"  // 只计数, 不拒绝
+	ChecksumSkip   = "skip"   // 不计算
+)
+
+const (
+	checksumSamples      = 1000
+	checksumOffloadRatio = 0.1
+)
+
+// checksumSample auto 模式下一个接口的检测状态
+type checksumSample struct {
+	seen, bad int
+	mode      string // 检测完成后为 verify 或 skip
+}
+
+// checksumPolicy 每个 Worker 一个实例, 非并发安全
+type checksumPolicy struct {
+	worker *Worker
+	mode   string
+	ifaces map[int]*checksumSample
+}
+
+// checkChecksumMode 校验配置中的模式, 空字符串为 auto
+func checkChecksumMode(mode string) error {
+	switch mode {
+	case "", ChecksumAuto, ChecksumVerify, ChecksumCount, ChecksumSkip:
+		return nil
+	}
+	return fmt.Errorf("unknown checksum mode %q", mode)
+}
+
+func newChecksumPolicy(w *Worker, mode string) *checksumPolicy {
+	if mode == "" {
+		mode = ChecksumAuto
+	}
+	return &checksumPolicy{worker: w, mode: mode, ifaces: make(map[int]*checksumSample)}
+}
+
+// accept 校验 TCP 报文, 返回 false 表示拒绝
+func (c *checksumPolicy) accept(tcp *layers.TCP, ci gopacket.CaptureInfo, ident string) bool {
+	mode := c.mode
+	var sample *checksumSample
+	if mode == ChecksumAuto {
+		if sample = c.ifaces[ci.InterfaceIndex]; sample == nil {
+			sample = &checksumSample{}
+			c.ifaces[ci.InterfaceIndex] = sample
+		}
+		if mode = sample.mode; mode == "" {
+			mode = ChecksumCount
+		}
+	}
+	if mode == ChecksumSkip {
+		return true
+	}
+	sum, err := tcp.ComputeChecksum()
+	bad := err != nil || sum != 0
+	if sample != nil && sample.mode == "" {
+		c.observe(sample, ci.InterfaceIndex, bad)
+	}
+	if !bad {
+		return true
+	}
+	c.worker.stats.badChecksum++
+	if mode != ChecksumVerify {
+		return true
+	}
+	if err != nil {
+		configs.Log.Errorf("ChecksumCompute %s: Got error computing checksum: %s\n", ident, err)
+	} else {
+		configs.Log.Debugf("Checksum %s: Invalid checksum: 0x%x\n", ident, sum)
+	}
+	c.worker.stats.rejectChecksum++
+	return false
+}
+
+// observe 记录检测结果, 样本足够时决定该接口的模式
+func (c *checksumPolicy) observe(s *checksumSample, iface int, bad bool) {
+	s.seen++
+	if bad {
+		s.bad++
+	}
+	if s.seen < checksumSamples {
+		return
+	}
+	if float64(s.bad)/float64(s.seen) > checksumOffloadRatio {
+		s.mode = ChecksumSkip
+		configs.Log.Warnf("Worker %d interface %d: %d/%d bad TCP checksums, assuming checksum offload and skipping validation",
+			c.worker.id, iface, s.bad, s.seen)
+	} else {
+		s.mode = ChecksumVerify
+		configs.Log.Infof("Worker %d interface %d: %d/%d bad TCP checksums, validating checksums",
+			c.worker.id, iface, s.bad, s.seen)
+	}
+}
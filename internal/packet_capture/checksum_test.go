@@ -0,0 +1,138 @@
+package packet_capture
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"testing"
+)
+
+// checksumSegments 返回校验和正确与错误的 TCP 报文
+func checksumSegments(t *testing.T) (good, bad *layers.TCP) {
+	t.Helper()
+	c := newTestCapture(t)
+	c.tcp("10.0.0.2", "10.0.0.80", 40000, 80).send(true, []byte("hello"))
+	corrupt := append([]byte(nil), c.packets[0].data...)
+	corrupt[14+20+16] ^= 0xff // TCP 校验和字段
+	decode := func(data []byte) *layers.TCP {
+		p := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
+		tcp := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if err := tcp.SetNetworkLayerForChecksum(p.NetworkLayer()); err != nil {
+			t.Fatal(err)
+		}
+		return tcp
+	}
+	return decode(c.packets[0].data), decode(corrupt)
+}
+
+func TestChecksumModes(t *testing.T) {
+	good, bad := checksumSegments(t)
+	for _, tt := range []struct {
+		mode           string
+		acceptBad      bool
+		badCount       int
+		rejectChecksum int
+	}{
+		{ChecksumVerify, false, 1, 1},
+		{ChecksumCount, true, 1, 0},
+		{ChecksumSkip, true, 0, 0},
+		// 检测期间按 count 处理
+		{ChecksumAuto, true, 1, 0},
+		{"", true, 1, 0},
+	} {
+		w := &Worker{}
+		c := newChecksumPolicy(w, tt.mode)
+		if !c.accept(good, gopacket.CaptureInfo{}, "good") {
+			t.Errorf("%q: good checksum rejected", tt.mode)
+		}
+		if c.accept(bad, gopacket.CaptureInfo{}, "bad") != tt.acceptBad {
+			t.Errorf("%q: bad checksum accepted %v, want %v", tt.mode, !tt.acceptBad, tt.acceptBad)
+		}
+		if w.stats.badChecksum != tt.badCount || w.stats.rejectChecksum != tt.rejectChecksum {
+			t.Errorf("%q: bad %d rejected %d, want %d %d", tt.mode, w.stats.badChecksum, w.stats.rejectChecksum, tt.badCount, tt.rejectChecksum)
+		}
+	}
+	if err := checkChecksumMode("sometimes"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestChecksumAuto(t *testing.T) {
+	good, bad := checksumSegments(t)
+	w := &Worker{}
+	c := newChecksumPolicy(w, ChecksumAuto)
+	// 接口 1 的错误比例超过阈值 (offload), 接口 2 低于阈值
+	offload, normal := gopacket.CaptureInfo{InterfaceIndex: 1}, gopacket.CaptureInfo{InterfaceIndex: 2}
+	for i := 0; i < checksumSamples; i++ {
+		tcp := good
+		if i%2 == 0 {
+			tcp = bad
+		}
+		if !c.accept(tcp, offload, "offload") {
+			t.Fatalf("offload sample %d rejected", i)
+		}
+		tcp = good
+		if i%20 == 0 {
+			tcp = bad
+		}
+		if !c.accept(tcp, normal, "normal") {
+			t.Fatalf("normal sample %d rejected", i)
+		}
+	}
+	if c.ifaces[1].mode != ChecksumSkip || c.ifaces[2].mode != ChecksumVerify {
+		t.Fatalf("modes %q %q, want skip verify", c.ifaces[1].mode, c.ifaces[2].mode)
+	}
+	counted := w.stats.badChecksum
+	if counted != checksumSamples/2+checksumSamples/20 || w.stats.rejectChecksum != 0 {
+		t.Errorf("sampling: bad %d rejected %d", counted, w.stats.rejectChecksum)
+	}
+
+	// 检测完成后按各自的模式处理, 新接口重新检测
+	if !c.accept(bad, offload, "offload") {
+		t.Error("offload interface rejected a bad checksum")
+	}
+	if c.accept(bad, normal, "normal") {
+		t.Error("verified interface accepted a bad checksum")
+	}
+	if !c.accept(bad, gopacket.CaptureInfo{InterfaceIndex: 3}, "new") {
+		t.Error("new interface rejected a bad checksum while sampling")
+	}
+	if w.stats.badChecksum != counted+2 || w.stats.rejectChecksum != 1 {
+		t.Errorf("after sampling: bad %d rejected %d, want %d 1", w.stats.badChecksum, w.stats.rejectChecksum, counted+2)
+	}
+}
+
+func TestChecksumMetrics(t *testing.T) {
+	c := newTestCapture(t)
+	conn := c.tcp("10.0.0.2", "10.0.0.80", 40000, 80).handshake()
+	conn.send(true, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	conn.close()
+	// 握手的第三个报文校验和错误
+	c.packets[2].data[14+20+16] ^= 0xff
+	path := c.file()
+
+	for _, tt := range []struct {
+		mode             string
+		bad, rejected    float64
+		wantHTTPRequests int
+	}{
+		{ChecksumVerify, 1, 1, 1},
+		{ChecksumCount, 1, 0, 1},
+		{ChecksumSkip, 0, 0, 1},
+	} {
+		s := &testSink{}
+		e := runEngine(t, Config{Dissectors: []string{"tcp"}, HTTP: true, Checksum: tt.mode, OfflineFiles: []string{path}, Sink: s})
+		values := gatherValues(t, e)
+		if v := values["dpi_reassembly_bad_checksum_packets_total{}"]; v != tt.bad {
+			t.Errorf("%s: bad checksum packets %v, want %v", tt.mode, v, tt.bad)
+		}
+		for reason, want := range map[string]float64{"checksum": tt.rejected, "fsm": 0, "options": 0} {
+			if v := values["dpi_reassembly_rejected_packets_total{"+reason+"}"]; v != want {
+				t.Errorf("%s: rejected %s %v, want %v", tt.mode, reason, v, want)
+			}
+		}
+		if n := len(s.kind(record.ProtocolHTTP)); n != tt.wantHTTPRequests {
+			t.Errorf("%s: %d http records, want %d", tt.mode, n, tt.wantHTTPRequests)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package packet_capture
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+)
+
+// defrag IPv4 packet IP碎片整理
+
+func init() {
+	RegisterPreShard("defrag", 10, func(w *Worker) Dissector {
+		return &defragDissector{
+			worker:    w,
+			defragger: ip4defrag.NewIPv4Defragmenter(),
+		}
+	})
+}
+
+type defragDissector struct {
+	worker    *Worker
+	defragger *ip4defrag.IPv4Defragmenter
+}
+
+func (d *defragDissector) Name() string {
+	return "defrag"
+}
+
+func (d *defragDissector) Dissect(p *Packet) bool {
+	ipv4Layer := p.Layer(layers.LayerTypeIPv4)
+	if ipv4Layer == nil {
+		return true
+	}
+	ip4 := ipv4Layer.(*layers.IPv4)
+	l := ip4.Length
+	var newip4 *layers.IPv4
+	var err error
+	if d.worker.engine.offline {
+		// 离线包使用数据包中的时间戳
+		newip4, err = d.defragger.DefragIPv4WithTimestamp(ip4, p.Metadata().CaptureInfo.Timestamp)
+	} else {
+		// 在线分析使用当前时间
+		newip4, err = d.defragger.DefragIPv4(ip4)
+	}
+
+	if err != nil {
+		configs.Log.Errorln("Error while de-fragmenting", err)
+		return false
+	} else if newip4 == nil {
+		configs.Log.Debug("Fragment...\n")
+		return false // packet fragment, we don't have whole packet yet.
+	}
+	if newip4.Length != l {
+		d.worker.stats.ipdefrag++
+		configs.Log.Debugf("Decoding re-assembled packet: %s\n", newip4.NextLayerType())
+		pb, ok := p.Packet.(gopacket.PacketBuilder)
+		if !ok {
+			panic("Not a PacketBuilder")
+		}
+		nextDecoder := newip4.NextLayerType()
+		_ = nextDecoder.Decode(newip4.Payload, pb)
+	}
+	return true
+}
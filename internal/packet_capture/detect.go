@@ -0,0 +1,125 @@
+package packet_capture
+
+import (
+	"bytes"
+)
+
+// 应用层协议识别
+// 根据 TCP 流中最先到达的数据识别协议, 与端口无关; 同时判断数据来自客户端还是服务端,
+// 没有抓到三次握手或服务端先发数据时据此纠正方向
+
+// 识别出的应用层协议名称, 写入流记录的 AppProto
+const (
+	protoUnknown    = "unknown"
+	protoHTTP       = "http"
+	protoHTTP2      = "http2"
+	protoTLS        = "tls"
+	protoSSH        = "ssh"
+	protoSMTP       = "smtp"
+	protoFTP        = "ftp"
+	protoPOP3       = "pop3"
+	protoIMAP       = "imap"
+	protoRDP        = "rdp"
+	protoVNC        = "vnc"
+	protoBitTorrent = "bittorrent"
+	protoDNS        = "dns"
+	protoQUIC       = "quic" // 由 quic 解析器设置
+	protoDoT        = "dot"  // DNS over TLS, 由 tls 解析器设置
+	protoDoH        = "doh"  // DNS over HTTPS, 由 tls 解析器设置
+)
+
+// detectMaxChunks 连续多少段数据无法识别后放弃
+const detectMaxChunks = 4
+
+// peerRole 识别出的数据发送方
+type peerRole uint8
+
+const (
+	roleAny    peerRole = iota // 双方都可能发送, 保持原方向
+	roleClient                 // 客户端发出
+	roleServer                 // 服务端发出
+)
+
+type prefixRule struct {
+	prefix []byte
+	proto  string
+	role   peerRole
+}
+
+var prefixRules = []prefixRule{
+	{[]byte("PRI * HTTP/2.0\r\n"), protoHTTP2, roleClient},
+	{[]byte("GET "), protoHTTP, roleClient},
+	{[]byte("POST "), protoHTTP, roleClient},
+	{[]byte("HEAD "), protoHTTP, roleClient},
+	{[]byte("PUT "), protoHTTP, roleClient},
+	{[]byte("DELETE "), protoHTTP, roleClient},
+	{[]byte("OPTIONS "), protoHTTP, roleClient},
+	{[]byte("PATCH "), protoHTTP, roleClient},
+	{[]byte("CONNECT "), protoHTTP, roleClient},
+	{[]byte("TRACE "), protoHTTP, roleClient},
+	{[]byte("HTTP/1."), protoHTTP, roleServer},
+	{[]byte("SSH-"), protoSSH, roleAny},
+	{[]byte("EHLO "), protoSMTP, roleClient},
+	{[]byte("HELO "), protoSMTP, roleClient},
+	{[]byte("+OK"), protoPOP3, roleServer},
+	{[]byte("* OK"), protoIMAP, roleServer},
+	{[]byte("RFB 00"), protoVNC, roleAny},
+	{[]byte("\x13BitTorrent protocol"), protoBitTorrent, roleAny},
+}
+
+// detectProtocol 识别一段数据的协议, 无法识别时返回空字符串
+func detectProtocol(data []byte) (string, peerRole) {
+	for _, r := range prefixRules {
+		if bytes.HasPrefix(data, r.prefix) {
+			return r.proto, r.role
+		}
+	}
+	switch {
+	case isTLSRecord(data):
+		// 握手消息类型: 1 ClientHello, 2 ServerHello
+		if data[0] == 0x16 && len(data) > 5 {
+			switch data[5] {
+			case 0x01:
+				return protoTLS, roleClient
+			case 0x02:
+				return protoTLS, roleServer
+			}
+		}
+		return protoTLS, roleAny
+	case bytes.HasPrefix(data, []byte("220")):
+		// SMTP 与 FTP 的欢迎信息都以 220 开头, 按内容区分
+		line := data
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		line = bytes.ToUpper(line)
+		if bytes.Contains(line, []byte("SMTP")) {
+			return protoSMTP, roleServer
+		} else if bytes.Contains(line, []byte("FTP")) {
+			return protoFTP, roleServer
+		}
+	case len(data) >= 11 && data[0] == 0x03 && data[1] == 0x00 && data[5] == 0xe0:
+		// TPKT + X.224 Connection Request
+		return protoRDP, roleClient
+	case isDNSOverTCP(data):
+		if data[4]&0x80 != 0 {
+			return protoDNS, roleServer
+		}
+		return protoDNS, roleClient
+	}
+	return "", roleAny
+}
+
+// isDNSOverTCP 判断是否以完整的 DNS 消息开头: 2 字节长度、标准查询、一个问题
+func isDNSOverTCP(data []byte) bool {
+	if len(data) < 14 {
+		return false
+	}
+	n := int(data[0])<<8 | int(data[1])
+	return n >= 12 && len(data) >= 2+n && data[4]>>3&0x0f == 0 && data[6] == 0 && data[7] == 1
+}
+
+// isTLSRecord 判断是否为 TLS 记录头: 类型 20-23, 版本 3.0-3.4
+func isTLSRecord(data []byte) bool {
+	return len(data) >= 5 && data[0] >= 0x14 && data[0] <= 0x17 && data[1] == 0x03 && data[2] <= 0x04
+}
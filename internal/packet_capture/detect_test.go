@@ -0,0 +1,87 @@
+package packet_capture
+
+import (
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"testing"
+)
+
+func TestDetectPrefixRules(t *testing.T) {
+	for _, r := range prefixRules {
+		data := append(append([]byte(nil), r.prefix...), "rest of the message\r\n"...)
+		if proto, role := detectProtocol(data); proto != r.proto || role != r.role {
+			t.Errorf("%q: got %s %d, want %s %d", r.prefix, proto, role, r.proto, r.role)
+		}
+		// 前缀不完整时不识别
+		if proto, _ := detectProtocol(r.prefix[:len(r.prefix)-1]); proto != "" && proto != r.proto {
+			t.Errorf("%q truncated: got %s", r.prefix, proto)
+		}
+	}
+}
+
+func TestDetectProtocol(t *testing.T) {
+	dnsQuery := append([]byte{0, 19}, 0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 1, 'a', 0, 0, 1, 0, 1)
+	dnsResponse := append([]byte{0, 19}, 0x12, 0x34, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 1, 'a', 0, 0, 1, 0, 1)
+	rdp := []byte{0x03, 0x00, 0x00, 0x13, 0x0e, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x08, 0x00, 0x03, 0x00, 0x00, 0x00}
+	for _, tt := range []struct {
+		name  string
+		data  []byte
+		proto string
+		role  peerRole
+	}{
+		// SMTP 与 FTP 的欢迎信息按第一行的内容区分
+		{"smtp banner", []byte("220 mail.example.com ESMTP Postfix\r\n"), protoSMTP, roleServer},
+		{"smtp banner lower case", []byte("220 mx.example.com esmtp ready\r\n"), protoSMTP, roleServer},
+		{"ftp banner", []byte("220 (vsFTPd 3.0.3)\r\n"), protoFTP, roleServer},
+		{"ftp banner without newline", []byte("220 ProFTPD Server ready"), protoFTP, roleServer},
+		{"220 other", []byte("220 Welcome\r\n"), "", roleAny},
+		{"220 ftp on the second line", []byte("220 Welcome\r\n220 FTP ready\r\n"), "", roleAny},
+		{"rdp", rdp, protoRDP, roleClient},
+		{"rdp too short", rdp[:10], "", roleAny},
+		{"tpkt without connection request", append([]byte{0x03, 0x00, 0x00, 0x13, 0x0e, 0xd0}, rdp[6:]...), "", roleAny},
+		// DNS over TCP: 长度前缀与完整的消息
+		{"dns query", dnsQuery, protoDNS, roleClient},
+		{"dns response", dnsResponse, protoDNS, roleServer},
+		{"dns incomplete", dnsQuery[:len(dnsQuery)-1], "", roleAny},
+		{"dns length too small", append([]byte{0, 11}, dnsQuery[2:]...), "", roleAny},
+		{"dns two questions", append(append([]byte(nil), dnsQuery[:7]...), append([]byte{2}, dnsQuery[8:]...)...), "", roleAny},
+		{"dns opcode", append(append([]byte(nil), dnsQuery[:4]...), append([]byte{0x28}, dnsQuery[5:]...)...), "", roleAny},
+		{"dns too short", dnsQuery[:13], "", roleAny},
+		{"tls client hello", []byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00}, protoTLS, roleClient},
+		{"tls server hello", []byte{0x16, 0x03, 0x03, 0x00, 0x05, 0x02, 0x00}, protoTLS, roleServer},
+		{"tls application data", []byte{0x17, 0x03, 0x03, 0x00, 0x05, 0x00}, protoTLS, roleAny},
+		{"tls bad version", []byte{0x16, 0x03, 0x05, 0x00, 0x05, 0x01}, "", roleAny},
+		{"empty", nil, "", roleAny},
+		{"too short", []byte("GE"), "", roleAny},
+		{"method without space", []byte("GETX / HTTP/1.1\r\n"), "", roleAny},
+		{"binary", []byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}, "", roleAny},
+	} {
+		if proto, role := detectProtocol(tt.data); proto != tt.proto || role != tt.role {
+			t.Errorf("%s: got %q %d, want %q %d", tt.name, proto, role, tt.proto, tt.role)
+		}
+	}
+}
+
+func TestDetectServerFirst(t *testing.T) {
+	// 抓包从连接中途开始, 最先看到的是服务端的应答, 端口与协议无关
+	c := newTestCapture(t)
+	conn := c.tcp("10.0.0.2", "10.0.0.80", 40000, 8888)
+	conn.send(false, []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	conn.send(true, []byte("GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	conn.send(false, []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	conn.close()
+
+	s := runCapture(t, Config{Dissectors: []string{"flow", "tcp"}, HTTP: true, Workers: 1}, c.file())
+	https := s.kind(record.ProtocolHTTP)
+	if len(https) == 0 {
+		t.Fatal("no http records")
+	}
+	for _, r := range https {
+		if h := r.(*record.Http); h.SrcIPStr != "10.0.0.2" || h.DstIPStr != "10.0.0.80" {
+			t.Errorf("http record %s -> %s, want the client as the source", h.SrcIPStr, h.DstIPStr)
+		}
+	}
+	flows := s.kind(record.ProtocolFlow)
+	if len(flows) != 1 || flows[0].(*record.Flow).AppProto != protoHTTP {
+		t.Errorf("flows %+v", flows)
+	}
+}
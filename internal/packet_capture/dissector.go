@@ -0,0 +1,136 @@
+package packet_capture
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Dissector 协议解析器
+// 每个 Worker 持有独立的解析器实例, 数据包按注册顺序依次交给已启用的解析器
+type Dissector interface {
+	Name() string
+	// Dissect 解析数据包, 返回 false 表示该数据包已被消费, 不再交给后续解析器
+	Dissect(p *Packet) bool
+}
+
+// Flusher 需要周期性刷新状态的解析器, now 为当前数据包的抓包时间
+type Flusher interface {
+	Flush(now time.Time)
+}
+
+// Closer 引擎结束时需要释放资源的解析器
+type Closer interface {
+	Close()
+}
+
+// DissectorFactory 为 Worker 创建解析器实例
+type DissectorFactory func(w *Worker) Dissector
+
+// Packet 交给解析器的数据包, 附带已解析的网络层信息
+type Packet struct {
+	gopacket.Packet
+	SrcIP net.IP
+	DstIP net.IP
+	TTL   uint8
+	// Index 抓包序号, 从 1 开始
+	Index int
+	// FlowID 所属流的 ID, 由 flow 解析器填写, 未启用时为空
+	FlowID string
+}
+
+type registration struct {
+	name     string
+	order    int
+	factory  DissectorFactory
+	preShard bool
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]registration)
+)
+
+// Register 注册协议解析器, order 越小越先执行
+// 重复注册同名解析器会 panic
+func Register(name string, order int, factory DissectorFactory) {
+	register(registration{name: name, order: order, factory: factory})
+}
+
+// RegisterPreShard 注册在分发到 Worker 之前执行的解析器
+// 只有一个实例, 在抓包 goroutine 中执行, 仅接收 IPv4 分片; 返回 true 的数据包按重组后的 5 元组分发
+func RegisterPreShard(name string, order int, factory DissectorFactory) {
+	register(registration{name: name, order: order, factory: factory, preShard: true})
+}
+
+func register(r registration) {
+	name, factory := r.name, r.factory
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("packet_capture: Register dissector factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("packet_capture: Register called twice for dissector " + name)
+	}
+	registry[name] = r
+}
+
+// Dissectors 返回已注册的解析器名称, 按执行顺序排列
+func Dissectors() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	regs := make([]registration, 0, len(registry))
+	for _, r := range registry {
+		regs = append(regs, r)
+	}
+	sortRegistrations(regs)
+	names := make([]string, len(regs))
+	for i, r := range regs {
+		names[i] = r.name
+	}
+	return names
+}
+
+// hasDissector 判断解析器是否启用
+func hasDissector(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupDissectors 按名称查找已注册的解析器, 返回按执行顺序排列的结果
+func lookupDissectors(names []string) ([]registration, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	seen := make(map[string]bool, len(names))
+	regs := make([]registration, 0, len(names))
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		r, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown dissector %q", name)
+		}
+		regs = append(regs, r)
+	}
+	sortRegistrations(regs)
+	return regs, nil
+}
+
+func sortRegistrations(regs []registration) {
+	sort.SliceStable(regs, func(i, j int) bool {
+		if regs[i].order != regs[j].order {
+			return regs[i].order < regs[j].order
+		}
+		return regs[i].name < regs[j].name
+	})
+}
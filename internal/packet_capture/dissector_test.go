@@ -0,0 +1,204 @@
+package packet_capture
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// dissectLog 记录测试解析器收到的数据包
+type dissectLog struct {
+	mu    sync.Mutex
+	calls []dissectCall
+}
+
+type dissectCall struct {
+	name   string
+	worker int
+	index  int
+}
+
+// testDissector 记录调用, pass 返回 false 时数据包不再交给后续解析器
+type testDissector struct {
+	name   string
+	worker *Worker
+	log    *dissectLog
+	pass   func(p *Packet) bool
+}
+
+func (d *testDissector) Name() string {
+	return d.name
+}
+
+func (d *testDissector) Dissect(p *Packet) bool {
+	d.log.mu.Lock()
+	d.log.calls = append(d.log.calls, dissectCall{d.name, d.worker.ID(), p.Index})
+	d.log.mu.Unlock()
+	return d.pass == nil || d.pass(p)
+}
+
+func (l *dissectLog) factory(name string, pass func(p *Packet) bool) DissectorFactory {
+	return func(w *Worker) Dissector {
+		return &testDissector{name: name, worker: w, log: l, pass: pass}
+	}
+}
+
+// indexes 返回解析器收到的数据包序号
+func (l *dissectLog) indexes(name string) []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []int
+	for _, c := range l.calls {
+		if c.name == name {
+			out = append(out, c.index)
+		}
+	}
+	return out
+}
+
+// withDissectors 测试期间使用空的解析器注册表
+func withDissectors(t *testing.T) {
+	t.Helper()
+	registryMu.Lock()
+	saved := registry
+	registry = make(map[string]registration)
+	registryMu.Unlock()
+	t.Cleanup(func() {
+		registryMu.Lock()
+		registry = saved
+		registryMu.Unlock()
+	})
+}
+
+func TestRegisterDissectors(t *testing.T) {
+	if names, want := Dissectors(), []string{"defrag", "flow", "tcp", "dns", "quic", "radius", "icmp"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("built-in dissectors %v, want %v", names, want)
+	}
+
+	withDissectors(t)
+	log := &dissectLog{}
+	Register("b", 20, log.factory("b", nil))
+	Register("a", 20, log.factory("a", nil))
+	Register("c", 10, log.factory("c", nil))
+	RegisterPreShard("pre", 30, log.factory("pre", nil))
+	// 按 order 排列, order 相同时按名称
+	if names, want := Dissectors(), []string{"c", "a", "b", "pre"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("dissectors %v, want %v", names, want)
+	}
+	regs, err := lookupDissectors([]string{"b", "c", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regs) != 2 || regs[0].name != "c" || regs[1].name != "b" {
+		t.Errorf("lookup %+v", regs)
+	}
+	if _, err = lookupDissectors([]string{"a", "missing"}); err == nil {
+		t.Error("unknown dissector found")
+	}
+
+	for name, register := range map[string]func(){
+		"duplicate":           func() { Register("a", 1, log.factory("a", nil)) },
+		"duplicate pre-shard": func() { RegisterPreShard("b", 1, log.factory("b", nil)) },
+		"nil factory":         func() { Register("d", 1, nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", name)
+				}
+			}()
+			register()
+		}()
+	}
+}
+
+func TestDissectorChain(t *testing.T) {
+	withDissectors(t)
+	log := &dissectLog{}
+	// stop 消费发往 9 端口的数据包, 之后的解析器不再收到
+	Register("stop", 10, log.factory("stop", func(p *Packet) bool {
+		udp, ok := p.TransportLayer().(*layers.UDP)
+		return !ok || udp.DstPort != 9
+	}))
+	Register("next", 20, log.factory("next", nil))
+	c := newTestCapture(t)
+	c.udp("10.0.0.2", "10.0.0.1", 40000, 9, []byte("discard"))
+	c.udp("10.0.0.2", "10.0.0.1", 40000, 10, []byte("pass"))
+	path := c.file()
+
+	// 执行顺序由 order 决定, 与配置中的顺序无关
+	runCapture(t, Config{Dissectors: []string{"next", "stop"}, Workers: 1}, path)
+	if got := log.indexes("stop"); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("stop got packets %v", got)
+	}
+	if got := log.indexes("next"); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("next got packets %v", got)
+	}
+	if calls := log.calls; len(calls) != 3 || calls[1].name != "stop" || calls[2].name != "next" {
+		t.Errorf("calls %+v", calls)
+	}
+
+	// 未启用的解析器不执行
+	log.calls = nil
+	runCapture(t, Config{Dissectors: []string{"next"}, Workers: 1}, path)
+	if got := log.indexes("next"); !reflect.DeepEqual(got, []int{1, 2}) || len(log.indexes("stop")) != 0 {
+		t.Errorf("calls %+v", log.calls)
+	}
+}
+
+func TestPreShardDissector(t *testing.T) {
+	withDissectors(t)
+	log := &dissectLog{}
+	var drop bool
+	// order 大于 Worker 中的解析器, 仍在分发前执行
+	RegisterPreShard("pre", 100, log.factory("pre", func(*Packet) bool { return !drop }))
+	Register("worker", 1, log.factory("worker", nil))
+	c := newTestCapture(t)
+	c.udp("10.0.0.2", "10.0.0.1", 40000, 53, []byte("whole"))
+	for _, frag := range []struct {
+		offset uint16
+		more   bool
+	}{{0, true}, {1, false}} {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, Id: 7, FragOffset: frag.offset,
+			SrcIP: net.ParseIP("10.0.0.2").To4(), DstIP: net.ParseIP("10.0.0.1").To4()}
+		if frag.more {
+			ip.Flags = layers.IPv4MoreFragments
+		}
+		c.add(layers.EthernetTypeIPv4, ip, gopacket.Payload(make([]byte, 8)))
+	}
+	path := c.file()
+
+	for _, drop = range []bool{false, true} {
+		log.calls = nil
+		runCapture(t, Config{Dissectors: []string{"worker", "pre"}, Workers: 2}, path)
+		// 分片前解析器只收到分片, 在抓包 goroutine 中执行
+		if got := log.indexes("pre"); !reflect.DeepEqual(got, []int{2, 3}) {
+			t.Errorf("drop %v: pre got packets %v", drop, got)
+		}
+		want := []int{1, 2, 3}
+		if drop {
+			want = []int{1}
+		}
+		got := log.indexes("worker")
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("drop %v: worker got packets %v, want %v", drop, got, want)
+		}
+		// 分片先经过分片前解析器, 再分发到 Worker
+		pre := make(map[int]bool)
+		for _, call := range log.calls {
+			if (call.name == "pre") != (call.worker == -1) {
+				t.Errorf("drop %v: %s ran on worker %d", drop, call.name, call.worker)
+			}
+			if call.name == "pre" {
+				pre[call.index] = true
+			} else if call.index > 1 && !pre[call.index] {
+				t.Errorf("drop %v: packet %d reached the worker before the pre-shard dissector", drop, call.index)
+			}
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package packet_capture
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS 分析
+// UDP 53 在此解析, DNS over TCP 由 tcp 解析器按载荷识别后交给 dnsTCPStream;
+// 查询与应答按地址、端口与事务 ID 匹配, 计算应答延迟; 应答中的地址写入引擎的域名缓存
+
+const (
+	dnsQueryTimeout = time.Second * 30 // 未应答查询的保留时间
+	dnsMaxPending   = 65536            // 每个 Worker 保留的未应答查询上限
+)
+
+func init() {
+	Register("dns", 30, func(w *Worker) Dissector {
+		return &dnsDissector{worker: w, pending: make(map[dnsKey]time.Time)}
+	})
+}
+
+// dnsKey 客户端、服务端与事务 ID
+type dnsKey struct {
+	client, server         [16]byte
+	clientPort, serverPort uint16
+	id                     uint16
+}
+
+func newDnsKey(client, server net.IP, clientPort, serverPort, id uint16) dnsKey {
+	k := dnsKey{clientPort: clientPort, serverPort: serverPort, id: id}
+	copy(k.client[:], client.To16())
+	copy(k.server[:], server.To16())
+	return k
+}
+
+type dnsDissector struct {
+	worker  *Worker
+	pending map[dnsKey]time.Time
+}
+
+func (d *dnsDissector) Name() string {
+	return "dns"
+}
+
+func (d *dnsDissector) Dissect(p *Packet) bool {
+	udpLayer := p.Layer(layers.LayerTypeUDP)
+	dnsLayer := p.Layer(layers.LayerTypeDNS)
+	if udpLayer == nil || dnsLayer == nil {
+		return true
+	}
+	udp := udpLayer.(*layers.UDP)
+	dns := dnsLayer.(*layers.DNS)
+	ts := p.Metadata().Timestamp
+	r := newDnsRecord(dns, ts)
+	r.FlowID = p.FlowID
+	r.SrcIP, r.DstIP = p.SrcIP, p.DstIP
+	r.SrcPort, r.DstPort = uint16(udp.SrcPort), uint16(udp.DstPort)
+	r.Transport = "udp"
+	if !dns.QR {
+		if len(d.pending) < dnsMaxPending {
+			d.pending[newDnsKey(p.SrcIP, p.DstIP, r.SrcPort, r.DstPort, dns.ID)] = ts
+		}
+	} else {
+		key := newDnsKey(p.DstIP, p.SrcIP, r.DstPort, r.SrcPort, dns.ID)
+		if sent, ok := d.pending[key]; ok {
+			r.Latency = ts.Sub(sent)
+			delete(d.pending, key)
+		}
+		d.worker.engine.domains.learn(p.DstIP, dns, ts)
+	}
+	d.worker.Emit(r)
+	return true
+}
+
+// Flush 删除超时未应答的查询
+func (d *dnsDissector) Flush(now time.Time) {
+	for key, sent := range d.pending {
+		if now.Sub(sent) >= dnsQueryTimeout {
+			delete(d.pending, key)
+		}
+	}
+}
+
+// dnsTCPStream DNS over TCP, 每个方向按 2 字节长度前缀拆分消息
+type dnsTCPStream struct {
+	parent  *tcpStream
+	buf     [2][]byte // 客户端、服务端方向未处理完的数据
+	pending map[uint16]time.Time
+	stopped bool
+}
+
+// feed 追加一个方向的数据并输出其中完整的消息
+func (s *dnsTCPStream) feed(data []byte, client bool, ts time.Time) {
+	if s.stopped {
+		return
+	}
+	i := 1
+	if client {
+		i = 0
+	}
+	s.buf[i] = append(s.buf[i], data...)
+	for len(s.buf[i]) >= 2 {
+		n := 2 + int(binary.BigEndian.Uint16(s.buf[i]))
+		if len(s.buf[i]) < n {
+			return
+		}
+		msg := s.buf[i][2:n]
+		s.buf[i] = s.buf[i][n:]
+		dns := &layers.DNS{}
+		if err := dns.DecodeFromBytes(msg, gopacket.NilDecodeFeedback); err != nil {
+			configs.Log.Debugf("%s: DNS over TCP err:%s", s.parent.ident, err)
+			s.stopped, s.buf = true, [2][]byte{}
+			return
+		}
+		s.emit(dns, client, ts)
+	}
+}
+
+func (s *dnsTCPStream) emit(dns *layers.DNS, client bool, ts time.Time) {
+	t := s.parent
+	r := newDnsRecord(dns, ts)
+	r.FlowID = t.flowID
+	r.Transport = "tcp"
+	clientPort, serverPort := t.ports()
+	if client {
+		r.SrcIP, r.DstIP, r.SrcPort, r.DstPort = t.src, t.dst, clientPort, serverPort
+		if s.pending == nil {
+			s.pending = make(map[uint16]time.Time)
+		}
+		s.pending[dns.ID] = ts
+	} else {
+		r.SrcIP, r.DstIP, r.SrcPort, r.DstPort = t.dst, t.src, serverPort, clientPort
+		if sent, ok := s.pending[dns.ID]; ok {
+			r.Latency = ts.Sub(sent)
+			delete(s.pending, dns.ID)
+		}
+		t.worker.engine.domains.learn(t.src, dns, ts)
+	}
+	t.worker.Emit(r)
+}
+
+// newDnsRecord 从 DNS 消息生成记录, 地址与延迟由调用方填写
+func newDnsRecord(dns *layers.DNS, ts time.Time) *record.Dns {
+	r := &record.Dns{
+		TxID:      dns.ID,
+		Response:  dns.QR,
+		OpCode:    dns.OpCode.String(),
+		RCode:     dnsRCodeName(dns.ResponseCode),
+		Size:      len(dns.Contents),
+		Timestamp: ts,
+	}
+	for _, q := range dns.Questions {
+		r.Questions = append(r.Questions, record.DnsQuestion{
+			Name:  string(q.Name),
+			Type:  dnsTypeName(q.Type),
+			Class: q.Class.String(),
+		})
+	}
+	if len(r.Questions) > 0 {
+		r.Host, r.Type, r.Class = r.Questions[0].Name, r.Questions[0].Type, r.Questions[0].Class
+	}
+	for _, a := range dns.Answers {
+		r.Answers = append(r.Answers, record.DnsAnswer{
+			Name: string(a.Name),
+			Type: dnsTypeName(a.Type),
+			TTL:  a.TTL,
+			Data: dnsAnswerData(&a),
+		})
+		if a.Type == layers.DNSTypeCNAME {
+			r.CNAMEs = append(r.CNAMEs, string(a.CNAME))
+		}
+	}
+	return r
+}
+
+// SVCB 与 HTTPS 记录, gopacket 未定义
+const (
+	dnsTypeSVCB  layers.DNSType = 64
+	dnsTypeHTTPS layers.DNSType = 65
+)
+
+func dnsTypeName(t layers.DNSType) string {
+	switch t {
+	case dnsTypeSVCB:
+		return "SVCB"
+	case dnsTypeHTTPS:
+		return "HTTPS"
+	}
+	if s := t.String(); s != "Unknown" {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+func dnsRCodeName(c layers.DNSResponseCode) string {
+	switch c {
+	case layers.DNSResponseCodeNoErr:
+		return "NOERROR"
+	case layers.DNSResponseCodeFormErr:
+		return "FORMERR"
+	case layers.DNSResponseCodeServFail:
+		return "SERVFAIL"
+	case layers.DNSResponseCodeNXDomain:
+		return "NXDOMAIN"
+	case layers.DNSResponseCodeNotImp:
+		return "NOTIMP"
+	case layers.DNSResponseCodeRefused:
+		return "REFUSED"
+	}
+	return "RCODE" + strconv.Itoa(int(c))
+}
+
+// dnsAnswerData 以 zone 文件的格式展示记录内容
+func dnsAnswerData(a *layers.DNSResourceRecord) string {
+	switch a.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return a.IP.String()
+	case layers.DNSTypeCNAME:
+		return string(a.CNAME)
+	case layers.DNSTypeNS:
+		return string(a.NS)
+	case layers.DNSTypePTR:
+		return string(a.PTR)
+	case layers.DNSTypeMX:
+		return fmt.Sprintf("%d %s", a.MX.Preference, a.MX.Name)
+	case layers.DNSTypeTXT:
+		txt := make([]string, len(a.TXTs))
+		for i, s := range a.TXTs {
+			txt[i] = strconv.Quote(string(s))
+		}
+		return strings.Join(txt, " ")
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", a.SRV.Priority, a.SRV.Weight, a.SRV.Port, a.SRV.Name)
+	case layers.DNSTypeSOA:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", a.SOA.MName, a.SOA.RName, a.SOA.Serial, a.SOA.Refresh, a.SOA.Retry, a.SOA.Expire, a.SOA.Minimum)
+	case dnsTypeSVCB, dnsTypeHTTPS:
+		return svcbData(a.Data)
+	}
+	return fmt.Sprintf("\\# %d %x", len(a.Data), a.Data)
+}
+
+// svcbData 解析 SVCB/HTTPS 记录, 见 RFC 9460; TargetName 不压缩
+func svcbData(data []byte) string {
+	if len(data) < 3 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(binary.BigEndian.Uint16(data))))
+	b.WriteByte(' ')
+	pos := 2
+	var labels []string
+	for pos < len(data) && data[pos] != 0 {
+		l := int(data[pos])
+		if pos+1+l > len(data) {
+			return b.String()
+		}
+		labels = append(labels, string(data[pos+1:pos+1+l]))
+		pos += 1 + l
+	}
+	pos++
+	b.WriteString(strings.Join(labels, ".") + ".")
+	for pos+4 <= len(data) {
+		key := binary.BigEndian.Uint16(data[pos:])
+		l := int(binary.BigEndian.Uint16(data[pos+2:]))
+		pos += 4
+		if pos+l > len(data) {
+			break
+		}
+		b.WriteByte(' ')
+		b.WriteString(svcbParam(key, data[pos:pos+l]))
+		pos += l
+	}
+	return b.String()
+}
+
+func svcbParam(key uint16, v []byte) string {
+	switch key {
+	case 1: // alpn
+		var ids []string
+		for len(v) > 0 && int(v[0]) < len(v) {
+			ids = append(ids, string(v[1:1+v[0]]))
+			v = v[1+v[0]:]
+		}
+		return "alpn=" + strings.Join(ids, ",")
+	case 2:
+		return "no-default-alpn"
+	case 3:
+		if len(v) == 2 {
+			return "port=" + strconv.Itoa(int(binary.BigEndian.Uint16(v)))
+		}
+	case 4, 6: // ipv4hint, ipv6hint
+		size, name := net.IPv4len, "ipv4hint="
+		if key == 6 {
+			size, name = net.IPv6len, "ipv6hint="
+		}
+		var ips []string
+		for ; len(v) >= size; v = v[size:] {
+			ips = append(ips, net.IP(v[:size]).String())
+		}
+		return name + strings.Join(ips, ",")
+	case 5:
+		return "ech=" + base64.StdEncoding.EncodeToString(v)
+	}
+	return fmt.Sprintf("key%d=%x", key, v)
+}
@@ -0,0 +1,212 @@
+package packet_capture
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testDNSResponse example.com 的 A 与 AAAA 两个问题, 应答经过一个 CNAME
+func testDNSResponse(id uint16) *layers.DNS {
+	return &layers.DNS{ID: id, QR: true, RD: true, RA: true,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("www.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+			{Name: []byte("www.example.com"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN},
+		},
+		Answers: []layers.DNSResourceRecord{
+			{Name: []byte("www.example.com"), Type: layers.DNSTypeCNAME, Class: layers.DNSClassIN, TTL: 3600, CNAME: []byte("edge.example.net")},
+			{Name: []byte("edge.example.net"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: net.IP{93, 184, 216, 34}},
+			{Name: []byte("edge.example.net"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: net.IP{93, 184, 216, 35}},
+			{Name: []byte("edge.example.net"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN, TTL: 60, IP: net.ParseIP("2606:2800:220:1:248:1893:25c8:1946")},
+		},
+	}
+}
+
+func testDNSQuery(id uint16) *layers.DNS {
+	d := testDNSResponse(id)
+	d.QR, d.RA, d.Answers = false, false, nil
+	return d
+}
+
+// dnsRecords 按时间排序的 DNS 记录
+func dnsRecords(t *testing.T, s *testSink, want int) []*record.Dns {
+	t.Helper()
+	var out []*record.Dns
+	for _, r := range s.kind(record.ProtocolDNS) {
+		out = append(out, r.(*record.Dns))
+	}
+	if len(out) != want {
+		t.Fatalf("got %d dns records, want %d", len(out), want)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Timestamp.Before(out[j].Timestamp) })
+	return out
+}
+
+// checkDNSResponse 检查 testDNSResponse 生成的应答
+func checkDNSResponse(t *testing.T, r *record.Dns) {
+	t.Helper()
+	wantQuestions := []record.DnsQuestion{{Name: "www.example.com", Type: "A", Class: "IN"}, {Name: "www.example.com", Type: "AAAA", Class: "IN"}}
+	if !reflect.DeepEqual(r.Questions, wantQuestions) || r.Host != "www.example.com" || r.Type != "A" || r.Class != "IN" {
+		t.Errorf("questions %+v host %q type %s class %s", r.Questions, r.Host, r.Type, r.Class)
+	}
+	wantAnswers := []record.DnsAnswer{
+		{Name: "www.example.com", Type: "CNAME", TTL: 3600, Data: "edge.example.net"},
+		{Name: "edge.example.net", Type: "A", TTL: 60, Data: "93.184.216.34"},
+		{Name: "edge.example.net", Type: "A", TTL: 60, Data: "93.184.216.35"},
+		{Name: "edge.example.net", Type: "AAAA", TTL: 60, Data: "2606:2800:220:1:248:1893:25c8:1946"},
+	}
+	if !reflect.DeepEqual(r.Answers, wantAnswers) || !reflect.DeepEqual(r.CNAMEs, []string{"edge.example.net"}) {
+		t.Errorf("answers %+v cnames %q", r.Answers, r.CNAMEs)
+	}
+	if !r.Response || r.RCode != "NOERROR" || r.Domain != "example" {
+		t.Errorf("response %v rcode %s domain %q", r.Response, r.RCode, r.Domain)
+	}
+}
+
+func TestDNSUDP(t *testing.T) {
+	c := newTestCapture(t)
+	query := serializeDNS(t, testDNSQuery(0x1111))
+	c.udp("10.0.0.2", "10.0.0.53", 40000, 53, query)
+	c.ts = c.ts.Add(time.Millisecond * 20)
+	c.udp("10.0.0.53", "10.0.0.2", 53, 40000, serializeDNS(t, testDNSResponse(0x1111)))
+	// 事务 ID 相同但端口不同的应答不匹配
+	c.udp("10.0.0.53", "10.0.0.2", 53, 40001, serializeDNS(t, testDNSResponse(0x1111)))
+	// 没有问题的 FORMERR 应答仍按事务 ID 匹配查询
+	c.udp("10.0.0.2", "10.0.0.53", 40002, 53, serializeDNS(t, testDNSQuery(0x2222)))
+	c.udp("10.0.0.53", "10.0.0.2", 53, 40002, serializeDNS(t, &layers.DNS{ID: 0x2222, QR: true, ResponseCode: layers.DNSResponseCodeFormErr}))
+
+	s := runCapture(t, Config{Dissectors: []string{"dns"}, Workers: 1}, c.file())
+	rs := dnsRecords(t, s, 5)
+	q := rs[0]
+	if q.Response || q.Transport != "udp" || q.SrcIPStr != "10.0.0.2" || q.DstPort != 53 || q.TxID != 0x1111 || q.Size != len(query) {
+		t.Errorf("query %+v", q)
+	}
+	if len(q.Questions) != 2 || len(q.Answers) != 0 || q.Latency != 0 {
+		t.Errorf("query questions %+v answers %+v latency %s", q.Questions, q.Answers, q.Latency)
+	}
+	r := rs[1]
+	checkDNSResponse(t, r)
+	if r.Transport != "udp" || r.SrcIPStr != "10.0.0.53" || r.DstPort != 40000 || r.Latency != time.Millisecond*30 {
+		t.Errorf("response from %s to port %d latency %s", r.SrcIPStr, r.DstPort, r.Latency)
+	}
+	if rs[2].Latency != 0 {
+		t.Errorf("unmatched response latency %s", rs[2].Latency)
+	}
+	if e := rs[4]; !e.Response || e.RCode != "FORMERR" || len(e.Questions) != 0 || e.Host != "" || e.Latency != time.Millisecond*10 {
+		t.Errorf("response without question: rcode %s questions %+v host %q latency %s", e.RCode, e.Questions, e.Host, e.Latency)
+	}
+}
+
+// dnsTCPMessage 加上 2 字节长度前缀
+func dnsTCPMessage(msg []byte) []byte {
+	return append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func TestDNSTCP(t *testing.T) {
+	// 按第一个消息识别 DNS over TCP 时要求只有一个问题
+	q1, r1 := dnsTCPMessage(testDNSMessage(t, "example.com", false)), dnsTCPMessage(testDNSMessage(t, "example.com", true))
+	q2, r2 := dnsTCPMessage(serializeDNS(t, testDNSQuery(0x2222))), dnsTCPMessage(serializeDNS(t, testDNSResponse(0x2222)))
+	c := newTestCapture(t)
+	conn := c.tcp("10.0.0.2", "10.0.0.53", 40000, 53).handshake()
+	// 第二个查询的长度前缀被拆到两个分段
+	conn.send(true, append(append([]byte(nil), q1...), q2[0]))
+	conn.send(true, q2[1:20])
+	conn.send(true, q2[20:])
+	// 应答按相反的顺序到达, 一个应答与下一个应答的长度前缀在同一个分段
+	conn.send(false, append(append([]byte(nil), r2...), r1[:1]...))
+	conn.send(false, r1[1:])
+	conn.close()
+
+	s := runCapture(t, Config{Dissectors: []string{"tcp", "dns"}, Workers: 1}, c.file())
+	rs := dnsRecords(t, s, 4)
+	sent := make(map[uint16]time.Time)
+	for i, id := range []uint16{0x1234, 0x2222, 0x2222, 0x1234} {
+		r := rs[i]
+		if r.TxID != id || r.Response != (i >= 2) || r.Transport != "tcp" {
+			t.Fatalf("record %d: id %#x response %v transport %s", i, r.TxID, r.Response, r.Transport)
+		}
+		if !r.Response {
+			sent[id] = r.Timestamp
+			if r.SrcIPStr != "10.0.0.2" || r.SrcPort != 40000 || r.DstPort != 53 || r.Latency != 0 {
+				t.Errorf("query %s:%d -> %d latency %s", r.SrcIPStr, r.SrcPort, r.DstPort, r.Latency)
+			}
+			continue
+		}
+		if r.SrcIPStr != "10.0.0.53" || r.SrcPort != 53 || r.DstPort != 40000 {
+			t.Errorf("response %s:%d -> %d", r.SrcIPStr, r.SrcPort, r.DstPort)
+		}
+		if r.Latency != r.Timestamp.Sub(sent[id]) || r.Latency <= 0 {
+			t.Errorf("response %#x latency %s", r.TxID, r.Latency)
+		}
+	}
+	checkDNSResponse(t, rs[2])
+	if len(rs[1].Questions) != 2 || rs[2].Size != len(r2)-2 {
+		t.Errorf("split query has %d questions, response size %d", len(rs[1].Questions), rs[2].Size)
+	}
+	if r := rs[3]; r.Host != "example.com" || len(r.Answers) != 1 || r.Answers[0].Data != "93.184.216.34" {
+		t.Errorf("response %#x host %q answers %+v", r.TxID, r.Host, r.Answers)
+	}
+}
+
+// dnsRaw 按字段拼接原始 DNS 消息, gopacket 无法序列化 SVCB 与 HTTPS 记录
+func dnsRaw(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func u16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func TestDNSSVCB(t *testing.T) {
+	name := []byte("\x07example\x03com\x00")
+	https := dnsRaw(
+		u16(1), []byte{0}, // SvcPriority 1, TargetName "."
+		u16(1), u16(6), []byte("\x02h2\x02h3"), // alpn
+		u16(3), u16(2), u16(443), // port
+		u16(4), u16(8), []byte{93, 184, 216, 34, 93, 184, 216, 35}, // ipv4hint
+		u16(6), u16(16), net.ParseIP("2606:2800:220:1:248:1893:25c8:1946"), // ipv6hint
+		u16(5), u16(3), []byte{1, 2, 3}, // ech
+		u16(9), u16(2), []byte{0xab, 0xcd}, // 未知参数
+	)
+	alias := dnsRaw(u16(0), []byte("\x03svc\x07example\x03net\x00"))
+	msg := dnsRaw(
+		u16(0x3333), u16(0x8180), u16(1), u16(2), u16(0), u16(0),
+		name, u16(65), u16(1),
+		[]byte{0xc0, 12}, u16(65), u16(1), []byte{0, 0, 0x0e, 0x10}, u16(uint16(len(https))), https,
+		[]byte{0xc0, 12}, u16(64), u16(1), []byte{0, 0, 0, 60}, u16(uint16(len(alias))), alias,
+	)
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(msg, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	r := newDnsRecord(dns, testStart)
+	if r.Host != "example.com" || r.Type != "HTTPS" || r.Size != len(msg) {
+		t.Errorf("host %q type %s size %d", r.Host, r.Type, r.Size)
+	}
+	want := []record.DnsAnswer{
+		{Name: "example.com", Type: "HTTPS", TTL: 3600,
+			Data: "1 . alpn=h2,h3 port=443 ipv4hint=93.184.216.34,93.184.216.35 ipv6hint=2606:2800:220:1:248:1893:25c8:1946 ech=AQID key9=abcd"},
+		{Name: "example.com", Type: "SVCB", TTL: 60, Data: "0 svc.example.net."},
+	}
+	if !reflect.DeepEqual(r.Answers, want) {
+		t.Errorf("answers %+v\nwant %+v", r.Answers, want)
+	}
+
+	// 截断的记录内容不能 panic
+	for i := 0; i < len(https); i++ {
+		_ = svcbData(https[:i])
+	}
+	if got := svcbData(https[:len(https)-3]); got != "1 . alpn=h2,h3 port=443 ipv4hint=93.184.216.34,93.184.216.35 ipv6hint=2606:2800:220:1:248:1893:25c8:1946 ech=AQID" {
+		t.Errorf("truncated parameter: %s", got)
+	}
+}
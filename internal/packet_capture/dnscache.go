@@ -0,0 +1,135 @@
+package packet_capture
+
+import (
+	"container/list"
+	"github.com/google/gopacket/layers"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS 地址-域名缓存
+// 按客户端记录 DNS 应答中 A/AAAA 地址对应的查询域名, 沿 CNAME 链回到客户端查询的名称;
+// 没有 SNI 或 HTTP Host 的流、TLS 与 HTTP 记录据此补充域名并识别应用.
+// 同一客户端的 DNS 与后续连接可能由不同 Worker 处理, 缓存由引擎持有并加锁访问
+
+const dnsCacheMinTTL = time.Minute * 5
+
+// domainKey 客户端与服务端地址
+type domainKey struct {
+	client, server [16]byte
+}
+
+func newDomainKey(client, server net.IP) domainKey {
+	var k domainKey
+	copy(k.client[:], client.To16())
+	copy(k.server[:], server.To16())
+	return k
+}
+
+type domainEntry struct {
+	key    domainKey
+	domain string
+	expire time.Time
+}
+
+// domainCache 容量有限, 满时淘汰最久未更新的记录; 为 nil 时不记录也不查询
+type domainCache struct {
+	mu      sync.Mutex
+	size    int
+	minTTL  time.Duration // 应用通常在 TTL 过期后继续使用已建立的连接与地址
+	entries map[domainKey]*list.Element
+	order   *list.List // 最近更新的在前
+}
+
+func newDomainCache(size int, minTTL time.Duration) *domainCache {
+	if size <= 0 {
+		return nil
+	}
+	return &domainCache{
+		size:    size,
+		minTTL:  minTTL,
+		entries: make(map[domainKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// learn 记录发往 client 的 DNS 应答中解析到的地址
+func (c *domainCache) learn(client net.IP, dns *layers.DNS, ts time.Time) {
+	if c == nil || !dns.QR || dns.ResponseCode != layers.DNSResponseCodeNoErr || len(dns.Questions) == 0 {
+		return
+	}
+	domain := dnsName(dns.Questions[0].Name)
+	if domain == "" {
+		return
+	}
+	// 查询名称及其 CNAME 链上的名称, 应答中的记录不一定按链的顺序排列
+	// 地址的有效期不超过链上任一 CNAME 的 TTL
+	names := map[string]bool{domain: true}
+	chainTTL := ^uint32(0)
+	for changed := true; changed; {
+		changed = false
+		for _, a := range dns.Answers {
+			if a.Type == layers.DNSTypeCNAME && names[dnsName(a.Name)] && !names[dnsName(a.CNAME)] {
+				names[dnsName(a.CNAME)] = true
+				if a.TTL < chainTTL {
+					chainTTL = a.TTL
+				}
+				changed = true
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range dns.Answers {
+		if (a.Type != layers.DNSTypeA && a.Type != layers.DNSTypeAAAA) || !names[dnsName(a.Name)] {
+			continue
+		}
+		ttl := time.Duration(a.TTL) * time.Second
+		if a.TTL > chainTTL {
+			ttl = time.Duration(chainTTL) * time.Second
+		}
+		if ttl < c.minTTL {
+			ttl = c.minTTL
+		}
+		c.add(newDomainKey(client, a.IP), domain, ts.Add(ttl))
+	}
+}
+
+func (c *domainCache) add(key domainKey, domain string, expire time.Time) {
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*domainEntry)
+		entry.domain, entry.expire = domain, expire
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		delete(c.entries, oldest.Value.(*domainEntry).key)
+		c.order.Remove(oldest)
+	}
+	c.entries[key] = c.order.PushFront(&domainEntry{key: key, domain: domain, expire: expire})
+}
+
+// lookup 返回 client 在 at 时刻最近解析到 server 的域名, 没有或已过期时返回空字符串
+func (c *domainCache) lookup(client, server net.IP, at time.Time) string {
+	if c == nil || client == nil || server == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[newDomainKey(client, server)]
+	if !ok {
+		return ""
+	}
+	entry := e.Value.(*domainEntry)
+	if at.After(entry.expire) {
+		return ""
+	}
+	return entry.domain
+}
+
+func dnsName(name []byte) string {
+	return strings.ToLower(strings.TrimSuffix(string(name), "."))
+}
@@ -0,0 +1,137 @@
+package packet_capture
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func dnsAnswer(name string, typ layers.DNSType, ttl uint32, value string) layers.DNSResourceRecord {
+	a := layers.DNSResourceRecord{Name: []byte(name), Type: typ, Class: layers.DNSClassIN, TTL: ttl}
+	if typ == layers.DNSTypeCNAME {
+		a.CNAME = []byte(value)
+	} else {
+		a.IP = net.ParseIP(value)
+	}
+	return a
+}
+
+func dnsResponse(name string, rcode layers.DNSResponseCode, answers ...layers.DNSResourceRecord) *layers.DNS {
+	return &layers.DNS{QR: true, ResponseCode: rcode, Answers: answers,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+}
+
+func TestDomainCacheLearn(t *testing.T) {
+	const client, other = "10.0.0.2", "10.0.0.3"
+	type lookup struct {
+		client, server string
+		after          time.Duration
+		want           string
+	}
+	for _, tt := range []struct {
+		name    string
+		minTTL  time.Duration
+		dns     *layers.DNS
+		lookups []lookup
+	}{
+		{"a", time.Second, dnsResponse("Example.COM.", layers.DNSResponseCodeNoErr,
+			dnsAnswer("example.com", layers.DNSTypeA, 300, "93.184.216.34")),
+			[]lookup{{client, "93.184.216.34", 0, "example.com"}, {client, "93.184.216.35", 0, ""}}},
+		{"aaaa", time.Second, dnsResponse("example.com", layers.DNSResponseCodeNoErr,
+			dnsAnswer("example.com", layers.DNSTypeAAAA, 300, "2606:2800:220:1::1")),
+			[]lookup{{client, "2606:2800:220:1::1", 0, "example.com"}}},
+		// 记录不按链的顺序排列, 不在链上的地址不记录
+		{"cname chain", time.Second, dnsResponse("www.example.com", layers.DNSResponseCodeNoErr,
+			dnsAnswer("edge.cdn.net", layers.DNSTypeA, 300, "198.51.100.1"),
+			dnsAnswer("cdn.example.net", layers.DNSTypeCNAME, 300, "edge.cdn.net"),
+			dnsAnswer("www.example.com", layers.DNSTypeCNAME, 300, "cdn.example.net"),
+			dnsAnswer("unrelated.net", layers.DNSTypeA, 300, "198.51.100.2")),
+			[]lookup{{client, "198.51.100.1", 0, "www.example.com"}, {client, "198.51.100.2", 0, ""}}},
+		// 有效期取链上最小的 TTL
+		{"chain ttl", time.Second, dnsResponse("www.example.com", layers.DNSResponseCodeNoErr,
+			dnsAnswer("www.example.com", layers.DNSTypeCNAME, 3600, "cdn.example.net"),
+			dnsAnswer("cdn.example.net", layers.DNSTypeCNAME, 60, "edge.cdn.net"),
+			dnsAnswer("edge.cdn.net", layers.DNSTypeA, 600, "198.51.100.1")),
+			[]lookup{{client, "198.51.100.1", time.Second * 60, "www.example.com"}, {client, "198.51.100.1", time.Second * 61, ""}}},
+		{"address ttl", time.Second, dnsResponse("www.example.com", layers.DNSResponseCodeNoErr,
+			dnsAnswer("www.example.com", layers.DNSTypeCNAME, 3600, "edge.cdn.net"),
+			dnsAnswer("edge.cdn.net", layers.DNSTypeA, 30, "198.51.100.1")),
+			[]lookup{{client, "198.51.100.1", time.Second * 30, "www.example.com"}, {client, "198.51.100.1", time.Second * 31, ""}}},
+		// TTL 小于最短保留时间时按最短保留时间计算
+		{"min ttl", time.Minute * 5, dnsResponse("example.com", layers.DNSResponseCodeNoErr,
+			dnsAnswer("example.com", layers.DNSTypeA, 10, "93.184.216.34")),
+			[]lookup{{client, "93.184.216.34", time.Minute * 5, "example.com"}, {client, "93.184.216.34", time.Minute*5 + time.Second, ""}}},
+		// 只有发起查询的客户端使用该记录
+		{"per client", time.Second, dnsResponse("example.com", layers.DNSResponseCodeNoErr,
+			dnsAnswer("example.com", layers.DNSTypeA, 300, "93.184.216.34")),
+			[]lookup{{other, "93.184.216.34", 0, ""}}},
+		{"nxdomain", time.Second, dnsResponse("example.com", layers.DNSResponseCodeNXDomain,
+			dnsAnswer("example.com", layers.DNSTypeA, 300, "93.184.216.34")),
+			[]lookup{{client, "93.184.216.34", 0, ""}}},
+		{"query", time.Second, &layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte("example.com")}},
+			Answers: []layers.DNSResourceRecord{dnsAnswer("example.com", layers.DNSTypeA, 300, "93.184.216.34")}},
+			[]lookup{{client, "93.184.216.34", 0, ""}}},
+	} {
+		c := newDomainCache(16, tt.minTTL)
+		c.learn(net.ParseIP(client), tt.dns, testStart)
+		for _, l := range tt.lookups {
+			if got := c.lookup(net.ParseIP(l.client), net.ParseIP(l.server), testStart.Add(l.after)); got != l.want {
+				t.Errorf("%s: lookup %s %s after %v = %q, want %q", tt.name, l.client, l.server, l.after, got, l.want)
+			}
+		}
+	}
+}
+
+func TestDomainCacheEviction(t *testing.T) {
+	c := newDomainCache(2, time.Minute)
+	client := net.ParseIP("10.0.0.2")
+	learn := func(name, ip string) {
+		c.learn(client, dnsResponse(name, layers.DNSResponseCodeNoErr, dnsAnswer(name, layers.DNSTypeA, 300, ip)), testStart)
+	}
+	learn("a.example", "192.0.2.1")
+	learn("b.example", "192.0.2.2")
+	// 更新 a 后 b 成为最久未更新的记录
+	learn("a2.example", "192.0.2.1")
+	learn("c.example", "192.0.2.3")
+	for ip, want := range map[string]string{"192.0.2.1": "a2.example", "192.0.2.2": "", "192.0.2.3": "c.example"} {
+		if got := c.lookup(client, net.ParseIP(ip), testStart); got != want {
+			t.Errorf("lookup %s = %q, want %q", ip, got, want)
+		}
+	}
+	if len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Errorf("%d entries, %d in order, want 2", len(c.entries), c.order.Len())
+	}
+
+	var disabled *domainCache
+	if newDomainCache(0, time.Minute) != nil {
+		t.Error("cache created with size 0")
+	}
+	disabled.learn(client, dnsResponse("a.example", layers.DNSResponseCodeNoErr), testStart)
+	if got := disabled.lookup(client, net.ParseIP("192.0.2.1"), testStart); got != "" {
+		t.Errorf("nil cache returned %q", got)
+	}
+}
+
+func TestDomainCacheMidStream(t *testing.T) {
+	// 没有握手的连接在记录过期后开始, 不应使用过期的域名
+	c := newTestCapture(t)
+	c.udp("10.0.0.53", "10.0.0.2", 53, 40000, testDNSMessage(t, "example.com", true))
+	c.ts = c.ts.Add(time.Hour)
+	c.tcp("10.0.0.2", "93.184.216.34", 40001, 80).send(true, []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")).close()
+	// 另一个客户端在记录有效期内的连接
+	c.udp("10.0.0.53", "10.0.0.3", 53, 40000, testDNSMessage(t, "example.com", true))
+	c.tcp("10.0.0.3", "93.184.216.34", 40002, 80).send(true, []byte("GET / HTTP/1.1\r\nHost: b\r\n\r\n")).close()
+
+	s := runCapture(t, Config{Dissectors: []string{"tcp", "dns"}, HTTP: true, Workers: 1, DNSCacheSize: 16}, c.file())
+	got := make(map[string]string)
+	for _, r := range s.kind(record.ProtocolHTTP) {
+		h := r.(*record.Http)
+		got[h.Host] = h.DNSDomain
+	}
+	if want := map[string]string{"a": "", "b": "example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dns domains %v, want %v", got, want)
+	}
+}
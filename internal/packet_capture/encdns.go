@@ -0,0 +1,178 @@
+package packet_capture
+
+import (
+	"fmt"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/fingerprint"
+	"net"
+	"strings"
+)
+
+// 加密 DNS 识别
+// DoT: 服务端端口 853 或 ALPN 为 dot; DoH: SNI 或服务端地址在解析器列表中,
+// 或开启 DoHShape 后 h2 连接的前若干个应用数据记录在两个方向都较小, 与 DNS 查询应答的形态一致.
+// 本单位的解析器不标记
+
+const (
+	dotPort               = 853
+	dohPort               = 443
+	encDNSMinRecords      = 8    // 形态识别要求每个方向至少有该数量的应用数据记录
+	encDNSMaxClientRecord = 1024 // 客户端应用数据记录的长度上限
+	encDNSMaxServerRecord = 2048 // 服务端应用数据记录的长度上限
+	tlsShapeMaxRecords    = 64   // 每个方向统计的应用数据记录数量
+)
+
+// 识别依据, 写入 TLS 记录的 EncryptedDNSBy
+const (
+	encDNSByPort  = "port"
+	encDNSByALPN  = "alpn"
+	encDNSBySNI   = "sni"
+	encDNSByIP    = "ip"
+	encDNSByShape = "shape"
+)
+
+// resolverList 解析器的域名、地址与网段, 域名同时匹配其子域名
+type resolverList struct {
+	names []string
+	nets  []*net.IPNet
+}
+
+func newResolverList(entries []string) (*resolverList, error) {
+	l := &resolverList{}
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if strings.Contains(e, "/") {
+			_, n, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, fmt.Errorf("resolver %q: %w", e, err)
+			}
+			l.nets = append(l.nets, n)
+		} else if ip := net.ParseIP(e); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			l.nets = append(l.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			l.names = append(l.names, strings.TrimSuffix(e, "."))
+		}
+	}
+	return l, nil
+}
+
+func (l *resolverList) matchName(host string) bool {
+	if l == nil || host == "" {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, name := range l.names {
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *resolverList) matchIP(ip net.IP) bool {
+	if l == nil || ip == nil {
+		return false
+	}
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptedDNS 按端口、ALPN、SNI 与服务端地址识别加密 DNS, 返回 dot 或 doh 与识别依据; hello 可为空
+func (e *Engine) encryptedDNS(hello *fingerprint.ClientHello, server net.IP, port uint16) (string, string) {
+	var sni string
+	if hello != nil {
+		sni = hello.ServerName
+	}
+	if e.isLocalResolver(server, sni) {
+		return "", ""
+	}
+	switch {
+	case port == dotPort:
+		return protoDoT, encDNSByPort
+	case hello != nil && hasString(hello.ALPN, "dot"):
+		return protoDoT, encDNSByALPN
+	case e.resolvers.matchName(sni):
+		return protoDoH, encDNSBySNI
+	case port == dohPort && e.resolvers.matchIP(server):
+		return protoDoH, encDNSByIP
+	}
+	return "", ""
+}
+
+// isLocalResolver 服务端是否为本单位的解析器
+func (e *Engine) isLocalResolver(server net.IP, sni string) bool {
+	return e.localResolvers.matchIP(server) || e.localResolvers.matchName(sni)
+}
+
+// tlsRecordShape 统计一个方向的 TLS 应用数据记录数量与最大长度
+type tlsRecordShape struct {
+	header  []byte // 未读完的记录头
+	remain  int    // 当前记录未读完的长度
+	records int
+	max     int
+	stopped bool
+}
+
+// feed 按记录头跳过数据, count 为 false 时只跟踪记录边界
+func (s *tlsRecordShape) feed(data []byte, count bool) {
+	for len(data) > 0 && !s.stopped && s.records < tlsShapeMaxRecords {
+		if s.remain > 0 {
+			n := s.remain
+			if n > len(data) {
+				n = len(data)
+			}
+			s.remain -= n
+			data = data[n:]
+			continue
+		}
+		need := 5 - len(s.header)
+		if need > len(data) {
+			s.header = append(s.header, data...)
+			return
+		}
+		s.header = append(s.header, data[:need]...)
+		data = data[need:]
+		if !isTLSRecord(s.header) {
+			s.stop()
+			return
+		}
+		s.remain = int(s.header[3])<<8 | int(s.header[4])
+		if s.header[0] == 0x17 && count {
+			s.records++
+			if s.remain > s.max {
+				s.max = s.remain
+			}
+		}
+		s.header = s.header[:0]
+	}
+}
+
+func (s *tlsRecordShape) stop() {
+	s.stopped, s.header = true, nil
+}
+
+// dohShape h2 连接两个方向的应用数据记录都较小, 与 DoH 的查询应答一致
+func dohShape(hello *fingerprint.ClientHello, client, server *tlsRecordShape) bool {
+	return hello != nil && hasString(hello.ALPN, "h2") &&
+		client.records >= encDNSMinRecords && server.records >= encDNSMinRecords &&
+		client.max <= encDNSMaxClientRecord && server.max <= encDNSMaxServerRecord
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
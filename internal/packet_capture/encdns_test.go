@@ -0,0 +1,143 @@
+package packet_capture
+
+import (
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/fingerprint"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestResolverList(t *testing.T) {
+	l, err := newResolverList([]string{" DNS.Google. ", "", "198.51.100.53", "203.0.113.0/24", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		host string
+		want bool
+	}{
+		{"dns.google", true},
+		{"DNS.GOOGLE.", true},
+		{"a.dns.google", true},
+		{"xdns.google", false},
+		{"google", false},
+		{"", false},
+	} {
+		if got := l.matchName(tt.host); got != tt.want {
+			t.Errorf("matchName(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"198.51.100.53", true},
+		{"::ffff:198.51.100.53", true},
+		{"198.51.100.54", false},
+		{"203.0.113.200", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	} {
+		if got := l.matchIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("matchIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	var disabled *resolverList
+	if disabled.matchName("dns.google") || disabled.matchIP(net.ParseIP("198.51.100.53")) {
+		t.Error("nil list matched")
+	}
+
+	if _, err = newResolverList([]string{"dns.google", "203.0.113.0/33"}); err == nil || !strings.Contains(err.Error(), "203.0.113.0/33") {
+		t.Errorf("bad network: error %v", err)
+	}
+}
+
+func TestEncryptedDNS(t *testing.T) {
+	resolvers, err := newResolverList([]string{"dns.google", "198.51.100.53", "203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := newResolverList([]string{"dns.corp.example", "10.0.0.53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Engine{resolvers: resolvers, localResolvers: local}
+	hello := func(sni string, alpn ...string) *fingerprint.ClientHello {
+		return &fingerprint.ClientHello{ServerName: sni, ALPN: alpn}
+	}
+	for _, tt := range []struct {
+		name   string
+		hello  *fingerprint.ClientHello
+		server string
+		port   uint16
+		want   string
+		by     string
+	}{
+		{"dot port", hello("example.com"), "192.0.2.1", 853, protoDoT, encDNSByPort},
+		{"dot port without hello", nil, "192.0.2.1", 853, protoDoT, encDNSByPort},
+		{"dot alpn", hello("example.com", "dot"), "192.0.2.1", 443, protoDoT, encDNSByALPN},
+		{"sni", hello("dns.google", "h2"), "192.0.2.1", 443, protoDoH, encDNSBySNI},
+		{"sni subdomain", hello("doh.dns.google", "h2"), "192.0.2.1", 8443, protoDoH, encDNSBySNI},
+		{"sni trailing dot", hello("DNS.Google.", "h2"), "192.0.2.1", 443, protoDoH, encDNSBySNI},
+		{"sni suffix only", hello("notdns.google", "h2"), "192.0.2.1", 443, "", ""},
+		{"ip", hello("example.com", "h2"), "198.51.100.53", 443, protoDoH, encDNSByIP},
+		{"network", hello("", "h2"), "203.0.113.9", 443, protoDoH, encDNSByIP},
+		{"ip without hello", nil, "198.51.100.53", 443, protoDoH, encDNSByIP},
+		// 地址只在 443 端口上识别
+		{"ip other port", hello("example.com", "h2"), "198.51.100.53", 8443, "", ""},
+		{"ip other port without hello", nil, "198.51.100.53", 80, "", ""},
+		{"plain https", hello("example.com", "h2"), "192.0.2.1", 443, "", ""},
+		{"no hello", nil, "192.0.2.1", 443, "", ""},
+		// 本单位的解析器不标记
+		{"local ip", hello("dns.google"), "10.0.0.53", 853, "", ""},
+		{"local ip without hello", nil, "10.0.0.53", 853, "", ""},
+		{"local sni", hello("a.dns.corp.example", "dot"), "192.0.2.1", 853, "", ""},
+	} {
+		if got, by := e.encryptedDNS(tt.hello, net.ParseIP(tt.server), tt.port); got != tt.want || by != tt.by {
+			t.Errorf("%s: got %q by %q, want %q by %q", tt.name, got, by, tt.want, tt.by)
+		}
+	}
+}
+
+func TestEncryptedDNSWithoutClientHello(t *testing.T) {
+	// 抓包从握手之后开始, 只看到服务端的 TLS 记录, 按端口与地址识别
+	c := newTestCapture(t)
+	conn := c.tcp("10.0.0.2", "192.0.2.1", 40000, 853)
+	conn.send(false, testServerHello())
+	conn.close()
+	conn = c.tcp("10.0.0.2", "198.51.100.53", 40001, 443)
+	conn.send(false, testServerHello())
+	conn.close()
+	conn = c.tcp("10.0.0.2", "192.0.2.2", 40002, 443)
+	conn.send(false, testServerHello())
+	conn.close()
+
+	s := runCapture(t, Config{Dissectors: []string{"flow", "tcp"}, Workers: 1, DNSResolvers: []string{"198.51.100.53"}}, c.file())
+	want := map[string][2]string{
+		"192.0.2.1":     {protoDoT, encDNSByPort},
+		"198.51.100.53": {protoDoH, encDNSByIP},
+		"192.0.2.2":     {"", ""},
+	}
+	tlss := s.kind(record.ProtocolHTTPS)
+	if len(tlss) != len(want) {
+		t.Fatalf("got %d tls records, want %d", len(tlss), len(want))
+	}
+	for _, r := range tlss {
+		r := r.(*record.Tls)
+		if w := want[r.DstIP.String()]; r.EncryptedDNS != w[0] || r.EncryptedDNSBy != w[1] {
+			t.Errorf("%s: encrypted dns %q by %q, want %q by %q", r.DstIP, r.EncryptedDNS, r.EncryptedDNSBy, w[0], w[1])
+		}
+	}
+	for _, r := range s.kind(record.ProtocolFlow) {
+		// 流的方向按第一个报文确定, 服务端为非 10.0.0.2 的一端
+		f := r.(*record.Flow)
+		server := f.SrcIP
+		if f.SrcIPStr == "10.0.0.2" {
+			server = f.DstIP
+		}
+		if w := want[server.String()]; w[0] != "" && f.AppProto != w[0] {
+			t.Errorf("%s: flow app %q, want %q", server, f.AppProto, w[0])
+		}
+	}
+}
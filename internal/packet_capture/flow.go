@@ -0,0 +1,383 @@
+package packet_capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+// 双向流统计
+// 按 5 元组跟踪 TCP/UDP/ICMP 流, 统计双向包数与字节数,
+// 在空闲超时、FIN/RST 或活动超时时输出 record.Flow
+
+const (
+	flowIdleTimeout   = time.Minute * 2
+	flowActiveTimeout = time.Minute * 30
+	flowCloseGrace    = time.Second * 5 // FIN/RST 后等待尾部 ACK 的时间
+	flowSweepInterval = time.Second
+)
+
+// 流结束原因
+const (
+	FlowEndIdle   = "idle"
+	FlowEndActive = "active"
+	FlowEndFin    = "fin"
+	FlowEndRst    = "rst"
+	FlowEndForced = "end"
+)
+
+func init() {
+	Register("flow", 15, func(w *Worker) Dissector {
+		w.flows = &flowTable{
+			worker: w,
+			flows:  make(map[flowKey]*flowEntry),
+			byID:   make(map[string]*flowEntry),
+			idle:   w.engine.config.FlowIdleTimeout,
+			active: w.engine.config.FlowActiveTimeout,
+		}
+		return w.flows
+	})
+}
+
+// flowKey 规范化的 5 元组, 两个方向的数据包得到同一个 key
+type flowKey struct {
+	proto        layers.IPProtocol
+	a, b         [16]byte
+	aPort, bPort uint16
+}
+
+// newFlowKey 返回规范化 key, forward 表示 src 是否为 key 的 a 端
+func newFlowKey(proto layers.IPProtocol, src, dst net.IP, srcPort, dstPort uint16) (k flowKey, forward bool) {
+	var s, d [16]byte
+	copy(s[:], src.To16())
+	copy(d[:], dst.To16())
+	k.proto = proto
+	if c := compareEndpoint(s, srcPort, d, dstPort); c <= 0 {
+		k.a, k.aPort, k.b, k.bPort = s, srcPort, d, dstPort
+		return k, true
+	}
+	k.a, k.aPort, k.b, k.bPort = d, dstPort, s, srcPort
+	return k, false
+}
+
+func compareEndpoint(a [16]byte, aPort uint16, b [16]byte, bPort uint16) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return int(a[i]) - int(b[i])
+		}
+	}
+	return int(aPort) - int(bPort)
+}
+
+type flowEntry struct {
+	id         string
+	proto      layers.IPProtocol
+	clientIP   net.IP
+	serverIP   net.IP
+	clientPort uint16
+	serverPort uint16
+	clientIsA  bool
+
+	firstSeen   time.Time
+	lastSeen    time.Time
+	upPackets   int
+	downPackets int
+	upBytes     int
+	downBytes   int
+	tcpFlags    uint8
+	finUp       bool
+	finDown     bool
+	closing     string // FIN/RST 后的结束原因
+	sni         string
+	httpHost    string
+	appProto    string
+}
+
+// flowTable 流表, 捕获 goroutine 与 HTTP/TLS 读取 goroutine 并发访问
+type flowTable struct {
+	worker    *Worker
+	mu        sync.Mutex
+	flows     map[flowKey]*flowEntry
+	byID      map[string]*flowEntry
+	idle      time.Duration
+	active    time.Duration
+	lastSweep time.Time
+}
+
+func (t *flowTable) Name() string {
+	return "flow"
+}
+
+// Dissect 更新数据包所属的流, 并将流 ID 写入 p.FlowID
+func (t *flowTable) Dissect(p *Packet) bool {
+	var proto layers.IPProtocol
+	var length int
+	switch ip := p.NetworkLayer().(type) {
+	case *layers.IPv4:
+		proto, length = ip.Protocol, int(ip.Length)
+	case *layers.IPv6:
+		proto, length = ip.NextHeader, int(ip.Length)+40
+	default:
+		return true
+	}
+	var srcPort, dstPort uint16
+	var flags uint8
+	switch l4 := p.TransportLayer().(type) {
+	case *layers.TCP:
+		proto = layers.IPProtocolTCP
+		srcPort, dstPort = uint16(l4.SrcPort), uint16(l4.DstPort)
+		flags = tcpFlags(l4)
+	case *layers.UDP:
+		proto = layers.IPProtocolUDP
+		srcPort, dstPort = uint16(l4.SrcPort), uint16(l4.DstPort)
+	default:
+		if icmp, ok := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+			proto = layers.IPProtocolICMPv4
+			dstPort = uint16(icmp.TypeCode)
+		} else if icmp6, ok := p.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+			proto = layers.IPProtocolICMPv6
+			dstPort = uint16(icmp6.TypeCode)
+		}
+	}
+	now := p.Metadata().Timestamp
+	key, forward := newFlowKey(proto, p.SrcIP, p.DstIP, srcPort, dstPort)
+	if proto == layers.IPProtocolICMPv4 || proto == layers.IPProtocolICMPv6 {
+		// ICMP 请求与应答的类型不同, 只按地址对归并
+		key.aPort, key.bPort = 0, 0
+	}
+
+	var done []*record.Flow
+	t.mu.Lock()
+	f, ok := t.flows[key]
+	if ok && f.closing != "" && flags&tcpFlagSYN != 0 && flags&tcpFlagACK == 0 {
+		// 端口复用, 新连接
+		done = append(done, t.expire(key, f, f.closing))
+		ok = false
+	}
+	if !ok {
+		f = t.newEntry(key, forward, proto, p, srcPort, dstPort, flags, now)
+	}
+	up := forward == f.clientIsA
+	f.lastSeen = now
+	f.tcpFlags |= flags
+	if up {
+		f.upPackets++
+		f.upBytes += length
+	} else {
+		f.downPackets++
+		f.downBytes += length
+	}
+	if flags&tcpFlagRST != 0 {
+		f.closing = FlowEndRst
+	} else if flags&tcpFlagFIN != 0 {
+		if up {
+			f.finUp = true
+		} else {
+			f.finDown = true
+		}
+		if f.finUp && f.finDown {
+			f.closing = FlowEndFin
+		}
+	}
+	if now.Sub(f.firstSeen) >= t.active {
+		done = append(done, t.export(f, FlowEndActive, now))
+	}
+	p.FlowID = f.id
+	sweep := now.Sub(t.lastSweep) >= flowSweepInterval
+	t.mu.Unlock()
+	t.emit(done)
+
+	if sweep {
+		t.Flush(now)
+	}
+	return true
+}
+
+func (t *flowTable) newEntry(key flowKey, forward bool, proto layers.IPProtocol, p *Packet, srcPort, dstPort uint16, flags uint8, now time.Time) *flowEntry {
+	f := &flowEntry{
+		proto:      proto,
+		clientIP:   p.SrcIP,
+		serverIP:   p.DstIP,
+		clientPort: srcPort,
+		serverPort: dstPort,
+		clientIsA:  forward,
+		firstSeen:  now,
+	}
+	// 首个数据包是服务端发出的 (SYN-ACK 或知名端口的应答), 交换方向
+	reverse := flags&tcpFlagSYN != 0 && flags&tcpFlagACK != 0
+	if proto == layers.IPProtocolUDP && srcPort < 1024 && dstPort >= 1024 {
+		reverse = true
+	}
+	if reverse {
+		f.clientIP, f.serverIP = p.DstIP, p.SrcIP
+		f.clientPort, f.serverPort = dstPort, srcPort
+		f.clientIsA = !forward
+	}
+	if proto == layers.IPProtocolICMPv4 || proto == layers.IPProtocolICMPv6 {
+		f.clientPort, f.serverPort = 0, dstPort
+	}
+	f.id = flowID(key, now)
+	t.flows[key] = f
+	t.byID[f.id] = f
+	return f
+}
+
+// flowID 由 5 元组与首包时间生成
+func flowID(key flowKey, first time.Time) string {
+	h := fnv.New64a()
+	var buf [8]byte
+	h.Write([]byte{byte(key.proto)})
+	h.Write(key.a[:])
+	h.Write(key.b[:])
+	binary.BigEndian.PutUint16(buf[:2], key.aPort)
+	binary.BigEndian.PutUint16(buf[2:4], key.bPort)
+	h.Write(buf[:4])
+	binary.BigEndian.PutUint64(buf[:], uint64(first.UnixNano()))
+	h.Write(buf[:])
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Flush 输出超时与已结束的流
+func (t *flowTable) Flush(now time.Time) {
+	var done []*record.Flow
+	t.mu.Lock()
+	t.lastSweep = now
+	for key, f := range t.flows {
+		if f.closing != "" && now.Sub(f.lastSeen) >= flowCloseGrace {
+			done = append(done, t.expire(key, f, f.closing))
+		} else if now.Sub(f.lastSeen) >= t.idle {
+			done = append(done, t.expire(key, f, FlowEndIdle))
+		}
+	}
+	t.mu.Unlock()
+	t.emit(done)
+}
+
+// Close 输出所有未结束的流
+func (t *flowTable) Close() {
+	var done []*record.Flow
+	t.mu.Lock()
+	for key, f := range t.flows {
+		reason := f.closing
+		if reason == "" {
+			reason = FlowEndForced
+		}
+		done = append(done, t.expire(key, f, reason))
+	}
+	t.mu.Unlock()
+	t.emit(done)
+}
+
+// emit 在释放锁后输出记录, 输出会经过 sink 与分析器, 不能阻塞流表
+func (t *flowTable) emit(done []*record.Flow) {
+	for _, r := range done {
+		t.worker.Emit(r)
+	}
+}
+
+// setSNI 记录流的 TLS Server Name, 流表未启用时忽略
+func (t *flowTable) setSNI(id, sni string) {
+	t.update(id, sni, func(f *flowEntry) { f.sni = sni })
+}
+
+// setHTTPHost 记录流的 HTTP Host, 流表未启用时忽略
+func (t *flowTable) setHTTPHost(id, host string) {
+	t.update(id, host, func(f *flowEntry) { f.httpHost = host })
+}
+
+// setAppProto 记录按载荷识别的应用层协议, 流表未启用时忽略
+func (t *flowTable) setAppProto(id, proto string) {
+	t.update(id, proto, func(f *flowEntry) { f.appProto = proto })
+}
+
+func (t *flowTable) update(id, value string, set func(f *flowEntry)) {
+	if t == nil || id == "" || value == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.byID[id]; ok {
+		set(f)
+	}
+}
+
+// expire 删除流并返回其记录, 调用方持有锁
+func (t *flowTable) expire(key flowKey, f *flowEntry, reason string) *record.Flow {
+	delete(t.flows, key)
+	delete(t.byID, f.id)
+	return t.export(f, reason, f.lastSeen)
+}
+
+// export 返回流统计, 活动超时后计数与 TCP 标志清零继续统计; 调用方持有锁
+func (t *flowTable) export(f *flowEntry, reason string, end time.Time) *record.Flow {
+	host := f.sni
+	if host == "" {
+		host = f.httpHost
+	}
+	r := &record.Flow{
+		FlowID:      f.id,
+		Proto:       protoName(f.proto),
+		SrcIP:       f.clientIP,
+		DstIP:       f.serverIP,
+		SrcPort:     f.clientPort,
+		DstPort:     f.serverPort,
+		StartTime:   f.firstSeen,
+		EndTime:     end,
+		UpPackets:   f.upPackets,
+		DownPackets: f.downPackets,
+		UpBytes:     f.upBytes,
+		DownBytes:   f.downBytes,
+		TCPFlags:    f.tcpFlags,
+		Reason:      reason,
+		Host:        host,
+		SNI:         f.sni,
+		HTTPHost:    f.httpHost,
+		AppProto:    f.appProto,
+		DNSDomain:   t.worker.engine.domains.lookup(f.clientIP, f.serverIP, f.firstSeen),
+	}
+	f.firstSeen = end
+	f.upPackets, f.downPackets, f.upBytes, f.downBytes = 0, 0, 0, 0
+	f.tcpFlags = 0
+	return r
+}
+
+func protoName(proto layers.IPProtocol) string {
+	switch proto {
+	case layers.IPProtocolTCP:
+		return "tcp"
+	case layers.IPProtocolUDP:
+		return "udp"
+	case layers.IPProtocolICMPv4:
+		return "icmp"
+	case layers.IPProtocolICMPv6:
+		return "icmpv6"
+	}
+	return fmt.Sprintf("%d", uint8(proto))
+}
+
+// TCP 标志位, 与 IPFIX tcpControlBits 一致
+const (
+	tcpFlagFIN = 1 << iota
+	tcpFlagSYN
+	tcpFlagRST
+	tcpFlagPSH
+	tcpFlagACK
+	tcpFlagURG
+	tcpFlagECE
+	tcpFlagCWR
+)
+
+func tcpFlags(tcp *layers.TCP) uint8 {
+	var f uint8
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			f |= 1 << i
+		}
+	}
+	return f
+}
@@ -0,0 +1,71 @@
+package packet_capture
+
+import (
+	"context"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"testing"
+	"time"
+)
+
+// lockCheckSink 记录输出流记录时流表锁是否被持有
+type lockCheckSink struct {
+	testSink
+	table  *flowTable
+	locked int
+}
+
+func (s *lockCheckSink) Write(r record.Protocol) error {
+	if _, ok := r.(*record.Flow); ok && s.table != nil {
+		if s.table.mu.TryLock() {
+			s.table.mu.Unlock()
+		} else {
+			s.locked++
+		}
+	}
+	return s.testSink.Write(r)
+}
+
+func TestFlowActiveTimeout(t *testing.T) {
+	c := newTestCapture(t)
+	conn := c.tcp("10.0.0.2", "93.184.216.34", 40001, 80).handshake()
+	for i := 0; i < 10; i++ {
+		conn.send(true, []byte("ping"))
+	}
+	path := c.file()
+
+	s := &lockCheckSink{}
+	e, err := New(Config{OfflineFiles: []string{path}, Dissectors: []string{"flow"}, Workers: 1,
+		FlowActiveTimeout: time.Millisecond * 25, Sink: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.table = e.workers[0].flows
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err = e.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if s.locked != 0 {
+		t.Errorf("%d flow records emitted while holding the flow table lock", s.locked)
+	}
+
+	flows := s.kind(record.ProtocolFlow)
+	if len(flows) < 2 {
+		t.Fatalf("got %d flow records, want active timeout exports", len(flows))
+	}
+	first, last := flows[0].(*record.Flow), flows[len(flows)-1].(*record.Flow)
+	if first.Reason != FlowEndActive || first.TCPFlags&tcpFlagSYN == 0 {
+		t.Errorf("first export %+v, want active with SYN", first)
+	}
+	if last.TCPFlags&tcpFlagSYN != 0 {
+		t.Errorf("last export flags %#x still carry the SYN from the first interval", last.TCPFlags)
+	}
+	var packets int
+	for _, r := range flows {
+		f := r.(*record.Flow)
+		packets += f.UpPackets + f.DownPackets
+	}
+	if packets != 13 {
+		t.Errorf("exported %d packets in total, want 13", packets)
+	}
+}
@@ -48,6 +48,7 @@ func (h *httpReader) run(wg *sync.WaitGroup) {
 				continue
 			}
 			httpBson := &record.Http{
+				FlowID:        h.parent.flowID,
 				Ident:         h.ident,
 				SrcIP:         h.parent.src,
 				DstIP:         h.parent.dst,
@@ -61,8 +62,11 @@ func (h *httpReader) run(wg *sync.WaitGroup) {
 				ContentLength: req.Header.Get("Content-Length"),
 				UserAgent:     req.UserAgent(),
 				Delay:         h.parent.delay,
+				DNSDomain:     h.parent.worker.engine.domains.lookup(h.parent.src, h.parent.dst, h.parent.domainTime()),
+				Timestamp:     h.parent.startTime,
 			}
-			httpBson.Save2Mongo()
+			h.parent.worker.Emit(httpBson)
+			h.parent.worker.flows.setHTTPHost(h.parent.flowID, req.Host)
 			body, err := io.ReadAll(req.Body)
 			s := len(body)
 			if err != nil {
@@ -3,6 +3,7 @@ package packet_capture
 import (
 	"fmt"
 	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
 	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
 	"net"
 	"sync"
@@ -68,7 +69,42 @@ var (
 	}
 )
 
+func init() {
+	Register("icmp", 50, func(w *Worker) Dissector {
+		return &icmpDissector{worker: w}
+	})
+}
+
+type icmpDissector struct {
+	worker *Worker
+}
+
+func (d *icmpDissector) Name() string {
+	return "icmp"
+}
+
+func (d *icmpDissector) Dissect(p *Packet) bool {
+	icmpLayer := p.Layer(layers.LayerTypeICMPv4)
+	if icmpLayer == nil {
+		return true
+	}
+	icmp := &IcmpReader{
+		worker: d.worker,
+		flowID: p.FlowID,
+		srcIP:  p.SrcIP,
+		dstIP:  p.DstIP,
+		ttl:    p.TTL,
+		time:   p.Metadata().Timestamp,
+		layers: icmpLayer.(*layers.ICMPv4),
+	}
+	configs.Log.Debugf(icmp.description)
+	//icmp.run()
+	return true
+}
+
 type IcmpReader struct {
+	worker      *Worker
+	flowID      string
 	srcIP       net.IP
 	dstIP       net.IP
 	ttl         uint8
@@ -97,6 +133,7 @@ func (i *IcmpReader) run() {
 		IcmpMap.LoadOrStore(req, i.time)
 	}
 	icmp := &record.Icmp{
+		FlowID:      i.flowID,
 		Ident:       req,
 		SrcIP:       i.srcIP,
 		DstIP:       i.dstIP,
@@ -107,6 +144,7 @@ func (i *IcmpReader) run() {
 		TTL:         i.ttl,
 		Description: i.description,
 		Delay:       i.delay,
+		Timestamp:   i.time,
 	}
-	icmp.Save2Mongo()
+	i.worker.Emit(icmp)
 }
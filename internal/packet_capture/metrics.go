@@ -0,0 +1,98 @@
+package packet_capture
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/metrics"
+	"strconv"
+	"sync/atomic"
+)
+
+// 引擎指标
+// Engine 实现 prometheus.Collector, 解析器统计来自 Worker 每秒发布的副本
+
+type statsMetric struct {
+	desc  *prometheus.Desc
+	typ   prometheus.ValueType
+	value func(s *stats) int
+}
+
+var statsMetrics = []statsMetric{
+	{metrics.Desc("capture", "defragmented_packets_total", "IPv4 packets reassembled from fragments."), prometheus.CounterValue, func(s *stats) int { return s.ipdefrag }},
+	{metrics.Desc("reassembly", "payload_bytes_total", "TCP payload bytes handed to the assembler."), prometheus.CounterValue, func(s *stats) int { return s.totalsz }},
+	{metrics.Desc("reassembly", "reassembled_bytes_total", "TCP bytes delivered in order to streams."), prometheus.CounterValue, func(s *stats) int { return s.sz }},
+	{metrics.Desc("reassembly", "packets_total", "TCP packets delivered to streams."), prometheus.CounterValue, func(s *stats) int { return s.pkt }},
+	{metrics.Desc("reassembly", "missed_bytes_total", "TCP bytes skipped because they were never captured."), prometheus.CounterValue, func(s *stats) int { return s.missedBytes }},
+	{metrics.Desc("reassembly", "rejected_fsm_connections_total", "TCP connections with packets rejected by the state machine."), prometheus.CounterValue, func(s *stats) int { return s.rejectConnFsm }},
+	{metrics.Desc("reassembly", "bad_checksum_packets_total", "TCP packets with an invalid checksum, rejected or not."), prometheus.CounterValue, func(s *stats) int { return s.badChecksum }},
+	{metrics.Desc("reassembly", "reassembled_chunks_total", "Deliveries assembled from more than one chunk."), prometheus.CounterValue, func(s *stats) int { return s.reassembled }},
+	{metrics.Desc("reassembly", "out_of_order_packets_total", "TCP packets queued out of order."), prometheus.CounterValue, func(s *stats) int { return s.outOfOrderPackets }},
+	{metrics.Desc("reassembly", "out_of_order_bytes_total", "TCP bytes queued out of order."), prometheus.CounterValue, func(s *stats) int { return s.outOfOrderBytes }},
+	{metrics.Desc("reassembly", "overlap_packets_total", "TCP packets overlapping already received data."), prometheus.CounterValue, func(s *stats) int { return s.overlapPackets }},
+	{metrics.Desc("reassembly", "overlap_bytes_total", "TCP bytes overlapping already received data."), prometheus.CounterValue, func(s *stats) int { return s.overlapBytes }},
+	{metrics.Desc("reassembly", "biggest_chunk_bytes", "Largest single delivery in bytes."), prometheus.GaugeValue, func(s *stats) int { return s.biggestChunkBytes }},
+	{metrics.Desc("reassembly", "biggest_chunk_packets", "Largest single delivery in packets."), prometheus.GaugeValue, func(s *stats) int { return s.biggestChunkPackets }},
+	{metrics.Desc("reassembly", "buffer_limit_hits_total", "Times the buffered page limit forced data to be skipped."), prometheus.CounterValue, func(s *stats) int { return s.bufferLimitHits }},
+	{metrics.Desc("reassembly", "evicted_connections_total", "TCP connections closed because the connection limit was reached."), prometheus.CounterValue, func(s *stats) int { return s.evictedConns }},
+	{metrics.Desc("reassembly", "open_connections", "TCP connections currently being reassembled."), prometheus.GaugeValue, func(s *stats) int { return s.openConns }},
+}
+
+var (
+	packetsDesc    = metrics.Desc("capture", "packets_total", "Packets read from the capture source.")
+	receivedDesc   = metrics.Desc("capture", "source_received_packets_total", "Packets received by the capture source.")
+	droppedDesc    = metrics.Desc("capture", "source_dropped_packets_total", "Packets dropped by the kernel or libpcap because buffers were full.")
+	ifDroppedDesc  = metrics.Desc("capture", "source_if_dropped_packets_total", "Packets dropped by the network interface or driver.")
+	queueDesc      = metrics.Desc("capture", "worker_queue_length", "Packets waiting in a worker queue.", "worker")
+	queueLimitDesc = metrics.Desc("capture", "worker_queue_capacity", "Capacity of each worker queue.")
+	rejectedDesc   = metrics.Desc("reassembly", "rejected_packets_total", "TCP packets failing a reassembly check, by reason. Only checksum failures are dropped.", "reason")
+	sessionsDesc   = metrics.Desc("radius", "sessions", "RADIUS accounting sessions mapping addresses to users.")
+)
+
+func newRecordCounter(name, help string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dissector",
+		Name:      name,
+		Help:      help,
+	}, []string{"kind"})
+}
+
+func (e *Engine) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range statsMetrics {
+		ch <- m.desc
+	}
+	ch <- packetsDesc
+	ch <- receivedDesc
+	ch <- droppedDesc
+	ch <- ifDroppedDesc
+	ch <- queueDesc
+	ch <- queueLimitDesc
+	ch <- rejectedDesc
+	ch <- sessionsDesc
+	e.records.Describe(ch)
+	e.errors.Describe(ch)
+}
+
+func (e *Engine) Collect(ch chan<- prometheus.Metric) {
+	s := e.stats()
+	for _, m := range statsMetrics {
+		ch <- prometheus.MustNewConstMetric(m.desc, m.typ, float64(m.value(&s)))
+	}
+	ch <- prometheus.MustNewConstMetric(rejectedDesc, prometheus.CounterValue, float64(s.rejectFsm), "fsm")
+	ch <- prometheus.MustNewConstMetric(rejectedDesc, prometheus.CounterValue, float64(s.rejectOpt), "options")
+	ch <- prometheus.MustNewConstMetric(rejectedDesc, prometheus.CounterValue, float64(s.rejectChecksum), "checksum")
+	ch <- prometheus.MustNewConstMetric(packetsDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&e.packets)))
+	if ss, ok := e.sourceStats(); ok {
+		ch <- prometheus.MustNewConstMetric(receivedDesc, prometheus.CounterValue, float64(ss.Received))
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(ss.Dropped))
+		ch <- prometheus.MustNewConstMetric(ifDroppedDesc, prometheus.CounterValue, float64(ss.IfDropped))
+	}
+	for _, w := range e.workers {
+		ch <- prometheus.MustNewConstMetric(queueDesc, prometheus.GaugeValue, float64(len(w.queue)), strconv.Itoa(w.id))
+	}
+	ch <- prometheus.MustNewConstMetric(queueLimitDesc, prometheus.GaugeValue, workerQueueSize)
+	if e.sessions != nil {
+		ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(e.sessions.len()))
+	}
+	e.records.Collect(ch)
+	e.errors.Collect(ch)
+}
@@ -0,0 +1,117 @@
+package packet_capture
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/sink"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingSink 拒绝 kind 类型的记录
+type failingSink struct {
+	testSink
+	kind string
+}
+
+func (s *failingSink) Write(r record.Protocol) error {
+	if r.Kind() == s.kind {
+		return errors.New("rejected")
+	}
+	return s.testSink.Write(r)
+}
+
+// gatherValues 按 "指标名{标签值,...}" 返回全部序列的值
+func gatherValues(t *testing.T, cs ...prometheus.Collector) map[string]float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(cs...)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetValue())
+			}
+			v := m.GetGauge().GetValue()
+			if m.Counter != nil {
+				v = m.GetCounter().GetValue()
+			}
+			values[f.GetName()+"{"+strings.Join(labels, ",")+"}"] = v
+		}
+	}
+	return values
+}
+
+// runEngine 运行引擎处理离线文件后返回, 用于读取指标
+func runEngine(t *testing.T, config Config) *Engine {
+	t.Helper()
+	e, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err = e.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEngineMetrics(t *testing.T) {
+	c := engineCapture(t)
+	s := &failingSink{kind: record.ProtocolHTTP}
+	e := runEngine(t, Config{Dissectors: []string{"flow", "tcp", "dns"}, HTTP: true, Workers: 2, OfflineFiles: []string{c.file()}, Sink: s})
+	// 与 main 相同, 引擎与输出的指标注册到同一个注册表
+	values := gatherValues(t, e, sink.Collector())
+
+	for series, want := range map[string]float64{
+		"dpi_capture_packets_total{}":                      float64(len(c.packets)),
+		"dpi_dissector_records_total{protocol_dns}":        2,
+		"dpi_dissector_records_total{protocol_http}":       1,
+		"dpi_dissector_records_total{protocol_flow}":       2,
+		"dpi_dissector_record_errors_total{protocol_http}": 1,
+		"dpi_capture_worker_queue_length{0}":               0,
+		"dpi_capture_worker_queue_length{1}":               0,
+		"dpi_capture_worker_queue_capacity{}":              workerQueueSize,
+		"dpi_reassembly_rejected_packets_total{checksum}":  0,
+		"dpi_reassembly_rejected_packets_total{fsm}":       0,
+		"dpi_reassembly_rejected_packets_total{options}":   0,
+		"dpi_reassembly_open_connections{}":                0,
+		"dpi_reassembly_missed_bytes_total{}":              0,
+	} {
+		if got, ok := values[series]; !ok || got != want {
+			t.Errorf("%s = %v (present %v), want %v", series, got, ok, want)
+		}
+	}
+	// HTTP 请求与响应经过重组
+	for _, series := range []string{"dpi_reassembly_packets_total{}", "dpi_reassembly_reassembled_bytes_total{}", "dpi_reassembly_payload_bytes_total{}"} {
+		if values[series] <= 0 {
+			t.Errorf("%s = %v, want positive", series, values[series])
+		}
+	}
+	// 离线文件没有内核统计, 没有出错的类型与未启用 RADIUS 时不输出
+	for _, series := range []string{"dpi_capture_source_received_packets_total{}", "dpi_dissector_record_errors_total{protocol_dns}", "dpi_radius_sessions{}"} {
+		if v, ok := values[series]; ok {
+			t.Errorf("%s = %v, want no series", series, v)
+		}
+	}
+	if n := len(s.records); n != 4 {
+		t.Errorf("sink accepted %d records, want 4", n)
+	}
+}
+
+func TestEngineRadiusMetrics(t *testing.T) {
+	e := runEngine(t, Config{Dissectors: []string{"radius"}, OfflineFiles: []string{engineCapture(t).file()}})
+	values := gatherValues(t, e)
+	if v, ok := values["dpi_radius_sessions{}"]; !ok || v != 0 {
+		t.Errorf("radius sessions %v (present %v)", v, ok)
+	}
+}
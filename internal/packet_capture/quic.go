@@ -0,0 +1,250 @@
+package packet_capture
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/fingerprint"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"golang.org/x/crypto/cryptobyte"
+	"sort"
+	"time"
+)
+
+// QUIC 分析
+// 解密客户端的 Initial 包, 按偏移拼接 CRYPTO 帧得到 ClientHello, 输出 SNI、ALPN 与 JA4.
+// ClientHello 可能分布在多个 Initial 包中, 同一个包内的 CRYPTO 帧也可能乱序;
+// 服务端的 Initial 包使用另一组密钥, 解密失败后忽略
+
+const (
+	quicConnTimeout = time.Second * 30 // 未完成的握手保留时间
+	quicMaxConns    = 16384            // 每个 Worker 跟踪的握手数量上限
+	quicMaxCrypto   = 64 << 10         // CRYPTO 数据上限
+)
+
+func init() {
+	Register("quic", 35, func(w *Worker) Dissector {
+		return &quicDissector{worker: w, conns: make(map[quicKey]*quicConn)}
+	})
+}
+
+// quicKey 客户端地址、服务端地址与客户端选择的 Destination Connection ID
+type quicKey struct {
+	src, dst         [16]byte
+	srcPort, dstPort uint16
+	dcid             string
+}
+
+type quicConn struct {
+	keys      *quicInitialKeys
+	version   uint32
+	frags     []quicFragment
+	done      bool // 已输出或无法解析
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+type quicFragment struct {
+	offset int
+	data   []byte
+}
+
+type quicDissector struct {
+	worker *Worker
+	conns  map[quicKey]*quicConn
+}
+
+func (d *quicDissector) Name() string {
+	return "quic"
+}
+
+func (d *quicDissector) Dissect(p *Packet) bool {
+	udpLayer := p.Layer(layers.LayerTypeUDP)
+	if udpLayer == nil {
+		return true
+	}
+	udp := udpLayer.(*layers.UDP)
+	// 一个数据报可能包含多个长包头的包
+	for data := udp.Payload; len(data) > 0; {
+		n := d.packet(p, udp, data)
+		if n <= 0 {
+			break
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+// packet 解析一个长包头的包, 返回其长度, 0 表示无法继续解析
+func (d *quicDissector) packet(p *Packet, udp *layers.UDP, data []byte) int {
+	s := cryptobyte.String(data)
+	var first uint8
+	var version uint32
+	var dcid, scid cryptobyte.String
+	if !s.ReadUint8(&first) || first&0xc0 != 0xc0 || !s.ReadUint32(&version) {
+		return 0
+	}
+	if version != quicVersion1 && version != quicVersion2 {
+		return 0
+	}
+	if !s.ReadUint8LengthPrefixed(&dcid) || len(dcid) > 20 || !s.ReadUint8LengthPrefixed(&scid) {
+		return 0
+	}
+	// 包类型: v1 中 Initial 为 0, Retry 为 3; v2 中 Initial 为 1, Retry 为 0
+	typ := first >> 4 & 0x03
+	if version == quicVersion2 {
+		typ = (typ + 3) & 0x03
+	}
+	if typ == 3 {
+		return 0
+	}
+	initial := typ == 0
+	if initial {
+		token, ok := readQuicVarint(&s)
+		if !ok || !s.Skip(int(token)) {
+			return 0
+		}
+	}
+	length, ok := readQuicVarint(&s)
+	if !ok || length > uint64(len(s)) {
+		return 0
+	}
+	pnOffset := len(data) - len(s)
+	end := pnOffset + int(length)
+	if initial {
+		d.initial(p, udp, version, dcid, data[:end], pnOffset)
+	}
+	return end
+}
+
+func (d *quicDissector) initial(p *Packet, udp *layers.UDP, version uint32, dcid, packet []byte, pnOffset int) {
+	key := quicKey{srcPort: uint16(udp.SrcPort), dstPort: uint16(udp.DstPort), dcid: string(dcid)}
+	copy(key.src[:], p.SrcIP.To16())
+	copy(key.dst[:], p.DstIP.To16())
+	now := p.Metadata().Timestamp
+
+	c, ok := d.conns[key]
+	if !ok {
+		if len(d.conns) >= quicMaxConns {
+			return
+		}
+		keys, err := newQuicInitialKeys(version, dcid)
+		if err != nil {
+			return
+		}
+		c = &quicConn{keys: keys, version: version, firstSeen: now}
+	}
+	plain, err := c.keys.open(packet, pnOffset)
+	if err != nil {
+		return
+	}
+	if !ok {
+		d.conns[key] = c
+	}
+	c.lastSeen = now
+	if c.done {
+		return
+	}
+	c.addFrames(plain)
+	data := c.crypto()
+	if len(data) < 4 {
+		return
+	}
+	l := 4 + (int(data[1])<<16 | int(data[2])<<8 | int(data[3]))
+	if len(data) < l {
+		return
+	}
+	c.done, c.frags = true, nil
+	hello, err := fingerprint.ParseClientHello(data[:l])
+	if err != nil {
+		configs.Log.Debugf("QUIC %s:%d->%s:%d ClientHello err:%s", p.SrcIP, udp.SrcPort, p.DstIP, udp.DstPort, err)
+		return
+	}
+	d.worker.flows.setSNI(p.FlowID, hello.ServerName)
+	d.worker.flows.setAppProto(p.FlowID, protoQUIC)
+	d.worker.Emit(&record.Quic{
+		FlowID:    p.FlowID,
+		SrcIP:     p.SrcIP,
+		DstIP:     p.DstIP,
+		SrcPort:   uint16(udp.SrcPort),
+		DstPort:   uint16(udp.DstPort),
+		Version:   quicVersionName(c.version),
+		Host:      hello.ServerName,
+		ALPN:      hello.ALPN,
+		JA4:       hello.JA4(fingerprint.TransportQUIC),
+		StartTime: c.firstSeen,
+	})
+}
+
+// addFrames 取出 CRYPTO 帧, 遇到无法识别的帧时停止
+func (c *quicConn) addFrames(plain []byte) {
+	s := cryptobyte.String(plain)
+	for !s.Empty() {
+		typ, ok := readQuicVarint(&s)
+		if !ok {
+			return
+		}
+		switch typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			var count uint64
+			for i := 0; i < 3; i++ {
+				if count, ok = readQuicVarint(&s); !ok {
+					return
+				}
+			}
+			// First ACK Range 与 count 组 Gap、ACK Range Length
+			n := 1 + 2*count
+			if typ == 0x03 {
+				n += 3 // ECN Counts
+			}
+			for ; n > 0; n-- {
+				if _, ok = readQuicVarint(&s); !ok {
+					return
+				}
+			}
+		case 0x06: // CRYPTO
+			offset, ok1 := readQuicVarint(&s)
+			length, ok2 := readQuicVarint(&s)
+			var data []byte
+			if !ok1 || !ok2 || offset+length > quicMaxCrypto || !s.ReadBytes(&data, int(length)) {
+				return
+			}
+			c.frags = append(c.frags, quicFragment{offset: int(offset), data: append([]byte(nil), data...)})
+		default: // CONNECTION_CLOSE 等
+			return
+		}
+	}
+}
+
+// crypto 从偏移 0 开始连续的 CRYPTO 数据
+func (c *quicConn) crypto() []byte {
+	sort.SliceStable(c.frags, func(i, j int) bool {
+		return c.frags[i].offset < c.frags[j].offset
+	})
+	var buf []byte
+	for _, f := range c.frags {
+		if f.offset > len(buf) {
+			break
+		}
+		if end := f.offset + len(f.data); end > len(buf) {
+			buf = append(buf, f.data[len(buf)-f.offset:]...)
+		}
+	}
+	return buf
+}
+
+// Flush 删除超时的握手
+func (d *quicDissector) Flush(now time.Time) {
+	for key, c := range d.conns {
+		if now.Sub(c.lastSeen) >= quicConnTimeout {
+			delete(d.conns, key)
+		}
+	}
+}
+
+func quicVersionName(version uint32) string {
+	if version == quicVersion2 {
+		return "v2"
+	}
+	return "v1"
+}
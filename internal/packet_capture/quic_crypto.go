@@ -0,0 +1,126 @@
+package packet_capture
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+// QUIC Initial 包解密
+// Initial 密钥由客户端第一个 Initial 包的 Destination Connection ID 派生, 见 RFC 9001 5.2 与 RFC 9369 3.3
+
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+)
+
+var (
+	quicSaltV1 = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	quicSaltV2 = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+
+	errQuicPacket = errors.New("malformed QUIC packet")
+)
+
+// quicInitialKeys 客户端 Initial 包的解密参数
+type quicInitialKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// newQuicInitialKeys 派生客户端方向的 Initial 密钥
+func newQuicInitialKeys(version uint32, dcid []byte) (*quicInitialKeys, error) {
+	return newQuicKeys(quicInitialSecrets(version, dcid, "client in"))
+}
+
+// quicInitialSecrets 派生一个方向的 Initial 密钥、IV 与头部保护密钥, label 为 "client in" 或 "server in"
+func quicInitialSecrets(version uint32, dcid []byte, label string) (key, iv, hp []byte) {
+	salt, prefix := quicSaltV1, "quic "
+	if version == quicVersion2 {
+		salt, prefix = quicSaltV2, "quicv2 "
+	}
+	initial := hkdf.Extract(sha256.New, dcid, salt)
+	secret := hkdfExpandLabel(initial, label, 32)
+	return hkdfExpandLabel(secret, prefix+"key", 16), hkdfExpandLabel(secret, prefix+"iv", 12), hkdfExpandLabel(secret, prefix+"hp", 16)
+}
+
+func newQuicKeys(key, iv, hp []byte) (*quicInitialKeys, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	return &quicInitialKeys{aead: aead, iv: iv, hp: hpBlock}, nil
+}
+
+// hkdfExpandLabel TLS 1.3 的 HKDF-Expand-Label, context 为空
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	out := make([]byte, length)
+	if _, err := hkdf.Expand(sha256.New, secret, b.BytesOrPanic()).Read(out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// open 去除头部保护并解密, packet 为一个完整的 Initial 包, pnOffset 为包号的位置
+func (k *quicInitialKeys) open(packet []byte, pnOffset int) ([]byte, error) {
+	if len(packet) < pnOffset+4+aes.BlockSize {
+		return nil, errQuicPacket
+	}
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	first := packet[0] ^ mask[0]&0x0f
+	pnLen := int(first&0x03) + 1
+	header := make([]byte, pnOffset+pnLen)
+	copy(header, packet)
+	header[0] = first
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+
+	nonce := make([]byte, len(k.iv))
+	copy(nonce, k.iv)
+	var pnBytes [8]byte
+	binary.BigEndian.PutUint64(pnBytes[:], pn)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-8+i] ^= pnBytes[i]
+	}
+	return k.aead.Open(nil, nonce, packet[pnOffset+pnLen:], header)
+}
+
+// readQuicVarint 读取 QUIC 变长整数, 见 RFC 9000 16
+func readQuicVarint(s *cryptobyte.String) (uint64, bool) {
+	var first uint8
+	if !s.ReadUint8(&first) {
+		return 0, false
+	}
+	v := uint64(first & 0x3f)
+	for n := 1<<(first>>6) - 1; n > 0; n-- {
+		var b uint8
+		if !s.ReadUint8(&b) {
+			return 0, false
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, true
+}
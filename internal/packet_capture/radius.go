@@ -2,51 +2,211 @@ package packet_capture
 
 import (
 	"encoding/binary"
-	"fmt"
+	"encoding/hex"
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/olekukonko/tablewriter"
-	"os"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"strconv"
+	"time"
+	"unicode"
 )
 
-type radiusReader struct {
-	*layers.RADIUS
-}
-
-func (r *radiusReader) Read(p []byte) (n int, err error) {
-	return n, nil
-}
-
-// FormatValue 格式化属性
-func FormatValue(t layers.RADIUSAttributeType, l layers.RADIUSAttributeLength, v []byte) string {
-	switch t {
-	case layers.RADIUSAttributeTypeUserPassword, layers.RADIUSAttributeTypeCHAPPassword, layers.RADIUSAttributeTypeCHAPChallenge:
-		// TODO 密码
-		return ""
-	case layers.RADIUSAttributeTypeNASIPAddress, layers.RADIUSAttributeTypeFramedIPAddress:
-		return fmt.Sprintf("%d.%d.%d.%d", v[0], v[1], v[2], v[3])
-	case layers.RADIUSAttributeTypeServiceType:
-		return ""
-	default:
-		if l == 6 {
-			return fmt.Sprintf("%d", int(binary.BigEndian.Uint32(v)))
-		} else {
-			return string(v)
-		}
+// Radius 协议
+// 解析 Accounting-Request 并输出记录, Start、Interim-Update 与 Stop 更新引擎的会话表,
+// 其他记录据此按 Framed-IP-Address 填写用户名
+
+// 计费端口, 1646 为早期实现使用的端口
+const (
+	radiusAcctPort    = 1813
+	radiusAcctPortOld = 1646
+)
+
+// Acct-Status-Type, 见 RFC 2866 5.1
+const (
+	radiusAcctStart         = 1
+	radiusAcctStop          = 2
+	radiusAcctInterimUpdate = 3
+	radiusAcctOn            = 7
+	radiusAcctOff           = 8
+)
+
+var radiusStatusNames = map[uint32]string{
+	radiusAcctStart:         "Start",
+	radiusAcctStop:          "Stop",
+	radiusAcctInterimUpdate: "Interim-Update",
+	radiusAcctOn:            "Accounting-On",
+	radiusAcctOff:           "Accounting-Off",
+}
+
+// radiusTerminateCauses Acct-Terminate-Cause, 见 RFC 2866 5.10
+var radiusTerminateCauses = []string{"", "User-Request", "Lost-Carrier", "Lost-Service", "Idle-Timeout",
+	"Session-Timeout", "Admin-Reset", "Admin-Reboot", "Port-Error", "NAS-Error", "NAS-Request", "NAS-Reboot",
+	"Port-Unneeded", "Port-Preempted", "Port-Suspended", "Service-Unavailable", "Callback", "User-Error", "Host-Request"}
+
+func init() {
+	Register("radius", 40, func(w *Worker) Dissector {
+		return &radiusDissector{worker: w}
+	})
+}
+
+type radiusDissector struct {
+	worker *Worker
+}
+
+func (d *radiusDissector) Name() string {
+	return "radius"
+}
+
+func (d *radiusDissector) Dissect(p *Packet) bool {
+	if radiusLayer := p.Layer(layers.LayerTypeRADIUS); radiusLayer != nil {
+		// 1812 认证端口由 gopacket 解码, 认证报文不输出
+		return false
+	}
+	udpLayer := p.Layer(layers.LayerTypeUDP)
+	if udpLayer == nil {
+		return true
+	}
+	udp := udpLayer.(*layers.UDP)
+	if !isRadiusAcctPort(udp.SrcPort) && !isRadiusAcctPort(udp.DstPort) {
+		return true
+	}
+	r := &layers.RADIUS{}
+	if err := r.DecodeFromBytes(udp.Payload, gopacket.NilDecodeFeedback); err != nil {
+		configs.Log.Debugf("Radius %s:%d->%s:%d err:%s", p.SrcIP, udp.SrcPort, p.DstIP, udp.DstPort, err)
+		return false
+	}
+	if r.Code != layers.RADIUSCodeAccountingRequest {
+		return false
 	}
+	ts := p.Metadata().Timestamp
+	acct := newRadiusRecord(r, ts)
+	acct.FlowID = p.FlowID
+	acct.SrcIP, acct.DstIP = p.SrcIP, p.DstIP
+	d.worker.engine.sessions.update(acct, ts)
+	d.worker.Emit(acct)
+	return false
 }
 
-func (r *radiusReader) run() {
-	if r.Code == layers.RADIUSCodeAccessRequest || r.Code == layers.RADIUSCodeAccountingRequest {
-		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Type", "Value"})
-		for _, item := range r.Attributes {
-			if item.Type == layers.RADIUSAttributeTypeVendorSpecific {
-				continue
+// Flush 删除超时与已下线的会话
+func (d *radiusDissector) Flush(now time.Time) {
+	d.worker.engine.sessions.expire(now)
+}
+
+func isRadiusAcctPort(port layers.UDPPort) bool {
+	return port == radiusAcctPort || port == radiusAcctPortOld
+}
+
+// newRadiusRecord 从 Accounting-Request 生成记录, 地址由调用方填写
+func newRadiusRecord(r *layers.RADIUS, ts time.Time) *record.Radius {
+	acct := &record.Radius{EventTime: ts, Timestamp: ts}
+	var inputGigawords, outputGigawords uint64
+	for _, a := range r.Attributes {
+		v := a.Value
+		switch a.Type {
+		case layers.RADIUSAttributeTypeAcctStatusType:
+			if status, ok := radiusUint32(v); ok {
+				acct.Status = radiusStatusNames[status]
+				if acct.Status == "" {
+					acct.Status = strconv.Itoa(int(status))
+				}
+			}
+		case layers.RADIUSAttributeTypeUserName:
+			acct.UserName = string(v)
+		case layers.RADIUSAttributeTypeFramedIPAddress:
+			if len(v) == net.IPv4len {
+				acct.FramedIP = net.IP(append([]byte(nil), v...))
 			}
-			table.Append([]string{item.Type.String(), FormatValue(item.Type, item.Length, item.Value)})
+		case layers.RADIUSAttributeTypeNASIPAddress:
+			if len(v) == net.IPv4len {
+				acct.NASIP = net.IP(append([]byte(nil), v...))
+			}
+		case layers.RADIUSAttributeTypeNASIdentifier:
+			acct.NASIdentifier = string(v)
+		case layers.RADIUSAttributeTypeNASPort:
+			acct.NASPort, _ = radiusUint32(v)
+		case layers.RADIUSAttributeTypeAcctSessionId:
+			acct.SessionID = string(v)
+		case layers.RADIUSAttributeTypeCallingStationId:
+			acct.CallingStationID = string(v)
+		case layers.RADIUSAttributeTypeCalledStationId:
+			acct.CalledStationID = string(v)
+		case layers.RADIUSAttributeTypeAcctInputOctets:
+			n, _ := radiusUint32(v)
+			acct.InputOctets = uint64(n)
+		case layers.RADIUSAttributeTypeAcctOutputOctets:
+			n, _ := radiusUint32(v)
+			acct.OutputOctets = uint64(n)
+		case layers.RADIUSAttributeTypeAcctInputGigawords:
+			n, _ := radiusUint32(v)
+			inputGigawords = uint64(n)
+		case layers.RADIUSAttributeTypeAcctOutputGigawords:
+			n, _ := radiusUint32(v)
+			outputGigawords = uint64(n)
+		case layers.RADIUSAttributeTypeAcctInputPackets:
+			acct.InputPackets, _ = radiusUint32(v)
+		case layers.RADIUSAttributeTypeAcctOutputPackets:
+			acct.OutputPackets, _ = radiusUint32(v)
+		case layers.RADIUSAttributeTypeAcctSessionTime:
+			acct.SessionTime, _ = radiusUint32(v)
+		case layers.RADIUSAttributeTypeAcctTerminateCause:
+			if cause, ok := radiusUint32(v); ok {
+				if int(cause) < len(radiusTerminateCauses) && cause > 0 {
+					acct.TerminateCause = radiusTerminateCauses[cause]
+				} else {
+					acct.TerminateCause = strconv.Itoa(int(cause))
+				}
+			}
+		case layers.RADIUSAttributeTypeEventTimestamp:
+			if sec, ok := radiusUint32(v); ok {
+				acct.EventTime = time.Unix(int64(sec), 0).UTC()
+			}
+		case layers.RADIUSAttributeTypeVendorSpecific:
+			acct.VendorAttributes = append(acct.VendorAttributes, radiusVendorAttributes(v)...)
 		}
+	}
+	acct.InputOctets += inputGigawords << 32
+	acct.OutputOctets += outputGigawords << 32
+	return acct
+}
 
-		table.Render()
+func radiusUint32(v []byte) (uint32, bool) {
+	if len(v) != 4 {
+		return 0, false
 	}
+	return binary.BigEndian.Uint32(v), true
+}
 
+// radiusVendorAttributes 拆分 Vendor-Specific 属性, 见 RFC 2865 5.26;
+// 子属性不符合推荐格式时整体作为类型 0 的一个值
+func radiusVendorAttributes(v []byte) []record.RadiusVendorAttribute {
+	if len(v) < 4 {
+		return nil
+	}
+	vendor := binary.BigEndian.Uint32(v)
+	data := v[4:]
+	var attrs []record.RadiusVendorAttribute
+	for len(data) >= 2 {
+		l := int(data[1])
+		if l < 2 || l > len(data) {
+			break
+		}
+		attrs = append(attrs, record.RadiusVendorAttribute{VendorID: vendor, Type: data[0], Value: radiusValue(data[2:l])})
+		data = data[l:]
+	}
+	if len(data) > 0 {
+		return []record.RadiusVendorAttribute{{VendorID: vendor, Value: radiusValue(v[4:])}}
+	}
+	return attrs
+}
+
+// radiusValue 可打印的值返回文本, 否则返回十六进制
+func radiusValue(v []byte) string {
+	for _, r := range string(v) {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return hex.EncodeToString(v)
+		}
+	}
+	return string(v)
 }
@@ -0,0 +1,289 @@
+package packet_capture
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	radiusUserIP = net.ParseIP("10.1.0.5").To4()
+	radiusNAS    = net.ParseIP("192.0.2.1").To4()
+)
+
+// acctRecord 用户 alice 在 radiusUserIP 上的计费记录
+func acctRecord(status uint32, sessionID string) *record.Radius {
+	return &record.Radius{Status: radiusStatusNames[status], UserName: "alice", SessionID: sessionID,
+		FramedIP: radiusUserIP, NASIP: radiusNAS, EventTime: testStart}
+}
+
+func TestRadiusSessionLifecycle(t *testing.T) {
+	s := newRadiusSessions(time.Hour)
+	s.update(acctRecord(radiusAcctStart, "s1"), testStart)
+	if got := s.user(radiusUserIP); got != "alice" {
+		t.Fatalf("after Start: user %q", got)
+	}
+
+	interim := acctRecord(radiusAcctInterimUpdate, "s1")
+	interim.EventTime = testStart.Add(time.Minute * 10)
+	interim.SessionTime, interim.InputOctets, interim.OutputPackets, interim.CallingStationID = 600, 1<<33, 7, "aa-bb-cc-dd-ee-ff"
+	s.update(interim, testStart.Add(time.Minute*10))
+	session := s.byIP[sessionKey(radiusUserIP)]
+	if session.inputOctets != 1<<33 || session.outputPackets != 7 || session.mac != "aa-bb-cc-dd-ee-ff" ||
+		session.nas != "192.0.2.1" || !session.start.Equal(testStart) || !session.stopped.IsZero() {
+		t.Errorf("after Interim-Update: %+v", session)
+	}
+
+	// Stop 后会话保留 radiusStopGrace, 供随后输出的记录使用
+	stop := testStart.Add(time.Minute * 20)
+	s.update(acctRecord(radiusAcctStop, "s1"), stop)
+	if !session.stopped.Equal(stop) || s.user(radiusUserIP) != "alice" {
+		t.Errorf("after Stop: %+v", session)
+	}
+	s.expire(stop.Add(radiusStopGrace - time.Second))
+	if s.user(radiusUserIP) != "alice" {
+		t.Error("session removed before the stop grace period")
+	}
+	s.expire(stop.Add(radiusStopGrace))
+	if s.len() != 0 {
+		t.Errorf("%d sessions after the stop grace period", s.len())
+	}
+}
+
+func TestRadiusSessionReuse(t *testing.T) {
+	s := newRadiusSessions(time.Hour)
+	s.update(acctRecord(radiusAcctStart, "s1"), testStart)
+	// 地址分配给新的会话
+	bob := acctRecord(radiusAcctStart, "s2")
+	bob.UserName = "bob"
+	s.update(bob, testStart.Add(time.Minute))
+	// 旧会话的 Stop 迟到
+	s.update(acctRecord(radiusAcctStop, "s1"), testStart.Add(time.Minute*2))
+	session := s.byIP[sessionKey(radiusUserIP)]
+	if session.user != "bob" || session.sessionID != "s2" || !session.stopped.IsZero() {
+		t.Errorf("session %+v, want bob online", session)
+	}
+	s.expire(testStart.Add(time.Minute*2 + radiusStopGrace))
+	if got := s.user(radiusUserIP); got != "bob" {
+		t.Errorf("user %q after the old Stop, want bob", got)
+	}
+
+	// 同一会话 Stop 后的 Interim-Update 重新上线
+	s.update(acctRecord(radiusAcctStart, "s3"), testStart.Add(time.Minute*3))
+	s.update(acctRecord(radiusAcctStop, "s3"), testStart.Add(time.Minute*4))
+	s.update(acctRecord(radiusAcctInterimUpdate, "s3"), testStart.Add(time.Minute*5))
+	if session = s.byIP[sessionKey(radiusUserIP)]; session.user != "alice" || !session.stopped.IsZero() {
+		t.Errorf("session %+v, want alice online", session)
+	}
+}
+
+func TestRadiusAccountingOnOff(t *testing.T) {
+	for _, status := range []uint32{radiusAcctOn, radiusAcctOff} {
+		s := newRadiusSessions(time.Hour)
+		other := net.ParseIP("192.0.2.2").To4()
+		for i, nas := range []net.IP{radiusNAS, radiusNAS, other} {
+			r := acctRecord(radiusAcctStart, string(rune('a'+i)))
+			r.FramedIP, r.NASIP = net.IPv4(10, 1, 0, byte(i)), nas
+			s.update(r, testStart)
+		}
+		// NAS-IP-Address 缺失时按 NAS-Identifier 区分
+		named := acctRecord(radiusAcctStart, "d")
+		named.FramedIP, named.NASIP, named.NASIdentifier = net.IPv4(10, 1, 0, 3), nil, "bras-1"
+		s.update(named, testStart)
+
+		s.update(&record.Radius{Status: radiusStatusNames[status], NASIP: radiusNAS}, testStart.Add(time.Minute))
+		if s.len() != 2 || s.user(net.IPv4(10, 1, 0, 2)) != "alice" || s.user(net.IPv4(10, 1, 0, 3)) != "alice" {
+			t.Errorf("%s: %d sessions left, want the other NAS's", radiusStatusNames[status], s.len())
+		}
+		s.update(&record.Radius{Status: radiusStatusNames[status], NASIdentifier: "bras-1"}, testStart.Add(time.Minute))
+		if s.len() != 1 || s.user(net.IPv4(10, 1, 0, 3)) != "" {
+			t.Errorf("%s by identifier: %d sessions left", radiusStatusNames[status], s.len())
+		}
+	}
+}
+
+func TestRadiusSessionTimeout(t *testing.T) {
+	s := newRadiusSessions(time.Hour)
+	s.update(acctRecord(radiusAcctStart, "s1"), testStart)
+	s.update(acctRecord(radiusAcctInterimUpdate, "s1"), testStart.Add(time.Minute*30))
+	s.expire(testStart.Add(time.Minute * 89))
+	if s.len() != 1 {
+		t.Fatal("session removed before the timeout since the last update")
+	}
+	s.expire(testStart.Add(time.Minute * 90))
+	if s.len() != 0 {
+		t.Error("session kept after the timeout")
+	}
+
+	// 没有地址或不是会话状态的记录不建立会话
+	for _, r := range []*record.Radius{
+		{Status: radiusStatusNames[radiusAcctStart], UserName: "alice"},
+		{Status: "15", UserName: "alice", FramedIP: radiusUserIP},
+	} {
+		s.update(r, testStart)
+	}
+	if s.len() != 0 {
+		t.Errorf("%d sessions from records without a session", s.len())
+	}
+
+	var disabled *radiusSessions
+	disabled.update(acctRecord(radiusAcctStart, "s1"), testStart)
+	disabled.expire(testStart)
+	if disabled.user(radiusUserIP) != "" || disabled.len() != 0 {
+		t.Error("nil session table returned a session")
+	}
+}
+
+func TestRadiusMaxSessions(t *testing.T) {
+	s := newRadiusSessions(time.Hour)
+	old := &radiusSession{user: "old", updated: testStart.Add(-time.Hour)}
+	for i := 0; i < radiusMaxSessions; i++ {
+		var key [16]byte
+		binary.BigEndian.PutUint32(key[:], uint32(i))
+		s.byIP[key] = old
+	}
+	s.byIP[sessionKey(radiusUserIP)] = &radiusSession{user: "alice", sessionID: "s1", updated: testStart}
+	delete(s.byIP, [16]byte{})
+
+	// 达到上限后不跟踪新会话, 已有会话照常更新
+	newIP := net.IPv4(10, 1, 0, 9)
+	r := acctRecord(radiusAcctStart, "s2")
+	r.FramedIP = newIP
+	s.update(r, testStart)
+	if s.user(newIP) != "" || !s.full || s.len() != radiusMaxSessions {
+		t.Fatalf("new session tracked at the limit: full %v, %d sessions", s.full, s.len())
+	}
+	s.update(acctRecord(radiusAcctInterimUpdate, "s1"), testStart.Add(time.Minute))
+	if session := s.byIP[sessionKey(radiusUserIP)]; !session.updated.Equal(testStart.Add(time.Minute)) {
+		t.Error("existing session not updated at the limit")
+	}
+
+	// 超时的会话删除后重新跟踪新会话
+	s.expire(testStart.Add(time.Minute))
+	if s.full || s.len() != 1 {
+		t.Fatalf("after expiry: full %v, %d sessions", s.full, s.len())
+	}
+	s.update(r, testStart.Add(time.Minute))
+	if s.user(newIP) != "alice" {
+		t.Error("new session not tracked after expiry")
+	}
+}
+
+func TestEngineAttribute(t *testing.T) {
+	e := &Engine{sessions: newRadiusSessions(time.Hour)}
+	resolver := net.ParseIP("10.1.0.53").To4()
+	server := net.ParseIP("93.184.216.34").To4()
+	s := e.sessions
+	s.update(acctRecord(radiusAcctStart, "s1"), testStart)
+	// 有会话的本地解析器
+	r := acctRecord(radiusAcctStart, "s2")
+	r.UserName, r.FramedIP = "resolver", resolver
+	s.update(r, testStart)
+
+	flow := &record.Flow{SrcIP: server, DstIP: radiusUserIP}
+	tls := &record.Tls{SrcIP: radiusUserIP, DstIP: server}
+	http := &record.Http{SrcIP: server, DstIP: server}
+	quic := &record.Quic{SrcIP: radiusUserIP, DstIP: server}
+	query := &record.Dns{SrcIP: radiusUserIP, DstIP: resolver}
+	// 应答先查目的地址, 即发起查询的客户端
+	response := &record.Dns{SrcIP: resolver, DstIP: radiusUserIP, Response: true}
+	alert := &record.Alert{SrcIP: radiusUserIP}
+	for _, r := range []record.Protocol{flow, tls, http, quic, query, response, alert} {
+		e.attribute(r)
+	}
+	got := []string{flow.UserName, tls.UserName, http.UserName, quic.UserName, query.UserName, response.UserName, alert.UserName}
+	if want := []string{"alice", "alice", "", "alice", "alice", "alice", "alice"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("users %v, want %v", got, want)
+	}
+
+	// 没有会话表时不修改记录
+	flow = &record.Flow{SrcIP: radiusUserIP, UserName: "kept"}
+	(&Engine{}).attribute(flow)
+	if flow.UserName != "kept" {
+		t.Errorf("user %q without a session table", flow.UserName)
+	}
+}
+
+func radiusAttr(typ layers.RADIUSAttributeType, v []byte) layers.RADIUSAttribute {
+	return layers.RADIUSAttribute{Type: typ, Length: layers.RADIUSAttributeLength(len(v) + 2), Value: v}
+}
+
+func radiusUint(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+func TestNewRadiusRecord(t *testing.T) {
+	event := time.Date(2024, 1, 1, 7, 59, 0, 0, time.UTC)
+	vsa := append(radiusUint(2011), 1, 7, 'g', 'o', 'l', 'd', '!')
+	r := &layers.RADIUS{Code: layers.RADIUSCodeAccountingRequest, Attributes: []layers.RADIUSAttribute{
+		radiusAttr(layers.RADIUSAttributeTypeAcctStatusType, radiusUint(radiusAcctStop)),
+		radiusAttr(layers.RADIUSAttributeTypeUserName, []byte("alice")),
+		radiusAttr(layers.RADIUSAttributeTypeFramedIPAddress, radiusUserIP),
+		radiusAttr(layers.RADIUSAttributeTypeNASIPAddress, radiusNAS),
+		radiusAttr(layers.RADIUSAttributeTypeNASPort, radiusUint(12)),
+		radiusAttr(layers.RADIUSAttributeTypeAcctSessionId, []byte("s1")),
+		// 超过 4 GiB 的流量由 Gigawords 记录高 32 位
+		radiusAttr(layers.RADIUSAttributeTypeAcctInputOctets, radiusUint(5)),
+		radiusAttr(layers.RADIUSAttributeTypeAcctInputGigawords, radiusUint(2)),
+		radiusAttr(layers.RADIUSAttributeTypeAcctOutputGigawords, radiusUint(1)),
+		radiusAttr(layers.RADIUSAttributeTypeAcctOutputOctets, radiusUint(7)),
+		radiusAttr(layers.RADIUSAttributeTypeAcctSessionTime, radiusUint(60)),
+		radiusAttr(layers.RADIUSAttributeTypeAcctTerminateCause, radiusUint(1)),
+		radiusAttr(layers.RADIUSAttributeTypeEventTimestamp, radiusUint(uint32(event.Unix()))),
+		radiusAttr(layers.RADIUSAttributeTypeVendorSpecific, vsa),
+	}}
+	acct := newRadiusRecord(r, testStart)
+	if acct.Status != "Stop" || acct.UserName != "alice" || !acct.FramedIP.Equal(radiusUserIP) || !acct.NASIP.Equal(radiusNAS) ||
+		acct.NASPort != 12 || acct.SessionID != "s1" || acct.SessionTime != 60 || acct.TerminateCause != "User-Request" {
+		t.Errorf("record %+v", acct)
+	}
+	if acct.InputOctets != 2<<32+5 || acct.OutputOctets != 1<<32+7 {
+		t.Errorf("octets %d %d", acct.InputOctets, acct.OutputOctets)
+	}
+	if !acct.EventTime.Equal(event) || !acct.Timestamp.Equal(testStart) {
+		t.Errorf("event %v timestamp %v", acct.EventTime, acct.Timestamp)
+	}
+	if want := []record.RadiusVendorAttribute{{VendorID: 2011, Type: 1, Value: "gold!"}}; !reflect.DeepEqual(acct.VendorAttributes, want) {
+		t.Errorf("vendor attributes %+v", acct.VendorAttributes)
+	}
+
+	// 未知的状态与终止原因按数字输出, 长度不对的值忽略
+	r.Attributes = []layers.RADIUSAttribute{
+		radiusAttr(layers.RADIUSAttributeTypeAcctStatusType, radiusUint(15)),
+		radiusAttr(layers.RADIUSAttributeTypeAcctTerminateCause, radiusUint(99)),
+		radiusAttr(layers.RADIUSAttributeTypeFramedIPAddress, []byte{10, 1, 0}),
+		radiusAttr(layers.RADIUSAttributeTypeAcctSessionTime, []byte{1}),
+	}
+	acct = newRadiusRecord(r, testStart)
+	if acct.Status != "15" || acct.TerminateCause != "99" || acct.FramedIP != nil || acct.SessionTime != 0 || !acct.EventTime.Equal(testStart) {
+		t.Errorf("record %+v", acct)
+	}
+}
+
+func TestRadiusVendorAttributes(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		v    []byte
+		want []record.RadiusVendorAttribute
+	}{
+		{"short", []byte{0, 0, 7}, nil},
+		{"empty", radiusUint(9), nil},
+		{"split", append(radiusUint(9), 1, 4, 'a', 'b', 26, 3, 0xff),
+			[]record.RadiusVendorAttribute{{VendorID: 9, Type: 1, Value: "ab"}, {VendorID: 9, Type: 26, Value: "ff"}}},
+		// 子属性长度超出时整体作为类型 0 的一个值
+		{"malformed", append(radiusUint(9), 1, 9, 'a', 'b'),
+			[]record.RadiusVendorAttribute{{VendorID: 9, Value: "01096162"}}},
+		{"trailing", append(radiusUint(9), 1, 3, 'a', 2),
+			[]record.RadiusVendorAttribute{{VendorID: 9, Value: "01036102"}}},
+		{"text", append(radiusUint(9), 'n', 'o', 't', ' ', 't', 'l', 'v'),
+			[]record.RadiusVendorAttribute{{VendorID: 9, Value: "not tlv"}}},
+	} {
+		if got := radiusVendorAttributes(tt.v); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
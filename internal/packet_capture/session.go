@@ -0,0 +1,183 @@
+package packet_capture
+
+import (
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"sync"
+	"time"
+)
+
+// RADIUS 会话表
+// 按 Framed-IP-Address 记录在线用户, 由 radius 解析器更新, 引擎输出记录时据此填写用户名.
+// RADIUS 报文与用户流量由不同 Worker 处理, 会话表由引擎持有并加锁访问
+
+const (
+	radiusSessionTimeout = time.Hour * 2   // 默认的会话超时
+	radiusStopGrace      = time.Minute * 5 // Stop 后保留会话的时间, 供随后输出的流记录使用
+	radiusMaxSessions    = 262144          // 会话数量上限
+)
+
+// radiusSession 一个在线用户的计费会话
+type radiusSession struct {
+	user          string
+	sessionID     string
+	nas           string // NAS-IP-Address, 没有时为 NAS-Identifier
+	mac           string // Calling-Station-Id
+	start         time.Time
+	updated       time.Time // 最近一次计费报文的抓包时间
+	stopped       time.Time // 收到 Stop 的抓包时间, 在线时为零
+	inputOctets   uint64
+	outputOctets  uint64
+	inputPackets  uint32
+	outputPackets uint32
+}
+
+// radiusSessions 为 nil 时不记录也不查询
+type radiusSessions struct {
+	mu      sync.Mutex
+	timeout time.Duration // 超过该时间没有计费报文的会话删除, 应大于 NAS 的 Interim 间隔
+	byIP    map[[16]byte]*radiusSession
+	full    bool // 已提示会话数量达到上限
+}
+
+func newRadiusSessions(timeout time.Duration) *radiusSessions {
+	return &radiusSessions{timeout: timeout, byIP: make(map[[16]byte]*radiusSession)}
+}
+
+func sessionKey(ip net.IP) [16]byte {
+	var k [16]byte
+	copy(k[:], ip.To16())
+	return k
+}
+
+// update 按计费报文更新会话, ts 为抓包时间
+func (s *radiusSessions) update(r *record.Radius, ts time.Time) {
+	if s == nil {
+		return
+	}
+	nas := r.NASIdentifier
+	if r.NASIP != nil {
+		nas = r.NASIP.String()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Status {
+	case radiusStatusNames[radiusAcctOn], radiusStatusNames[radiusAcctOff]:
+		// NAS 重启, 其上的会话都已结束
+		for key, session := range s.byIP {
+			if session.nas == nas {
+				delete(s.byIP, key)
+			}
+		}
+		return
+	case radiusStatusNames[radiusAcctStart], radiusStatusNames[radiusAcctInterimUpdate], radiusStatusNames[radiusAcctStop]:
+	default:
+		return
+	}
+	if r.FramedIP == nil {
+		return
+	}
+	key := sessionKey(r.FramedIP)
+	session, ok := s.byIP[key]
+	if ok && (session.sessionID != r.SessionID || session.user != r.UserName) {
+		if r.Status == radiusStatusNames[radiusAcctStop] {
+			// 地址已分配给新的会话, 旧会话的 Stop 不影响当前用户
+			return
+		}
+		ok = false
+	}
+	if !ok {
+		if len(s.byIP) >= radiusMaxSessions {
+			if !s.full {
+				s.full = true
+				configs.Log.Warnf("Radius sessions exceed %d, new sessions are not tracked", radiusMaxSessions)
+			}
+			return
+		}
+		session = &radiusSession{
+			user:      r.UserName,
+			sessionID: r.SessionID,
+			start:     r.EventTime.Add(-time.Duration(r.SessionTime) * time.Second),
+		}
+		s.byIP[key] = session
+	}
+	session.nas, session.mac = nas, r.CallingStationID
+	session.updated = ts
+	session.inputOctets, session.outputOctets = r.InputOctets, r.OutputOctets
+	session.inputPackets, session.outputPackets = r.InputPackets, r.OutputPackets
+	if r.Status == radiusStatusNames[radiusAcctStop] {
+		session.stopped = ts
+	} else {
+		session.stopped = time.Time{}
+	}
+}
+
+// expire 删除超时未更新与 Stop 后超过 radiusStopGrace 的会话
+func (s *radiusSessions) expire(now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, session := range s.byIP {
+		if now.Sub(session.updated) >= s.timeout || (!session.stopped.IsZero() && now.Sub(session.stopped) >= radiusStopGrace) {
+			delete(s.byIP, key)
+		}
+	}
+	if len(s.byIP) < radiusMaxSessions {
+		s.full = false
+	}
+}
+
+// user 按顺序查找地址所属的用户, 都没有会话时返回空字符串
+func (s *radiusSessions) user(ips ...net.IP) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+		if session, ok := s.byIP[sessionKey(ip)]; ok {
+			return session.user
+		}
+	}
+	return ""
+}
+
+func (s *radiusSessions) len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.byIP)
+}
+
+// attribute 按会话表填写记录的用户名, 先查客户端地址再查服务端地址
+func (e *Engine) attribute(r record.Protocol) {
+	if e.sessions == nil {
+		return
+	}
+	switch v := r.(type) {
+	case *record.Flow:
+		v.UserName = e.sessions.user(v.SrcIP, v.DstIP)
+	case *record.Tls:
+		v.UserName = e.sessions.user(v.SrcIP, v.DstIP)
+	case *record.Http:
+		v.UserName = e.sessions.user(v.SrcIP, v.DstIP)
+	case *record.Quic:
+		v.UserName = e.sessions.user(v.SrcIP, v.DstIP)
+	case *record.Dns:
+		if v.Response {
+			v.UserName = e.sessions.user(v.DstIP, v.SrcIP)
+		} else {
+			v.UserName = e.sessions.user(v.SrcIP, v.DstIP)
+		}
+	case *record.Alert:
+		v.UserName = e.sessions.user(v.SrcIP)
+	}
+}
@@ -0,0 +1,119 @@
+package packet_capture
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"hash/fnv"
+	"net"
+)
+
+// 分发哈希
+// 抓包 goroutine 使用 DecodingLayerParser 只解析到传输层, 不分配内存,
+// 解析失败 (未知封装、非 IP) 时再完整解码
+
+// shardParser 非并发安全, 只在抓包 goroutine 中使用
+type shardParser struct {
+	parsers []*gopacket.DecodingLayerParser // 按链路层类型选择, 裸 IP 时按版本号选择
+	raw     bool
+	decoded []gopacket.LayerType
+
+	eth      layers.Ethernet
+	dot1q    layers.Dot1Q
+	sll      layers.LinuxSLL
+	loopback layers.Loopback
+	ip4      layers.IPv4
+	ip6      layers.IPv6
+	tcp      layers.TCP
+	udp      layers.UDP
+}
+
+func newShardParser(linkType layers.LinkType) *shardParser {
+	s := &shardParser{}
+	decoders := []gopacket.DecodingLayer{&s.eth, &s.dot1q, &s.sll, &s.loopback, &s.ip4, &s.ip6, &s.tcp, &s.udp}
+	newParser := func(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+		p := gopacket.NewDecodingLayerParser(first, decoders...)
+		p.IgnoreUnsupported = true
+		return p
+	}
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		s.parsers = append(s.parsers, newParser(layers.LayerTypeEthernet))
+	case layers.LinkTypeLinuxSLL:
+		s.parsers = append(s.parsers, newParser(layers.LayerTypeLinuxSLL))
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		s.parsers = append(s.parsers, newParser(layers.LayerTypeLoopback))
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6, 12:
+		s.raw = true
+		s.parsers = append(s.parsers, newParser(layers.LayerTypeIPv4), newParser(layers.LayerTypeIPv6))
+	}
+	return s
+}
+
+// hash 计算数据包的分发哈希
+// fragment 表示 IPv4 分片, ok 为 false 表示无法解析到 IP 层
+func (s *shardParser) hash(data []byte) (hash uint32, fragment, ok bool) {
+	if len(s.parsers) == 0 || len(data) == 0 {
+		return 0, false, false
+	}
+	parser := s.parsers[0]
+	if s.raw && data[0]>>4 == 6 {
+		parser = s.parsers[1]
+	}
+	s.decoded = s.decoded[:0]
+	_ = parser.DecodeLayers(data, &s.decoded)
+
+	var proto layers.IPProtocol
+	var src, dst net.IP
+	var srcPort, dstPort uint16
+	for _, t := range s.decoded {
+		switch t {
+		case layers.LayerTypeIPv4:
+			proto, src, dst = s.ip4.Protocol, s.ip4.SrcIP, s.ip4.DstIP
+			fragment = s.ip4.Flags&layers.IPv4MoreFragments != 0 || s.ip4.FragOffset != 0
+			ok = true
+		case layers.LayerTypeIPv6:
+			proto, src, dst = s.ip6.NextHeader, s.ip6.SrcIP, s.ip6.DstIP
+			ok = true
+		case layers.LayerTypeTCP:
+			proto, srcPort, dstPort = layers.IPProtocolTCP, uint16(s.tcp.SrcPort), uint16(s.tcp.DstPort)
+		case layers.LayerTypeUDP:
+			proto, srcPort, dstPort = layers.IPProtocolUDP, uint16(s.udp.SrcPort), uint16(s.udp.DstPort)
+		}
+	}
+	if !ok {
+		return 0, false, false
+	}
+	return shardHash(proto, src, dst, srcPort, dstPort), fragment, true
+}
+
+// packetHash 计算已解码数据包的分发哈希, 与 shardParser.hash 结果一致
+func packetHash(p *Packet) uint32 {
+	var proto layers.IPProtocol
+	switch ip := p.NetworkLayer().(type) {
+	case *layers.IPv4:
+		proto = ip.Protocol
+	case *layers.IPv6:
+		proto = ip.NextHeader
+	}
+	var srcPort, dstPort uint16
+	switch l4 := p.TransportLayer().(type) {
+	case *layers.TCP:
+		proto, srcPort, dstPort = layers.IPProtocolTCP, uint16(l4.SrcPort), uint16(l4.DstPort)
+	case *layers.UDP:
+		proto, srcPort, dstPort = layers.IPProtocolUDP, uint16(l4.SrcPort), uint16(l4.DstPort)
+	}
+	return shardHash(proto, p.SrcIP, p.DstIP, srcPort, dstPort)
+}
+
+// shardHash 对称 5 元组哈希, 两个方向结果相同
+func shardHash(proto layers.IPProtocol, src, dst net.IP, srcPort, dstPort uint16) uint32 {
+	key, _ := newFlowKey(proto, src, dst, srcPort, dstPort)
+	h := fnv.New32a()
+	buf := make([]byte, 0, 37)
+	buf = append(buf, byte(key.proto))
+	buf = append(buf, key.a[:]...)
+	buf = append(buf, key.b[:]...)
+	buf = append(buf, byte(key.aPort>>8), byte(key.aPort), byte(key.bPort>>8), byte(key.bPort))
+	h.Write(buf)
+	return h.Sum32()
+}
@@ -0,0 +1,82 @@
+package packet_capture
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"testing"
+)
+
+// shardHashes 返回数据包在快速解析 (以太网与裸 IP) 和完整解码路径上的分发哈希
+func shardHashes(t *testing.T, tp testPacket) []uint32 {
+	t.Helper()
+	eth, _, ok := newShardParser(layers.LinkTypeEthernet).hash(tp.data)
+	if !ok {
+		t.Fatal("ethernet: not parsed")
+	}
+	raw, _, ok := newShardParser(layers.LinkTypeRaw).hash(tp.data[14:])
+	if !ok {
+		t.Fatal("raw ip: not parsed")
+	}
+	p := (&Worker{}).decode(workItem{data: tp.data, ci: tp.ci, decoder: layers.LinkTypeEthernet})
+	if p == nil {
+		t.Fatal("decode: no ip layer")
+	}
+	return []uint32{eth, raw, packetHash(p)}
+}
+
+func TestShardHashSymmetric(t *testing.T) {
+	c := newTestCapture(t)
+	c.tcp("10.0.0.2", "93.184.216.34", 40000, 443).handshake()
+	c.tcp("2001:db8::2", "2001:db8::443", 40001, 443).handshake()
+	c.udp("10.0.0.2", "10.0.0.53", 5353, 53, []byte("query"))
+	c.udp("10.0.0.53", "10.0.0.2", 53, 5353, []byte("reply"))
+	c.udp("2001:db8::2", "2001:db8::53", 5353, 53, []byte("query"))
+	c.udp("2001:db8::53", "2001:db8::2", 53, 5353, []byte("reply"))
+	for _, typ := range []uint8{layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply} {
+		src, dst := "10.0.0.2", "10.0.0.1"
+		if typ == layers.ICMPv4TypeEchoReply {
+			src, dst = dst, src
+		}
+		ip, _, ethType := c.ip(src, dst, layers.IPProtocolICMPv4)
+		c.add(ethType, ip, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(typ, 0), Id: 1, Seq: 1}, gopacket.Payload("ping"))
+	}
+
+	// 每组数据包属于同一个 5 元组的两个方向
+	groups := [][]testPacket{c.packets[0:3], c.packets[3:6], c.packets[6:8], c.packets[8:10], c.packets[10:12]}
+	seen := make(map[uint32]bool)
+	for i, group := range groups {
+		want := shardHashes(t, group[0])[0]
+		for j, tp := range group {
+			for path, hash := range shardHashes(t, tp) {
+				if hash != want {
+					t.Errorf("flow %d packet %d path %d: hash %#x, want %#x", i, j, path, hash, want)
+				}
+			}
+		}
+		seen[want] = true
+	}
+	if len(seen) != len(groups) {
+		t.Errorf("%d flows share %d hashes", len(groups), len(seen))
+	}
+}
+
+func TestShardHashFragment(t *testing.T) {
+	c := newTestCapture(t)
+	c.udp("10.0.0.2", "10.0.0.53", 5353, 53, []byte("query"))
+	full := c.packets[0].data
+	// 设置 MF 标志后 IPv4 分片在抓包 goroutine 中交给分片前解析器
+	frag := append([]byte(nil), full...)
+	frag[14+6] |= 0x20
+	for _, tt := range []struct {
+		data     []byte
+		fragment bool
+	}{{full, false}, {frag, true}} {
+		_, fragment, ok := newShardParser(layers.LinkTypeEthernet).hash(tt.data)
+		if !ok || fragment != tt.fragment {
+			t.Errorf("fragment %v ok %v, want %v", fragment, ok, tt.fragment)
+		}
+	}
+	if _, _, ok := newShardParser(layers.LinkTypeEthernet).hash([]byte{1, 2, 3}); ok {
+		t.Error("truncated packet parsed")
+	}
+}
@@ -0,0 +1,101 @@
+package packet_capture
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"sync"
+)
+
+// 数据源
+// 抓包后端通过 RegisterSource 注册, 由 Config.Source 选择, 默认为 pcap;
+// 指定离线文件时总是使用 file
+
+// ErrTimeout 数据源在超时时间内没有收到数据包
+var ErrTimeout = errors.New("capture: read timeout")
+
+// Source 数据包来源
+type Source interface {
+	// ReadPacketData 读取一个数据包, data 归调用方所有
+	// 超时返回 ErrTimeout, 数据源结束返回 io.EOF
+	ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	// LinkType 链路层类型, 数据包的 ci.AncillaryData 中带有 layers.LinkType 时以后者为准
+	LinkType() layers.LinkType
+	// SetBPFFilter 替换 Berkeley Packet Filter, 可在读取过程中调用
+	SetBPFFilter(expr string) error
+	Close()
+}
+
+// SourceStats 数据源的收包与丢包计数
+type SourceStats struct {
+	Received  uint64 // 收到的数据包
+	Dropped   uint64 // 缓冲区满被内核或 libpcap 丢弃的数据包
+	IfDropped uint64 // 被网卡或驱动丢弃的数据包
+}
+
+// StatsSource 可以提供收包统计的数据源, 可在读取过程中调用
+type StatsSource interface {
+	Stats() (SourceStats, error)
+}
+
+// SourceFactory 根据引擎配置打开数据源
+type SourceFactory func(c Config) (Source, error)
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = make(map[string]SourceFactory)
+)
+
+// RegisterSource 注册抓包后端, 重复注册同名后端会 panic
+func RegisterSource(name string, factory SourceFactory) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	if factory == nil {
+		panic("packet_capture: RegisterSource factory is nil")
+	}
+	if _, dup := sources[name]; dup {
+		panic("packet_capture: RegisterSource called twice for source " + name)
+	}
+	sources[name] = factory
+}
+
+// Sources 返回已注册的抓包后端名称
+func Sources() []string {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// packetLinkType 返回 AncillaryData 中的链路层类型
+func packetLinkType(ci gopacket.CaptureInfo) (layers.LinkType, bool) {
+	for _, v := range ci.AncillaryData {
+		if lt, ok := v.(layers.LinkType); ok {
+			return lt, true
+		}
+	}
+	return 0, false
+}
+
+// openSource 按配置打开数据源
+func openSource(c Config) (Source, error) {
+	name := c.Source
+	if len(c.OfflineFiles) > 0 {
+		name = "file"
+	} else if name == "" {
+		name = "pcap"
+	}
+	sourcesMu.RLock()
+	factory, ok := sources[name]
+	sourcesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown capture source %q", name)
+	}
+	return factory(c)
+}
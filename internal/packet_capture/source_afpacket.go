@@ -0,0 +1,157 @@
+//go:build linux
+
+package packet_capture
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+	"net"
+	"time"
+)
+
+// AF_PACKET 数据源
+// 使用 TPACKET_V3 内存映射环形缓冲区, 数据包从环形缓冲区直接复制到 Go 内存, 不经过 cgo;
+// 设置 FanoutGroup 后多个进程 (或多个引擎) 可加入同一个 fanout 组, 由内核分担流量
+
+func init() {
+	RegisterSource("afpacket", openAFPacket)
+}
+
+// fanoutTypes 配置中的 fanout 类型名称
+var fanoutTypes = map[string]afpacket.FanoutType{
+	"hash":     afpacket.FanoutHash | afpacket.FanoutHashWithDefrag,
+	"lb":       afpacket.FanoutLoadBalance,
+	"cpu":      afpacket.FanoutCPU,
+	"rollover": afpacket.FanoutRollover,
+	"random":   afpacket.FanoutRandom,
+	"qm":       afpacket.FanoutQueueMapping,
+}
+
+type afpacketSource struct {
+	tp      *afpacket.TPacket
+	snapLen int
+	promisc int // 混杂模式 socket, 未开启时为 -1
+}
+
+func openAFPacket(c Config) (Source, error) {
+	opts := c.AFPacket
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = afpacket.DefaultBlockSize
+	}
+	if opts.NumBlocks <= 0 {
+		opts.NumBlocks = afpacket.DefaultNumBlocks
+	}
+	tp, err := afpacket.NewTPacket(
+		afpacket.OptInterface(c.Device),
+		afpacket.TPacketVersion3,
+		afpacket.OptFrameSize(afpacket.DefaultFrameSize),
+		afpacket.OptBlockSize(opts.BlockSize),
+		afpacket.OptNumBlocks(opts.NumBlocks),
+		afpacket.OptPollTimeout(time.Second),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("AF_PACKET open %s error: %w", c.Device, err)
+	}
+	s := &afpacketSource{tp: tp, snapLen: c.SnapLen, promisc: -1}
+	if opts.FanoutGroup != 0 {
+		t, ok := fanoutTypes[opts.FanoutType]
+		if opts.FanoutType == "" {
+			t, ok = fanoutTypes["hash"], true
+		}
+		if !ok {
+			tp.Close()
+			return nil, fmt.Errorf("unknown fanout type %q", opts.FanoutType)
+		}
+		if err = tp.SetFanout(t, opts.FanoutGroup); err != nil {
+			tp.Close()
+			return nil, fmt.Errorf("AF_PACKET fanout error: %w", err)
+		}
+		configs.Log.Infof("AF_PACKET fanout group:%d type:%s", opts.FanoutGroup, opts.FanoutType)
+	}
+	if c.BPF != "" {
+		configs.Log.Infof("Berkeley Packet Filter:%s", c.BPF)
+		if err = s.SetBPFFilter(c.BPF); err != nil {
+			tp.Close()
+			return nil, fmt.Errorf("BPF filter error: %w", err)
+		}
+	}
+	if c.Promisc {
+		if s.promisc, err = setPromisc(c.Device); err != nil {
+			tp.Close()
+			return nil, fmt.Errorf("could not set promisc mode: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// setPromisc 通过单独的 socket 加入 PACKET_MR_PROMISC 组, socket 关闭时内核自动恢复网卡状态
+func setPromisc(device string) (int, error) {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return -1, err
+	}
+	mreq := &unix.PacketMreq{Ifindex: int32(iface.Index), Type: unix.PACKET_MR_PROMISC}
+	if err = unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func (s *afpacketSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.tp.ReadPacketData()
+	if err == afpacket.ErrTimeout {
+		return nil, ci, ErrTimeout
+	} else if err != nil {
+		return nil, ci, err
+	}
+	if s.snapLen > 0 && len(data) > s.snapLen {
+		data = data[:s.snapLen]
+		ci.CaptureLength = s.snapLen
+	}
+	return data, ci, nil
+}
+
+// Stats 内核环形缓冲区计数, TPACKET_V3 不区分网卡丢包
+func (s *afpacketSource) Stats() (SourceStats, error) {
+	_, v3, err := s.tp.SocketStats()
+	if err != nil {
+		return SourceStats{}, err
+	}
+	return SourceStats{Received: uint64(v3.Packets()), Dropped: uint64(v3.Drops())}, nil
+}
+
+// LinkType AF_PACKET SOCK_RAW 总是返回以太网帧
+func (s *afpacketSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// SetBPFFilter 使用 libpcap 编译表达式后挂载到 socket
+func (s *afpacketSource) SetBPFFilter(expr string) error {
+	compiled, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, s.snapLen, expr)
+	if err != nil {
+		return err
+	}
+	raw := make([]bpf.RawInstruction, len(compiled))
+	for i, ins := range compiled {
+		raw[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return s.tp.SetBPF(raw)
+}
+
+func (s *afpacketSource) Close() {
+	s.tp.Close()
+	if s.promisc >= 0 {
+		unix.Close(s.promisc)
+	}
+}
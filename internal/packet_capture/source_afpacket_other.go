@@ -0,0 +1,15 @@
+//go:build !linux
+
+package packet_capture
+
+import (
+	"errors"
+)
+
+// AF_PACKET 仅支持 Linux, 其他平台选择该后端时返回错误
+
+func init() {
+	RegisterSource("afpacket", func(c Config) (Source, error) {
+		return nil, errors.New("afpacket capture source is only supported on linux")
+	})
+}
@@ -0,0 +1,144 @@
+//go:build linux
+
+package packet_capture
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// canCapture 是否为 root 或拥有 CAP_NET_RAW
+func canCapture() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "CapEff:") {
+			caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+			return err == nil && caps&(1<<13) != 0
+		}
+	}
+	return false
+}
+
+func TestAFPacketLoopback(t *testing.T) {
+	if !canCapture() {
+		t.Skip("AF_PACKET needs root or CAP_NET_RAW")
+	}
+	// 两个端口都不监听, 数据包照常经过 lo
+	ports := make([]int, 2)
+	for i := range ports {
+		l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[i] = l.LocalAddr().(*net.UDPAddr).Port
+		_ = l.Close()
+	}
+	wanted, other := ports[0], ports[1]
+
+	s, err := openAFPacket(Config{Device: "lo", SnapLen: 65536, BPF: fmt.Sprintf("udp and dst port %d", wanted)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	send := func(port int, payload string) {
+		conn, err := net.Dial("udp4", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte(payload))
+	}
+	for i := 0; i < 3; i++ {
+		send(other, "filtered")
+		send(wanted, fmt.Sprintf("captured-%d", i))
+	}
+
+	seen := make(map[string]bool)
+	deadline := time.Now().Add(time.Second * 5)
+	for len(seen) < 3 && time.Now().Before(deadline) {
+		data, ci, err := s.ReadPacketData()
+		if err == ErrTimeout {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		p := gopacket.NewPacket(data, s.LinkType(), gopacket.NoCopy)
+		udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok || int(udp.DstPort) != wanted {
+			t.Fatalf("filter passed %v", p)
+		}
+		if ci.CaptureLength != len(data) || ci.Timestamp.IsZero() {
+			t.Errorf("capture info %+v for %d bytes", ci, len(data))
+		}
+		if bytes.HasPrefix(udp.Payload, []byte("captured-")) {
+			seen[string(udp.Payload)] = true
+		}
+	}
+	if len(seen) != 3 {
+		t.Fatalf("captured %v, want 3 packets to port %d", seen, wanted)
+	}
+
+	// 读取过程中替换过滤器
+	if err = s.SetBPFFilter(fmt.Sprintf("udp dst port %d", other)); err != nil {
+		t.Fatal(err)
+	}
+	send(wanted, "filtered")
+	send(other, "replaced")
+	deadline = time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		data, _, err := s.ReadPacketData()
+		if err == ErrTimeout {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		p := gopacket.NewPacket(data, s.LinkType(), gopacket.NoCopy)
+		if udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP); ok && string(udp.Payload) == "replaced" {
+			if st, err := s.(*afpacketSource).Stats(); err != nil || st.Received == 0 {
+				t.Errorf("stats %+v, %v", st, err)
+			}
+			return
+		} else if ok && int(udp.DstPort) == wanted && string(udp.Payload) == "filtered" {
+			t.Fatalf("old filter still applied: %v", p)
+		}
+	}
+	t.Fatal("packet for the replaced filter not captured")
+}
+
+func TestAFPacketFilterSyntax(t *testing.T) {
+	if !canCapture() {
+		t.Skip("AF_PACKET needs root or CAP_NET_RAW")
+	}
+	s, err := openAFPacket(Config{Device: "lo", SnapLen: 65536})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// 与 pcap 数据源使用相同的 libpcap 语法
+	for _, expr := range []string{
+		"vlan and tcp", "tcp[tcpflags] & (tcp-syn|tcp-ack) != 0", "portrange 1000-2000",
+		"net 10.0.0.0/8 and not host 10.0.0.1", "ip[2:2] - ((ip[0] & 0xf) << 2) > 100", "",
+	} {
+		if err = s.SetBPFFilter(expr); err != nil {
+			t.Errorf("%q: %v", expr, err)
+		}
+	}
+	if err = s.SetBPFFilter("port abc"); err == nil {
+		t.Error("invalid expression accepted")
+	}
+}
@@ -0,0 +1,300 @@
+package packet_capture
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 离线文件数据源
+// 支持 pcap 与 pcapng (多接口、不同链路层类型), gzip 与 zstd 压缩按文件头自动识别.
+// 可指定多个文件或目录, 所有文件按首个数据包的时间排序后依次读取, 适合回放按时间切分的归档抓包;
+// 文件之间的时间范围不应重叠. 每个数据包的链路层类型放在 ci.AncillaryData 中, 与 pcapgo.NgReader 一致.
+
+func init() {
+	RegisterSource("file", openFiles)
+}
+
+var (
+	magicGzip   = []byte{0x1f, 0x8b}
+	magicZstd   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicPcapng = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+	magicPcap   = [][]byte{
+		{0xd4, 0xc3, 0xb2, 0xa1}, {0xa1, 0xb2, 0xc3, 0xd4}, // 微秒
+		{0x4d, 0x3c, 0xb2, 0xa1}, {0xa1, 0xb2, 0x3c, 0x4d}, // 纳秒
+	}
+
+	errNotCapture = errors.New("not a pcap or pcapng file")
+)
+
+// captureFile 已打开的离线文件
+type captureFile struct {
+	path    string
+	closers []func()
+	reader  interface {
+		ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	}
+	ancillary []interface{} // pcap 文件头中的链路层类型, pcapng 由 NgReader 按接口填写
+}
+
+// openCaptureFile 打开文件并识别压缩与抓包格式
+func openCaptureFile(path string) (*captureFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &captureFile{path: path, closers: []func(){func() { f.Close() }}}
+	br := bufio.NewReaderSize(f, 1<<20)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, magicGzip):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.closers = append(c.closers, func() { gz.Close() })
+		br = bufio.NewReaderSize(gz, 1<<20)
+	case bytes.HasPrefix(magic, magicZstd):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.closers = append(c.closers, zr.Close)
+		br = bufio.NewReaderSize(zr, 1<<20)
+	}
+	magic, _ = br.Peek(4)
+	if bytes.Equal(magic, magicPcapng) {
+		r, err := pcapgo.NewNgReader(br, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.reader = r
+		return c, nil
+	}
+	known := false
+	for _, m := range magicPcap {
+		known = known || bytes.Equal(magic, m)
+	}
+	if !known {
+		c.Close()
+		return nil, errNotCapture
+	}
+	r, err := pcapgo.NewReader(br)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.reader, c.ancillary = r, []interface{}{r.LinkType()}
+	return c, nil
+}
+
+// ReadPacketData 读取数据包并在 AncillaryData 中附带链路层类型
+func (c *captureFile) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := c.reader.ReadPacketData()
+	if err == nil && c.ancillary != nil {
+		ci.AncillaryData = c.ancillary
+	}
+	return data, ci, err
+}
+
+func (c *captureFile) Close() {
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i]()
+	}
+}
+
+type fileSource struct {
+	paths    []string
+	linkType layers.LinkType // 第一个数据包的链路层类型
+	snapLen  int
+	cur      *captureFile
+	next     int
+	err      error // 第一个打开或读取失败的文件, 全部文件读完后代替 io.EOF 返回
+
+	mu      sync.Mutex // 保护 BPF, SetBPFFilter 可能在其他 goroutine 中调用
+	bpf     string
+	filters map[layers.LinkType]*pcap.BPF // 按链路层类型编译, 编译失败时为 nil
+}
+
+// openFiles 展开目录并按首个数据包时间排序
+func openFiles(c Config) (Source, error) {
+	type candidate struct {
+		path    string
+		fromDir bool
+	}
+	var candidates []candidate
+	for _, p := range c.OfflineFiles {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			candidates = append(candidates, candidate{path: p})
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+				candidates = append(candidates, candidate{path: filepath.Join(p, e.Name()), fromDir: true})
+			}
+		}
+	}
+
+	type scanned struct {
+		path     string
+		first    time.Time
+		linkType layers.LinkType
+	}
+	var files []scanned
+	for _, cand := range candidates {
+		f, err := openCaptureFile(cand.path)
+		if err == errNotCapture && cand.fromDir {
+			configs.Log.Debugf("Skip offline file:%s %s", cand.path, err)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", cand.path, err)
+		}
+		_, ci, err := f.ReadPacketData()
+		f.Close()
+		if err == io.EOF {
+			configs.Log.Warnf("Skip empty offline file:%s", cand.path)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", cand.path, err)
+		}
+		lt, _ := packetLinkType(ci)
+		files = append(files, scanned{path: cand.path, first: ci.Timestamp, linkType: lt})
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no packets in offline files")
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].first.Before(files[j].first)
+	})
+
+	s := &fileSource{linkType: files[0].linkType, snapLen: c.SnapLen}
+	for _, f := range files {
+		s.paths = append(s.paths, f.path)
+	}
+	configs.Log.Infof("Offline files:%d first:%s", len(s.paths), files[0].first.Format(time.RFC3339))
+	if c.BPF != "" {
+		configs.Log.Infof("Berkeley Packet Filter:%s", c.BPF)
+		if err := s.SetBPFFilter(c.BPF); err != nil {
+			return nil, fmt.Errorf("BPF filter error: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// ReadPacketData 依次读取各文件, 文件损坏或截断时跳到下一个文件
+// 读完全部文件后, 如有文件失败则返回第一个错误, 否则返回 io.EOF
+func (s *fileSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		if s.cur == nil {
+			if s.next >= len(s.paths) {
+				if s.err != nil {
+					return nil, gopacket.CaptureInfo{}, s.err
+				}
+				return nil, gopacket.CaptureInfo{}, io.EOF
+			}
+			path := s.paths[s.next]
+			s.next++
+			f, err := openCaptureFile(path)
+			if err != nil {
+				configs.Log.Errorf("Open offline file:%s err:%s", path, err)
+				s.fail(path, err)
+				continue
+			}
+			configs.Log.Infof("Reading offline file:%s", path)
+			s.cur = f
+		}
+		data, ci, err := s.cur.ReadPacketData()
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				configs.Log.Warnf("Offline file truncated:%s", s.cur.path)
+				s.fail(s.cur.path, err)
+			} else if err != io.EOF {
+				configs.Log.Errorf("Read offline file:%s err:%s", s.cur.path, err)
+				s.fail(s.cur.path, err)
+			}
+			s.cur.Close()
+			s.cur = nil
+			continue
+		}
+		if !s.match(ci, data) {
+			continue
+		}
+		return data, ci, nil
+	}
+}
+
+// fail 记录第一个失败的文件
+func (s *fileSource) fail(path string, err error) {
+	if s.err == nil {
+		s.err = fmt.Errorf("offline file %s: %w", path, err)
+	}
+}
+
+// match 使用对应链路层类型的 BPF 过滤数据包
+func (s *fileSource) match(ci gopacket.CaptureInfo, data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bpf == "" {
+		return true
+	}
+	lt, _ := packetLinkType(ci)
+	f, ok := s.filters[lt]
+	if !ok {
+		var err error
+		if f, err = pcap.NewBPF(lt, s.snapLen, s.bpf); err != nil {
+			configs.Log.Warnf("BPF filter for link type %s err:%s, dropping its packets", lt, err)
+		}
+		s.filters[lt] = f
+	}
+	return f != nil && f.Matches(ci, data)
+}
+
+func (s *fileSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+// SetBPFFilter 按第一个文件的链路层类型校验表达式, 其他链路层类型在遇到时编译
+func (s *fileSource) SetBPFFilter(expr string) error {
+	f, err := pcap.NewBPF(s.linkType, s.snapLen, expr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bpf = expr
+	s.filters = map[layers.LinkType]*pcap.BPF{s.linkType: f}
+	return nil
+}
+
+func (s *fileSource) Close() {
+	if s.cur != nil {
+		s.cur.Close()
+		s.cur = nil
+	}
+}
@@ -0,0 +1,119 @@
+package packet_capture
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testdata/offline 中各文件首包时间与文件名顺序不同:
+// 1-late.pcapng 09:00, 2-early.pcap.gz 08:00, 3-middle.pcap.zst 08:30,
+// 4-truncated.pcap 08:45 (第二个数据包被截断), .hidden.pcap 与 notes.txt 应被跳过
+
+// readPayloads 读取数据源的全部数据包, 返回 UDP 载荷与结束时的错误 (io.EOF 时为 nil)
+func readPayloads(t *testing.T, s Source) ([]string, error) {
+	t.Helper()
+	var out []string
+	for {
+		data, ci, err := s.ReadPacketData()
+		if err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return out, err
+		}
+		if lt, ok := packetLinkType(ci); !ok || lt != layers.LinkTypeEthernet {
+			t.Errorf("packet link type %v %v", lt, ok)
+		}
+		p := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.NoCopy)
+		if udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+			out = append(out, string(udp.Payload))
+		}
+	}
+}
+
+func TestOpenFilesDirectory(t *testing.T) {
+	s, err := openFiles(Config{OfflineFiles: []string{"testdata/offline"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	want := []string{"early-0", "early-1", "middle-0", "middle-1", "truncated-0", "late-0", "late-1"}
+	got, err := readPayloads(t, s)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read %v, want %v", got, want)
+	}
+	// 截断的文件不影响后续文件, 读完后报告
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), "4-truncated.pcap") {
+		t.Errorf("got %v, want the truncated file reported", err)
+	}
+	if _, _, err = s.ReadPacketData(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("read after the end: %v", err)
+	}
+}
+
+func TestOpenCaptureFileFormats(t *testing.T) {
+	for _, name := range []string{"1-late.pcapng", "2-early.pcap.gz", "3-middle.pcap.zst", "4-truncated.pcap"} {
+		f, err := openCaptureFile(filepath.Join("testdata/offline", name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if _, _, err = f.ReadPacketData(); err != nil {
+			t.Errorf("%s: first packet: %v", name, err)
+		}
+		f.Close()
+	}
+	if _, err := openCaptureFile("testdata/offline/notes.txt"); err != errNotCapture {
+		t.Errorf("notes.txt: got %v, want %v", err, errNotCapture)
+	}
+
+	// 压缩格式按文件头识别, 与扩展名无关
+	dir := t.TempDir()
+	data, err := os.ReadFile("testdata/offline/3-middle.pcap.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "capture")
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openFiles(Config{OfflineFiles: []string{path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, err := readPayloads(t, s); err != nil || !reflect.DeepEqual(got, []string{"middle-0", "middle-1"}) {
+		t.Errorf("read %v, %v from zstd file without extension", got, err)
+	}
+}
+
+func TestOpenFilesErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pcap")
+	newTestCapture(t).write(empty)
+	for name, files := range map[string][]string{
+		"missing":       {filepath.Join(dir, "missing.pcap")},
+		"not a capture": {"testdata/offline/notes.txt"},
+		"no packets":    {empty},
+	} {
+		if _, err := openFiles(Config{OfflineFiles: files}); err == nil {
+			t.Errorf("%s: openFiles succeeded", name)
+		}
+	}
+
+	// 没有数据包的文件被跳过
+	s, err := openFiles(Config{OfflineFiles: []string{empty, "testdata/offline/2-early.pcap.gz"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, err := readPayloads(t, s); err != nil || !reflect.DeepEqual(got, []string{"early-0", "early-1"}) {
+		t.Errorf("read %v, %v", got, err)
+	}
+}
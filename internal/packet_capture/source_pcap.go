@@ -0,0 +1,73 @@
+package packet_capture
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"time"
+)
+
+// libpcap 网卡数据源
+
+func init() {
+	RegisterSource("pcap", openPcap)
+}
+
+type pcapSource struct {
+	*pcap.Handle
+}
+
+func openPcap(c Config) (Source, error) {
+	inactive, err := pcap.NewInactiveHandle(c.Device)
+	if err != nil {
+		return nil, fmt.Errorf("could not create: %w", err)
+	}
+	defer inactive.CleanUp()
+	if err = inactive.SetSnapLen(c.SnapLen); err != nil {
+		return nil, fmt.Errorf("could not set snap length: %w", err)
+	} else if err = inactive.SetPromisc(c.Promisc); err != nil {
+		return nil, fmt.Errorf("could not set promisc mode: %w", err)
+	} else if err = inactive.SetTimeout(time.Second); err != nil {
+		return nil, fmt.Errorf("could not set timeout: %w", err)
+	}
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("PCAP Activate error: %w", err)
+	}
+	// Berkeley Packet Filter 流量条件过滤
+	if c.BPF != "" {
+		configs.Log.Infof("Berkeley Packet Filter:%s", c.BPF)
+		if err = handle.SetBPFFilter(c.BPF); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("BPF filter error: %w", err)
+		}
+	}
+	return &pcapSource{Handle: handle}, nil
+}
+
+// ReadPacketData pcap 会将数据包复制到新的切片中
+func (s *pcapSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.Handle.ReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		err = ErrTimeout
+	}
+	return data, ci, err
+}
+
+func (s *pcapSource) Stats() (SourceStats, error) {
+	st, err := s.Handle.Stats()
+	if err != nil {
+		return SourceStats{}, err
+	}
+	return SourceStats{
+		Received:  uint64(st.PacketsReceived),
+		Dropped:   uint64(st.PacketsDropped),
+		IfDropped: uint64(st.PacketsIfDropped),
+	}, nil
+}
+
+func (s *pcapSource) LinkType() layers.LinkType {
+	return s.Handle.LinkType()
+}
@@ -1,15 +1,18 @@
 package packet_capture
 
 import (
+	"crypto/x509"
+	"encoding/binary"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/reassembly"
 	"github.com/sirupsen/logrus"
 	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/fingerprint"
 	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
 	"net"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 )
@@ -17,33 +20,164 @@ import (
 // Context The assembler context
 type Context struct {
 	CaptureInfo gopacket.CaptureInfo
+	FlowID      string
 }
 
 func (c *Context) GetCaptureInfo() gopacket.CaptureInfo {
 	return c.CaptureInfo
 }
 
+// TCP 流重组
+// 缓冲页数与连接数上限按 Worker 数量平分; 缓冲页达到上限时 assembler 跳过缺失的数据,
+// 连接数达到上限时关闭最久未活动的一部分连接, 关闭时照常输出已解析的记录
+
+const (
+	connEvictRatio   = 8           // 连接数达到上限时一次关闭的比例
+	connEvictBackoff = time.Second // 一次未能关闭任何连接后暂停驱逐的抓包时间
+)
+
+func init() {
+	Register("tcp", 20, func(w *Worker) Dissector {
+		c := w.engine.config
+		d := &tcpDissector{
+			factory: &tcpStreamFactory{
+				worker:   w,
+				doHTTP:   c.HTTP,
+				doDNS:    hasDissector(c.Dissectors, "dns"),
+				open:     make(map[*tcpStream]struct{}),
+				checksum: newChecksumPolicy(w, c.Checksum),
+			},
+			maxConns: perWorker(c.MaxConnections, c.Workers),
+		}
+		d.pool = reassembly.NewStreamPool(d.factory)
+		d.assembler = reassembly.NewAssembler(d.pool)
+		d.assembler.MaxBufferedPagesTotal = perWorker(c.MaxBufferedPages, c.Workers)
+		d.assembler.MaxBufferedPagesPerConnection = c.MaxBufferedPagesPerConn
+		return d
+	})
+}
+
+// perWorker 将全局上限平分给每个 Worker, 0 表示不限制
+func perWorker(limit, workers int) int {
+	if limit <= 0 || workers <= 1 {
+		return limit
+	}
+	return (limit + workers - 1) / workers
+}
+
+// tcpDissector 创建流重组连接池, 将 TCP 报文交给 assembler
+type tcpDissector struct {
+	factory   *tcpStreamFactory
+	pool      *reassembly.StreamPool
+	assembler *reassembly.Assembler
+	maxConns  int
+	nextEvict time.Time // 早于该时间的数据包不触发驱逐
+}
+
+func (d *tcpDissector) Name() string {
+	return "tcp"
+}
+
+func (d *tcpDissector) Dissect(p *Packet) bool {
+	tcpLayer := p.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		return true
+	}
+	tcp := tcpLayer.(*layers.TCP)
+	err := tcp.SetNetworkLayerForChecksum(p.NetworkLayer())
+	if err != nil {
+		configs.Log.Errorf("Failed to set network layer for checksum: %s\n", err)
+		return true
+	}
+	c := Context{
+		CaptureInfo: p.Metadata().CaptureInfo,
+		FlowID:      p.FlowID,
+	}
+	d.factory.worker.stats.totalsz += len(tcp.Payload)
+	if d.maxConns > 0 && len(d.factory.open) >= d.maxConns && !c.CaptureInfo.Timestamp.Before(d.nextEvict) {
+		d.evict(c.CaptureInfo.Timestamp)
+	}
+	d.factory.assembling = true
+	d.assembler.AssembleWithContext(p.NetworkLayer().NetworkFlow(), tcp, &c)
+	d.factory.assembling = false
+	return true
+}
+
+// evict 关闭最久未活动的 1/connEvictRatio 连接, 一个也没关闭时 (如连接仍有更新的缓冲数据)
+// 逐步扩大到 1/4、1/2 直至全部; 仍未关闭时在 connEvictBackoff 内不再尝试, 避免每个数据包都重新排序
+func (d *tcpDissector) evict(now time.Time) {
+	seen := make([]time.Time, 0, len(d.factory.open))
+	for s := range d.factory.open {
+		seen = append(seen, s.lastSeen)
+	}
+	sort.Slice(seen, func(i, j int) bool {
+		return seen[i].Before(seen[j])
+	})
+	evicted := 0
+	for n := len(seen) / connEvictRatio; ; n *= 2 {
+		if n == 0 {
+			n = 1
+		} else if n > len(seen) {
+			n = len(seen)
+		}
+		before := len(d.factory.open)
+		d.assembler.FlushCloseOlderThan(seen[n-1].Add(time.Nanosecond))
+		if evicted = before - len(d.factory.open); evicted > 0 || n == len(seen) {
+			break
+		}
+	}
+	d.factory.worker.stats.evictedConns += evicted
+	if evicted == 0 {
+		d.nextEvict = now.Add(connEvictBackoff)
+	}
+	configs.Log.Debugf("Connection limit %d reached: %d evicted", d.maxConns, evicted)
+}
+
+func (d *tcpDissector) Flush(now time.Time) {
+	flushed, closed := d.assembler.FlushWithOptions(reassembly.FlushOptions{
+		T:  now.Add(-d.factory.worker.engine.config.FlushTimeout),
+		TC: now.Add(-d.factory.worker.engine.config.CloseTimeout),
+	})
+	configs.Log.Debugf("Forced flush: %d flushed, %d closed (%s)", flushed, closed, now)
+}
+
+func (d *tcpDissector) Close() {
+	closed := d.assembler.FlushAll()
+	configs.Log.Debugf("Final flush: %d closed", closed)
+	if configs.Log.IsLevelEnabled(logrus.DebugLevel) {
+		d.pool.Dump()
+	}
+
+	d.factory.WaitGoRoutines()
+	configs.Log.Debugf("%s\n", d.assembler.Dump())
+}
+
 /**
  * The TCP factory: returns new Stream
  */
 type tcpStreamFactory struct {
-	wg     sync.WaitGroup
-	doHTTP bool
+	wg         sync.WaitGroup
+	worker     *Worker
+	doHTTP     bool
+	doDNS      bool                    // DNS over TCP 在启用 dns 解析器时输出
+	open       map[*tcpStream]struct{} // 未完成重组的连接
+	checksum   *checksumPolicy
+	assembling bool // 正在处理数据包, 此时出现的跳过是缓冲页达到上限导致的
 }
 
 func (factory *tcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
 	configs.Log.WithFields(logrus.Fields{
 		"net":          net,
 		"transport":    transport,
-		"packetCounts": COUNT,
+		"packetCounts": factory.worker.count,
 	}).Info("* NEW:")
 	fsmOptions := reassembly.TCPSimpleFSMOptions{SupportMissingEstablishment: true}
 	stream := &tcpStream{
+		factory:    factory,
+		worker:     factory.worker,
+		flowID:     ac.(*Context).FlowID,
 		net:        net,
 		transport:  transport,
-		isHTTP:     strings.Contains(tcp.DstPort.String(), "80") && factory.doHTTP,
-		isTLS:      tcp.DstPort == 443,
-		reversed:   tcp.SrcPort == 80,
 		tcpstate:   reassembly.NewTCPSimpleFSM(fsmOptions),
 		ident:      fmt.Sprintf("%s:%s", net, transport),
 		src:        net.Src().Raw(),
@@ -51,34 +185,11 @@ func (factory *tcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.T
 		optchecker: reassembly.NewTCPOptionCheck(),
 		payload:    tcp.Payload,
 		delay:      time.Now().Sub(ac.GetCaptureInfo().Timestamp),
+		firstSeen:  ac.GetCaptureInfo().Timestamp,
+		lastSeen:   ac.GetCaptureInfo().Timestamp,
 	}
-	if stream.isHTTP {
-		stream.client = httpReader{
-			bytes:    make(chan []byte),
-			ident:    fmt.Sprintf("%s %s", net, transport),
-			hexdump:  true,
-			parent:   stream,
-			isClient: true,
-		}
-		stream.server = httpReader{
-			bytes:   make(chan []byte),
-			ident:   fmt.Sprintf("%s %s", net.Reverse(), transport.Reverse()),
-			hexdump: true,
-			parent:  stream,
-		}
-		factory.wg.Add(2)
-		go stream.client.run(&factory.wg)
-		go stream.server.run(&factory.wg)
-	}
-	if stream.isTLS {
-		stream.handshake = tlsReader{
-			ident:  fmt.Sprintf("%s %s", net, transport),
-			bytes:  make(chan []byte),
-			parent: stream,
-		}
-		factory.wg.Add(1)
-		go stream.handshake.run(&factory.wg)
-	}
+	factory.open[stream] = struct{}{}
+	factory.worker.stats.openConns = len(factory.open)
 	return stream
 }
 
@@ -91,17 +202,29 @@ func (factory *tcpStreamFactory) WaitGoRoutines() {
  */
 /* It's a connection (bidirectional) */
 type tcpStream struct {
+	factory        *tcpStreamFactory
+	worker         *Worker
+	flowID         string
 	tcpstate       *reassembly.TCPSimpleFSM
 	fsmerr         bool
 	optchecker     reassembly.TCPOptionCheck
 	net, transport gopacket.Flow
+	proto          string // 按载荷识别的应用层协议, 识别前为空
+	detectChunks   int
+	clientDir      reassembly.TCPFlowDirection // 客户端发出数据的方向
 	isHTTP         bool
-	reversed       bool
 	client         httpReader
 	server         httpReader
 	handshake      tlsReader
+	dns            *dnsTCPStream
 	urls           []string
 	hostname       string
+	clientHello    *fingerprint.ClientHello
+	serverHello    *fingerprint.ServerHello
+	certificates   []*x509.Certificate
+	certTime       time.Time // 收到证书的报文时间
+	encDNS         string    // 识别为加密 DNS 时为 dot 或 doh
+	encDNSBy       string
 	ident          string
 	src            net.IP
 	dst            net.IP
@@ -116,17 +239,28 @@ type tcpStream struct {
 	downStream     int
 	packageCount   int
 	delay          time.Duration
+	firstSeen      time.Time // 第一个报文的时间, 中途开始的连接没有 startTime
+	lastSeen       time.Time
 	sync.Mutex
 }
 
+// domainTime 查询 DNS 缓存使用的时间, 没有看到连接开始时使用第一个报文的时间
+func (t *tcpStream) domainTime() time.Time {
+	if t.startTime.IsZero() {
+		return t.firstSeen
+	}
+	return t.startTime
+}
+
 func (t *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, _ reassembly.AssemblerContext) bool {
+	t.lastSeen = ci.Timestamp
 	// FSM
 	if !t.tcpstate.CheckState(tcp, dir) {
 		//configs.Log.Errorf("FSM %s: Packet rejected by FSM (state:%s)\n", t.ident, t.tcpstate.String())
-		stats.rejectFsm++
+		t.worker.stats.rejectFsm++
 		if !t.fsmerr {
 			t.fsmerr = true
-			stats.rejectConnFsm++
+			t.worker.stats.rejectConnFsm++
 		}
 
 	}
@@ -134,22 +268,10 @@ func (t *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassem
 	err := t.optchecker.Accept(tcp, ci, dir, nextSeq, start)
 	if err != nil {
 		configs.Log.Errorf("OptionChecker %s: Packet rejected by OptionChecker: %s\n", t.ident, err)
-		stats.rejectOpt++
+		t.worker.stats.rejectOpt++
 	}
 	// Checksum
-	accept := true
-	c, err := tcp.ComputeChecksum()
-	if err != nil {
-		configs.Log.Errorf("ChecksumCompute %s: Got error computing checksum: %s\n", t.ident, err)
-		accept = false
-	} else if c != 0x0 {
-		configs.Log.Errorf("Checksum %s: Invalid checksum: 0x%x\n", t.ident, c)
-		accept = false
-	}
-	if !accept {
-		stats.rejectOpt++
-	}
-	return accept
+	return t.factory.checksum.accept(tcp, ci, t.ident)
 }
 
 func (t *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
@@ -159,27 +281,30 @@ func (t *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.Ass
 	// update stats
 	sgStats := sg.Stats()
 	if skip > 0 {
-		stats.missedBytes += skip
+		t.worker.stats.missedBytes += skip
+		if t.factory.assembling {
+			t.worker.stats.bufferLimitHits++
+		}
 	}
-	stats.sz += length - saved
-	stats.pkt += sgStats.Packets
+	t.worker.stats.sz += length - saved
+	t.worker.stats.pkt += sgStats.Packets
 	if sgStats.Chunks > 1 {
-		stats.reassembled++
+		t.worker.stats.reassembled++
 	}
-	stats.outOfOrderPackets += sgStats.QueuedPackets
-	stats.outOfOrderBytes += sgStats.QueuedBytes
-	if length > stats.biggestChunkBytes {
-		stats.biggestChunkBytes = length
+	t.worker.stats.outOfOrderPackets += sgStats.QueuedPackets
+	t.worker.stats.outOfOrderBytes += sgStats.QueuedBytes
+	if length > t.worker.stats.biggestChunkBytes {
+		t.worker.stats.biggestChunkBytes = length
 	}
-	if sgStats.Packets > stats.biggestChunkPackets {
-		stats.biggestChunkPackets = sgStats.Packets
+	if sgStats.Packets > t.worker.stats.biggestChunkPackets {
+		t.worker.stats.biggestChunkPackets = sgStats.Packets
 	}
 	if sgStats.OverlapBytes != 0 && sgStats.OverlapPackets == 0 {
 		configs.Log.Infof("bytes:%d, pkts:%d\n", sgStats.OverlapBytes, sgStats.OverlapPackets)
 		panic("Invalid overlap")
 	}
-	stats.overlapBytes += sgStats.OverlapBytes
-	stats.overlapPackets += sgStats.OverlapPackets
+	t.worker.stats.overlapBytes += sgStats.OverlapBytes
+	t.worker.stats.overlapPackets += sgStats.OverlapPackets
 
 	var ident string
 	if dir == reassembly.TCPDirClientToServer {
@@ -192,9 +317,12 @@ func (t *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.Ass
 		// TODO this is allowed
 	} else if skip != 0 {
 		// TODO Missing bytes in stream: do not even try to Parse it
+		if t.isTLS {
+			t.handshake.bytes <- tlsChunk{server: dir != t.clientDir, gap: true}
+		}
 		return
 	}
-	if dir {
+	if dir == t.clientDir {
 		// 上行流量
 		t.upStream += length
 	} else {
@@ -202,50 +330,167 @@ func (t *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.Ass
 	}
 	if start {
 		t.startTime = ac.GetCaptureInfo().Timestamp
-		t.startPID = COUNT
+		t.startPID = t.worker.count
 	} else {
 		t.endTime = ac.GetCaptureInfo().Timestamp
-		t.endPID = COUNT
+		t.endPID = t.worker.count
 	}
 	data := sg.Fetch(length)
+	if t.proto == "" && length > 0 {
+		t.detect(data, dir)
+	}
 	if t.isHTTP {
 		if length > 0 {
 			// configs.Log.Debugf("Feeding http with:\n%s", hex.Dump(data))
-			if dir == reassembly.TCPDirClientToServer {
+			if dir == t.clientDir {
 				t.client.bytes <- data
 			} else {
 				t.server.bytes <- data
 			}
 		}
+	} else if t.dns != nil {
+		if length > 0 {
+			t.dns.feed(data, dir == t.clientDir, ac.GetCaptureInfo().Timestamp)
+		}
 	} else if t.isTLS {
 		if length > 0 {
-			t.handshake.bytes <- data
+			t.handshake.bytes <- tlsChunk{data: data, at: ac.GetCaptureInfo().Timestamp, server: dir != t.clientDir}
+		}
+	}
+}
+
+// detect 根据首批数据识别协议并启动对应的解析 goroutine
+func (t *tcpStream) detect(data []byte, dir reassembly.TCPFlowDirection) {
+	proto, role := detectProtocol(data)
+	if proto == "" {
+		if t.detectChunks++; t.detectChunks >= detectMaxChunks {
+			t.proto = protoUnknown
+		}
+		return
+	}
+	t.proto = proto
+	t.clientDir = reassembly.TCPDirClientToServer
+	if (role == roleClient && dir != reassembly.TCPDirClientToServer) || (role == roleServer && dir == reassembly.TCPDirClientToServer) {
+		// 首个数据包来自服务端, 记录中的源地址应为客户端
+		t.clientDir = reassembly.TCPDirServerToClient
+		t.src, t.dst = t.dst, t.src
+		t.upStream, t.downStream = t.downStream, t.upStream
+	}
+	configs.Log.Debugf("%s: Detected %s", t.ident, proto)
+	t.worker.flows.setAppProto(t.flowID, proto)
+	switch proto {
+	case protoHTTP:
+		if t.factory.doHTTP {
+			t.startHTTP()
+		}
+	case protoTLS:
+		t.startTLS()
+	case protoDNS:
+		if t.factory.doDNS {
+			t.dns = &dnsTCPStream{parent: t}
 		}
 	}
 }
 
+// ports 客户端与服务端端口
+func (t *tcpStream) ports() (client, server uint16) {
+	client = binary.BigEndian.Uint16(t.transport.Src().Raw())
+	server = binary.BigEndian.Uint16(t.transport.Dst().Raw())
+	if t.clientDir != reassembly.TCPDirClientToServer {
+		client, server = server, client
+	}
+	return client, server
+}
+
+func (t *tcpStream) startHTTP() {
+	clientNet, clientTransport := t.net, t.transport
+	if t.clientDir != reassembly.TCPDirClientToServer {
+		clientNet, clientTransport = t.net.Reverse(), t.transport.Reverse()
+	}
+	t.isHTTP = true
+	t.client = httpReader{
+		bytes:    make(chan []byte),
+		ident:    fmt.Sprintf("%s %s", clientNet, clientTransport),
+		hexdump:  true,
+		parent:   t,
+		isClient: true,
+	}
+	t.server = httpReader{
+		bytes:   make(chan []byte),
+		ident:   fmt.Sprintf("%s %s", clientNet.Reverse(), clientTransport.Reverse()),
+		hexdump: true,
+		parent:  t,
+	}
+	t.factory.wg.Add(2)
+	go t.client.run(&t.factory.wg)
+	go t.server.run(&t.factory.wg)
+}
+
+func (t *tcpStream) startTLS() {
+	t.isTLS = true
+	t.handshake = tlsReader{
+		ident:  fmt.Sprintf("%s %s", t.net, t.transport),
+		bytes:  make(chan tlsChunk),
+		done:   make(chan struct{}),
+		parent: t,
+	}
+	t.factory.wg.Add(1)
+	go t.handshake.run(&t.factory.wg)
+}
+
 func (t *tcpStream) ReassemblyComplete(_ reassembly.AssemblerContext) bool {
 	configs.Log.Debugf("%s: Connection closed\n", t.ident)
+	delete(t.factory.open, t)
+	t.worker.stats.openConns = len(t.factory.open)
 	if t.isHTTP {
 		close(t.client.bytes)
 		close(t.server.bytes)
 	}
 	if t.isTLS {
-		if len(t.hostname) > 0 {
+		// 等待握手解析完成后再输出记录
+		close(t.handshake.bytes)
+		<-t.handshake.done
+		t.Lock()
+		hostname, hello := t.hostname, t.clientHello
+		serverHello, certs, certTime := t.serverHello, t.certificates, t.certTime
+		encDNS, encDNSBy := t.encDNS, t.encDNSBy
+		t.Unlock()
+		if encDNS == "" && hello == nil {
+			// 没有抓到 ClientHello 时按端口与地址识别
+			_, port := t.ports()
+			encDNS, encDNSBy = t.worker.engine.encryptedDNS(nil, t.dst, port)
+		}
+		if encDNS == "" && t.worker.engine.config.DoHShape && dohShape(hello, &t.handshake.clientShape, &t.handshake.serverShape) && !t.worker.engine.isLocalResolver(t.dst, hostname) {
+			encDNS, encDNSBy = protoDoH, encDNSByShape
+		}
+		if encDNS != "" {
+			t.worker.flows.setAppProto(t.flowID, encDNS)
+		}
+		if len(hostname) > 0 || hello != nil || serverHello != nil {
 			httpsBson := &record.Tls{
-				SrcIP:      t.src,
-				DstIP:      t.dst,
-				Host:       t.hostname,
-				Ident:      t.ident,
-				UpStream:   t.upStream,
-				DownStream: t.downStream,
-				StartTime:  t.startTime,
-				EndTime:    t.endTime,
-				Delay:      t.delay,
+				FlowID:         t.flowID,
+				SrcIP:          t.src,
+				DstIP:          t.dst,
+				Host:           hostname,
+				Ident:          t.ident,
+				UpStream:       t.upStream,
+				DownStream:     t.downStream,
+				StartTime:      t.startTime,
+				EndTime:        t.endTime,
+				Delay:          t.delay,
+				DNSDomain:      t.worker.engine.domains.lookup(t.src, t.dst, t.domainTime()),
+				EncryptedDNS:   encDNS,
+				EncryptedDNSBy: encDNSBy,
 			}
-			httpsBson.Save2Mongo()
+			if hello != nil {
+				httpsBson.Version = fingerprint.VersionName(hello.MaxVersion())
+				httpsBson.ALPN = hello.ALPN
+				httpsBson.JA3, httpsBson.JA3Hash = hello.JA3()
+				httpsBson.JA4 = hello.JA4(fingerprint.TransportTCP)
+			}
+			setServerInfo(httpsBson, serverHello, certs, certTime)
+			t.worker.Emit(httpsBson)
 		}
-		close(t.handshake.bytes)
 	}
 	// do not remove the connection to allow last ack
 	return false
@@ -0,0 +1,169 @@
+package packet_capture
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"io"
+	"net"
+	"testing"
+)
+
+// newTCPDissector 返回单 Worker 引擎中的 TCP 解析器
+func newTCPDissector(t *testing.T, config Config) *tcpDissector {
+	t.Helper()
+	config.OfflineFiles, config.Dissectors, config.Workers = []string{engineCapture(t).file()}, []string{"tcp"}, 1
+	config.Sink = &testSink{}
+	e, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range e.workers[0].dissectors {
+		if d, ok := d.(*tcpDissector); ok {
+			t.Cleanup(d.Close)
+			return d
+		}
+	}
+	t.Fatal("no tcp dissector")
+	return nil
+}
+
+// dissect 将构造的数据包依次交给解析器, 从第 from 个开始
+func dissect(d Dissector, c *testCapture, from int) {
+	for _, tp := range c.packets[from:] {
+		gp := gopacket.NewPacket(tp.data, layers.LinkTypeEthernet, gopacket.Default)
+		gp.Metadata().CaptureInfo = tp.ci
+		d.Dissect(&Packet{Packet: gp})
+	}
+}
+
+func TestTCPEvictOldest(t *testing.T) {
+	d := newTCPDissector(t, Config{MaxConnections: 4})
+	c := newTestCapture(t)
+	for i := 0; i < 8; i++ {
+		c.tcp("10.0.0.2", "10.0.0.80", uint16(40000+i), 80).handshake().send(true, []byte("hello"))
+		dissect(d, c, len(c.packets)-4)
+		if n := len(d.factory.open); n > 4 {
+			t.Fatalf("%d connections open after connection %d, limit 4", n, i)
+		}
+	}
+	if n := d.factory.worker.stats.evictedConns; n < 4 {
+		t.Errorf("evicted %d connections, want at least 4", n)
+	}
+	for s := range d.factory.open {
+		if s.transport.Src().String() < "40004" {
+			t.Errorf("old connection %s still open", s.ident)
+		}
+	}
+}
+
+func TestTCPEvictBackoff(t *testing.T) {
+	d := newTCPDissector(t, Config{MaxConnections: 4})
+	// 流重组之外的连接, 驱逐无法关闭它们
+	for i := 0; i < 4; i++ {
+		d.factory.open[&tcpStream{lastSeen: testStart}] = struct{}{}
+	}
+	c := newTestCapture(t)
+	c.tcp("10.0.0.2", "10.0.0.80", 40000, 80).handshake()
+	dissect(d, c, 0)
+	first := c.packets[0].ci.Timestamp
+	if want := first.Add(connEvictBackoff); !d.nextEvict.Equal(want) {
+		t.Fatalf("next eviction at %s, want %s", d.nextEvict, want)
+	}
+	if n := d.factory.worker.stats.evictedConns; n != 0 {
+		t.Fatalf("evicted %d connections", n)
+	}
+
+	// 暂停结束后扩大范围, 关闭更新的真实连接
+	c.ts = first.Add(connEvictBackoff * 2)
+	c.tcp("10.0.0.2", "10.0.0.80", 40001, 80).segment(true, &layers.TCP{SYN: true}, nil)
+	dissect(d, c, 3)
+	if n := d.factory.worker.stats.evictedConns; n != 1 {
+		t.Errorf("evicted %d connections after the backoff, want 1", n)
+	}
+	if !d.nextEvict.Equal(first.Add(connEvictBackoff)) {
+		t.Errorf("next eviction moved to %s after a successful pass", d.nextEvict)
+	}
+	if n := len(d.factory.open); n != 5 {
+		t.Errorf("%d connections open, want the 4 untracked and the new one", n)
+	}
+}
+
+// testClientHello 由 crypto/tls 生成的 ClientHello 记录
+func testClientHello(t *testing.T, sni string, alpn ...string) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		_ = tls.Client(c, &tls.Config{ServerName: sni, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+	}()
+	defer c.Close()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(s, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[3:]))
+	if _, err := io.ReadFull(s, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(hdr, body...)
+}
+
+// testServerHello 选择 TLS_AES_128_GCM_SHA256 与 TLS 1.3 的 ServerHello 记录
+func testServerHello() []byte {
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0, 0x13, 0x01, 0)    // session id, cipher suite, compression
+	body = append(body, 0, 6, 0, 0x2b, 0, 2, 0x03, 0x04)
+	msg := append([]byte{0x02, 0, 0, byte(len(body))}, body...)
+	return append([]byte{0x16, 0x03, 0x03, 0, byte(len(msg))}, msg...)
+}
+
+func TestTCPServerFirstCounters(t *testing.T) {
+	serverHello := testServerHello()
+	ccs := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+	c := newTestCapture(t)
+	conn := c.tcp("10.0.0.2", "93.184.216.34", 40000, 443)
+	// 抓包从服务端的 SYN-ACK 开始, 重组器把服务端当作发起方, 服务端先发出数据
+	conn.segment(false, &layers.TCP{SYN: true, ACK: true}, nil)
+	conn.send(false, serverHello)
+	conn.send(true, ccs)
+	conn.close()
+
+	s := runCapture(t, Config{Dissectors: []string{"tcp"}, Workers: 1}, c.file())
+	tlss := s.kind(record.ProtocolHTTPS)
+	if len(tlss) != 1 {
+		t.Fatalf("got %d tls records, want 1", len(tlss))
+	}
+	r := tlss[0].(*record.Tls)
+	if r.SrcIPStr != "10.0.0.2" || r.DstIPStr != "93.184.216.34" || r.CipherSuite == "" {
+		t.Errorf("record %s -> %s cipher suite %q", r.SrcIPStr, r.DstIPStr, r.CipherSuite)
+	}
+	if r.UpStream != len(ccs) || r.DownStream != len(serverHello) {
+		t.Errorf("up %d down %d bytes, want %d and %d", r.UpStream, r.DownStream, len(ccs), len(serverHello))
+	}
+}
+
+func TestTCPClientFirstCounters(t *testing.T) {
+	hello := testClientHello(t, "example.com")
+	c := newTestCapture(t)
+	conn := c.tcp("10.0.0.2", "93.184.216.34", 40000, 443).handshake()
+	conn.send(true, hello)
+	conn.send(false, testServerHello())
+	conn.close()
+
+	s := runCapture(t, Config{Dissectors: []string{"tcp"}, Workers: 1}, c.file())
+	tlss := s.kind(record.ProtocolHTTPS)
+	if len(tlss) != 1 {
+		t.Fatalf("got %d tls records, want 1", len(tlss))
+	}
+	r := tlss[0].(*record.Tls)
+	if r.SrcIPStr != "10.0.0.2" || r.Host != "example.com" {
+		t.Errorf("record %s -> %s host %q", r.SrcIPStr, r.DstIPStr, r.Host)
+	}
+	if r.UpStream != len(hello) || r.DownStream != len(testServerHello()) {
+		t.Errorf("up %d down %d bytes, want %d and %d", r.UpStream, r.DownStream, len(hello), len(testServerHello()))
+	}
+}
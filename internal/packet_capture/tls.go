@@ -1,19 +1,44 @@
 package packet_capture
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"github.com/srun-soft/dpi-analysis-toolkit/configs"
-	"github.com/srun-soft/dpi-analysis-toolkit/internal/utils"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/fingerprint"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
 	"sync"
+	"time"
 )
 
 // tls 协议
-// 通过 handshake 获取 hostname
+// 两个方向分别拼接 TLS 记录并拆分握手消息, 握手消息可以跨越多个 TCP 分段与多个记录;
+// 客户端取得 hostname 与 ClientHello 指纹, 服务端取得 ServerHello 与 TLS 1.2 及以下的证书链
+
+const (
+	tlsMaxRecord    = 16384 + 2048 // 记录长度上限, 见 RFC 5246 6.2.3
+	tlsMaxHandshake = 256 << 10    // 每个方向解析的握手数据上限
+)
+
+// tlsChunk 一段重组后的数据
+type tlsChunk struct {
+	data   []byte
+	at     time.Time // 数据所在报文的抓包时间
+	server bool      // 服务端发出
+	gap    bool      // 该方向有数据缺失
+}
 
 type tlsReader struct {
 	ident    string
 	hostname string
 	parent   *tcpStream
-	bytes    chan []byte
+	bytes    chan tlsChunk
+	done     chan struct{} // run 退出时关闭
+	client   tlsHandshake
+	server   tlsHandshake
+	// 应用数据记录的形态, 服务端从客户端发出应用数据后开始统计, 跳过 TLS 1.3 加密的握手消息
+	clientShape tlsRecordShape
+	serverShape tlsRecordShape
 }
 
 func (t *tlsReader) Read(p []byte) (n int, err error) {
@@ -22,22 +47,182 @@ func (t *tlsReader) Read(p []byte) (n int, err error) {
 
 func (t *tlsReader) run(wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer close(t.done)
 	for {
-		data, ok := <-t.bytes
+		chunk, ok := <-t.bytes
 		if !ok {
 			break
 		}
-		if len(data) < 42 || data[0] != 0x16 || data[5] != 0x01 {
-			continue
+		h, shape := &t.client, &t.clientShape
+		if chunk.server {
+			h, shape = &t.server, &t.serverShape
 		}
-		hostname := utils.GetServerExtensionName(data[5:])
-		if len(hostname) > 0 {
-			t.parent.Lock()
-			t.parent.hostname = hostname
-			t.parent.Unlock()
-		} else {
+		if chunk.gap {
+			// 数据缺失后无法确定记录边界
+			h.stop()
+			shape.stop()
 			continue
 		}
-		configs.Log.Warn("Server Host Indication is ", hostname)
+		shape.feed(chunk.data, !chunk.server || t.clientShape.records > 0)
+		for _, msg := range h.feed(chunk.data) {
+			if chunk.server {
+				t.handleServer(msg, chunk.at)
+			} else {
+				t.handleClient(msg)
+			}
+		}
+		if h.overflow {
+			configs.Log.Debugf("%s: TLS handshake exceeds %d bytes, stop parsing", t.ident, tlsMaxHandshake)
+			h.overflow = false
+		}
+	}
+}
+
+// handleClient 处理客户端的握手消息
+func (t *tlsReader) handleClient(msg []byte) {
+	if msg[0] != fingerprint.HandshakeClientHello {
+		return
+	}
+	hello, err := fingerprint.ParseClientHello(msg)
+	if err != nil {
+		configs.Log.Debugf("%s: ClientHello err:%s", t.ident, err)
+		return
+	}
+	_, port := t.parent.ports()
+	encDNS, by := t.parent.worker.engine.encryptedDNS(hello, t.parent.dst, port)
+	t.parent.Lock()
+	t.parent.clientHello = hello
+	if len(hello.ServerName) > 0 {
+		t.parent.hostname = hello.ServerName
+		t.parent.worker.flows.setSNI(t.parent.flowID, hello.ServerName)
+	}
+	if encDNS != "" {
+		t.parent.encDNS, t.parent.encDNSBy = encDNS, by
+		t.parent.worker.flows.setAppProto(t.parent.flowID, encDNS)
+	}
+	t.parent.Unlock()
+	if len(hello.ServerName) > 0 {
+		configs.Log.Warn("Server Host Indication is ", hello.ServerName)
+	}
+}
+
+// handleServer 处理服务端的握手消息, at 为携带该消息的报文时间
+func (t *tlsReader) handleServer(msg []byte, at time.Time) {
+	switch msg[0] {
+	case fingerprint.HandshakeServerHello:
+		hello, err := fingerprint.ParseServerHello(msg)
+		if err != nil {
+			configs.Log.Debugf("%s: ServerHello err:%s", t.ident, err)
+			return
+		}
+		if hello.HelloRetryRequest {
+			return
+		}
+		t.parent.Lock()
+		t.parent.serverHello = hello
+		t.parent.Unlock()
+	case fingerprint.HandshakeCertificate:
+		certs, err := fingerprint.ParseCertificates(msg)
+		if err != nil {
+			configs.Log.Debugf("%s: Certificate err:%s", t.ident, err)
+		}
+		if len(certs) == 0 {
+			return
+		}
+		t.parent.Lock()
+		t.parent.certificates, t.parent.certTime = certs, at
+		t.parent.Unlock()
+	}
+}
+
+// tlsHandshake 拼接一个方向的 TLS 记录并拆分出握手消息,
+// 遇到 ChangeCipherSpec、加密数据、非 TLS 数据或超过 tlsMaxHandshake 后停止
+type tlsHandshake struct {
+	records  []byte // 未处理完的记录层数据
+	msgs     []byte // 未处理完的握手消息
+	total    int    // 已接收的数据量
+	stopped  bool
+	overflow bool // 因超过上限停止
+}
+
+// feed 追加数据, 返回已完整的握手消息
+func (h *tlsHandshake) feed(data []byte) [][]byte {
+	if h.stopped {
+		return nil
+	}
+	if h.total += len(data); h.total > tlsMaxHandshake {
+		h.stop()
+		h.overflow = true
+		return nil
+	}
+	h.records = append(h.records, data...)
+	var out [][]byte
+	for len(h.records) >= 5 {
+		if !isTLSRecord(h.records) || h.records[0] != 0x16 {
+			h.stop()
+			break
+		}
+		n := 5 + (int(h.records[3])<<8 | int(h.records[4]))
+		if n > 5+tlsMaxRecord {
+			h.stop()
+			break
+		}
+		if len(h.records) < n {
+			break
+		}
+		h.msgs = append(h.msgs, h.records[5:n]...)
+		h.records = h.records[n:]
+		for len(h.msgs) >= 4 {
+			l := 4 + (int(h.msgs[1])<<16 | int(h.msgs[2])<<8 | int(h.msgs[3]))
+			if l > tlsMaxHandshake {
+				h.stop()
+				h.overflow = true
+				return out
+			}
+			if len(h.msgs) < l {
+				break
+			}
+			out = append(out, h.msgs[:l])
+			h.msgs = h.msgs[l:]
+		}
+	}
+	return out
+}
+
+func (h *tlsHandshake) stop() {
+	h.stopped = true
+	h.records, h.msgs = nil, nil
+}
+
+// setServerInfo 填写 ServerHello 与服务端证书, at 为收到证书的报文时间, 证书有效期按它判断
+func setServerInfo(r *record.Tls, hello *fingerprint.ServerHello, certs []*x509.Certificate, at time.Time) {
+	if hello != nil {
+		r.ServerVersion = fingerprint.VersionName(hello.NegotiatedVersion())
+		r.CipherSuite = fingerprint.CipherSuiteName(hello.CipherSuite)
+		r.JA3S, r.JA3SHash = hello.JA3S()
+		r.JA4S = hello.JA4S(fingerprint.TransportTCP)
+	}
+	if len(certs) == 0 {
+		return
+	}
+	for _, c := range certs {
+		sum := sha256.Sum256(c.Raw)
+		sans := append([]string(nil), c.DNSNames...)
+		for _, ip := range c.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+		r.Certificates = append(r.Certificates, record.Certificate{
+			Subject:   c.Subject.String(),
+			Issuer:    c.Issuer.String(),
+			SANs:      sans,
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+			Serial:    c.SerialNumber.Text(16),
+			SHA256:    hex.EncodeToString(sum[:]),
+		})
 	}
+	leaf := certs[0]
+	r.CertExpired = at.Before(leaf.NotBefore) || at.After(leaf.NotAfter)
+	r.CertSelfSigned = string(leaf.RawIssuer) == string(leaf.RawSubject) && leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil
+	r.CertMismatch = r.Host != "" && leaf.VerifyHostname(r.Host) != nil
 }
@@ -0,0 +1,273 @@
+package packet_capture
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCert 生成证书, parent 为 nil 时自签名
+func testCert(t *testing.T, name string, notBefore, notAfter time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(notBefore.Unix()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// tlsRecord 把握手消息封装为一个握手记录
+func tlsRecord(msgs ...[]byte) []byte {
+	var body []byte
+	for _, m := range msgs {
+		body = append(body, m...)
+	}
+	return append([]byte{0x16, 0x03, 0x03, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// handshakeMsg 从握手类型开始的握手消息
+func handshakeMsg(typ byte, body []byte) []byte {
+	return append([]byte{typ, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// testServerFlight TLS 1.2 的 ServerHello 与 Certificate 记录
+func testServerFlight(certs ...*x509.Certificate) []byte {
+	hello := []byte{0x03, 0x03}
+	hello = append(hello, make([]byte, 32)...) // random
+	hello = append(hello, 0, 0xc0, 0x2f, 0)    // session id, cipher suite, compression
+	var list []byte
+	for _, c := range certs {
+		list = append(list, byte(len(c.Raw)>>16), byte(len(c.Raw)>>8), byte(len(c.Raw)))
+		list = append(list, c.Raw...)
+	}
+	list = append([]byte{byte(len(list) >> 16), byte(len(list) >> 8), byte(len(list))}, list...)
+	return tlsRecord(handshakeMsg(0x02, hello), handshakeMsg(0x0b, list))
+}
+
+func TestTLSCertificateFlags(t *testing.T) {
+	// 证书有效期按抓包时间判断, 与运行测试的时间无关
+	ca, caKey := testCert(t, "Test CA", testStart.AddDate(-1, 0, 0), testStart.AddDate(1, 0, 0), nil, nil)
+	valid, _ := testCert(t, "example.com", testStart.AddDate(0, -1, 0), testStart.AddDate(0, 1, 0), ca, caKey)
+	expired, _ := testCert(t, "example.com", testStart.AddDate(0, -2, 0), testStart.AddDate(0, -1, 0), ca, caKey)
+	notYet, _ := testCert(t, "example.com", testStart.Add(time.Hour), testStart.AddDate(0, 1, 0), ca, caKey)
+	self, _ := testCert(t, "example.com", testStart.AddDate(0, -1, 0), testStart.AddDate(0, 1, 0), nil, nil)
+	other, _ := testCert(t, "example.org", testStart.AddDate(0, -1, 0), testStart.AddDate(0, 1, 0), ca, caKey)
+
+	for _, tt := range []struct {
+		name                       string
+		midstream                  bool // 没有抓到三次握手
+		certs                      []*x509.Certificate
+		expired, selfSigned, wrong bool
+	}{
+		{"valid", false, []*x509.Certificate{valid, ca}, false, false, false},
+		{"valid midstream", true, []*x509.Certificate{valid, ca}, false, false, false},
+		{"expired", false, []*x509.Certificate{expired, ca}, true, false, false},
+		{"not yet valid", false, []*x509.Certificate{notYet, ca}, true, false, false},
+		{"self-signed", false, []*x509.Certificate{self}, false, true, false},
+		{"sni mismatch", false, []*x509.Certificate{other, ca}, false, false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCapture(t)
+			conn := c.tcp("10.0.0.2", "93.184.216.34", 40000, 443)
+			if !tt.midstream {
+				conn.handshake()
+			}
+			conn.send(true, testClientHello(t, "example.com"))
+			conn.send(false, testServerFlight(tt.certs...))
+			conn.close()
+
+			s := runCapture(t, Config{Dissectors: []string{"tcp"}, Workers: 1}, c.file())
+			tlss := s.kind(record.ProtocolHTTPS)
+			if len(tlss) != 1 {
+				t.Fatalf("got %d tls records, want 1", len(tlss))
+			}
+			r := tlss[0].(*record.Tls)
+			if len(r.Certificates) != len(tt.certs) || r.CipherSuite != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" {
+				t.Fatalf("%d certificates, cipher suite %q", len(r.Certificates), r.CipherSuite)
+			}
+			if r.CertExpired != tt.expired || r.CertSelfSigned != tt.selfSigned || r.CertMismatch != tt.wrong {
+				t.Errorf("expired %v self-signed %v mismatch %v", r.CertExpired, r.CertSelfSigned, r.CertMismatch)
+			}
+		})
+	}
+}
+
+func TestTLSHandshakeFeed(t *testing.T) {
+	rec := testClientHello(t, "example.com", "h2")
+	hello := rec[5:]
+	// 同一个 ClientHello 拆成两个记录
+	split := append(tlsRecord(hello[:40]), tlsRecord(hello[40:])...)
+	flight := testServerFlight()
+	for _, tt := range []struct {
+		name   string
+		data   []byte
+		chunks []int // 每段数据的长度, 最后一段取剩余数据
+		want   [][]byte
+	}{
+		{"one segment", rec, nil, [][]byte{hello}},
+		{"split header", rec, []int{3, 4}, [][]byte{hello}},
+		{"byte by byte", rec, repeatInt(1, len(rec)), [][]byte{hello}},
+		{"two records", split, nil, [][]byte{hello}},
+		{"two records across segments", split, []int{20, 30, 10}, [][]byte{hello}},
+		{"two messages in a record", flight, []int{50}, [][]byte{flight[5:47], flight[47:]}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var h tlsHandshake
+			var got [][]byte
+			data := tt.data
+			for _, n := range append(tt.chunks, len(data)) {
+				if n > len(data) {
+					n = len(data)
+				}
+				for _, m := range h.feed(data[:n]) {
+					got = append(got, append([]byte(nil), m...))
+				}
+				data = data[n:]
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %d messages, want %d", len(got), len(tt.want))
+			}
+			if h.stopped || h.overflow || len(h.records) != 0 || len(h.msgs) != 0 {
+				t.Errorf("stopped %v overflow %v, %d record and %d message bytes left", h.stopped, h.overflow, len(h.records), len(h.msgs))
+			}
+		})
+	}
+}
+
+func repeatInt(v, n int) []int {
+	s := make([]int, n)
+	for i := range s {
+		s[i] = v
+	}
+	return s
+}
+
+func TestTLSHandshakeStop(t *testing.T) {
+	// 握手消息之后的 ChangeCipherSpec 停止解析, 之前的消息仍然返回
+	var h tlsHandshake
+	rec := testClientHello(t, "example.com")
+	msgs := h.feed(append(append([]byte(nil), rec...), 0x14, 0x03, 0x03, 0x00, 0x01, 0x01))
+	if len(msgs) != 1 || !h.stopped || h.overflow {
+		t.Errorf("got %d messages, stopped %v overflow %v", len(msgs), h.stopped, h.overflow)
+	}
+	if msgs = h.feed(rec); msgs != nil {
+		t.Errorf("got %d messages after stopping", len(msgs))
+	}
+
+	for name, data := range map[string][]byte{
+		"application data": {0x17, 0x03, 0x03, 0x00, 0x01, 0x00},
+		"not tls":          []byte("GET / HTTP/1.1\r\n"),
+		"record too long":  {0x16, 0x03, 0x03, 0xff, 0xff},
+	} {
+		var h tlsHandshake
+		if msgs := h.feed(data); msgs != nil || !h.stopped || h.overflow {
+			t.Errorf("%s: got %d messages, stopped %v overflow %v", name, len(msgs), h.stopped, h.overflow)
+		}
+	}
+}
+
+func TestTLSHandshakeLimit(t *testing.T) {
+	// 证书消息正好等于上限, 分成多个最大长度的记录
+	body := make([]byte, tlsMaxHandshake-4)
+	msg := handshakeMsg(0x0b, body)
+	var stream []byte
+	for len(msg) > 0 {
+		n := tlsMaxRecord
+		if n > len(msg) {
+			n = len(msg)
+		}
+		stream = append(stream, tlsRecord(msg[:n])...)
+		msg = msg[n:]
+	}
+	var h tlsHandshake
+	// 加上记录头后接收的数据超过上限, 超过时停止并丢弃已缓存的数据
+	var got int
+	for i := 0; i < len(stream); i += 1460 {
+		end := i + 1460
+		if end > len(stream) {
+			end = len(stream)
+		}
+		got += len(h.feed(stream[i:end]))
+		if h.total > tlsMaxHandshake != h.overflow {
+			t.Fatalf("received %d bytes, overflow %v", h.total, h.overflow)
+		}
+	}
+	if got != 0 || !h.stopped || !h.overflow || h.records != nil || h.msgs != nil {
+		t.Errorf("got %d messages, stopped %v overflow %v", got, h.stopped, h.overflow)
+	}
+
+	// 声明的握手消息长度超过上限时不再等待其余数据
+	h = tlsHandshake{}
+	oversized := tlsRecord(handshakeMsg(0x0b, nil))
+	n := tlsMaxHandshake + 1
+	oversized[6], oversized[7], oversized[8] = byte(n>>16), byte(n>>8), byte(n)
+	if msgs := h.feed(oversized); msgs != nil || !h.stopped || !h.overflow {
+		t.Errorf("oversized message: got %d messages, stopped %v overflow %v", len(msgs), h.stopped, h.overflow)
+	}
+
+	// 上限以内的数据正常解析
+	h = tlsHandshake{}
+	rec := testClientHello(t, "example.com")
+	h.total = tlsMaxHandshake - len(rec)
+	if msgs := h.feed(rec); len(msgs) != 1 || h.stopped || h.overflow {
+		t.Errorf("at the limit: got %d messages, stopped %v overflow %v", len(msgs), h.stopped, h.overflow)
+	}
+}
+
+func TestTLSDoHShape(t *testing.T) {
+	// h2 连接两个方向都只有小的应用数据记录, 与 DoH 和 gRPC 等 API 调用的形态相同
+	c := newTestCapture(t)
+	conn := c.tcp("10.0.0.2", "203.0.113.10", 40000, 443).handshake()
+	conn.send(true, testClientHello(t, "api.example.com", "h2"))
+	conn.send(false, testServerHello())
+	for i := 0; i < encDNSMinRecords; i++ {
+		conn.send(true, []byte{0x17, 0x03, 0x03, 0x00, 0x40})
+		conn.send(true, make([]byte, 0x40))
+		conn.send(false, append([]byte{0x17, 0x03, 0x03, 0x00, 0x80}, make([]byte, 0x80)...))
+	}
+	conn.close()
+	path := c.file()
+
+	for _, shape := range []bool{false, true} {
+		s := runCapture(t, Config{Dissectors: []string{"tcp"}, Workers: 1, DoHShape: shape}, path)
+		tlss := s.kind(record.ProtocolHTTPS)
+		if len(tlss) != 1 {
+			t.Fatalf("shape %v: got %d tls records, want 1", shape, len(tlss))
+		}
+		r := tlss[0].(*record.Tls)
+		want, wantBy := "", ""
+		if shape {
+			want, wantBy = protoDoH, encDNSByShape
+		}
+		if r.EncryptedDNS != want || r.EncryptedDNSBy != wantBy {
+			t.Errorf("shape %v: encrypted dns %q by %q, want %q by %q", shape, r.EncryptedDNS, r.EncryptedDNSBy, want, wantBy)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package packet_capture
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"sync"
+	"time"
+)
+
+// 多核并行
+// 抓包 goroutine 只做轻量解析, 按对称 5 元组哈希将数据包分发到 Worker,
+// 同一条流两个方向的数据包落在同一个 Worker 上, 每个 Worker 持有独立的解析器实例
+// (TCP 重组、流表等), 状态不需要加锁. IPv4 分片在分发前由 RegisterPreShard 注册的解析器处理.
+
+const (
+	workerQueueSize     = 4096
+	workerFlushInterval = time.Second // 按抓包时间周期性刷新所有 Worker
+)
+
+// Worker 处理一部分流量的工作 goroutine
+type Worker struct {
+	id         int
+	engine     *Engine
+	dissectors []Dissector
+	flows      *flowTable // 未启用 flow 解析器时为 nil
+	stats      stats
+	count      int // 当前数据包的抓包序号
+	queue      chan workItem
+
+	mu        sync.Mutex
+	published stats // 周期性发布的 stats 副本, 供其他 goroutine 读取
+}
+
+// workItem 交给 Worker 的数据包或刷新指令
+type workItem struct {
+	packet  *Packet // 抓包 goroutine 已解码的数据包, 为空时由 Worker 解码 data
+	data    []byte
+	ci      gopacket.CaptureInfo
+	decoder gopacket.Decoder // 链路层解码器
+	index   int
+	flush   time.Time // 不为零时刷新解析器状态
+}
+
+func newWorker(e *Engine, id int, regs []registration) *Worker {
+	w := &Worker{
+		id:     id,
+		engine: e,
+		queue:  make(chan workItem, workerQueueSize),
+	}
+	for _, r := range regs {
+		w.dissectors = append(w.dissectors, r.factory(w))
+	}
+	return w
+}
+
+// ID 返回 Worker 编号, 分片前解析器所在的抓包 goroutine 为 -1
+func (w *Worker) ID() int {
+	return w.id
+}
+
+// Engine 返回所属引擎
+func (w *Worker) Engine() *Engine {
+	return w.engine
+}
+
+// Emit 写入记录, 见 Engine.Emit
+func (w *Worker) Emit(r record.Protocol) {
+	w.engine.Emit(r)
+}
+
+func (w *Worker) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for item := range w.queue {
+		if !item.flush.IsZero() {
+			w.flush(item.flush)
+			w.publish()
+			continue
+		}
+		p := item.packet
+		if p == nil {
+			if p = w.decode(item); p == nil {
+				continue
+			}
+		}
+		w.dissect(p)
+	}
+	w.close()
+	w.publish()
+}
+
+// publish 发布当前 stats, 只在 Worker 自己的 goroutine 中调用
+func (w *Worker) publish() {
+	w.mu.Lock()
+	w.published = w.stats
+	w.mu.Unlock()
+}
+
+// snapshot 返回最近一次发布的 stats
+func (w *Worker) snapshot() stats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.published
+}
+
+// decode 解码数据包, 没有 IP 层时返回 nil
+func (w *Worker) decode(item workItem) *Packet {
+	packet := gopacket.NewPacket(item.data, item.decoder, gopacket.DecodeOptions{NoCopy: true})
+	m := packet.Metadata()
+	m.CaptureInfo = item.ci
+	m.Truncated = m.Truncated || item.ci.CaptureLength < item.ci.Length
+	p := &Packet{Packet: packet, Index: item.index}
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		p.SrcIP, p.DstIP, p.TTL = ip.SrcIP, ip.DstIP, ip.TTL
+	case *layers.IPv6:
+		p.SrcIP, p.DstIP, p.TTL = ip.SrcIP, ip.DstIP, ip.HopLimit
+	default:
+		return nil
+	}
+	return p
+}
+
+// dissect 依次交给解析器, 返回 false 表示数据包已被消费
+func (w *Worker) dissect(p *Packet) bool {
+	w.count = p.Index
+	for _, d := range w.dissectors {
+		if !d.Dissect(p) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *Worker) flush(now time.Time) {
+	for _, d := range w.dissectors {
+		if f, ok := d.(Flusher); ok {
+			f.Flush(now)
+		}
+	}
+}
+
+// close 逆序关闭, 保证 TCP 流结束时写入的信息在流表输出前到达
+func (w *Worker) close() {
+	for i := len(w.dissectors) - 1; i >= 0; i-- {
+		if c, ok := w.dissectors[i].(Closer); ok {
+			c.Close()
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package record
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net"
+	"time"
+)
+
+// Alert 分析器输出的告警
+// Evidence 为触发告警时窗口内的统计值, 键由分析器定义
+
+type Alert struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Analyzer  string             `bson:"analyzer"`
+	Type      string             `bson:"type"` // 如 dns_tunnel, dga
+	SrcIP     net.IP             `bson:"src_ip"`
+	SrcIPStr  string             `bson:"src_ip_str"`
+	UserName  string             `bson:"user_name"` // 客户端地址所属的 RADIUS 用户
+	Zone      string             `bson:"zone"`      // 告警涉及的区域, 不针对单个区域时为空
+	Score     int                `bson:"score"`     // 命中的指标数
+	Reasons   []string           `bson:"reasons"`   // 命中的指标
+	Evidence  map[string]int     `bson:"evidence"`
+	Samples   []string           `bson:"samples,omitempty"` // 可疑的查询名称
+	StartTime time.Time          `bson:"start_time"`        // 统计窗口开始时间
+	Timestamp time.Time          `bson:"timestamp"`         // 触发告警的记录时间
+}
+
+func (a *Alert) Parse() {
+	a.SrcIPStr = a.SrcIP.String()
+}
+
+func (a *Alert) Kind() string {
+	return ProtocolAlert
+}
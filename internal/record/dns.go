@@ -1,9 +1,6 @@
 package record
 
 import (
-	"context"
-	"github.com/srun-soft/dpi-analysis-toolkit/configs"
-	"github.com/srun-soft/dpi-analysis-toolkit/internal/database"
 	"github.com/srun-soft/dpi-analysis-toolkit/internal/utils"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net"
@@ -11,32 +8,54 @@ import (
 )
 
 // DNS Protocol Analyze
+// 查询与应答各输出一条记录, 应答的 Latency 为与对应查询的时间差
 
 type Dns struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty"`
-	SrcIP    net.IP             `bson:"src_ip"`
-	DstIP    net.IP             `bson:"dst_ip"`
-	SrcIPStr string             `bson:"src_ip_str"`
-	DstIPStr string             `bson:"dst_ip_str"`
-	Host     string             `bson:"host"`
-	Domain   string             `bson:"domain"`
-	Suffix   string             `bson:"suffix"`
-	Type     string             `bson:"type"`
-	Class    string             `bson:"class"`
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	FlowID    string             `bson:"flow_id"`
+	SrcIP     net.IP             `bson:"src_ip"`
+	DstIP     net.IP             `bson:"dst_ip"`
+	SrcIPStr  string             `bson:"src_ip_str"`
+	DstIPStr  string             `bson:"dst_ip_str"`
+	UserName  string             `bson:"user_name"`
+	SrcPort   uint16             `bson:"src_port"`
+	DstPort   uint16             `bson:"dst_port"`
+	Transport string             `bson:"transport"` // udp 或 tcp
+	Host      string             `bson:"host"`      // 第一个问题的名称
+	Domain    string             `bson:"domain"`
+	Suffix    string             `bson:"suffix"`
+	Type      string             `bson:"type"`
+	Class     string             `bson:"class"`
+	TxID      uint16             `bson:"tx_id"`
+	Response  bool               `bson:"response"`
+	OpCode    string             `bson:"opcode"`
+	RCode     string             `bson:"rcode"` // 如 NOERROR, NXDOMAIN
+	Questions []DnsQuestion      `bson:"questions"`
+	Answers   []DnsAnswer        `bson:"answers,omitempty"`
+	CNAMEs    []string           `bson:"cnames,omitempty"` // 应答中按顺序出现的 CNAME
+	Size      int                `bson:"size"`             // 消息长度
+	Timestamp time.Time          `bson:"timestamp"`        // 抓包时间
+	Latency   time.Duration      `bson:"latency"`          // 未匹配到查询时为 0
+}
+
+type DnsQuestion struct {
+	Name  string `bson:"name"`
+	Type  string `bson:"type"`
+	Class string `bson:"class"`
+}
+
+type DnsAnswer struct {
+	Name string `bson:"name"`
+	Type string `bson:"type"`
+	TTL  uint32 `bson:"ttl"`
+	Data string `bson:"data"` // 地址、目标域名或按 zone 文件格式展示的内容
 }
 
 func (d *Dns) Parse() {
 	d.Domain, d.Suffix = utils.ParseHost(d.Host)
+	d.SrcIPStr, d.DstIPStr = d.SrcIP.String(), d.DstIP.String()
 }
 
-func (d *Dns) Save2Mongo() {
-	d.Parse()
-
-	mongo := database.MongoDB.Database(ProtocolDNS)
-	one, err := mongo.Collection(time.Now().Format("C_2006_01_02_15")).InsertOne(context.TODO(), d)
-	if err != nil {
-		configs.Log.Errorf("Save2Mongo protocol dns2mongo err:%s", err)
-		return
-	}
-	configs.Log.Debugf("Save2Mongo protocol dns2mongo id:%s", one)
+func (d *Dns) Kind() string {
+	return ProtocolDNS
 }
@@ -0,0 +1,50 @@
+package record
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net"
+	"time"
+)
+
+// Flow 双向流统计
+
+type Flow struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	FlowID      string             `bson:"flow_id"`
+	Proto       string             `bson:"proto"`
+	SrcIP       net.IP             `bson:"src_ip"`
+	DstIP       net.IP             `bson:"dst_ip"`
+	SrcIPStr    string             `bson:"src_ip_str"`
+	DstIPStr    string             `bson:"dst_ip_str"`
+	UserName    string             `bson:"user_name"` // RADIUS 计费会话中客户端地址所属的用户
+	SrcPort     uint16             `bson:"src_port"`
+	DstPort     uint16             `bson:"dst_port"`
+	StartTime   time.Time          `bson:"start_time"`
+	EndTime     time.Time          `bson:"end_time"`
+	UpPackets   int                `bson:"up_packets"`
+	DownPackets int                `bson:"down_packets"`
+	UpBytes     int                `bson:"up_bytes"`
+	DownBytes   int                `bson:"down_bytes"`
+	TCPFlags    uint8              `bson:"tcp_flags"` // 双向出现过的 TCP 标志位
+	Reason      string             `bson:"reason"`    // 结束原因: idle, active, fin, rst, end
+	Host        string             `bson:"host"`      // SNI, 没有时为 HTTP Host
+	SNI         string             `bson:"sni"`
+	HTTPHost    string             `bson:"http_host"`
+	AppProto    string             `bson:"app_proto"`  // 按载荷识别的应用层协议, 如 http, tls, ssh
+	DNSDomain   string             `bson:"dns_domain"` // 客户端最近通过 DNS 解析到服务端地址的域名
+	App         string             `bson:"app"`        // 按 Host 识别, 未识别时按 DNSDomain
+}
+
+func (f *Flow) Parse() {
+	f.SrcIPStr, f.DstIPStr = f.SrcIP.String(), f.DstIP.String()
+	if f.Host != "" {
+		f.App = matchApp(f.Host)
+	}
+	if f.App == "" && f.DNSDomain != "" {
+		f.App = matchApp(f.DNSDomain)
+	}
+}
+
+func (f *Flow) Kind() string {
+	return ProtocolFlow
+}
@@ -1,12 +1,8 @@
 package record
 
 import (
-	"context"
 	"fmt"
 	"github.com/mileusna/useragent"
-	"github.com/srun-soft/dpi-analysis-toolkit/configs"
-	"github.com/srun-soft/dpi-analysis-toolkit/internal/database"
-	"github.com/srun-soft/dpi-analysis-toolkit/internal/feature"
 	"github.com/srun-soft/dpi-analysis-toolkit/internal/utils"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net"
@@ -18,11 +14,13 @@ import (
 
 type Http struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	FlowID        string             `bson:"flow_id"`
 	Ident         string             `bson:"ident"`
 	SrcIP         net.IP             `bson:"src_ip"`
 	DstIP         net.IP             `bson:"dst_ip"`
 	SrcIPStr      string             `bson:"src_ip_str"`
 	DstIPStr      string             `bson:"dst_ip_str"`
+	UserName      string             `bson:"user_name"`
 	Method        string             `bson:"method"`
 	URL           string             `bson:"url"`
 	Proto         string             `bson:"proto"`
@@ -36,7 +34,9 @@ type Http struct {
 	UserAgent     string             `bson:"user_agent"`
 	UAParser      string             `bson:"ua_parser"`
 	Delay         time.Duration      `bson:"delay"`
-	App           string             `bson:"app"`
+	DNSDomain     string             `bson:"dns_domain"` // 客户端最近通过 DNS 解析到服务端地址的域名
+	App           string             `bson:"app"`        // 按 Host 识别, 未识别时按 DNSDomain
+	Timestamp     time.Time          `bson:"timestamp"`  // 连接开始时间
 }
 
 func (h *Http) Parse() {
@@ -48,35 +48,19 @@ func (h *Http) Parse() {
 	}
 	h.Domain, h.Suffix = utils.ParseHost(h.Host)
 	h.SrcIPStr, h.DstIPStr = h.SrcIP.String(), h.DstIP.String()
-	if h.Host != "" {
-		hits := feature.Ac.MatchThreadSafe([]byte(h.Host))
-		if hits == nil {
-			return
-		}
-		if name, ok := feature.HostMap[hits[0]]; ok {
-			//fmt.Println(name)
-			h.App = name
-		}
-	}
-}
-
-func (h *Http) Save2Mongo() {
-	h.Parse()
-
 	if h.UserAgent != "" {
 		h.ua()
 	}
-	//
-	//rdb := database.Rdb
-	//rdb.HIncrBy(context.Background(), "test", h.UserAgent, 1)
-
-	mongo := database.MongoDB.Database(ProtocolHTTP)
-	one, err := mongo.Collection(time.Now().Format("C_2006_01_02_15")).InsertOne(context.TODO(), h)
-	if err != nil {
-		configs.Log.Errorf("Save2Mongo protol http2mongo err:%s", err)
-		return
+	if h.Host != "" {
+		h.App = matchApp(h.Host)
+	}
+	if h.App == "" && h.DNSDomain != "" {
+		h.App = matchApp(h.DNSDomain)
 	}
-	configs.Log.Debugf("Save2Mongo protol http2mongo id:%s", one.InsertedID)
+}
+
+func (h *Http) Kind() string {
+	return ProtocolHTTP
 }
 
 func (h *Http) ua() {
@@ -1,18 +1,31 @@
 package record
 
+import "github.com/srun-soft/dpi-analysis-toolkit/internal/feature"
+
 // packet interface
 // Define protocol handling operations
 
 // Protocol const
 
 const (
-	ProtocolHTTP  = "protocol_http"
-	ProtocolHTTPS = "protocol_https"
-	ProtocolDNS   = "protocol_dns"
-	ProtocolICMP  = "protocol_icmp"
+	ProtocolHTTP   = "protocol_http"
+	ProtocolHTTPS  = "protocol_https"
+	ProtocolDNS    = "protocol_dns"
+	ProtocolICMP   = "protocol_icmp"
+	ProtocolFlow   = "protocol_flow"
+	ProtocolQUIC   = "protocol_quic"
+	ProtocolAlert  = "protocol_alert"
+	ProtocolRADIUS = "protocol_radius"
 )
 
 type Protocol interface {
+	// Parse 补全派生字段 (域名、应用等), 在写入输出前调用
 	Parse()
-	Save2Mongo()
+	// Kind 记录所属协议, 输出以此区分库或表
+	Kind() string
+}
+
+// matchApp 根据特征库匹配域名对应的应用名称
+func matchApp(host string) string {
+	return feature.Match(host)
 }
@@ -0,0 +1,43 @@
+package record
+
+import (
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net"
+	"time"
+)
+
+// QUIC Initial
+// 解密客户端 Initial 包得到的 ClientHello 信息
+
+type Quic struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	FlowID    string             `bson:"flow_id"`
+	Host      string             `bson:"host"`
+	Domain    string             `bson:"domain"`
+	Suffix    string             `bson:"suffix"`
+	SrcIP     net.IP             `bson:"src_ip"`
+	DstIP     net.IP             `bson:"dst_ip"`
+	SrcIPStr  string             `bson:"src_ip_str"`
+	DstIPStr  string             `bson:"dst_ip_str"`
+	UserName  string             `bson:"user_name"`
+	SrcPort   uint16             `bson:"src_port"`
+	DstPort   uint16             `bson:"dst_port"`
+	Version   string             `bson:"version"` // QUIC 版本: v1, v2
+	ALPN      []string           `bson:"alpn"`
+	JA4       string             `bson:"ja4"`
+	StartTime time.Time          `bson:"start_time"` // 第一个 Initial 包的时间
+	App       string             `bson:"app"`
+}
+
+func (q *Quic) Parse() {
+	q.Domain, q.Suffix = utils.ParseHost(q.Host)
+	q.SrcIPStr, q.DstIPStr = q.SrcIP.String(), q.DstIP.String()
+	if q.Host != "" {
+		q.App = matchApp(q.Host)
+	}
+}
+
+func (q *Quic) Kind() string {
+	return ProtocolQUIC
+}
@@ -0,0 +1,60 @@
+package record
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net"
+	"time"
+)
+
+// RADIUS Accounting
+// 每个 Accounting-Request 输出一条记录, Input 为用户发出的流量, Output 为用户收到的流量
+
+type Radius struct {
+	ID               primitive.ObjectID      `bson:"_id,omitempty"`
+	FlowID           string                  `bson:"flow_id"`
+	SrcIP            net.IP                  `bson:"src_ip"` // NAS 或转发计费报文的服务器
+	DstIP            net.IP                  `bson:"dst_ip"`
+	SrcIPStr         string                  `bson:"src_ip_str"`
+	DstIPStr         string                  `bson:"dst_ip_str"`
+	Status           string                  `bson:"status"` // Start, Stop, Interim-Update, Accounting-On, Accounting-Off
+	UserName         string                  `bson:"user_name"`
+	FramedIP         net.IP                  `bson:"framed_ip"` // 分配给用户的地址
+	FramedIPStr      string                  `bson:"framed_ip_str"`
+	NASIP            net.IP                  `bson:"nas_ip"`
+	NASIPStr         string                  `bson:"nas_ip_str"`
+	NASIdentifier    string                  `bson:"nas_identifier"`
+	NASPort          uint32                  `bson:"nas_port"`
+	SessionID        string                  `bson:"session_id"`
+	CallingStationID string                  `bson:"calling_station_id"` // 通常为终端 MAC
+	CalledStationID  string                  `bson:"called_station_id"`
+	InputOctets      uint64                  `bson:"input_octets"` // 已加上 Gigawords
+	OutputOctets     uint64                  `bson:"output_octets"`
+	InputPackets     uint32                  `bson:"input_packets"`
+	OutputPackets    uint32                  `bson:"output_packets"`
+	SessionTime      uint32                  `bson:"session_time"` // 秒
+	TerminateCause   string                  `bson:"terminate_cause"`
+	EventTime        time.Time               `bson:"event_time"` // Event-Timestamp, 没有时为抓包时间
+	Timestamp        time.Time               `bson:"timestamp"`  // 抓包时间
+	VendorAttributes []RadiusVendorAttribute `bson:"vendor_attributes,omitempty"`
+}
+
+// RadiusVendorAttribute Vendor-Specific 属性中的一个子属性
+type RadiusVendorAttribute struct {
+	VendorID uint32 `bson:"vendor_id"`
+	Type     uint8  `bson:"type"`
+	Value    string `bson:"value"` // 可打印时为文本, 否则为十六进制
+}
+
+func (r *Radius) Parse() {
+	r.SrcIPStr, r.DstIPStr = r.SrcIP.String(), r.DstIP.String()
+	if r.FramedIP != nil {
+		r.FramedIPStr = r.FramedIP.String()
+	}
+	if r.NASIP != nil {
+		r.NASIPStr = r.NASIP.String()
+	}
+}
+
+func (r *Radius) Kind() string {
+	return ProtocolRADIUS
+}
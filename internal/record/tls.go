@@ -1,10 +1,6 @@
 package record
 
 import (
-	"context"
-	"github.com/srun-soft/dpi-analysis-toolkit/configs"
-	"github.com/srun-soft/dpi-analysis-toolkit/internal/database"
-	"github.com/srun-soft/dpi-analysis-toolkit/internal/feature"
 	"github.com/srun-soft/dpi-analysis-toolkit/internal/utils"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net"
@@ -16,6 +12,7 @@ import (
 
 type Tls struct {
 	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	FlowID     string             `bson:"flow_id"`
 	Host       string             `bson:"host"`
 	Domain     string             `bson:"domain"`
 	Suffix     string             `bson:"suffix"`
@@ -23,13 +20,44 @@ type Tls struct {
 	DstIP      net.IP             `bson:"dst_ip"`
 	SrcIPStr   string             `bson:"src_ip_str"`
 	DstIPStr   string             `bson:"dst_ip_str"`
+	UserName   string             `bson:"user_name"`
 	Ident      string             `bson:"ident"`
 	UpStream   int                `bson:"up_stream"`
 	DownStream int                `bson:"down_stream"`
 	StartTime  time.Time          `bson:"start_time"`
 	EndTime    time.Time          `bson:"end_time"`
 	Delay      time.Duration      `bson:"delay"`
-	App        string             `bson:"app"`
+	DNSDomain  string             `bson:"dns_domain"` // 客户端最近通过 DNS 解析到服务端地址的域名
+	App        string             `bson:"app"`        // 按 SNI 识别, 未识别时按 DNSDomain
+	// ClientHello 指纹
+	Version string   `bson:"version"` // 客户端支持的最高版本
+	ALPN    []string `bson:"alpn"`
+	JA3     string   `bson:"ja3"`
+	JA3Hash string   `bson:"ja3_hash"`
+	JA4     string   `bson:"ja4"`
+	// ServerHello 与证书, TLS 1.3 的证书已加密, 只有 TLS 1.2 及以下有证书
+	ServerVersion  string        `bson:"server_version"` // 协商的版本
+	CipherSuite    string        `bson:"cipher_suite"`
+	JA3S           string        `bson:"ja3s"`
+	JA3SHash       string        `bson:"ja3s_hash"`
+	JA4S           string        `bson:"ja4s"`
+	Certificates   []Certificate `bson:"certificates,omitempty"` // 第一个为服务端证书
+	CertExpired    bool          `bson:"cert_expired"`           // 握手时服务端证书不在有效期内
+	CertSelfSigned bool          `bson:"cert_self_signed"`
+	CertMismatch   bool          `bson:"cert_mismatch"` // SNI 与服务端证书不符
+	// 加密 DNS
+	EncryptedDNS   string `bson:"encrypted_dns"`    // dot 或 doh, 不是加密 DNS 时为空
+	EncryptedDNSBy string `bson:"encrypted_dns_by"` // 识别依据: port, alpn, sni, ip, shape
+}
+
+type Certificate struct {
+	Subject   string    `bson:"subject"`
+	Issuer    string    `bson:"issuer"`
+	SANs      []string  `bson:"sans"`
+	NotBefore time.Time `bson:"not_before"`
+	NotAfter  time.Time `bson:"not_after"`
+	Serial    string    `bson:"serial"` // 十六进制
+	SHA256    string    `bson:"sha256"`
 }
 
 func (h *Tls) Parse() {
@@ -37,25 +65,13 @@ func (h *Tls) Parse() {
 	h.SrcIPStr, h.DstIPStr = h.SrcIP.String(), h.DstIP.String()
 
 	if h.Host != "" {
-		hits := feature.Ac.MatchThreadSafe([]byte(h.Host))
-		if hits == nil {
-			return
-		}
-		if name, ok := feature.HostMap[hits[0]]; ok {
-			//fmt.Println(name)
-			h.App = name
-		}
+		h.App = matchApp(h.Host)
+	}
+	if h.App == "" && h.DNSDomain != "" {
+		h.App = matchApp(h.DNSDomain)
 	}
-
 }
 
-func (h *Tls) Save2Mongo() {
-	h.Parse()
-	mongo := database.MongoDB.Database(ProtocolHTTPS)
-	one, err := mongo.Collection(time.Now().Format("C_2006_01_02_15")).InsertOne(context.TODO(), h)
-	if err != nil {
-		configs.Log.Errorf("Save2Mongo protocol handshake2mongo err:%s", err)
-		return
-	}
-	configs.Log.Debugf("Save2Mongo protocol handshake2mongo id:%s", one)
+func (h *Tls) Kind() string {
+	return ProtocolHTTPS
 }
@@ -0,0 +1,268 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 批量异步写入
+// 记录先进入有界队列, 由后台 goroutine 按 key (集合/表) 聚合后批量写入,
+// 写入失败时按指数退避重试. 队列满时根据 Block 选择阻塞调用方或丢弃记录.
+
+// BatchOptions 批量写入配置
+type BatchOptions struct {
+	QueueSize     int           // 队列长度上限
+	BatchSize     int           // 单个 key 累积多少条记录后写入
+	FlushInterval time.Duration // 定时写入间隔
+	MaxRetries    int           // 写入失败后的重试次数
+	RetryBackoff  time.Duration // 首次重试等待时间, 之后每次翻倍
+	Block         bool          // 队列满时阻塞调用方, 否则丢弃记录
+}
+
+const maxRetryBackoff = time.Second * 30
+
+// ErrDropped 队列已满或已关闭, 记录被丢弃. 丢弃数见 BatchStats.Dropped, 由 Add 限频打印日志
+var ErrDropped = errors.New("writer queue full, record dropped")
+
+func (o *BatchOptions) setDefaults() {
+	if o.QueueSize <= 0 {
+		o.QueueSize = 10000
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 500
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Second
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = time.Millisecond * 200
+	}
+}
+
+// BatchStats 批量写入计数
+type BatchStats struct {
+	Queued  int    // 当前队列长度
+	Written uint64 // 写入成功的记录数
+	Dropped uint64 // 队列满被丢弃的记录数
+	Failed  uint64 // 重试耗尽后放弃的记录数
+	Retries uint64 // 重试次数
+	Errors  uint64 // 写入失败次数, 包括之后重试成功的
+}
+
+var (
+	batchersMu sync.Mutex
+	batchers   = make(map[*Batcher]struct{}) // 未关闭的 Batcher, 供指标读取
+)
+
+// BatchWriteFunc 写入同一 key 的一批记录, 返回错误时整批重试
+type BatchWriteFunc func(key string, docs []interface{}) error
+
+type batchItem struct {
+	key string
+	doc interface{}
+}
+
+// Batcher 批量异步写入器
+type Batcher struct {
+	name  string
+	opts  BatchOptions
+	write BatchWriteFunc
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan batchItem
+	flush  chan chan error
+	done   chan struct{}
+
+	written uint64
+	dropped uint64
+	failed  uint64
+	retries uint64
+	errors  uint64
+}
+
+// NewBatcher 创建批量写入器并启动后台写入 goroutine
+func NewBatcher(name string, opts BatchOptions, write BatchWriteFunc) *Batcher {
+	opts.setDefaults()
+	b := &Batcher{
+		name:  name,
+		opts:  opts,
+		write: write,
+		queue: make(chan batchItem, opts.QueueSize),
+		flush: make(chan chan error),
+		done:  make(chan struct{}),
+	}
+	batchersMu.Lock()
+	// 指标按名称区分, 同名 Batcher 同时存在时加序号
+	for n := 2; batcherNamed(b.name); n++ {
+		b.name = name + "-" + strconv.Itoa(n)
+	}
+	batchers[b] = struct{}{}
+	batchersMu.Unlock()
+	go b.run()
+	return b
+}
+
+// batcherNamed 是否存在同名的未关闭 Batcher, 调用方持有 batchersMu
+func batcherNamed(name string) bool {
+	for b := range batchers {
+		if b.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Add 将记录放入队列, 队列满且非阻塞模式时丢弃并返回 false
+func (b *Batcher) Add(key string, doc interface{}) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		atomic.AddUint64(&b.dropped, 1)
+		return false
+	}
+	item := batchItem{key: key, doc: doc}
+	if b.opts.Block {
+		b.queue <- item
+		return true
+	}
+	select {
+	case b.queue <- item:
+		return true
+	default:
+		if atomic.AddUint64(&b.dropped, 1)%1000 == 1 {
+			configs.Log.Warnf("%s writer queue full, dropped %d records", b.name, atomic.LoadUint64(&b.dropped))
+		}
+		return false
+	}
+}
+
+// Flush 写入队列及缓冲中的全部记录, 写入完成后返回
+// 返回上次 Flush 之后第一个重试耗尽的写入错误, 包括定时或满批写入的记录
+func (b *Batcher) Flush() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return nil
+	}
+	ack := make(chan error)
+	b.flush <- ack
+	return <-ack
+}
+
+// Close 写入剩余记录并停止后台 goroutine, 可重复调用
+func (b *Batcher) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		<-b.done
+		return
+	}
+	b.closed = true
+	close(b.queue)
+	b.mu.Unlock()
+	<-b.done
+	batchersMu.Lock()
+	delete(batchers, b)
+	batchersMu.Unlock()
+	s := b.Stats()
+	configs.Log.Infof("%s writer closed: written:%d dropped:%d failed:%d retries:%d", b.name, s.Written, s.Dropped, s.Failed, s.Retries)
+}
+
+// Stats 返回当前计数
+func (b *Batcher) Stats() BatchStats {
+	return BatchStats{
+		Queued:  len(b.queue),
+		Written: atomic.LoadUint64(&b.written),
+		Dropped: atomic.LoadUint64(&b.dropped),
+		Failed:  atomic.LoadUint64(&b.failed),
+		Retries: atomic.LoadUint64(&b.retries),
+		Errors:  atomic.LoadUint64(&b.errors),
+	}
+}
+
+func (b *Batcher) run() {
+	defer close(b.done)
+	pending := make(map[string][]interface{})
+	ticker := time.NewTicker(b.opts.FlushInterval)
+	defer ticker.Stop()
+
+	var failed error // 上次 Flush 之后第一个写入错误
+	commit := func(key string, docs []interface{}) {
+		if err := b.commit(key, docs); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	add := func(item batchItem) {
+		pending[item.key] = append(pending[item.key], item.doc)
+		if len(pending[item.key]) >= b.opts.BatchSize {
+			commit(item.key, pending[item.key])
+			delete(pending, item.key)
+		}
+	}
+	flushAll := func() {
+		for key, docs := range pending {
+			commit(key, docs)
+			delete(pending, key)
+		}
+	}
+
+	for {
+		select {
+		case item, ok := <-b.queue:
+			if !ok {
+				flushAll()
+				return
+			}
+			add(item)
+		case <-ticker.C:
+			flushAll()
+		case ack := <-b.flush:
+			// 先取出已入队的记录
+			for drained := false; !drained; {
+				select {
+				case item := <-b.queue:
+					add(item)
+				default:
+					drained = true
+				}
+			}
+			flushAll()
+			ack <- failed
+			failed = nil
+		}
+	}
+}
+
+// commit 写入一批记录, 失败时指数退避重试, 返回重试耗尽后的错误
+func (b *Batcher) commit(key string, docs []interface{}) error {
+	backoff := b.opts.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= b.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			atomic.AddUint64(&b.retries, 1)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+		if err = b.write(key, docs); err == nil {
+			atomic.AddUint64(&b.written, uint64(len(docs)))
+			configs.Log.Debugf("%s writer %s: %d records written", b.name, key, len(docs))
+			return nil
+		}
+		atomic.AddUint64(&b.errors, 1)
+		configs.Log.Warnf("%s writer %s: attempt %d failed: %s", b.name, key, attempt+1, err)
+	}
+	atomic.AddUint64(&b.failed, uint64(len(docs)))
+	configs.Log.Errorf("%s writer %s: giving up %d records: %s", b.name, key, len(docs), err)
+	return fmt.Errorf("%s writer %s: %d records not written: %w", b.name, key, len(docs), err)
+}
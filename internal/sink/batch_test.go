@@ -0,0 +1,220 @@
+package sink
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWriter 记录每次写入, gate 不为 nil 时写入前等待放行
+type testWriter struct {
+	mu      sync.Mutex
+	batches map[string][][]interface{}
+	calls   []time.Time
+	fail    int // 前 fail 次写入返回错误
+	gate    chan struct{}
+	started chan struct{}
+}
+
+func newTestWriter() *testWriter {
+	return &testWriter{batches: make(map[string][][]interface{}), started: make(chan struct{}, 100)}
+}
+
+func (w *testWriter) write(key string, docs []interface{}) error {
+	w.started <- struct{}{}
+	if w.gate != nil {
+		<-w.gate
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls = append(w.calls, time.Now())
+	if len(w.calls) <= w.fail {
+		return errors.New("write failed")
+	}
+	w.batches[key] = append(w.batches[key], append([]interface{}(nil), docs...))
+	return nil
+}
+
+// docs 返回 key 下写入成功的全部记录
+func (w *testWriter) docs(key string) []interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var docs []interface{}
+	for _, batch := range w.batches[key] {
+		docs = append(docs, batch...)
+	}
+	return docs
+}
+
+func checkStats(t *testing.T, b *Batcher, want BatchStats) {
+	t.Helper()
+	if s := b.Stats(); s != want {
+		t.Errorf("stats %+v, want %+v", s, want)
+	}
+}
+
+func TestBatcherDrop(t *testing.T) {
+	w := newTestWriter()
+	w.gate = make(chan struct{})
+	b := NewBatcher("test", BatchOptions{QueueSize: 2, BatchSize: 1, FlushInterval: time.Hour}, w.write)
+	if !b.Add("k", 1) {
+		t.Fatal("first record dropped")
+	}
+	// 第一条记录写入阻塞后队列为空
+	<-w.started
+	if !b.Add("k", 2) || !b.Add("k", 3) {
+		t.Fatal("record dropped before the queue is full")
+	}
+	if b.Add("k", 4) {
+		t.Error("record accepted by a full queue")
+	}
+	checkStats(t, b, BatchStats{Queued: 2, Dropped: 1})
+	close(w.gate)
+	b.Close()
+	if b.Add("k", 5) {
+		t.Error("record accepted after close")
+	}
+	if docs := w.docs("k"); len(docs) != 3 {
+		t.Errorf("written %v", docs)
+	}
+	checkStats(t, b, BatchStats{Written: 3, Dropped: 2})
+}
+
+func TestBatcherBlock(t *testing.T) {
+	w := newTestWriter()
+	w.gate = make(chan struct{})
+	b := NewBatcher("test", BatchOptions{QueueSize: 2, BatchSize: 1, FlushInterval: time.Hour, Block: true}, w.write)
+	b.Add("k", 1)
+	<-w.started
+	b.Add("k", 2)
+	b.Add("k", 3)
+	added := make(chan bool)
+	go func() { added <- b.Add("k", 4) }()
+	select {
+	case <-added:
+		t.Fatal("Add returned while the queue is full")
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(w.gate)
+	if !<-added {
+		t.Error("blocked record dropped")
+	}
+	b.Close()
+	if docs := w.docs("k"); len(docs) != 4 {
+		t.Errorf("written %v", docs)
+	}
+	checkStats(t, b, BatchStats{Written: 4})
+}
+
+func TestBatcherRetry(t *testing.T) {
+	const backoff = time.Millisecond * 20
+	for _, tt := range []struct {
+		name    string
+		fail    int
+		retries int
+		want    BatchStats
+		failed  bool // 重试耗尽, Flush 返回错误
+	}{
+		{"first attempt", 0, 3, BatchStats{Written: 2}, false},
+		{"retried", 2, 3, BatchStats{Written: 2, Retries: 2, Errors: 2}, false},
+		{"given up", 5, 2, BatchStats{Failed: 2, Retries: 2, Errors: 3}, true},
+		{"no retries", 1, 0, BatchStats{Failed: 2, Errors: 1}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWriter()
+			w.fail = tt.fail
+			b := NewBatcher("test", BatchOptions{BatchSize: 10, FlushInterval: time.Hour, MaxRetries: tt.retries, RetryBackoff: backoff}, w.write)
+			defer b.Close()
+			b.Add("k", 1)
+			b.Add("k", 2)
+			if err := b.Flush(); (err != nil) != tt.failed {
+				t.Errorf("flush error %v, want failed %v", err, tt.failed)
+			}
+			checkStats(t, b, tt.want)
+			// 重试等待时间每次翻倍
+			for i := 1; i < len(w.calls); i++ {
+				if gap, want := w.calls[i].Sub(w.calls[i-1]), backoff<<(i-1); gap < want {
+					t.Errorf("retry %d after %s, want at least %s", i, gap, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBatcherFlushClose(t *testing.T) {
+	w := newTestWriter()
+	b := NewBatcher("test", BatchOptions{BatchSize: 100, FlushInterval: time.Hour}, w.write)
+	for i := 0; i < 5; i++ {
+		b.Add([]string{"a", "b"}[i%2], i)
+	}
+	// Flush 返回时队列与缓冲中的记录均已按 key 写入
+	b.Flush()
+	if a, bb := w.docs("a"), w.docs("b"); len(a) != 3 || len(bb) != 2 {
+		t.Errorf("after flush a:%v b:%v", a, bb)
+	}
+	checkStats(t, b, BatchStats{Written: 5})
+
+	for i := 5; i < 8; i++ {
+		b.Add("c", i)
+	}
+	b.Close()
+	b.Close()
+	b.Flush()
+	if c := w.docs("c"); len(c) != 3 {
+		t.Errorf("after close c:%v", c)
+	}
+	checkStats(t, b, BatchStats{Written: 8})
+	if len(w.batches) != 3 || len(w.batches["a"]) != 1 {
+		t.Errorf("batches %v", w.batches)
+	}
+}
+
+func TestBatcherSize(t *testing.T) {
+	w := newTestWriter()
+	b := NewBatcher("test", BatchOptions{BatchSize: 3, FlushInterval: time.Hour}, w.write)
+	defer b.Close()
+	for i := 0; i < 7; i++ {
+		b.Add("k", i)
+	}
+	// 累积到 BatchSize 时不等 Flush 直接写入
+	for i := 0; i < 2; i++ {
+		select {
+		case <-w.started:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("batch %d not written", i)
+		}
+	}
+	b.Flush()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if batches := w.batches["k"]; len(batches) != 3 || len(batches[0]) != 3 || len(batches[1]) != 3 || len(batches[2]) != 1 {
+		t.Errorf("batches %v", batches)
+	}
+}
+
+func TestBatcherFlushError(t *testing.T) {
+	w := newTestWriter()
+	w.fail = 1 << 30
+	b := NewBatcher("test", BatchOptions{BatchSize: 2, FlushInterval: time.Hour, RetryBackoff: time.Millisecond}, w.write)
+	defer b.Close()
+	b.Add("k", 1)
+	err := b.Flush()
+	if err == nil || !strings.Contains(err.Error(), "write failed") {
+		t.Errorf("flush error %v", err)
+	}
+	// 错误只返回一次
+	if err = b.Flush(); err != nil {
+		t.Errorf("second flush error %v", err)
+	}
+	// 满批写入在 Flush 之前失败, 由之后的 Flush 返回
+	b.Add("k", 2)
+	b.Add("k", 3)
+	<-w.started
+	<-w.started
+	if err = b.Flush(); err == nil {
+		t.Error("failed full batch not reported")
+	}
+	checkStats(t, b, BatchStats{Failed: 3, Errors: 2})
+}
@@ -0,0 +1,558 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/database"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"strings"
+	"time"
+)
+
+// ClickHouse 输出
+// 启动时按协议建表并补充缺少的列, 记录编码为 JSONEachRow 后通过 Batcher 大批量写入
+
+const clickhouseTimeFormat = "2006-01-02 15:04:05.000"
+
+func init() {
+	Register("clickhouse", func(c *configs.Config) (Sink, error) {
+		ch := c.Sinks.ClickHouse
+		client := database.NewClickHouse(ch.URL, ch.Database, ch.User, ch.Password, ch.Timeout)
+		return NewClickHouse(client, BatchOptions{
+			QueueSize:     ch.QueueSize,
+			BatchSize:     ch.BatchSize,
+			FlushInterval: ch.FlushInterval,
+			MaxRetries:    ch.Retries,
+			RetryBackoff:  ch.RetryBackoff,
+			Block:         ch.Block,
+		})
+	})
+}
+
+// clickhouseTable 表名与列定义
+type clickhouseTable struct {
+	name    string
+	columns string
+}
+
+// addColumns 为每一列生成 ADD COLUMN IF NOT EXISTS, 列定义每行一列
+func (t clickhouseTable) addColumns() string {
+	var clauses []string
+	for _, line := range strings.Split(t.columns, "\n") {
+		if column := strings.TrimSuffix(strings.TrimSpace(line), ","); column != "" {
+			clauses = append(clauses, "ADD COLUMN IF NOT EXISTS "+column)
+		}
+	}
+	return strings.Join(clauses, ", ")
+}
+
+// clickhouseTables 每种协议对应的表, IP 统一存为 IPv6 (IPv4 使用映射地址)
+var clickhouseTables = map[string]clickhouseTable{
+	record.ProtocolHTTP: {"http", `
+		time           DateTime64(3, 'UTC'),
+		flow_id        String,
+		ident          String,
+		src_ip         IPv6,
+		dst_ip         IPv6,
+		user_name      String,
+		method         LowCardinality(String),
+		url            String,
+		proto          LowCardinality(String),
+		host           String,
+		domain         LowCardinality(String),
+		suffix         LowCardinality(String),
+		request_uri    String,
+		content_type   LowCardinality(String),
+		content_length String,
+		user_agent     String,
+		ua_parser      LowCardinality(String),
+		delay          Int64,
+		dns_domain     String,
+		app            LowCardinality(String)`},
+	record.ProtocolHTTPS: {"tls", `
+		time        DateTime64(3, 'UTC'),
+		flow_id     String,
+		ident       String,
+		src_ip      IPv6,
+		dst_ip      IPv6,
+		user_name   String,
+		host        String,
+		domain      LowCardinality(String),
+		suffix      LowCardinality(String),
+		up_stream   UInt64,
+		down_stream UInt64,
+		start_time  DateTime64(3, 'UTC'),
+		end_time    DateTime64(3, 'UTC'),
+		delay       Int64,
+		dns_domain  String,
+		app         LowCardinality(String),
+		version     LowCardinality(String),
+		alpn        Array(String),
+		ja3         String,
+		ja3_hash    String,
+		ja4         String,
+		server_version   LowCardinality(String),
+		cipher_suite     LowCardinality(String),
+		ja3s             String,
+		ja3s_hash        String,
+		ja4s             String,
+		cert_subject     String,
+		cert_issuer      String,
+		cert_sans        Array(String),
+		cert_not_before  Nullable(DateTime64(3, 'UTC')),
+		cert_not_after   Nullable(DateTime64(3, 'UTC')),
+		cert_serial      String,
+		cert_sha256      String,
+		cert_chain       UInt8,
+		cert_expired     Bool,
+		cert_self_signed Bool,
+		cert_mismatch    Bool,
+		encrypted_dns    LowCardinality(String),
+		encrypted_dns_by LowCardinality(String)`},
+	record.ProtocolDNS: {"dns", `
+		time         DateTime64(3, 'UTC'),
+		timestamp    DateTime64(3, 'UTC'),
+		flow_id      String,
+		src_ip       IPv6,
+		dst_ip       IPv6,
+		user_name    String,
+		src_port     UInt16,
+		dst_port     UInt16,
+		transport    LowCardinality(String),
+		host         String,
+		domain       LowCardinality(String),
+		suffix       LowCardinality(String),
+		type         LowCardinality(String),
+		class        LowCardinality(String),
+		tx_id        UInt16,
+		response     Bool,
+		opcode       LowCardinality(String),
+		rcode        LowCardinality(String),
+		questions    Array(String),
+		answer_names Array(String),
+		answer_types Array(LowCardinality(String)),
+		answer_ttls  Array(UInt32),
+		answer_data  Array(String),
+		cnames       Array(String),
+		size         UInt32,
+		latency      Int64`},
+	record.ProtocolICMP: {"icmp", `
+		time        DateTime64(3, 'UTC'),
+		flow_id     String,
+		ident       String,
+		src_ip      IPv6,
+		dst_ip      IPv6,
+		type        UInt8,
+		code        UInt8,
+		ttl         UInt8,
+		description LowCardinality(String),
+		delay       Int64`},
+	record.ProtocolQUIC: {"quic", `
+		time       DateTime64(3, 'UTC'),
+		flow_id    String,
+		src_ip     IPv6,
+		dst_ip     IPv6,
+		user_name  String,
+		src_port   UInt16,
+		dst_port   UInt16,
+		host       String,
+		domain     LowCardinality(String),
+		suffix     LowCardinality(String),
+		version    LowCardinality(String),
+		alpn       Array(String),
+		ja4        String,
+		start_time DateTime64(3, 'UTC'),
+		app        LowCardinality(String)`},
+	record.ProtocolFlow: {"flow", `
+		time         DateTime64(3, 'UTC'),
+		flow_id      String,
+		proto        LowCardinality(String),
+		src_ip       IPv6,
+		dst_ip       IPv6,
+		user_name    String,
+		src_port     UInt16,
+		dst_port     UInt16,
+		start_time   DateTime64(3, 'UTC'),
+		end_time     DateTime64(3, 'UTC'),
+		up_packets   UInt64,
+		down_packets UInt64,
+		up_bytes     UInt64,
+		down_bytes   UInt64,
+		tcp_flags    UInt8,
+		reason       LowCardinality(String),
+		host         String,
+		sni          String,
+		http_host    String,
+		app_proto    LowCardinality(String),
+		dns_domain   String,
+		app          LowCardinality(String)`},
+	record.ProtocolAlert: {"alert", `
+		time       DateTime64(3, 'UTC'),
+		timestamp  DateTime64(3, 'UTC'),
+		start_time DateTime64(3, 'UTC'),
+		analyzer   LowCardinality(String),
+		type       LowCardinality(String),
+		src_ip     IPv6,
+		user_name  String,
+		zone       String,
+		score      UInt8,
+		reasons    Array(LowCardinality(String)),
+		evidence   Map(String, Int64),
+		samples    Array(String)`},
+	record.ProtocolRADIUS: {"radius", `
+		time               DateTime64(3, 'UTC'),
+		timestamp          DateTime64(3, 'UTC'),
+		event_time         DateTime64(3, 'UTC'),
+		flow_id            String,
+		src_ip             IPv6,
+		dst_ip             IPv6,
+		status             LowCardinality(String),
+		user_name          String,
+		framed_ip          IPv6,
+		nas_ip             IPv6,
+		nas_identifier     LowCardinality(String),
+		nas_port           UInt32,
+		session_id         String,
+		calling_station_id String,
+		called_station_id  String,
+		input_octets       UInt64,
+		output_octets      UInt64,
+		input_packets      UInt32,
+		output_packets     UInt32,
+		session_time       UInt32,
+		terminate_cause    LowCardinality(String),
+		vendor_ids         Array(UInt32),
+		vendor_types       Array(UInt8),
+		vendor_values      Array(String)`},
+}
+
+type ClickHouse struct {
+	client  *database.ClickHouse
+	batcher *Batcher
+}
+
+// NewClickHouse 创建 ClickHouse 输出, 并创建库与缺失的表
+func NewClickHouse(client *database.ClickHouse, opts BatchOptions) (*ClickHouse, error) {
+	if db := client.Database(); db != "" && !configs.ClickHouseIdentifier.MatchString(db) {
+		return nil, fmt.Errorf("invalid database name %q", db)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err := client.Ping(ctx); err != nil {
+		return nil, err
+	}
+	if db := client.Database(); db != "" {
+		if err := client.Exec(ctx, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", db), nil); err != nil {
+			return nil, err
+		}
+	}
+	c := &ClickHouse{client: client}
+	for _, t := range clickhouseTables {
+		ddl := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s\n) ENGINE = MergeTree PARTITION BY toYYYYMMDD(time) ORDER BY time", c.table(t.name), t.columns)
+		if err := client.Exec(ctx, ddl, nil); err != nil {
+			return nil, fmt.Errorf("create table %s: %w", t.name, err)
+		}
+		// 旧版本创建的表缺少之后新增的列
+		if err := client.Exec(ctx, fmt.Sprintf("ALTER TABLE %s %s", c.table(t.name), t.addColumns()), nil); err != nil {
+			return nil, fmt.Errorf("alter table %s: %w", t.name, err)
+		}
+	}
+	c.batcher = NewBatcher("clickhouse", opts, c.insert)
+	return c, nil
+}
+
+// Write 将记录编码为一行 JSON 放入写入队列, time 列为记录的抓包时间
+func (c *ClickHouse) Write(r record.Protocol) error {
+	t, ok := clickhouseTables[r.Kind()]
+	if !ok {
+		return nil
+	}
+	row := clickhouseRow(r)
+	if row == nil {
+		return nil
+	}
+	row["time"] = clickhouseTime(recordTime(r))
+	line, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if !c.batcher.Add(t.name, line) {
+		return ErrDropped
+	}
+	return nil
+}
+
+func (c *ClickHouse) Flush() error {
+	return c.batcher.Flush()
+}
+
+func (c *ClickHouse) Close() error {
+	c.batcher.Close()
+	return nil
+}
+
+// Stats 返回写入计数
+func (c *ClickHouse) Stats() BatchStats {
+	return c.batcher.Stats()
+}
+
+func (c *ClickHouse) insert(table string, rows []interface{}) error {
+	var body bytes.Buffer
+	for _, row := range rows {
+		body.Write(row.([]byte))
+		body.WriteByte('\n')
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	return c.client.Exec(ctx, fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", c.table(table)), body.Bytes())
+}
+
+// table 表名加上库名前缀
+func (c *ClickHouse) table(name string) string {
+	if db := c.client.Database(); db != "" {
+		return db + "." + name
+	}
+	return name
+}
+
+// clickhouseRow 按表结构将记录转换为列值
+func clickhouseRow(r record.Protocol) map[string]interface{} {
+	switch v := r.(type) {
+	case *record.Http:
+		return map[string]interface{}{
+			"flow_id":        v.FlowID,
+			"ident":          v.Ident,
+			"src_ip":         clickhouseIP(v.SrcIP),
+			"dst_ip":         clickhouseIP(v.DstIP),
+			"user_name":      v.UserName,
+			"method":         v.Method,
+			"url":            v.URL,
+			"proto":          v.Proto,
+			"host":           v.Host,
+			"domain":         v.Domain,
+			"suffix":         v.Suffix,
+			"request_uri":    v.RequestURI,
+			"content_type":   v.ContentType,
+			"content_length": v.ContentLength,
+			"user_agent":     v.UserAgent,
+			"ua_parser":      v.UAParser,
+			"delay":          int64(v.Delay),
+			"dns_domain":     v.DNSDomain,
+			"app":            v.App,
+		}
+	case *record.Tls:
+		row := map[string]interface{}{
+			"flow_id":          v.FlowID,
+			"ident":            v.Ident,
+			"src_ip":           clickhouseIP(v.SrcIP),
+			"dst_ip":           clickhouseIP(v.DstIP),
+			"user_name":        v.UserName,
+			"host":             v.Host,
+			"domain":           v.Domain,
+			"suffix":           v.Suffix,
+			"up_stream":        v.UpStream,
+			"down_stream":      v.DownStream,
+			"start_time":       clickhouseTime(v.StartTime),
+			"end_time":         clickhouseTime(v.EndTime),
+			"delay":            int64(v.Delay),
+			"dns_domain":       v.DNSDomain,
+			"app":              v.App,
+			"version":          v.Version,
+			"alpn":             clickhouseStrings(v.ALPN),
+			"ja3":              v.JA3,
+			"ja3_hash":         v.JA3Hash,
+			"ja4":              v.JA4,
+			"server_version":   v.ServerVersion,
+			"cipher_suite":     v.CipherSuite,
+			"ja3s":             v.JA3S,
+			"ja3s_hash":        v.JA3SHash,
+			"ja4s":             v.JA4S,
+			"cert_chain":       len(v.Certificates),
+			"cert_expired":     v.CertExpired,
+			"cert_self_signed": v.CertSelfSigned,
+			"cert_mismatch":    v.CertMismatch,
+			"encrypted_dns":    v.EncryptedDNS,
+			"encrypted_dns_by": v.EncryptedDNSBy,
+		}
+		if len(v.Certificates) > 0 {
+			// 只写服务端证书, 完整证书链见 MongoDB
+			leaf := v.Certificates[0]
+			row["cert_subject"] = leaf.Subject
+			row["cert_issuer"] = leaf.Issuer
+			row["cert_sans"] = clickhouseStrings(leaf.SANs)
+			row["cert_not_before"] = clickhouseTime(leaf.NotBefore)
+			row["cert_not_after"] = clickhouseTime(leaf.NotAfter)
+			row["cert_serial"] = leaf.Serial
+			row["cert_sha256"] = leaf.SHA256
+		}
+		return row
+	case *record.Dns:
+		questions := make([]string, len(v.Questions))
+		for i, q := range v.Questions {
+			questions[i] = q.Name
+		}
+		names, types, ttls, data := make([]string, len(v.Answers)), make([]string, len(v.Answers)), make([]uint32, len(v.Answers)), make([]string, len(v.Answers))
+		for i, a := range v.Answers {
+			names[i], types[i], ttls[i], data[i] = a.Name, a.Type, a.TTL, a.Data
+		}
+		return map[string]interface{}{
+			"timestamp":    clickhouseTime(v.Timestamp),
+			"flow_id":      v.FlowID,
+			"src_ip":       clickhouseIP(v.SrcIP),
+			"dst_ip":       clickhouseIP(v.DstIP),
+			"user_name":    v.UserName,
+			"src_port":     v.SrcPort,
+			"dst_port":     v.DstPort,
+			"transport":    v.Transport,
+			"host":         v.Host,
+			"domain":       v.Domain,
+			"suffix":       v.Suffix,
+			"type":         v.Type,
+			"class":        v.Class,
+			"tx_id":        v.TxID,
+			"response":     v.Response,
+			"opcode":       v.OpCode,
+			"rcode":        v.RCode,
+			"questions":    questions,
+			"answer_names": names,
+			"answer_types": types,
+			"answer_ttls":  ttls,
+			"answer_data":  data,
+			"cnames":       clickhouseStrings(v.CNAMEs),
+			"size":         v.Size,
+			"latency":      int64(v.Latency),
+		}
+	case *record.Icmp:
+		return map[string]interface{}{
+			"flow_id":     v.FlowID,
+			"ident":       v.Ident,
+			"src_ip":      clickhouseIP(v.SrcIP),
+			"dst_ip":      clickhouseIP(v.DstIP),
+			"type":        v.Type,
+			"code":        v.Code,
+			"ttl":         v.TTL,
+			"description": v.Description,
+			"delay":       int64(v.Delay),
+		}
+	case *record.Quic:
+		return map[string]interface{}{
+			"flow_id":    v.FlowID,
+			"src_ip":     clickhouseIP(v.SrcIP),
+			"dst_ip":     clickhouseIP(v.DstIP),
+			"user_name":  v.UserName,
+			"src_port":   v.SrcPort,
+			"dst_port":   v.DstPort,
+			"host":       v.Host,
+			"domain":     v.Domain,
+			"suffix":     v.Suffix,
+			"version":    v.Version,
+			"alpn":       clickhouseStrings(v.ALPN),
+			"ja4":        v.JA4,
+			"start_time": clickhouseTime(v.StartTime),
+			"app":        v.App,
+		}
+	case *record.Flow:
+		return map[string]interface{}{
+			"flow_id":      v.FlowID,
+			"proto":        v.Proto,
+			"src_ip":       clickhouseIP(v.SrcIP),
+			"dst_ip":       clickhouseIP(v.DstIP),
+			"user_name":    v.UserName,
+			"src_port":     v.SrcPort,
+			"dst_port":     v.DstPort,
+			"start_time":   clickhouseTime(v.StartTime),
+			"end_time":     clickhouseTime(v.EndTime),
+			"up_packets":   v.UpPackets,
+			"down_packets": v.DownPackets,
+			"up_bytes":     v.UpBytes,
+			"down_bytes":   v.DownBytes,
+			"tcp_flags":    v.TCPFlags,
+			"reason":       v.Reason,
+			"host":         v.Host,
+			"sni":          v.SNI,
+			"http_host":    v.HTTPHost,
+			"app_proto":    v.AppProto,
+			"dns_domain":   v.DNSDomain,
+			"app":          v.App,
+		}
+	case *record.Alert:
+		evidence := v.Evidence
+		if evidence == nil {
+			evidence = map[string]int{}
+		}
+		return map[string]interface{}{
+			"timestamp":  clickhouseTime(v.Timestamp),
+			"start_time": clickhouseTime(v.StartTime),
+			"analyzer":   v.Analyzer,
+			"type":       v.Type,
+			"src_ip":     clickhouseIP(v.SrcIP),
+			"user_name":  v.UserName,
+			"zone":       v.Zone,
+			"score":      v.Score,
+			"reasons":    clickhouseStrings(v.Reasons),
+			"evidence":   evidence,
+			"samples":    clickhouseStrings(v.Samples),
+		}
+	case *record.Radius:
+		ids, types, values := make([]uint32, len(v.VendorAttributes)), make([]uint8, len(v.VendorAttributes)), make([]string, len(v.VendorAttributes))
+		for i, a := range v.VendorAttributes {
+			ids[i], types[i], values[i] = a.VendorID, a.Type, a.Value
+		}
+		return map[string]interface{}{
+			"timestamp":          clickhouseTime(v.Timestamp),
+			"event_time":         clickhouseTime(v.EventTime),
+			"flow_id":            v.FlowID,
+			"src_ip":             clickhouseIP(v.SrcIP),
+			"dst_ip":             clickhouseIP(v.DstIP),
+			"status":             v.Status,
+			"user_name":          v.UserName,
+			"framed_ip":          clickhouseIP(v.FramedIP),
+			"nas_ip":             clickhouseIP(v.NASIP),
+			"nas_identifier":     v.NASIdentifier,
+			"nas_port":           v.NASPort,
+			"session_id":         v.SessionID,
+			"calling_station_id": v.CallingStationID,
+			"called_station_id":  v.CalledStationID,
+			"input_octets":       v.InputOctets,
+			"output_octets":      v.OutputOctets,
+			"input_packets":      v.InputPackets,
+			"output_packets":     v.OutputPackets,
+			"session_time":       v.SessionTime,
+			"terminate_cause":    v.TerminateCause,
+			"vendor_ids":         ids,
+			"vendor_types":       types,
+			"vendor_values":      values,
+		}
+	}
+	return nil
+}
+
+// clickhouseStrings nil 切片写为空数组
+func clickhouseStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// clickhouseIP IPv4 转为 IPv4 映射的 IPv6 文本, 空地址写 ::
+func clickhouseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	if ip.To16() == nil {
+		return "::"
+	}
+	return ip.String()
+}
+
+func clickhouseTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Unix(0, 0)
+	}
+	return t.UTC().Format(clickhouseTimeFormat)
+}
@@ -0,0 +1,340 @@
+package sink
+
+import (
+	"encoding/json"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/database"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClickHouse 记录收到的语句, fail 返回非空时以 500 响应
+type fakeClickHouse struct {
+	mu      sync.Mutex
+	queries []string
+	bodies  map[string][]string // INSERT 语句的数据部分
+	users   []string
+	fail    func(query string) string
+}
+
+func newFakeClickHouse(t *testing.T) (*fakeClickHouse, *database.ClickHouse) {
+	f := &fakeClickHouse{bodies: make(map[string][]string)}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	return f, database.NewClickHouse(srv.URL+"/", "dpi", "default", "secret", time.Second*5)
+}
+
+func (f *fakeClickHouse) serve(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("query")
+	if r.URL.Path == "/ping" {
+		query = "PING"
+	}
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	f.queries = append(f.queries, query)
+	f.users = append(f.users, r.Header.Get("X-ClickHouse-User")+":"+r.Header.Get("X-ClickHouse-Key"))
+	fail := f.fail
+	if len(body) > 0 {
+		f.bodies[query] = append(f.bodies[query], string(body))
+	}
+	f.mu.Unlock()
+	if fail != nil {
+		if msg := fail(query); msg != "" {
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+	}
+	_, _ = io.WriteString(w, "Ok.\n")
+}
+
+func (f *fakeClickHouse) setFail(fail func(query string) string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+// matching 返回以 prefix 开头的语句
+func (f *fakeClickHouse) matching(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for _, q := range f.queries {
+		if strings.HasPrefix(q, prefix) {
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+func (f *fakeClickHouse) inserted(table string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bodies["INSERT INTO dpi."+table+" FORMAT JSONEachRow"]
+}
+
+// columnNames 表定义中的列名
+func columnNames(t clickhouseTable) map[string]bool {
+	names := make(map[string]bool)
+	for _, line := range strings.Split(t.columns, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			names[fields[0]] = true
+		}
+	}
+	return names
+}
+
+func TestClickHouseCreateTables(t *testing.T) {
+	f, client := newFakeClickHouse(t)
+	c, err := NewClickHouse(client, BatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got := f.matching("PING"); len(got) != 1 {
+		t.Errorf("got %d pings, want 1", len(got))
+	}
+	if got := f.matching("CREATE DATABASE"); len(got) != 1 || got[0] != "CREATE DATABASE IF NOT EXISTS dpi" {
+		t.Errorf("create database: %q", got)
+	}
+	for _, u := range f.users {
+		if u != "default:secret" {
+			t.Errorf("credentials %q, want default:secret", u)
+		}
+	}
+	creates, alters := f.matching("CREATE TABLE"), f.matching("ALTER TABLE")
+	if len(creates) != len(clickhouseTables) || len(alters) != len(clickhouseTables) {
+		t.Fatalf("got %d CREATE and %d ALTER statements, want %d each", len(creates), len(alters), len(clickhouseTables))
+	}
+	for kind, table := range clickhouseTables {
+		var create, alter string
+		for _, q := range creates {
+			if strings.HasPrefix(q, "CREATE TABLE IF NOT EXISTS dpi."+table.name+" (") {
+				create = q
+			}
+		}
+		for _, q := range alters {
+			if strings.HasPrefix(q, "ALTER TABLE dpi."+table.name+" ") {
+				alter = q
+			}
+		}
+		if create == "" || alter == "" {
+			t.Errorf("%s: table %s not created and altered", kind, table.name)
+			continue
+		}
+		if !strings.HasSuffix(create, ") ENGINE = MergeTree PARTITION BY toYYYYMMDD(time) ORDER BY time") {
+			t.Errorf("%s: create statement %q", table.name, create)
+		}
+		names := columnNames(table)
+		if !names["time"] {
+			t.Errorf("%s: no time column", table.name)
+		}
+		clauses := strings.Split(strings.TrimPrefix(alter, "ALTER TABLE dpi."+table.name+" "), ", ADD COLUMN")
+		if len(clauses) != len(names) {
+			t.Errorf("%s: alter adds %d columns, want %d", table.name, len(clauses), len(names))
+		}
+		for name := range names {
+			if !strings.Contains(alter, "ADD COLUMN IF NOT EXISTS "+name+" ") {
+				t.Errorf("%s: alter missing column %s", table.name, name)
+			}
+		}
+	}
+	// 类型中的逗号不应拆分列定义
+	if alter := clickhouseTables[record.ProtocolAlert].addColumns(); !strings.Contains(alter, "ADD COLUMN IF NOT EXISTS evidence   Map(String, Int64)") {
+		t.Errorf("alert alter: %s", alter)
+	}
+}
+
+// testRecords 每种记录各一条
+func testRecords() []record.Protocol {
+	src, dst := net.ParseIP("10.0.0.2"), net.ParseIP("2001:db8::1")
+	ts := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	return []record.Protocol{
+		&record.Http{FlowID: "f1", SrcIP: src, DstIP: dst, Method: "GET", Host: "example.com", UserName: "alice", Delay: time.Millisecond},
+		&record.Tls{FlowID: "f2", SrcIP: src, DstIP: dst, Host: "example.com", StartTime: ts, ALPN: []string{"h2"}, JA4: "t13d",
+			Certificates: []record.Certificate{{Subject: "CN=example.com", SANs: []string{"example.com"}, NotBefore: ts, NotAfter: ts}},
+			EncryptedDNS: "doh", EncryptedDNSBy: "sni"},
+		&record.Dns{FlowID: "f3", SrcIP: src, DstIP: dst, Transport: "udp", Host: "example.com", Response: true, RCode: "NOERROR",
+			Questions: []record.DnsQuestion{{Name: "example.com", Type: "A", Class: "IN"}},
+			Answers:   []record.DnsAnswer{{Name: "example.com", Type: "A", TTL: 60, Data: "93.184.216.34"}}, Timestamp: ts},
+		&record.Icmp{SrcIP: src, DstIP: dst, Type: 8, TTL: 64},
+		&record.Quic{FlowID: "f4", SrcIP: src, DstIP: dst, Host: "example.com", Version: "v1", StartTime: ts},
+		&record.Flow{FlowID: "f5", Proto: "tcp", SrcIP: src, DstIP: dst, StartTime: ts, EndTime: ts, UpBytes: 10, AppProto: "tls", DNSDomain: "example.com"},
+		&record.Alert{Analyzer: "dns", Type: "dga", SrcIP: src, Reasons: []string{"nxdomain"}, Evidence: map[string]int{"nxdomains": 30}, Timestamp: ts},
+		&record.Radius{SrcIP: src, DstIP: dst, Status: "Start", UserName: "alice", FramedIP: src, EventTime: ts, Timestamp: ts,
+			VendorAttributes: []record.RadiusVendorAttribute{{VendorID: 14988, Type: 1, Value: "rate"}}},
+	}
+}
+
+func TestClickHouseInsertRows(t *testing.T) {
+	f, client := newFakeClickHouse(t)
+	c, err := NewClickHouse(client, BatchOptions{BatchSize: 100, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := testRecords()
+	for _, r := range records {
+		r.Parse()
+		if err = c.Write(r); err != nil {
+			t.Fatalf("%s: %v", r.Kind(), err)
+		}
+	}
+	if err = c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records {
+		table, ok := clickhouseTables[r.Kind()]
+		if !ok {
+			t.Errorf("%s: no table", r.Kind())
+			continue
+		}
+		bodies := f.inserted(table.name)
+		if len(bodies) != 1 {
+			t.Errorf("%s: got %d inserts, want 1", table.name, len(bodies))
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(bodies[0], "\n"), "\n")
+		if len(lines) != 1 {
+			t.Errorf("%s: got %d rows, want 1", table.name, len(lines))
+			continue
+		}
+		var row map[string]interface{}
+		if err = json.Unmarshal([]byte(lines[0]), &row); err != nil {
+			t.Errorf("%s: row %s: %v", table.name, lines[0], err)
+			continue
+		}
+		names := columnNames(table)
+		for key := range row {
+			if !names[key] {
+				t.Errorf("%s: row has column %q not in the table", table.name, key)
+			}
+		}
+		if _, ok = row["time"]; !ok {
+			t.Errorf("%s: row without time", table.name)
+		}
+		if names["src_ip"] && row["src_ip"] != "::ffff:10.0.0.2" {
+			t.Errorf("%s: src_ip %v", table.name, row["src_ip"])
+		}
+		if names["dst_ip"] && row["dst_ip"] != "2001:db8::1" {
+			t.Errorf("%s: dst_ip %v", table.name, row["dst_ip"])
+		}
+	}
+
+	var tls map[string]interface{}
+	_ = json.Unmarshal([]byte(f.inserted("tls")[0]), &tls)
+	if tls["cert_subject"] != "CN=example.com" || tls["cert_chain"] != float64(1) || tls["start_time"] != "2024-01-01 08:00:00.000" {
+		t.Errorf("tls row %v", tls)
+	}
+	var dns map[string]interface{}
+	_ = json.Unmarshal([]byte(f.inserted("dns")[0]), &dns)
+	// time 列为抓包时间, 离线回放时不随写入时间变化
+	if dns["time"] != "2024-01-01 08:00:00.000" {
+		t.Errorf("dns time %v", dns["time"])
+	}
+	if data, _ := dns["answer_data"].([]interface{}); len(data) != 1 || data[0] != "93.184.216.34" {
+		t.Errorf("dns answer_data %v", dns["answer_data"])
+	}
+	var icmp map[string]interface{}
+	_ = json.Unmarshal([]byte(f.inserted("icmp")[0]), &icmp)
+	if _, ok := icmp["user_name"]; ok {
+		t.Error("icmp row has user_name")
+	}
+
+	c.Close()
+	if s := c.Stats(); s.Written != uint64(len(records)) || s.Failed != 0 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestClickHouseRetry(t *testing.T) {
+	f, client := newFakeClickHouse(t)
+	c, err := NewClickHouse(client, BatchOptions{FlushInterval: time.Hour, MaxRetries: 3, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attempts int
+	f.setFail(func(query string) string {
+		if strings.HasPrefix(query, "INSERT") {
+			if attempts++; attempts <= 2 {
+				return "Code: 252. DB::Exception: Too many parts"
+			}
+		}
+		return ""
+	})
+	_ = c.Write(testRecords()[0])
+	_ = c.Flush()
+	c.Close()
+	if s := c.Stats(); s.Written != 1 || s.Retries != 2 || s.Errors != 2 || s.Failed != 0 {
+		t.Errorf("stats %+v, want written 1 retries 2 errors 2", s)
+	}
+	if got := len(f.inserted("http")); got != 3 {
+		t.Errorf("got %d insert attempts, want 3", got)
+	}
+}
+
+func TestClickHouseInsertFailure(t *testing.T) {
+	f, client := newFakeClickHouse(t)
+	c, err := NewClickHouse(client, BatchOptions{FlushInterval: time.Hour, MaxRetries: 1, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.setFail(func(query string) string {
+		if strings.HasPrefix(query, "INSERT") {
+			return "Code: 16. DB::Exception: No such column"
+		}
+		return ""
+	})
+	records := testRecords()
+	_ = c.Write(records[0])
+	_ = c.Write(records[0])
+	if err = c.Flush(); err == nil || !strings.Contains(err.Error(), "No such column") {
+		t.Errorf("flush error %v", err)
+	}
+	c.Close()
+	if s := c.Stats(); s.Written != 0 || s.Failed != 2 || s.Retries != 1 {
+		t.Errorf("stats %+v, want failed 2 retries 1", s)
+	}
+}
+
+func TestClickHouseSchemaErrors(t *testing.T) {
+	for _, prefix := range []string{"PING", "CREATE DATABASE", "CREATE TABLE", "ALTER TABLE"} {
+		f, client := newFakeClickHouse(t)
+		f.setFail(func(query string) string {
+			if strings.HasPrefix(query, prefix) {
+				return "Code: 497. DB::Exception: not enough privileges"
+			}
+			return ""
+		})
+		c, err := NewClickHouse(client, BatchOptions{})
+		if err == nil {
+			c.Close()
+			t.Errorf("%s failure: NewClickHouse succeeded", prefix)
+			continue
+		}
+		if !strings.Contains(err.Error(), "500") || !strings.Contains(err.Error(), "not enough privileges") {
+			t.Errorf("%s failure: error %q", prefix, err)
+		}
+	}
+}
+
+func TestClickHouseDatabaseName(t *testing.T) {
+	for _, db := range []string{"dpi; DROP TABLE x", "dpi.x", "1dpi", "`dpi`"} {
+		f := &fakeClickHouse{bodies: make(map[string][]string)}
+		srv := httptest.NewServer(http.HandlerFunc(f.serve))
+		c, err := NewClickHouse(database.NewClickHouse(srv.URL, db, "", "", time.Second), BatchOptions{})
+		srv.Close()
+		if err == nil {
+			c.Close()
+			t.Errorf("database %q accepted", db)
+		}
+		if len(f.queries) != 0 {
+			t.Errorf("database %q: sent %q", db, f.queries)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package sink
+
+import (
+	"encoding/json"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"os"
+	"sync"
+)
+
+// Console 输出到标准输出, 每条记录一行 JSON
+
+func init() {
+	Register("console", func(_ *configs.Config) (Sink, error) {
+		return &Console{enc: json.NewEncoder(os.Stdout)}, nil
+	})
+}
+
+type Console struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// consoleLine 附带协议名称, 方便区分记录类型
+type consoleLine struct {
+	Kind   string          `json:"kind"`
+	Record record.Protocol `json:"record"`
+}
+
+func (c *Console) Write(r record.Protocol) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(consoleLine{Kind: r.Kind(), Record: r})
+}
+
+func (c *Console) Flush() error {
+	return nil
+}
+
+func (c *Console) Close() error {
+	return nil
+}
@@ -0,0 +1,51 @@
+package sink
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/metrics"
+)
+
+// 输出指标
+// 按 Batcher 名称 (mongo, clickhouse, redis, netflow) 输出队列长度与写入计数, 同名时第二个起名称带序号 (如 mongo-2)
+
+var (
+	queuedDesc   = metrics.Desc("sink", "queue_length", "Records waiting in the writer queue.", "sink")
+	capacityDesc = metrics.Desc("sink", "queue_capacity", "Capacity of the writer queue.", "sink")
+	writtenDesc  = metrics.Desc("sink", "written_records_total", "Records written successfully.", "sink")
+	droppedDesc  = metrics.Desc("sink", "dropped_records_total", "Records dropped because the queue was full.", "sink")
+	failedDesc   = metrics.Desc("sink", "failed_records_total", "Records given up after all retries failed.", "sink")
+	retriesDesc  = metrics.Desc("sink", "retries_total", "Batch write retries.", "sink")
+	errorsDesc   = metrics.Desc("sink", "write_errors_total", "Failed batch write attempts.", "sink")
+)
+
+type collector struct{}
+
+// Collector 返回所有未关闭 Batcher 的指标
+func Collector() prometheus.Collector {
+	return collector{}
+}
+
+func (collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queuedDesc
+	ch <- capacityDesc
+	ch <- writtenDesc
+	ch <- droppedDesc
+	ch <- failedDesc
+	ch <- retriesDesc
+	ch <- errorsDesc
+}
+
+func (collector) Collect(ch chan<- prometheus.Metric) {
+	batchersMu.Lock()
+	defer batchersMu.Unlock()
+	for b := range batchers {
+		s := b.Stats()
+		ch <- prometheus.MustNewConstMetric(queuedDesc, prometheus.GaugeValue, float64(s.Queued), b.name)
+		ch <- prometheus.MustNewConstMetric(capacityDesc, prometheus.GaugeValue, float64(b.opts.QueueSize), b.name)
+		ch <- prometheus.MustNewConstMetric(writtenDesc, prometheus.CounterValue, float64(s.Written), b.name)
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(s.Dropped), b.name)
+		ch <- prometheus.MustNewConstMetric(failedDesc, prometheus.CounterValue, float64(s.Failed), b.name)
+		ch <- prometheus.MustNewConstMetric(retriesDesc, prometheus.CounterValue, float64(s.Retries), b.name)
+		ch <- prometheus.MustNewConstMetric(errorsDesc, prometheus.CounterValue, float64(s.Errors), b.name)
+	}
+}
@@ -0,0 +1,81 @@
+package sink
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gatherSink 注册 Collector 并按 "指标名{sink}" 返回 sink 标签以 prefix 开头的值
+func gatherSink(t *testing.T, prefix string) map[string]float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(Collector())
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			name := m.GetLabel()[0].GetValue()
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			v := m.GetGauge().GetValue()
+			if m.Counter != nil {
+				v = m.GetCounter().GetValue()
+			}
+			values[strings.TrimPrefix(f.GetName(), "dpi_sink_")+"{"+name+"}"] = v
+		}
+	}
+	return values
+}
+
+func TestSinkCollector(t *testing.T) {
+	write := func(string, []interface{}) error { return nil }
+	a := NewBatcher("metrics-test", BatchOptions{QueueSize: 10, FlushInterval: time.Hour}, write)
+	// 同名的第二个 Batcher 不应导致重复序列
+	b := NewBatcher("metrics-test", BatchOptions{QueueSize: 1, FlushInterval: time.Hour, MaxRetries: 1, RetryBackoff: time.Millisecond},
+		func(string, []interface{}) error { return errors.New("write failed") })
+	for i := 0; i < 3; i++ {
+		a.Add("k", i)
+	}
+	a.Flush()
+	b.Add("k", 1)
+	b.Flush()
+
+	values := gatherSink(t, "metrics-test")
+	for series, want := range map[string]float64{
+		"queue_capacity{metrics-test}":          10,
+		"queue_capacity{metrics-test-2}":        1,
+		"queue_length{metrics-test}":            0,
+		"written_records_total{metrics-test}":   3,
+		"written_records_total{metrics-test-2}": 0,
+		"failed_records_total{metrics-test-2}":  1,
+		"retries_total{metrics-test-2}":         1,
+		"write_errors_total{metrics-test-2}":    2,
+		"dropped_records_total{metrics-test}":   0,
+	} {
+		if got, ok := values[series]; !ok || got != want {
+			t.Errorf("%s = %v (present %v), want %v", series, got, ok, want)
+		}
+	}
+	if len(values) != 14 {
+		t.Errorf("got %d series, want 14: %v", len(values), values)
+	}
+
+	// 关闭后不再输出, 名称可以再次使用
+	a.Close()
+	b.Close()
+	if values = gatherSink(t, "metrics-test"); len(values) != 0 {
+		t.Errorf("closed batchers still collected: %v", values)
+	}
+	c := NewBatcher("metrics-test", BatchOptions{}, write)
+	defer c.Close()
+	if c.name != "metrics-test" {
+		t.Errorf("name %q after the others closed", c.name)
+	}
+}
@@ -0,0 +1,134 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/database"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+// MongoDB 输出
+// 默认每种协议一个库, 按小时分集合, 通过 Batcher 批量 InsertMany
+// 仅在启用时连接数据库
+
+const mongoWriteTimeout = time.Second * 30
+
+func init() {
+	Register("mongo", func(c *configs.Config) (Sink, error) {
+		m := c.Sinks.Mongo
+		client, err := database.ConnectMongo(database.MongoConfig{
+			URI:            m.URI,
+			Username:       m.User,
+			Password:       m.Password,
+			AuthSource:     m.AuthSource,
+			TLS:            m.TLS,
+			CAFile:         m.CAFile,
+			ConnectTimeout: m.Timeout,
+			MaxPoolSize:    m.PoolSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return NewMongo(client, m.Database, BatchOptions{
+			QueueSize:     m.QueueSize,
+			BatchSize:     m.BatchSize,
+			FlushInterval: m.FlushInterval,
+			MaxRetries:    m.Retries,
+			RetryBackoff:  m.RetryBackoff,
+			Block:         m.Block,
+		}), nil
+	})
+}
+
+type Mongo struct {
+	client   *mongo.Client
+	database string
+	batcher  *Batcher
+}
+
+// NewMongo 创建 MongoDB 输出, 关闭时断开 client
+// database 为空时每种协议一个库, 否则写入同一个库并以协议名作为集合前缀
+func NewMongo(client *mongo.Client, database string, opts BatchOptions) *Mongo {
+	m := &Mongo{client: client, database: database}
+	m.batcher = NewBatcher("mongo", opts, m.insert)
+	return m
+}
+
+// Write 将记录编码为文档后放入写入队列
+// 入队前分配 _id, 保证重试时不会重复插入
+func (m *Mongo) Write(r record.Protocol) error {
+	raw, err := bson.Marshal(r)
+	if err != nil {
+		return err
+	}
+	var doc bson.D
+	if err = bson.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	if len(doc) == 0 || doc[0].Key != "_id" {
+		doc = append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, doc...)
+	}
+	if !m.batcher.Add(m.key(r), doc) {
+		return ErrDropped
+	}
+	return nil
+}
+
+// key 返回 "库/集合", 集合按记录时间分小时, 离线回放时写入抓包时间对应的集合
+func (m *Mongo) key(r record.Protocol) string {
+	collection := recordTime(r).Format("C_2006_01_02_15")
+	if m.database == "" {
+		return r.Kind() + "/" + collection
+	}
+	return m.database + "/" + r.Kind() + "_" + collection
+}
+
+func (m *Mongo) Flush() error {
+	return m.batcher.Flush()
+}
+
+func (m *Mongo) Close() error {
+	m.batcher.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), mongoWriteTimeout)
+	defer cancel()
+	return m.client.Disconnect(ctx)
+}
+
+// Stats 返回写入计数
+func (m *Mongo) Stats() BatchStats {
+	return m.batcher.Stats()
+}
+
+// insert 批量写入一个集合, key 为 "库/集合"
+func (m *Mongo) insert(key string, docs []interface{}) error {
+	db, collection, _ := strings.Cut(key, "/")
+	ctx, cancel := context.WithTimeout(context.Background(), mongoWriteTimeout)
+	defer cancel()
+	_, err := m.client.Database(db).Collection(collection).InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if isDuplicateOnly(err) {
+		// 重试时之前已写入的文档
+		return nil
+	}
+	return err
+}
+
+// isDuplicateOnly 批量写入错误是否全部为主键重复
+func isDuplicateOnly(err error) bool {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil || len(bwe.WriteErrors) == 0 {
+		return false
+	}
+	for _, we := range bwe.WriteErrors {
+		if we.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
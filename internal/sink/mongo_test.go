@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"testing"
+	"time"
+)
+
+func TestMongoKey(t *testing.T) {
+	at := time.Date(2023, 5, 6, 7, 30, 0, 0, time.Local)
+	for _, tt := range []struct {
+		database string
+		r        record.Protocol
+		want     string
+	}{
+		{"", &record.Dns{Timestamp: at}, "protocol_dns/C_2023_05_06_07"},
+		{"", &record.Flow{StartTime: at, EndTime: at.Add(time.Hour)}, "protocol_flow/C_2023_05_06_07"},
+		{"", &record.Http{Timestamp: at}, "protocol_http/C_2023_05_06_07"},
+		{"dpi", &record.Tls{StartTime: at}, "dpi/protocol_https_C_2023_05_06_07"},
+		{"dpi", &record.Radius{EventTime: at.Add(-time.Hour), Timestamp: at}, "dpi/protocol_radius_C_2023_05_06_07"},
+	} {
+		m := &Mongo{database: tt.database}
+		if key := m.key(tt.r); key != tt.want {
+			t.Errorf("%s: key %s, want %s", tt.r.Kind(), key, tt.want)
+		}
+	}
+	// 没有时间的记录按当前时间
+	m := &Mongo{}
+	if key, want := m.key(&record.Icmp{}), "protocol_icmp/"+time.Now().Format("C_2006_01_02_15"); key != want {
+		t.Errorf("key %s, want %s", key, want)
+	}
+}
+
+func TestMongoWriteDropped(t *testing.T) {
+	m := &Mongo{}
+	m.batcher = NewBatcher("mongo", BatchOptions{}, func(string, []interface{}) error { return nil })
+	if err := m.Write(&record.Dns{Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	m.batcher.Close()
+	if err := m.Write(&record.Dns{Timestamp: time.Now()}); err != ErrDropped {
+		t.Errorf("write after close: %v", err)
+	}
+	if s := m.batcher.Stats(); s.Written != 1 || s.Dropped != 1 {
+		t.Errorf("stats %+v", s)
+	}
+}
@@ -0,0 +1,344 @@
+package sink
+
+import (
+	"encoding/binary"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"time"
+)
+
+// NetFlow v9 / IPFIX 导出
+// 将 flow 解析器输出的 record.Flow 编码为 NetFlow v9 (RFC 3954) 或 IPFIX (RFC 7011) 报文,
+// 通过 UDP 发送到采集器. 应用名称、SNI 与 HTTP Host 使用私有字段导出,
+// 模板按时间与报文数周期性重发, 流的活动/空闲超时通过 options 记录告知采集器.
+
+func init() {
+	Register("netflow", func(c *configs.Config) (Sink, error) {
+		nf := c.Sinks.NetFlow
+		conn, err := net.Dial("udp", nf.Collector)
+		if err != nil {
+			return nil, err
+		}
+		return NewNetFlow(conn, NetFlowOptions{
+			IPFIX:           nf.Version == "ipfix",
+			DomainID:        nf.DomainID,
+			EnterpriseID:    nf.EnterpriseID,
+			TemplateRefresh: nf.TemplateRefresh,
+			TemplatePackets: nf.TemplatePackets,
+			MTU:             nf.MTU,
+			StringLength:    nf.StringLength,
+			ActiveTimeout:   c.Timeouts.FlowActive,
+			IdleTimeout:     c.Timeouts.FlowIdle,
+		}, BatchOptions{
+			QueueSize:     nf.QueueSize,
+			FlushInterval: nf.FlushInterval,
+		}), nil
+	})
+}
+
+// NetFlowOptions 导出配置
+type NetFlowOptions struct {
+	IPFIX           bool          // true 为 IPFIX, 否则为 NetFlow v9
+	DomainID        uint32        // IPFIX Observation Domain ID / v9 Source ID
+	EnterpriseID    uint32        // 私有字段的 Private Enterprise Number, 仅 IPFIX
+	TemplateRefresh time.Duration // 模板重发间隔
+	TemplatePackets int           // 每发送多少个报文重发模板
+	MTU             int           // 单个 UDP 报文的最大长度
+	StringLength    int           // v9 字符串字段的固定长度, IPFIX 使用可变长度
+	ActiveTimeout   time.Duration // 流活动超时, 写入 options 记录
+	IdleTimeout     time.Duration // 流空闲超时, 写入 options 记录
+}
+
+func (o *NetFlowOptions) setDefaults() {
+	if o.TemplateRefresh <= 0 {
+		o.TemplateRefresh = time.Minute
+	}
+	if o.TemplatePackets <= 0 {
+		o.TemplatePackets = 20
+	}
+	if o.MTU <= 0 {
+		o.MTU = 1400
+	}
+	if o.StringLength <= 0 {
+		o.StringLength = 64
+	}
+}
+
+type NetFlow struct {
+	conn    net.Conn
+	opts    NetFlowOptions
+	batcher *Batcher
+
+	// 以下字段仅在 Batcher 的写入 goroutine 中访问
+	start        time.Time
+	lastTemplate time.Time
+	sentPackets  int    // 上次发送模板后的报文数
+	packetSeq    uint32 // v9 报文序号
+	recordSeq    uint32 // IPFIX 数据记录序号, 含 options 数据记录
+}
+
+// NewNetFlow 创建导出器, 关闭时关闭 conn
+func NewNetFlow(conn net.Conn, opts NetFlowOptions, batch BatchOptions) *NetFlow {
+	opts.setDefaults()
+	// UDP 发送失败不重试
+	batch.MaxRetries = 0
+	n := &NetFlow{conn: conn, opts: opts, start: time.Now()}
+	n.batcher = NewBatcher("netflow", batch, n.export)
+	return n
+}
+
+// Write 仅导出流统计记录, 其他记录忽略
+func (n *NetFlow) Write(r record.Protocol) error {
+	if f, ok := r.(*record.Flow); ok && !n.batcher.Add("flow", f) {
+		return ErrDropped
+	}
+	return nil
+}
+
+func (n *NetFlow) Flush() error {
+	return n.batcher.Flush()
+}
+
+func (n *NetFlow) Close() error {
+	n.batcher.Close()
+	return n.conn.Close()
+}
+
+// Stats 返回写入计数
+func (n *NetFlow) Stats() BatchStats {
+	return n.batcher.Stats()
+}
+
+// export 将一批流记录编码为一个或多个报文发送
+func (n *NetFlow) export(_ string, docs []interface{}) error {
+	m := n.newMessage()
+	for _, doc := range docs {
+		f := doc.(*record.Flow)
+		id := uint16(nfTemplateIPv4)
+		if f.SrcIP.To4() == nil {
+			id = nfTemplateIPv6
+		}
+		rec := n.encodeRecord(id, f)
+		if m.data > 0 && m.size(id, len(rec)) > n.opts.MTU {
+			if err := n.send(m); err != nil {
+				return err
+			}
+			m = n.newMessage()
+		}
+		m.add(id, rec)
+		m.data++
+	}
+	if m.data == 0 {
+		return nil
+	}
+	return n.send(m)
+}
+
+// newMessage 创建报文, 需要时先写入模板
+func (n *NetFlow) newMessage() *nfMessage {
+	m := &nfMessage{header: nfV9HeaderLen}
+	if n.opts.IPFIX {
+		m.header = nfIPFIXHeaderLen
+	}
+	now := time.Now()
+	if n.lastTemplate.IsZero() || now.Sub(n.lastTemplate) >= n.opts.TemplateRefresh || n.sentPackets >= n.opts.TemplatePackets {
+		n.writeTemplates(m)
+		n.lastTemplate, n.sentPackets = now, 0
+	}
+	return m
+}
+
+// send 写入报文头并发送
+func (n *NetFlow) send(m *nfMessage) error {
+	m.closeSet()
+	now := time.Now()
+	hdr := make([]byte, m.header, m.header+len(m.buf))
+	if n.opts.IPFIX {
+		binary.BigEndian.PutUint16(hdr[0:], 10)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(m.header+len(m.buf)))
+		binary.BigEndian.PutUint32(hdr[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(hdr[8:], n.recordSeq)
+		binary.BigEndian.PutUint32(hdr[12:], n.opts.DomainID)
+	} else {
+		binary.BigEndian.PutUint16(hdr[0:], 9)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(m.records))
+		binary.BigEndian.PutUint32(hdr[4:], uint32(now.Sub(n.start).Milliseconds()))
+		binary.BigEndian.PutUint32(hdr[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(hdr[12:], n.packetSeq)
+		binary.BigEndian.PutUint32(hdr[16:], n.opts.DomainID)
+	}
+	// RFC 7011 §3.1: 序号计数全部数据记录, 包括 options 数据记录, 不含模板
+	n.recordSeq += uint32(m.data + m.options)
+	n.packetSeq++
+	n.sentPackets++
+	_, err := n.conn.Write(append(hdr, m.buf...))
+	return err
+}
+
+// writeTemplates 写入数据模板、options 模板与 options 记录
+func (n *NetFlow) writeTemplates(m *nfMessage) {
+	setID := uint16(nfV9TemplateSet)
+	if n.opts.IPFIX {
+		setID = nfIPFIXTemplateSet
+	}
+	for _, id := range []uint16{nfTemplateIPv4, nfTemplateIPv6} {
+		fields := nfTemplateFields(id)
+		rec := be16(nil, id)
+		rec = be16(rec, uint16(len(fields)))
+		for _, field := range fields {
+			rec = n.appendFieldSpec(rec, field)
+		}
+		m.add(setID, rec)
+	}
+
+	var rec []byte
+	if n.opts.IPFIX {
+		rec = be16(rec, nfTemplateOptions)
+		rec = be16(rec, 3) // 字段数
+		rec = be16(rec, 1) // scope 字段数
+		rec = be16(be16(rec, ieObservationDomainID), 4)
+		setID = nfIPFIXOptionsSet
+	} else {
+		rec = be16(rec, nfTemplateOptions)
+		rec = be16(rec, 4) // scope 长度
+		rec = be16(rec, 8) // options 字段长度
+		rec = be16(be16(rec, nfV9ScopeSystem), 4)
+		setID = nfV9OptionsSet
+	}
+	rec = be16(be16(rec, ieFlowActiveTimeout), 2)
+	rec = be16(be16(rec, ieFlowIdleTimeout), 2)
+	m.add(setID, rec)
+
+	rec = be32(nil, n.opts.DomainID)
+	rec = be16(rec, nfSeconds(n.opts.ActiveTimeout))
+	rec = be16(rec, nfSeconds(n.opts.IdleTimeout))
+	m.add(nfTemplateOptions, rec)
+	m.options++
+}
+
+func (n *NetFlow) appendFieldSpec(b []byte, field nfField) []byte {
+	length := field.length
+	if field.str != nil {
+		length = nfVarLength
+		if !n.opts.IPFIX {
+			length = uint16(n.opts.StringLength)
+		}
+	}
+	if !field.private {
+		return be16(be16(b, field.id), length)
+	}
+	if !n.opts.IPFIX {
+		// v9 没有 enterprise 位, 私有字段使用高位区间的字段类型
+		return be16(be16(b, nfV9PrivateBase+field.id), length)
+	}
+	b = be16(be16(b, 0x8000|field.id), length)
+	return be32(b, n.opts.EnterpriseID)
+}
+
+// encodeRecord 按模板编码一条流记录
+func (n *NetFlow) encodeRecord(id uint16, f *record.Flow) []byte {
+	b := make([]byte, 0, 128)
+	for _, field := range nfTemplateFields(id) {
+		switch {
+		case field.ip != nil:
+			ip := field.ip(f)
+			if field.length == 4 {
+				ip = ip.To4()
+			} else {
+				ip = ip.To16()
+			}
+			if ip == nil {
+				ip = make(net.IP, field.length)
+			}
+			b = append(b, ip...)
+		case field.str != nil:
+			b = n.appendString(b, field.str(f))
+		default:
+			v := field.num(f)
+			for i := int(field.length) - 1; i >= 0; i-- {
+				b = append(b, byte(v>>(8*uint(i))))
+			}
+		}
+	}
+	return b
+}
+
+// appendString IPFIX 使用可变长度编码, v9 截断或补零到固定长度
+func (n *NetFlow) appendString(b []byte, s string) []byte {
+	if !n.opts.IPFIX {
+		if len(s) > n.opts.StringLength {
+			s = s[:n.opts.StringLength]
+		}
+		b = append(b, s...)
+		return append(b, make([]byte, n.opts.StringLength-len(s))...)
+	}
+	if len(s) > 0xffff {
+		s = s[:0xffff]
+	}
+	if len(s) < 255 {
+		b = append(b, byte(len(s)))
+	} else {
+		b = be16(append(b, 255), uint16(len(s)))
+	}
+	return append(b, s...)
+}
+
+// nfMessage 正在组装的报文, buf 不含报文头
+type nfMessage struct {
+	header   int
+	buf      []byte
+	setStart int // 当前 set 在 buf 中的偏移
+	setID    uint16
+	open     bool
+	records  int // 全部记录数, 用于 v9 报文头
+	data     int // 流数据记录数
+	options  int // options 数据记录数
+}
+
+// add 写入一条记录, set ID 变化时开始新的 set
+func (m *nfMessage) add(setID uint16, rec []byte) {
+	if !m.open || m.setID != setID {
+		m.closeSet()
+		m.setStart, m.setID, m.open = len(m.buf), setID, true
+		m.buf = be16(be16(m.buf, setID), 0)
+	}
+	m.buf = append(m.buf, rec...)
+	m.records++
+}
+
+// closeSet 补齐 4 字节边界并写入 set 长度
+func (m *nfMessage) closeSet() {
+	if !m.open {
+		return
+	}
+	for (len(m.buf)-m.setStart)%4 != 0 {
+		m.buf = append(m.buf, 0)
+	}
+	binary.BigEndian.PutUint16(m.buf[m.setStart+2:], uint16(len(m.buf)-m.setStart))
+	m.open = false
+}
+
+// size 写入一条记录后的报文长度
+func (m *nfMessage) size(setID uint16, n int) int {
+	size := m.header + len(m.buf) + n + 3
+	if !m.open || m.setID != setID {
+		size += 4 + 3
+	}
+	return size
+}
+
+func be16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func be32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func nfSeconds(d time.Duration) uint16 {
+	if s := d / time.Second; s < 0xffff {
+		return uint16(s)
+	}
+	return 0xffff
+}
@@ -0,0 +1,150 @@
+package sink
+
+import (
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+)
+
+// NetFlow v9 / IPFIX 模板定义
+// 字段编号使用 IANA IPFIX Information Elements, v9 与 IPFIX 共用
+
+const (
+	nfV9HeaderLen    = 20
+	nfIPFIXHeaderLen = 16
+
+	nfV9TemplateSet    = 0
+	nfV9OptionsSet     = 1
+	nfIPFIXTemplateSet = 2
+	nfIPFIXOptionsSet  = 3
+
+	nfTemplateIPv4    = 256
+	nfTemplateIPv6    = 257
+	nfTemplateOptions = 258
+
+	nfVarLength     = 0xffff // IPFIX 可变长度字段
+	nfV9ScopeSystem = 1
+	nfV9PrivateBase = 40000 // v9 私有字段类型起始值
+)
+
+// IANA Information Elements
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieTCPControlBits           = 6
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowActiveTimeout        = 36
+	ieFlowIdleTimeout          = 37
+	ieFlowEndReason            = 136
+	ieObservationDomainID      = 149
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+	ieInitiatorOctets          = 231
+	ieResponderOctets          = 232
+	ieInitiatorPackets         = 298
+	ieResponderPackets         = 299
+)
+
+// 私有字段, IPFIX 中与 EnterpriseID 组合使用
+const (
+	peApplicationName = 1
+	peTLSServerName   = 2
+	peHTTPHost        = 3
+)
+
+// flowEndReason 取值, 见 RFC 5102
+const (
+	nfEndIdle   = 1
+	nfEndActive = 2
+	nfEndOfFlow = 3
+	nfEndForced = 4
+)
+
+// nfField 模板字段, ip、str、num 三者之一不为空
+type nfField struct {
+	id      uint16
+	length  uint16
+	private bool
+	ip      func(f *record.Flow) net.IP
+	str     func(f *record.Flow) string
+	num     func(f *record.Flow) uint64
+}
+
+var (
+	nfIPv4Fields = append([]nfField{
+		{id: ieSourceIPv4Address, length: 4, ip: func(f *record.Flow) net.IP { return f.SrcIP }},
+		{id: ieDestinationIPv4Address, length: 4, ip: func(f *record.Flow) net.IP { return f.DstIP }},
+	}, nfCommonFields...)
+	nfIPv6Fields = append([]nfField{
+		{id: ieSourceIPv6Address, length: 16, ip: func(f *record.Flow) net.IP { return f.SrcIP }},
+		{id: ieDestinationIPv6Address, length: 16, ip: func(f *record.Flow) net.IP { return f.DstIP }},
+	}, nfCommonFields...)
+
+	// nfCommonFields 源地址为客户端, 目的地址为服务端
+	nfCommonFields = []nfField{
+		{id: ieSourceTransportPort, length: 2, num: func(f *record.Flow) uint64 { return uint64(f.SrcPort) }},
+		{id: ieDestinationTransportPort, length: 2, num: func(f *record.Flow) uint64 { return uint64(f.DstPort) }},
+		{id: ieProtocolIdentifier, length: 1, num: func(f *record.Flow) uint64 { return nfProtocol(f.Proto) }},
+		{id: ieTCPControlBits, length: 1, num: func(f *record.Flow) uint64 { return uint64(f.TCPFlags) }},
+		{id: ieFlowEndReason, length: 1, num: func(f *record.Flow) uint64 { return nfEndReason(f.Reason) }},
+		{id: ieFlowStartMilliseconds, length: 8, num: func(f *record.Flow) uint64 { return uint64(f.StartTime.UnixMilli()) }},
+		{id: ieFlowEndMilliseconds, length: 8, num: func(f *record.Flow) uint64 { return uint64(f.EndTime.UnixMilli()) }},
+		{id: ieOctetDeltaCount, length: 8, num: func(f *record.Flow) uint64 { return uint64(f.UpBytes + f.DownBytes) }},
+		{id: iePacketDeltaCount, length: 8, num: func(f *record.Flow) uint64 { return uint64(f.UpPackets + f.DownPackets) }},
+		{id: ieInitiatorOctets, length: 8, num: func(f *record.Flow) uint64 { return uint64(f.UpBytes) }},
+		{id: ieResponderOctets, length: 8, num: func(f *record.Flow) uint64 { return uint64(f.DownBytes) }},
+		{id: ieInitiatorPackets, length: 8, num: func(f *record.Flow) uint64 { return uint64(f.UpPackets) }},
+		{id: ieResponderPackets, length: 8, num: func(f *record.Flow) uint64 { return uint64(f.DownPackets) }},
+		{id: peApplicationName, private: true, str: func(f *record.Flow) string { return f.App }},
+		{id: peTLSServerName, private: true, str: func(f *record.Flow) string { return f.SNI }},
+		{id: peHTTPHost, private: true, str: func(f *record.Flow) string { return f.HTTPHost }},
+	}
+)
+
+func nfTemplateFields(id uint16) []nfField {
+	if id == nfTemplateIPv6 {
+		return nfIPv6Fields
+	}
+	return nfIPv4Fields
+}
+
+func nfProtocol(proto string) uint64 {
+	switch proto {
+	case "icmp":
+		return 1
+	case "tcp":
+		return 6
+	case "udp":
+		return 17
+	case "icmpv6":
+		return 58
+	}
+	var n uint64
+	for _, c := range proto {
+		if c < '0' || c > '9' {
+			return 0
+		}
+		n = n*10 + uint64(c-'0')
+	}
+	return n
+}
+
+// nfEndReason 将 flow 解析器的结束原因转换为 flowEndReason
+func nfEndReason(reason string) uint64 {
+	switch reason {
+	case "idle":
+		return nfEndIdle
+	case "active":
+		return nfEndActive
+	case "fin", "rst":
+		return nfEndOfFlow
+	case "end":
+		return nfEndForced
+	}
+	return 0
+}
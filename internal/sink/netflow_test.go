@@ -0,0 +1,312 @@
+package sink
+
+import (
+	"encoding/binary"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"net"
+	"testing"
+	"time"
+)
+
+// 采集端解码: 按收到的模板解析数据记录, 与导出端的编码实现无关
+
+type nfSpec struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+type nfHeader struct {
+	version uint16
+	count   uint16 // v9 记录数 / IPFIX 报文长度
+	seq     uint32
+	domain  uint32
+}
+
+// nfCollector 在本地 UDP 端口接收报文, 记录收到的模板
+type nfCollector struct {
+	t         *testing.T
+	conn      *net.UDPConn
+	ipfix     bool
+	templates map[uint16][]nfSpec
+	scopes    map[uint16]int // options 模板的 scope 字段数
+}
+
+func newNFCollector(t *testing.T, ipfix bool) *nfCollector {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &nfCollector{t: t, conn: conn, ipfix: ipfix, templates: make(map[uint16][]nfSpec), scopes: make(map[uint16]int)}
+}
+
+// receive 读取一个报文, 返回报文头与按模板 ID 分组的数据记录
+func (c *nfCollector) receive() (nfHeader, map[uint16][]map[nfSpec][]byte) {
+	c.t.Helper()
+	buf := make([]byte, 65535)
+	_ = c.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatalf("read export packet: %v", err)
+	}
+	b := buf[:n]
+	var h nfHeader
+	h.version, h.count = binary.BigEndian.Uint16(b), binary.BigEndian.Uint16(b[2:])
+	if c.ipfix {
+		h.seq, h.domain = binary.BigEndian.Uint32(b[8:]), binary.BigEndian.Uint32(b[12:])
+		if int(h.count) != n {
+			c.t.Errorf("IPFIX length %d, packet is %d bytes", h.count, n)
+		}
+		b = b[nfIPFIXHeaderLen:]
+	} else {
+		h.seq, h.domain = binary.BigEndian.Uint32(b[12:]), binary.BigEndian.Uint32(b[16:])
+		b = b[nfV9HeaderLen:]
+	}
+
+	data := make(map[uint16][]map[nfSpec][]byte)
+	records := 0
+	for len(b) > 0 {
+		setID, length := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if length < 4 || length > len(b) || length%4 != 0 {
+			c.t.Fatalf("set %d length %d, %d bytes left", setID, length, len(b))
+		}
+		body := b[4:length]
+		b = b[length:]
+		switch {
+		case setID == nfV9TemplateSet || setID == nfIPFIXTemplateSet:
+			for len(body) >= 4 {
+				id, count := binary.BigEndian.Uint16(body), int(binary.BigEndian.Uint16(body[2:]))
+				c.templates[id], body = c.specs(body[4:], count)
+				records++
+			}
+		case setID == nfV9OptionsSet:
+			id := binary.BigEndian.Uint16(body)
+			scope, options := int(binary.BigEndian.Uint16(body[2:])), int(binary.BigEndian.Uint16(body[4:]))
+			c.templates[id], _ = c.specs(body[6:], (scope+options)/4)
+			c.scopes[id] = scope / 4
+			records++
+		case setID == nfIPFIXOptionsSet:
+			id, count := binary.BigEndian.Uint16(body), int(binary.BigEndian.Uint16(body[2:]))
+			c.templates[id], _ = c.specs(body[6:], count)
+			c.scopes[id] = int(binary.BigEndian.Uint16(body[4:]))
+			records++
+		default:
+			specs, ok := c.templates[setID]
+			if !ok {
+				c.t.Fatalf("data set %d before its template", setID)
+			}
+			for len(body) >= 4 {
+				var rec map[nfSpec][]byte
+				rec, body = c.record(specs, body)
+				data[setID] = append(data[setID], rec)
+				records++
+			}
+		}
+	}
+	if !c.ipfix && int(h.count) != records {
+		c.t.Errorf("v9 header count %d, packet has %d records", h.count, records)
+	}
+	return h, data
+}
+
+func (c *nfCollector) specs(b []byte, count int) ([]nfSpec, []byte) {
+	specs := make([]nfSpec, count)
+	for i := range specs {
+		specs[i] = nfSpec{id: binary.BigEndian.Uint16(b), length: binary.BigEndian.Uint16(b[2:])}
+		b = b[4:]
+		if c.ipfix && specs[i].id&0x8000 != 0 {
+			specs[i].id &^= 0x8000
+			specs[i].enterprise, b = binary.BigEndian.Uint32(b), b[4:]
+		}
+	}
+	return specs, b
+}
+
+// record 解码一条数据记录, 可变长度字段只返回值
+func (c *nfCollector) record(specs []nfSpec, b []byte) (map[nfSpec][]byte, []byte) {
+	rec := make(map[nfSpec][]byte)
+	for _, s := range specs {
+		n := int(s.length)
+		if c.ipfix && s.length == nfVarLength {
+			n, b = int(b[0]), b[1:]
+			if n == 255 {
+				n, b = int(binary.BigEndian.Uint16(b)), b[2:]
+			}
+		}
+		if n > len(b) {
+			c.t.Fatalf("field %d needs %d bytes, %d left", s.id, n, len(b))
+		}
+		rec[s], b = b[:n], b[n:]
+	}
+	return rec, b
+}
+
+func testFlows() []*record.Flow {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	return []*record.Flow{
+		{Proto: "tcp", SrcIP: net.ParseIP("10.0.0.2"), DstIP: net.ParseIP("93.184.216.34"), SrcPort: 40001, DstPort: 443,
+			StartTime: start, EndTime: start.Add(time.Second * 3), UpPackets: 12, DownPackets: 20, UpBytes: 1500, DownBytes: 24000,
+			TCPFlags: 0x1b, Reason: "fin", App: "example", SNI: "example.com"},
+		{Proto: "udp", SrcIP: net.ParseIP("2001:db8::2"), DstIP: net.ParseIP("2001:db8::53"), SrcPort: 53000, DstPort: 53,
+			StartTime: start, EndTime: start.Add(time.Second), UpPackets: 1, DownPackets: 1, UpBytes: 80, DownBytes: 120,
+			Reason: "idle", HTTPHost: "a-very-long-host-name-that-does-not-fit-in-a-short-fixed-length-field.example.com"},
+	}
+}
+
+func nfUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func TestNetFlowExport(t *testing.T) {
+	for _, ipfix := range []bool{false, true} {
+		name := "v9"
+		if ipfix {
+			name = "ipfix"
+		}
+		t.Run(name, func(t *testing.T) {
+			c := newNFCollector(t, ipfix)
+			conn, err := net.Dial("udp", c.conn.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := NewNetFlow(conn, NetFlowOptions{IPFIX: ipfix, DomainID: 7, EnterpriseID: 32473, StringLength: 16,
+				ActiveTimeout: time.Minute * 30, IdleTimeout: time.Minute * 2}, BatchOptions{FlushInterval: time.Hour})
+			defer n.Close()
+
+			flows := testFlows()
+			for _, f := range flows {
+				_ = n.Write(f)
+			}
+			_ = n.Write(&record.Dns{Host: "ignored.example.com"})
+			_ = n.Flush()
+			h1, data := c.receive()
+			_ = n.Write(flows[0])
+			_ = n.Flush()
+			h2, data2 := c.receive()
+
+			version, stringLength := uint16(9), uint16(16)
+			if ipfix {
+				version, stringLength = 10, nfVarLength
+			}
+			if h1.version != version || h2.version != version || h1.domain != 7 {
+				t.Errorf("headers %+v %+v", h1, h2)
+			}
+			// v9 按报文计数, IPFIX 按之前发送的数据记录计数, 包括 options 数据记录
+			wantSeq := uint32(1)
+			if ipfix {
+				wantSeq = uint32(len(flows) + 1)
+			}
+			if h1.seq != 0 || h2.seq != wantSeq {
+				t.Errorf("sequence numbers %d, %d, want 0, %d", h1.seq, h2.seq, wantSeq)
+			}
+
+			for id, addr := range map[uint16]uint16{nfTemplateIPv4: 4, nfTemplateIPv6: 16} {
+				specs := c.templates[id]
+				if len(specs) != 18 {
+					t.Fatalf("template %d has %d fields, want 18", id, len(specs))
+				}
+				if specs[0].length != addr || specs[1].length != addr {
+					t.Errorf("template %d address lengths %d, %d, want %d", id, specs[0].length, specs[1].length, addr)
+				}
+				for _, s := range specs[2:] {
+					want := map[uint16]uint16{ieSourceTransportPort: 2, ieDestinationTransportPort: 2, ieProtocolIdentifier: 1,
+						ieTCPControlBits: 1, ieFlowEndReason: 1}[s.id]
+					switch {
+					case s.id >= ieFlowStartMilliseconds && s.id <= ieFlowEndMilliseconds, s.id <= iePacketDeltaCount, s.id >= ieInitiatorOctets:
+						want = 8
+					}
+					if ipfix && s.enterprise == 32473 || !ipfix && s.id > nfV9PrivateBase {
+						want = stringLength
+					}
+					if s.length != want {
+						t.Errorf("template %d field %+v, want length %d", id, s, want)
+					}
+				}
+			}
+			if opts := data[nfTemplateOptions]; len(opts) != 1 || c.scopes[nfTemplateOptions] != 1 {
+				t.Errorf("options records %v, scope %d", opts, c.scopes[nfTemplateOptions])
+			} else {
+				for s, v := range opts[0] {
+					if s.id == ieFlowActiveTimeout && nfUint(v) != 1800 || s.id == ieFlowIdleTimeout && nfUint(v) != 120 {
+						t.Errorf("options field %d = %d", s.id, nfUint(v))
+					}
+				}
+			}
+
+			v4, v6 := data[nfTemplateIPv4], data[nfTemplateIPv6]
+			if len(v4) != 1 || len(v6) != 1 || len(data2[nfTemplateIPv4]) != 1 {
+				t.Fatalf("got %d IPv4 and %d IPv6 records, then %d", len(v4), len(v6), len(data2[nfTemplateIPv4]))
+			}
+			if _, ok := c.templates[nfTemplateIPv4]; !ok || len(data2) != 1 {
+				t.Errorf("second packet resent templates or options: %v", data2)
+			}
+			private := func(id uint16) nfSpec {
+				if ipfix {
+					return nfSpec{id: id, length: nfVarLength, enterprise: 32473}
+				}
+				return nfSpec{id: nfV9PrivateBase + id, length: 16}
+			}
+			for i, rec := range []map[nfSpec][]byte{v4[0], v6[0]} {
+				f, specs := flows[i], c.templates[nfTemplateIPv4]
+				if i == 1 {
+					specs = c.templates[nfTemplateIPv6]
+				}
+				if !net.IP(rec[specs[0]]).Equal(f.SrcIP) || !net.IP(rec[specs[1]]).Equal(f.DstIP) {
+					t.Errorf("flow %d addresses %v %v", i, rec[specs[0]], rec[specs[1]])
+				}
+				for spec, want := range map[nfSpec]uint64{
+					{id: ieSourceTransportPort, length: 2}:      uint64(f.SrcPort),
+					{id: ieDestinationTransportPort, length: 2}: uint64(f.DstPort),
+					{id: ieTCPControlBits, length: 1}:           uint64(f.TCPFlags),
+					{id: ieOctetDeltaCount, length: 8}:          uint64(f.UpBytes + f.DownBytes),
+					{id: iePacketDeltaCount, length: 8}:         uint64(f.UpPackets + f.DownPackets),
+					{id: ieInitiatorOctets, length: 8}:          uint64(f.UpBytes),
+					{id: ieResponderOctets, length: 8}:          uint64(f.DownBytes),
+					{id: ieInitiatorPackets, length: 8}:         uint64(f.UpPackets),
+					{id: ieResponderPackets, length: 8}:         uint64(f.DownPackets),
+					{id: ieFlowStartMilliseconds, length: 8}:    uint64(f.StartTime.UnixMilli()),
+					{id: ieFlowEndMilliseconds, length: 8}:      uint64(f.EndTime.UnixMilli()),
+				} {
+					if got := nfUint(rec[spec]); got != want {
+						t.Errorf("flow %d field %d = %d, want %d", i, spec.id, got, want)
+					}
+				}
+				host := f.HTTPHost
+				if !ipfix && len(host) > 16 {
+					host = host[:16]
+				}
+				if got := string(trimZero(rec[private(peHTTPHost)], ipfix)); got != host {
+					t.Errorf("flow %d http host %q, want %q", i, got, host)
+				}
+				if got := string(trimZero(rec[private(peTLSServerName)], ipfix)); got != f.SNI {
+					t.Errorf("flow %d sni %q, want %q", i, got, f.SNI)
+				}
+			}
+			if p := nfUint(v4[0][nfSpec{id: ieProtocolIdentifier, length: 1}]); p != 6 {
+				t.Errorf("tcp protocol %d", p)
+			}
+			if r := nfUint(v6[0][nfSpec{id: ieFlowEndReason, length: 1}]); r != nfEndIdle {
+				t.Errorf("idle end reason %d", r)
+			}
+			if s := n.Stats(); s.Written != 3 || s.Failed != 0 {
+				t.Errorf("stats %+v", s)
+			}
+		})
+	}
+}
+
+// trimZero 去掉 v9 定长字符串的补零
+func trimZero(b []byte, ipfix bool) []byte {
+	if ipfix {
+		return b
+	}
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,103 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/redis/go-redis/v9"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/database"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"time"
+)
+
+// Redis 输出
+// 每种协议一个 Stream, 记录编码为 JSON 写入 record 字段, 通过 Batcher 以 pipeline 批量 XADD;
+// 消费方可用消费组读取. 仅在启用时连接
+
+const redisWriteTimeout = time.Second * 30
+
+func init() {
+	Register("redis", func(c *configs.Config) (Sink, error) {
+		r := c.Sinks.Redis
+		client, err := database.ConnectRedis(database.RedisConfig{
+			Addr:        r.Addr,
+			Username:    r.User,
+			Password:    r.Password,
+			DB:          r.DB,
+			TLS:         r.TLS,
+			CAFile:      r.CAFile,
+			DialTimeout: r.Timeout,
+			PoolSize:    r.PoolSize,
+			MaxRetries:  r.Retries,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return NewRedis(client, r.Prefix, r.MaxLen, BatchOptions{
+			QueueSize:     r.QueueSize,
+			BatchSize:     r.BatchSize,
+			FlushInterval: r.FlushInterval,
+			MaxRetries:    r.Retries,
+			RetryBackoff:  r.RetryBackoff,
+			Block:         r.Block,
+		}), nil
+	})
+}
+
+type Redis struct {
+	client  *redis.Client
+	prefix  string
+	maxLen  int64
+	batcher *Batcher
+}
+
+// NewRedis 创建 Redis 输出, 关闭时关闭 client; maxLen 为 0 时不裁剪 Stream
+func NewRedis(client *redis.Client, prefix string, maxLen int64, opts BatchOptions) *Redis {
+	r := &Redis{client: client, prefix: prefix, maxLen: maxLen}
+	r.batcher = NewBatcher("redis", opts, r.insert)
+	return r
+}
+
+// Write 将记录编码为 JSON 放入写入队列
+func (r *Redis) Write(rec record.Protocol) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if !r.batcher.Add(r.prefix+rec.Kind(), data) {
+		return ErrDropped
+	}
+	return nil
+}
+
+func (r *Redis) Flush() error {
+	return r.batcher.Flush()
+}
+
+func (r *Redis) Close() error {
+	r.batcher.Close()
+	return r.client.Close()
+}
+
+// Stats 返回写入计数
+func (r *Redis) Stats() BatchStats {
+	return r.batcher.Stats()
+}
+
+// insert 以 pipeline 写入一个 Stream
+func (r *Redis) insert(stream string, docs []interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisWriteTimeout)
+	defer cancel()
+	_, err := r.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, doc := range docs {
+			p.XAdd(ctx, &redis.XAddArgs{
+				Stream: stream,
+				MaxLen: r.maxLen,
+				Approx: true,
+				Values: []interface{}{"record", string(doc.([]byte))},
+			})
+		}
+		return nil
+	})
+	return err
+}
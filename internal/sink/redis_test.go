@@ -0,0 +1,147 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis 只实现连接握手与 XADD 的 RESP 服务
+type fakeRedis struct {
+	mu    sync.Mutex
+	xadds [][]string
+}
+
+func newFakeRedis(t *testing.T) (*fakeRedis, *redis.Client) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	client := redis.NewClient(&redis.Options{Addr: ln.Addr().String()})
+	t.Cleanup(func() { _ = ln.Close() })
+	return f, client
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "HELLO":
+			reply = "-ERR unknown command 'HELLO'\r\n"
+		case "PING":
+			reply = "+PONG\r\n"
+		case "XADD":
+			f.mu.Lock()
+			f.xadds = append(f.xadds, args[1:])
+			n := len(f.xadds)
+			f.mu.Unlock()
+			id := fmt.Sprintf("%d-0", n)
+			reply = fmt.Sprintf("$%d\r\n%s\r\n", len(id), id)
+		default:
+			reply = "+OK\r\n"
+		}
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readRESP 读取一个由批量字符串组成的数组
+func readRESP(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisWrite(t *testing.T) {
+	f, client := newFakeRedis(t)
+	r := NewRedis(client, "dpi:", 1000, BatchOptions{BatchSize: 10, FlushInterval: time.Hour})
+	records := testRecords()
+	for _, rec := range records[:3] {
+		rec.Parse()
+		if err := r.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Stats(); s.Written != 3 || s.Failed != 0 {
+		t.Errorf("stats %+v", s)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.xadds) != 3 {
+		t.Fatalf("got %d XADD, want 3", len(f.xadds))
+	}
+	streams := make(map[string]bool)
+	for _, args := range f.xadds {
+		// stream MAXLEN ~ 1000 * record <json>
+		if len(args) != 7 || !strings.EqualFold(args[1], "MAXLEN") || args[2] != "~" || args[3] != "1000" || args[4] != "*" || args[5] != "record" {
+			t.Errorf("XADD args %q", args)
+			continue
+		}
+		streams[args[0]] = true
+		if args[0] == "dpi:"+record.ProtocolHTTP {
+			var h record.Http
+			if err := json.Unmarshal([]byte(args[6]), &h); err != nil || h.Host != "example.com" || h.UserName != "alice" {
+				t.Errorf("http record %s: %v", args[6], err)
+			}
+		}
+	}
+	for _, kind := range []string{record.ProtocolHTTP, record.ProtocolHTTPS, record.ProtocolDNS} {
+		if !streams["dpi:"+kind] {
+			t.Errorf("no XADD to dpi:%s", kind)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package sink
+
+import (
+	"fmt"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sink 记录输出
+// 解析完成的记录通过 Write 写入, Flush 提交缓冲中的记录, Close 释放连接
+type Sink interface {
+	Write(r record.Protocol) error
+	Flush() error
+	Close() error
+}
+
+// Factory 根据配置创建输出实例
+type Factory func(c *configs.Config) (Sink, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register 注册输出, 重复注册同名输出会 panic
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("sink: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("sink: Register called twice for sink " + name)
+	}
+	registry[name] = factory
+}
+
+// Sinks 返回已注册的输出名称
+func Sinks() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New 按配置中启用的名称创建输出, 多个输出组合为 Multi
+// 任一输出创建失败时关闭已创建的输出并返回错误
+func New(c *configs.Config) (Sink, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	var multi Multi
+	seen := make(map[string]bool, len(c.Sinks.Enabled))
+	for _, name := range c.Sinks.Enabled {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		factory, ok := registry[name]
+		if !ok {
+			_ = multi.Close()
+			return nil, fmt.Errorf("unknown sink %q", name)
+		}
+		s, err := factory(c)
+		if err != nil {
+			_ = multi.Close()
+			return nil, fmt.Errorf("sink %s: %w", name, err)
+		}
+		multi = append(multi, s)
+	}
+	return multi, nil
+}
+
+// Multi 将记录写入所有输出, 返回遇到的第一个错误
+type Multi []Sink
+
+func (m Multi) Write(r record.Protocol) error {
+	var first error
+	for _, s := range m {
+		if err := s.Write(r); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m Multi) Flush() error {
+	var first error
+	for _, s := range m {
+		if err := s.Flush(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m Multi) Close() error {
+	var first error
+	for _, s := range m {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// recordTime 返回记录的抓包时间, 记录没有时间时返回当前时间
+func recordTime(r record.Protocol) time.Time {
+	var t time.Time
+	switch v := r.(type) {
+	case *record.Http:
+		t = v.Timestamp
+	case *record.Tls:
+		t = v.StartTime
+	case *record.Dns:
+		t = v.Timestamp
+	case *record.Icmp:
+		t = v.Timestamp
+	case *record.Quic:
+		t = v.StartTime
+	case *record.Flow:
+		t = v.StartTime
+	case *record.Alert:
+		t = v.Timestamp
+	case *record.Radius:
+		t = v.Timestamp
+	}
+	if t.IsZero() {
+		return time.Now()
+	}
+	return t
+}
@@ -0,0 +1,131 @@
+package sink
+
+import (
+	"errors"
+	"github.com/srun-soft/dpi-analysis-toolkit/configs"
+	"github.com/srun-soft/dpi-analysis-toolkit/internal/record"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeSink 记录调用次数, err 不为 nil 时每次调用都返回该错误
+type fakeSink struct {
+	err                     error
+	writes, flushes, closes int
+}
+
+func (f *fakeSink) Write(record.Protocol) error {
+	f.writes++
+	return f.err
+}
+
+func (f *fakeSink) Flush() error {
+	f.flushes++
+	return f.err
+}
+
+func (f *fakeSink) Close() error {
+	f.closes++
+	return f.err
+}
+
+// withRegistry 测试期间使用空的注册表
+func withRegistry(t *testing.T) {
+	t.Helper()
+	registryMu.Lock()
+	saved := registry
+	registry = make(map[string]Factory)
+	registryMu.Unlock()
+	t.Cleanup(func() {
+		registryMu.Lock()
+		registry = saved
+		registryMu.Unlock()
+	})
+}
+
+func TestNew(t *testing.T) {
+	withRegistry(t)
+	var built []*fakeSink
+	factory := func(err error) Factory {
+		return func(*configs.Config) (Sink, error) {
+			if err != nil {
+				return nil, err
+			}
+			s := &fakeSink{}
+			built = append(built, s)
+			return s, nil
+		}
+	}
+	Register("a", factory(nil))
+	Register("b", factory(nil))
+	Register("broken", factory(errors.New("connection refused")))
+	if names := Sinks(); !reflect.DeepEqual(names, []string{"a", "b", "broken"}) {
+		t.Errorf("registered %v", names)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("duplicate registration did not panic")
+			}
+		}()
+		Register("a", factory(nil))
+	}()
+
+	cfg := configs.Default()
+	// 重复的名称只创建一次
+	cfg.Sinks.Enabled = []string{"a", "b", "a"}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := s.(Multi); !ok || len(m) != 2 || len(built) != 2 {
+		t.Errorf("sink %#v, built %d", s, len(built))
+	}
+
+	// 创建失败时关闭已创建的输出
+	for _, tt := range []struct {
+		enabled []string
+		err     string
+	}{
+		{[]string{"a", "missing"}, `unknown sink "missing"`},
+		{[]string{"a", "b", "broken"}, "sink broken: connection refused"},
+	} {
+		built = nil
+		cfg.Sinks.Enabled = tt.enabled
+		if _, err = New(cfg); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: error %v, want %q", tt.enabled, err, tt.err)
+		}
+		for i, s := range built {
+			if s.closes != 1 {
+				t.Errorf("%v: sink %d closed %d times", tt.enabled, i, s.closes)
+			}
+		}
+	}
+}
+
+func TestMulti(t *testing.T) {
+	first, second := errors.New("first"), errors.New("second")
+	ok, failing, failing2 := &fakeSink{}, &fakeSink{err: first}, &fakeSink{err: second}
+	m := Multi{ok, failing, failing2}
+	r := &record.Dns{Host: "example.com"}
+	for name, call := range map[string]func() error{
+		"write": func() error { return m.Write(r) },
+		"flush": m.Flush,
+		"close": m.Close,
+	} {
+		// 一个输出失败时仍调用其他输出, 返回第一个错误
+		if err := call(); err != first {
+			t.Errorf("%s: error %v, want %v", name, err, first)
+		}
+	}
+	for i, s := range m {
+		f := s.(*fakeSink)
+		if f.writes != 1 || f.flushes != 1 || f.closes != 1 {
+			t.Errorf("sink %d: %d writes, %d flushes, %d closes", i, f.writes, f.flushes, f.closes)
+		}
+	}
+	if err := (Multi{ok}).Flush(); err != nil {
+		t.Errorf("no failing sink: %v", err)
+	}
+}